@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gysosin/Logs_exporter/internal/collectors"
+	"github.com/nats-io/nats.go"
+)
+
+// flowBatchSchema identifies the layout of flow batch messages. Bump it
+// when fields are removed or change meaning.
+const flowBatchSchema = "logs_exporter.netflow.v1"
+
+// FlowStreamOptions configures publishing of expired flows to JetStream.
+type FlowStreamOptions struct {
+	Enabled    bool   `json:"enabled"`
+	Subject    string `json:"subject"`     // default "netflow"
+	BatchSize  int    `json:"batch_size"`  // flows per message, default 500
+	BatchAge   string `json:"batch_age"`   // publish partial batches after this, default "5s"
+	MaxPending int    `json:"max_pending"` // flows held while NATS is slow or down, default 50000
+}
+
+// flowBatch is the message published for each batch of flows.
+type flowBatch struct {
+	Schema     string                    `json:"schema"`
+	SystemName string                    `json:"system_name"`
+	Seq        uint64                    `json:"seq"`
+	SentAt     time.Time                 `json:"sent_at"`
+	Dropped    uint64                    `json:"dropped"` // flows discarded for backpressure since the previous batch
+	Flows      []collectors.NetFlowEntry `json:"flows"`
+}
+
+// flowStreamer queues expired flows and publishes them in batches. When
+// JetStream does not keep up the queue is capped at MaxPending by dropping
+// the oldest flows, so that capture never blocks on the network.
+type flowStreamer struct {
+	opts     FlowStreamOptions
+	batchAge time.Duration
+	wake     chan struct{}
+
+	mu       sync.Mutex
+	pending  []collectors.NetFlowEntry
+	arrivals []arrival // when the pending flows were queued, oldest first
+	dropped  uint64    // since the last published batch
+	inFlight bool
+	flushing bool // publish partial batches immediately
+}
+
+// arrival records that n of the pending flows were queued at once.
+type arrival struct {
+	at time.Time
+	n  int
+}
+
+func (o FlowStreamOptions) withDefaults() (FlowStreamOptions, time.Duration, error) {
+	if o.Subject == "" {
+		o.Subject = "netflow"
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.MaxPending <= 0 {
+		o.MaxPending = 50000
+	}
+	if o.MaxPending < o.BatchSize {
+		o.MaxPending = o.BatchSize
+	}
+	age := 5 * time.Second
+	if o.BatchAge != "" {
+		d, err := time.ParseDuration(o.BatchAge)
+		if err != nil || d <= 0 {
+			return o, 0, fmt.Errorf("netflow_stream: invalid batch_age %q", o.BatchAge)
+		}
+		age = d
+	}
+	return o, age, nil
+}
+
+var streamer *flowStreamer
+
+// startFlowStream registers the streamer as a flow sink and starts
+// publishing to natsURL.
+func startFlowStream(natsURL string, o FlowStreamOptions) error {
+	if !o.Enabled {
+		return nil
+	}
+	if !collectors.FlowExpiryEnabled() {
+		return fmt.Errorf("netflow_stream: flows never expire; set netflow_expiry timeouts")
+	}
+	o, age, err := o.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	// Keep reconnecting for the life of the process; flows queue meanwhile.
+	nc, err := nats.Connect(natsURL, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("connecting to NATS: %v", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("getting JetStream context: %v", err)
+	}
+
+	streamer = &flowStreamer{opts: o, batchAge: age, wake: make(chan struct{}, 1)}
+	collectors.RegisterFlowSink(streamer.enqueue)
+	go streamer.run(js, systemName())
+	logWarning("Streaming expired flows to NATS subject %s", o.Subject)
+	return nil
+}
+
+// enqueue is the flow sink. It never blocks on NATS.
+func (s *flowStreamer) enqueue(flows []collectors.NetFlowEntry) {
+	if len(flows) == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.pending = append(s.pending, flows...)
+	s.arrivals = append(s.arrivals, arrival{at: time.Now(), n: len(flows)})
+	if over := len(s.pending) - s.opts.MaxPending; over > 0 {
+		// Copy so the dropped flows are not kept alive by the backing array.
+		s.pending = append([]collectors.NetFlowEntry(nil), s.pending[over:]...)
+		s.dropped += uint64(over)
+		s.forget(over)
+	}
+	full := len(s.pending) >= s.opts.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next waits until a full batch is queued or the oldest queued flow has
+// waited batchAge, and takes that batch off the queue.
+func (s *flowStreamer) next() ([]collectors.NetFlowEntry, uint64) {
+	for {
+		s.mu.Lock()
+		n := len(s.pending)
+		wait := s.batchAge
+		if n > 0 {
+			wait -= time.Since(s.arrivals[0].at)
+		}
+		if n >= s.opts.BatchSize || (n > 0 && (wait <= 0 || s.flushing)) {
+			n = min(n, s.opts.BatchSize)
+			batch := s.pending[:n:n]
+			s.pending = s.pending[n:]
+			s.forget(n)
+			dropped := s.dropped
+			s.dropped = 0
+			s.inFlight = true
+			s.mu.Unlock()
+			return batch, dropped
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// forget removes the arrivals of the n oldest pending flows.
+func (s *flowStreamer) forget(n int) {
+	for n > 0 {
+		if a := &s.arrivals[0]; a.n > n {
+			a.n -= n
+			return
+		}
+		n -= s.arrivals[0].n
+		s.arrivals = s.arrivals[1:]
+	}
+}
+
+// flowPublisher is the part of nats.JetStreamContext the streamer uses.
+type flowPublisher interface {
+	PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error)
+}
+
+// run publishes batches one at a time, waiting for the JetStream ack. A
+// failed batch is retried with backoff; each message carries a stable
+// Nats-Msg-Id so the stream can discard duplicates of retried batches.
+func (s *flowStreamer) run(js flowPublisher, host string) {
+	boot := strconv.FormatInt(time.Now().UnixNano(), 36)
+	var (
+		seq         uint64
+		lastDropLog time.Time
+	)
+	for {
+		flows, dropped := s.next()
+		seq++
+		payload, err := json.Marshal(flowBatch{
+			Schema:     flowBatchSchema,
+			SystemName: host,
+			Seq:        seq,
+			SentAt:     time.Now().UTC(),
+			Dropped:    dropped,
+			Flows:      flows,
+		})
+		if err != nil {
+			logError("Failed to marshal flow batch: %v", err)
+			s.done()
+			continue
+		}
+		if dropped > 0 && time.Since(lastDropLog) >= time.Minute {
+			logWarning("NATS flow stream is behind: dropped %d flows", dropped)
+			lastDropLog = time.Now()
+		}
+
+		msg := &nats.Msg{Subject: s.opts.Subject, Data: payload, Header: nats.Header{}}
+		msg.Header.Set(nats.MsgIdHdr, host+"-"+boot+"-"+strconv.FormatUint(seq, 10))
+		backoff := time.Second
+		for {
+			_, err := js.PublishMsg(msg)
+			if err == nil {
+				break
+			}
+			logError("Failed to publish flow batch %d (%d flows): %v (retrying)", seq, len(flows), err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+		}
+		s.done()
+	}
+}
+
+func (s *flowStreamer) done() {
+	s.mu.Lock()
+	s.inFlight = false
+	s.mu.Unlock()
+}
+
+// drainFlowStream waits up to timeout for queued flows to be published,
+// so that flows flushed at shutdown are not lost while NATS is reachable.
+func drainFlowStream(timeout time.Duration) {
+	if streamer == nil {
+		return
+	}
+	// Publish what is queued without waiting for batch_age.
+	streamer.mu.Lock()
+	streamer.flushing = true
+	streamer.mu.Unlock()
+	select {
+	case streamer.wake <- struct{}{}:
+	default:
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		streamer.mu.Lock()
+		idle := len(streamer.pending) == 0 && !streamer.inFlight
+		streamer.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logWarning("Flow stream not drained before shutdown")
+}
+
+// systemName is the name agents report as: system_name from the config,
+// or the hostname.
+func systemName() string {
+	if config.SystemName != "" {
+		return config.SystemName
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "unknown"
+}
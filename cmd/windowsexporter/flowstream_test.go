@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gysosin/Logs_exporter/internal/collectors"
+	"github.com/nats-io/nats.go"
+)
+
+func newTestStreamer(t *testing.T, o FlowStreamOptions) *flowStreamer {
+	t.Helper()
+	o, age, err := o.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &flowStreamer{opts: o, batchAge: age, wake: make(chan struct{}, 1)}
+}
+
+// testFlows returns n flows numbered from first by source port.
+func testFlows(first, n int) []collectors.NetFlowEntry {
+	flows := make([]collectors.NetFlowEntry, n)
+	for i := range flows {
+		flows[i] = collectors.NetFlowEntry{SrcIP: "192.0.2.10", DstIP: "198.51.100.1", SrcPort: uint16(first + i), Protocol: "TCP"}
+	}
+	return flows
+}
+
+func ports(flows []collectors.NetFlowEntry) []int {
+	p := make([]int, len(flows))
+	for i, f := range flows {
+		p[i] = int(f.SrcPort)
+	}
+	return p
+}
+
+func TestFlowStreamBatching(t *testing.T) {
+	const age = 300 * time.Millisecond
+	s := newTestStreamer(t, FlowStreamOptions{BatchSize: 3, BatchAge: age.String()})
+
+	// Full batches go at once. The flows are queued while an earlier batch
+	// is still being published.
+	s.enqueue(testFlows(1, 4))
+	time.Sleep(age * 2 / 3)
+	start := time.Now()
+	batch, _ := s.next()
+	if got := ports(batch); len(got) != 3 || got[0] != 1 || time.Since(start) > age/4 {
+		t.Fatalf("full batch %v after %v", got, time.Since(start))
+	}
+	s.done()
+
+	// The partial rest goes once its first flow has waited batch_age,
+	// counted from when it was queued rather than from the last batch.
+	start = time.Now()
+	batch, _ = s.next()
+	if waited := time.Since(start); waited > age/2 {
+		t.Errorf("partial batch waited %v after the full one, want about %v", waited, age/3)
+	}
+	if got := ports(batch); len(got) != 1 || got[0] != 4 {
+		t.Errorf("partial batch %v", got)
+	}
+	s.done()
+
+	// A new partial batch waits for the whole batch_age.
+	s.enqueue(testFlows(5, 1))
+	start = time.Now()
+	s.next()
+	if waited := time.Since(start); waited < age*9/10 {
+		t.Errorf("new partial batch sent after %v, want %v", waited, age)
+	}
+	if len(s.arrivals) != 0 {
+		t.Errorf("%d arrivals left for an empty queue", len(s.arrivals))
+	}
+}
+
+func TestFlowStreamDropsOldest(t *testing.T) {
+	s := newTestStreamer(t, FlowStreamOptions{BatchSize: 2, MaxPending: 5})
+	s.enqueue(testFlows(1, 2))
+	s.enqueue(testFlows(3, 2))
+	s.enqueue(testFlows(5, 3))
+	if got := ports(s.pending); len(got) != 5 || got[0] != 3 || got[4] != 7 {
+		t.Fatalf("pending %v, want 3 to 7", got)
+	}
+	// The first arrival is gone, the second lost none of its flows.
+	if len(s.arrivals) != 2 || s.arrivals[0].n != 2 || s.arrivals[1].n != 3 {
+		t.Errorf("arrivals %+v", s.arrivals)
+	}
+
+	batch, dropped := s.next()
+	if got := ports(batch); dropped != 2 || len(got) != 2 || got[0] != 3 {
+		t.Errorf("first batch %v, dropped %d; want [3 4], 2", got, dropped)
+	}
+	s.done()
+	s.enqueue(testFlows(8, 3))
+	batch, dropped = s.next()
+	if got := ports(batch); dropped != 1 || got[0] != 6 {
+		t.Errorf("second batch %v, dropped %d; want [6 7], 1", got, dropped)
+	}
+	n := 0
+	for _, a := range s.arrivals {
+		n += a.n
+	}
+	if n != len(s.pending) {
+		t.Errorf("arrivals count %d flows, %d pending", n, len(s.pending))
+	}
+}
+
+// fakePublisher fails the first publish attempts, then records messages.
+type fakePublisher struct {
+	mu        sync.Mutex
+	failures  int
+	attempts  []*nats.Msg
+	published chan *nats.Msg
+}
+
+func (p *fakePublisher) PublishMsg(m *nats.Msg, _ ...nats.PubOpt) (*nats.PubAck, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts = append(p.attempts, m)
+	if p.failures > 0 {
+		p.failures--
+		return nil, errors.New("nats: timeout")
+	}
+	p.published <- m
+	return &nats.PubAck{}, nil
+}
+
+func TestFlowStreamRetry(t *testing.T) {
+	s := newTestStreamer(t, FlowStreamOptions{Subject: "flows", BatchSize: 2})
+	p := &fakePublisher{failures: 1, published: make(chan *nats.Msg, 10)}
+	go s.run(p, "host1")
+
+	s.enqueue(testFlows(1, 3))
+	var msgs []*nats.Msg
+	receive := func() {
+		t.Helper()
+		select {
+		case m := <-p.published:
+			msgs = append(msgs, m)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("published %d batches, want 2", len(msgs))
+		}
+	}
+	receive()
+	// The partial batch goes out when the stream is drained at shutdown.
+	streamer = s
+	t.Cleanup(func() { streamer = nil })
+	drainFlowStream(5 * time.Second)
+	receive()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.attempts) != 3 {
+		t.Fatalf("%d publish attempts, want 3", len(p.attempts))
+	}
+	// The retry resends the same message under the same ID.
+	failed, retried := p.attempts[0], p.attempts[1]
+	if failed.Header.Get(nats.MsgIdHdr) == "" || failed.Header.Get(nats.MsgIdHdr) != retried.Header.Get(nats.MsgIdHdr) ||
+		string(failed.Data) != string(retried.Data) {
+		t.Errorf("retry differs: %s %s, %s %s", failed.Header.Get(nats.MsgIdHdr), failed.Data, retried.Header.Get(nats.MsgIdHdr), retried.Data)
+	}
+	if msgs[0].Header.Get(nats.MsgIdHdr) == msgs[1].Header.Get(nats.MsgIdHdr) {
+		t.Errorf("two batches share the ID %s", msgs[0].Header.Get(nats.MsgIdHdr))
+	}
+	for i, m := range msgs {
+		var b flowBatch
+		if err := json.Unmarshal(m.Data, &b); err != nil {
+			t.Fatal(err)
+		}
+		if m.Subject != "flows" || b.Schema != flowBatchSchema || b.SystemName != "host1" || b.Seq != uint64(i+1) {
+			t.Errorf("batch %d: subject %s, %+v", i, m.Subject, b)
+		}
+		if len(b.Flows) != 2-i {
+			t.Errorf("batch %d has %d flows, want %d", i, len(b.Flows), 2-i)
+		}
+	}
+}
+
+func TestFlowStreamOptions(t *testing.T) {
+	o, age, err := FlowStreamOptions{BatchSize: 100, MaxPending: 10}.withDefaults()
+	if err != nil || o.Subject != "netflow" || o.MaxPending != 100 || age != 5*time.Second {
+		t.Errorf("defaults: %+v, %v, %v", o, age, err)
+	}
+	for _, a := range []string{"soon", "0s", "-1s"} {
+		if _, _, err := (FlowStreamOptions{BatchAge: a}).withDefaults(); err == nil {
+			t.Errorf("batch_age %q accepted", a)
+		}
+	}
+}
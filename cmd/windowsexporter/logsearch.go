@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gysosin/Logs_exporter/internal/logs"
+)
+
+// followKeepalive is how often an idle follow stream sends a comment, so
+// that proxies and clients do not time it out.
+const followKeepalive = 15 * time.Second
+
+// handleLogs searches the buffer of recent log records; see
+// logs.ParseLogQuery for the filters. Matching records are returned as
+// NDJSON, oldest first. follow=1 (or Accept: text/event-stream) streams
+// them as server-sent events instead and keeps the stream open for new
+// records. Each event's id is the record's seq, so a client that
+// reconnects with Last-Event-ID carries on after the last one it received.
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	if !logs.RecentEnabled() {
+		http.Error(w, "log buffer disabled; set logs.recent.enabled", http.StatusNotFound)
+		return
+	}
+	q, err := logs.ParseLogQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if follow := r.URL.Query().Get("follow"); follow == "1" || follow == "true" ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		followLogs(w, r, q)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for i, rec := range logs.QueryRecent(q) {
+		if err := enc.Encode(rec); err != nil {
+			return
+		}
+		if flusher != nil && i%1000 == 999 {
+			flusher.Flush()
+		}
+	}
+}
+
+// followLogs sends the matching buffered records and then new ones as
+// server-sent events until the client goes away.
+func followLogs(w http.ResponseWriter, r *http.Request, q logs.LogQuery) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil && n > q.After {
+			q.After = n
+		}
+	}
+	backlog, records, cancel := logs.FollowRecent(q)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Records delivered while the backlog was searched arrive on the
+	// channel as well; last skips them.
+	var last uint64
+	send := func(rec logs.RecentRecord) bool {
+		if rec.Seq <= last {
+			return true
+		}
+		last = rec.Seq
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", rec.Seq, b)
+		return err == nil
+	}
+	for _, rec := range backlog {
+		if !send(rec) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(followKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rec := <-records:
+			if !send(rec) {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
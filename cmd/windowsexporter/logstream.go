@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gysosin/Logs_exporter/internal/logs"
+	"github.com/nats-io/nats.go"
+)
+
+// logBatchSchema identifies the layout of log batch messages.
+const logBatchSchema = "logs_exporter.logs.v1"
+
+// LogStreamOptions configures publishing of log records to JetStream.
+type LogStreamOptions struct {
+	Enabled    bool   `json:"enabled"`
+	Subject    string `json:"subject"`     // "{host}" is replaced by the system name, default "logs.{host}"
+	BatchSize  int    `json:"batch_size"`  // records per message, default 500
+	BatchAge   string `json:"batch_age"`   // publish partial batches after this, default "2s"
+	MaxPending int    `json:"max_pending"` // records queued before the inputs are held back, default 10000
+}
+
+// logBatch is the message published for each batch of records.
+type logBatch struct {
+	Schema     string        `json:"schema"`
+	SystemName string        `json:"system_name"`
+	Seq        uint64        `json:"seq"`
+	SentAt     time.Time     `json:"sent_at"`
+	Records    []logs.Record `json:"records"`
+}
+
+// logStreamer publishes log records with at-least-once delivery: records
+// are acknowledged to their inputs, and file positions advance, only after
+// JetStream has acknowledged the batch that carries them. A full queue
+// holds back the file and journal inputs (see logs.RegisterSink); records
+// held when the service stops are read again after a restart.
+type logStreamer struct {
+	opts     LogStreamOptions
+	subject  string
+	batchAge time.Duration
+	queue    chan logs.Record
+	flush    chan struct{}
+	idle     chan struct{}
+	stop     chan struct{} // closed when shutdown stops waiting for NATS
+}
+
+var logStream *logStreamer
+
+// startLogStream registers the streamer as an acknowledging log sink and
+// starts publishing to natsURL.
+func startLogStream(natsURL string, o LogStreamOptions) error {
+	if !o.Enabled {
+		return nil
+	}
+	if o.Subject == "" {
+		o.Subject = "logs.{host}"
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.MaxPending <= 0 {
+		o.MaxPending = 10000
+	}
+	age := 2 * time.Second
+	if o.BatchAge != "" {
+		d, err := time.ParseDuration(o.BatchAge)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("logs_stream: invalid batch_age %q", o.BatchAge)
+		}
+		age = d
+	}
+
+	nc, err := nats.Connect(natsURL, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("connecting to NATS: %v", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("getting JetStream context: %v", err)
+	}
+
+	host := systemName()
+	logStream = &logStreamer{
+		opts:     o,
+		subject:  strings.ReplaceAll(o.Subject, "{host}", subjectToken(host)),
+		batchAge: age,
+		queue:    make(chan logs.Record, o.MaxPending),
+		flush:    make(chan struct{}, 1),
+		idle:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	logs.RegisterSink(logStream.enqueue, true)
+	go logStream.run(js, host)
+	logWarning("Streaming logs to NATS subject %s", logStream.subject)
+	return nil
+}
+
+// subjectToken makes a name usable as one NATS subject token.
+func subjectToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// enqueue is the log sink. It blocks while the queue is full, which holds
+// back only this sink's own queue in the logs package.
+func (s *logStreamer) enqueue(r logs.Record) {
+	select {
+	case s.queue <- r:
+	case <-s.stop:
+	}
+}
+
+// run collects batches from the queue and publishes them one at a time,
+// retrying each until JetStream acknowledges it or the streamer is
+// stopped.
+func (s *logStreamer) run(js nats.JetStreamContext, host string) {
+	boot := strconv.FormatInt(time.Now().UnixNano(), 36)
+	var seq uint64
+	batch := make([]logs.Record, 0, s.opts.BatchSize)
+	timer := time.NewTimer(s.batchAge)
+	timer.Stop()
+
+	// publish returns false when stopped before JetStream acknowledged the
+	// batch; its records are then left unacknowledged.
+	publish := func() bool {
+		seq++
+		payload, err := json.Marshal(logBatch{
+			Schema:     logBatchSchema,
+			SystemName: host,
+			Seq:        seq,
+			SentAt:     time.Now().UTC(),
+			Records:    batch,
+		})
+		if err != nil {
+			// Not retryable; acknowledge so the inputs do not stall.
+			logError("Failed to marshal log batch: %v", err)
+		} else {
+			msgID := host + "-logs-" + boot + "-" + strconv.FormatUint(seq, 10)
+			backoff := time.Second
+			for {
+				_, err := js.Publish(s.subject, payload, nats.MsgId(msgID))
+				if err == nil {
+					break
+				}
+				logError("Failed to publish log batch %d (%d records): %v (retrying)", seq, len(batch), err)
+				select {
+				case <-s.stop:
+					return false
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > 30*time.Second {
+					backoff = 30 * time.Second
+				}
+			}
+		}
+		for i := range batch {
+			batch[i].Ack()
+		}
+		batch = batch[:0]
+		return true
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case r := <-s.queue:
+			if len(batch) == 0 {
+				timer.Reset(s.batchAge)
+			}
+			batch = append(batch, r)
+			if len(batch) >= s.opts.BatchSize {
+				timer.Stop()
+				if !publish() {
+					return
+				}
+			}
+		case <-timer.C:
+			if len(batch) > 0 && !publish() {
+				return
+			}
+		case <-s.flush:
+			// Publish everything queued, then report that the queue is empty.
+			for {
+				select {
+				case r := <-s.queue:
+					batch = append(batch, r)
+					if len(batch) >= s.opts.BatchSize && !publish() {
+						return
+					}
+					continue
+				default:
+				}
+				break
+			}
+			timer.Stop()
+			if len(batch) > 0 && !publish() {
+				return
+			}
+			s.idle <- struct{}{}
+		}
+	}
+}
+
+// drainLogStream publishes every queued record, waiting up to timeout, so
+// that positions saved at shutdown cover as much as possible. It then stops
+// the streamer, so that a publish still being retried gives up.
+func drainLogStream(timeout time.Duration) {
+	if logStream == nil {
+		return
+	}
+	select {
+	case logStream.flush <- struct{}{}:
+	default:
+	}
+	select {
+	case <-logStream.idle:
+	case <-time.After(timeout):
+		logWarning("Log stream not drained before shutdown")
+	}
+	close(logStream.stop)
+}
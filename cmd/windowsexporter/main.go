@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/gysosin/Logs_exporter/internal/collectors"
+	"github.com/gysosin/Logs_exporter/internal/logs"
 	"github.com/kardianos/service"
 	"github.com/nats-io/nats.go"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -19,11 +21,25 @@ import (
 
 // Config holds runtime configuration read from JSON.
 type Config struct {
-	Port       string   `json:"port"`
-	SystemName string   `json:"system_name"`
-	NatsURL    string   `json:"nats_url"`
-	Mode       string   `json:"mode"`               // "push" or "scrape"
-	NetIfaces  []string `json:"netflow_interfaces"` // optional
+	Port        string                           `json:"port"`
+	SystemName  string                           `json:"system_name"`
+	NatsURL     string                           `json:"nats_url"`
+	Mode        string                           `json:"mode"`                    // "push" or "scrape"
+	NetIfaces   []string                         `json:"netflow_interfaces"`      // optional
+	NetCapture  []collectors.CaptureOptions      `json:"netflow_capture"`         // per-interface capture settings
+	NetListen   []string                         `json:"netflow_listen"`          // optional UDP addresses for NetFlow/IPFIX/sFlow
+	NetAllowed  []string                         `json:"netflow_exporters"`       // addresses or CIDRs allowed to send to netflow_listen; empty allows all
+	PcapFile    string                           `json:"netflow_pcap_file"`       // replay this capture instead of live interfaces
+	PcapSpeed   float64                          `json:"netflow_pcap_speed"`      // 0 = as fast as possible, 1 = real time
+	NetMetrics  collectors.NetFlowMetricsOptions `json:"netflow_metrics"`         // cardinality limits for flow metrics
+	Networks    collectors.NetworkOptions        `json:"netflow_networks"`        // internal CIDRs and local address refresh
+	GeoIP       collectors.GeoIPOptions          `json:"netflow_geoip"`           // optional local .mmdb enrichment
+	ProcRefresh string                           `json:"netflow_process_refresh"` // socket table refresh for process attribution, "0s" disables
+	NetExpiry   collectors.FlowExpiryOptions     `json:"netflow_expiry"`          // idle/active timeouts; flows never expire when unset, unless netflow_listen is set
+	NetArchive  collectors.FlowArchiveOptions    `json:"netflow_archive"`         // rotating local files of expired flows
+	NetStream   FlowStreamOptions                `json:"netflow_stream"`          // publish expired flows to JetStream
+	Logs        logs.Options                     `json:"logs"`                    // log files to tail
+	LogStream   LogStreamOptions                 `json:"logs_stream"`             // publish log records to JetStream
 }
 
 var config Config
@@ -48,6 +64,15 @@ func logError(format string, v ...any) {
 	log.Printf("[ERROR] "+format, v...)
 }
 
+// exitInvalidConfig reports a configuration error on stderr as well as in
+// the log file, so that a service manager or a terminal sees it, and exits
+// with status 1.
+func exitInvalidConfig(err error) {
+	logError("Invalid configuration: %v", err)
+	fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+	os.Exit(1)
+}
+
 func loadConfig(filename string) error {
 	if !filepath.IsAbs(filename) {
 		exePath, err := os.Executable()
@@ -73,7 +98,44 @@ type program struct {
 
 func (p *program) Start(s service.Service) error {
 	logWarning("Service starting with mode=%s", p.Mode)
-	go collectors.CaptureNetFlowFromAll(config.NetIfaces)
+	collectors.SetNetFlowMetricsOptions(config.NetMetrics)
+	if err := collectors.OpenGeoIP(config.GeoIP); err != nil {
+		logError("GeoIP enrichment disabled: %v", err)
+	}
+	if err := collectors.OpenFlowArchive(config.NetArchive); err != nil {
+		logError("Flow archive disabled: %v", err)
+	}
+	if err := startFlowStream(p.NatsURL, config.NetStream); err != nil {
+		logError("Flow streaming disabled: %v", err)
+	}
+	procRefresh := 10 * time.Second
+	if config.ProcRefresh != "" {
+		if d, err := time.ParseDuration(config.ProcRefresh); err == nil {
+			procRefresh = d
+		} else {
+			logWarning("Invalid netflow_process_refresh=%s. Defaulting to %v", config.ProcRefresh, procRefresh)
+		}
+	}
+	collectors.StartProcessAttribution(procRefresh)
+	if config.PcapFile != "" {
+		go func() {
+			if err := collectors.ReplayPcapFile(config.PcapFile, config.PcapSpeed); err != nil {
+				logError("NetFlow replay failed: %v", err)
+			}
+		}()
+	} else {
+		go collectors.CaptureNetFlowFromAll(config.NetIfaces, config.NetCapture)
+	}
+	if len(config.NetListen) > 0 {
+		go collectors.ListenNetFlow(config.NetListen)
+	}
+	// Sinks first, so that no record is read before they are registered.
+	if err := startLogStream(p.NatsURL, config.LogStream); err != nil {
+		logError("Log streaming disabled: %v", err)
+	}
+	if err := logs.Start(config.Logs); err != nil {
+		logError("Log collection disabled: %v", err)
+	}
 	go p.run() // <-- always start the HTTP server
 	if p.Mode == "push" {
 		go pushMetrics(p.NatsURL, p.PushInterval)
@@ -86,25 +148,78 @@ func (p *program) run() {
 	logWarning("Starting HTTP server on %s...", addr)
 
 	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		metrics := collectors.GenerateMetrics()
+		metrics := collectors.GenerateMetrics() + logs.GenerateMetrics()
 		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 		_, _ = w.Write([]byte(metrics))
 	})
 
-	http.HandleFunc("/netflow", func(w http.ResponseWriter, r *http.Request) {
-		entries := collectors.GetNetFlowEntries()
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(entries)
-	})
+	http.HandleFunc("/netflow", handleNetFlow)
+	http.HandleFunc("/logs", handleLogs)
 
 	if err := http.ListenAndServe(addr, nil); err != nil {
 		logError("HTTP server failed: %v", err)
 	}
 }
 
+// handleNetFlow serves the flow buffer. Without parameters it returns every
+// entry as one JSON array; see collectors.ParseNetFlowQuery for filters,
+// sorting and group_by. format=ndjson (or Accept: application/x-ndjson)
+// streams one JSON object per line.
+func handleNetFlow(w http.ResponseWriter, r *http.Request) {
+	q, err := collectors.ParseNetFlowQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("format") != "ndjson" && r.Header.Get("Accept") != "application/x-ndjson" {
+		w.Header().Set("Content-Type", "application/json")
+		if q.GroupBy != "" {
+			_ = json.NewEncoder(w).Encode(collectors.GroupNetFlowEntries(q))
+		} else {
+			_ = json.NewEncoder(w).Encode(collectors.QueryNetFlowEntries(q))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(item any) bool {
+		if err := enc.Encode(item); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	if q.GroupBy != "" {
+		for _, g := range collectors.GroupNetFlowEntries(q) {
+			if !send(g) {
+				return
+			}
+		}
+		return
+	}
+	for _, e := range collectors.QueryNetFlowEntries(q) {
+		if !send(e) {
+			return
+		}
+	}
+}
+
 func (p *program) Stop(s service.Service) error {
 	logWarning("Service stopping")
-	// Perform any necessary cleanup here
+	// Hand flows still in progress to the sinks before closing them.
+	collectors.FlushNetFlows()
+	drainFlowStream(5 * time.Second)
+	collectors.CloseFlowArchive()
+	// Stop reading logs, ship what was read, then save the acknowledged
+	// positions.
+	logs.Stop(5 * time.Second)
+	drainLogStream(5 * time.Second)
+	logs.SavePositions()
 	return nil
 }
 
@@ -135,7 +250,7 @@ func pushMetrics(natsURL string, interval time.Duration) {
 
 	for {
 		<-ticker.C
-		metrics := collectors.GenerateMetrics()
+		metrics := collectors.GenerateMetrics() + logs.GenerateMetrics()
 		payload := map[string]string{
 			"system_name": hostname,
 			"metrics":     metrics,
@@ -168,6 +283,8 @@ func main() {
 	modeFlag := flag.String("mode", "", "Mode (push or scrape)")
 	natsURLFlag := flag.String("nats_url", "", "NATS server URL")
 	pushIntervalFlag := flag.String("push_interval", "1s", "Interval for push mode")
+	pcapFileFlag := flag.String("netflow.pcap-file", "", "Replay a pcap/pcapng file instead of capturing live")
+	pcapSpeedFlag := flag.Float64("netflow.pcap-speed", -1, "Replay speed multiplier (0 = as fast as possible, 1 = real time)")
 
 	flag.Parse()
 
@@ -189,6 +306,34 @@ func main() {
 	if *natsURLFlag != "" {
 		config.NatsURL = *natsURLFlag
 	}
+	if *pcapFileFlag != "" {
+		config.PcapFile = *pcapFileFlag
+	}
+	if *pcapSpeedFlag >= 0 {
+		config.PcapSpeed = *pcapSpeedFlag
+	}
+
+	if err := collectors.ValidateCaptureOptions(config.NetCapture); err != nil {
+		exitInvalidConfig(err)
+	}
+	if err := collectors.ConfigureNetworks(config.Networks); err != nil {
+		exitInvalidConfig(err)
+	}
+	if err := collectors.ConfigureFlowExporters(config.NetAllowed); err != nil {
+		exitInvalidConfig(err)
+	}
+	// Exporters keep sending flows for as long as they run; without expiry
+	// the collector's flow cache would only grow.
+	if len(config.NetListen) > 0 && config.NetExpiry == (collectors.FlowExpiryOptions{}) {
+		config.NetExpiry = collectors.FlowExpiryOptions{IdleTimeout: "60s", ActiveTimeout: "30m"}
+		logWarning("netflow_listen is set without netflow_expiry; expiring flows after 60s idle or 30m active")
+	}
+	if err := collectors.ConfigureFlowExpiry(config.NetExpiry); err != nil {
+		exitInvalidConfig(err)
+	}
+	if err := logs.Validate(config.Logs); err != nil {
+		exitInvalidConfig(err)
+	}
 
 	var mode string
 	if *modeFlag != "" {
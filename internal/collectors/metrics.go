@@ -2,6 +2,7 @@ package collectors
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -109,6 +110,172 @@ func GenerateMetrics() string {
 	sb.WriteString("# TYPE logs_exporter_udp_datagrams_noport counter\n")
 	sb.WriteString(fmt.Sprintf("logs_exporter_udp_datagrams_noport %d\n\n", tcpudp.UDPDatagramsNoPort))
 
+	// NetFlow capture health
+	capStats := GetCaptureStats()
+	sb.WriteString("# HELP logs_exporter_netflow_capture_up Whether the capture handle for an interface is open (1) or being reopened (0).\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_capture_up gauge\n")
+	for _, cs := range capStats {
+		up := 0
+		if cs.Up {
+			up = 1
+		}
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_capture_up{interface=\"%s\"} %d\n", escapeLabel(cs.Interface), up))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_capture_packets_received_total Packets received by the capture filter, as reported by the capture backend.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_capture_packets_received_total counter\n")
+	for _, cs := range capStats {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_capture_packets_received_total{interface=\"%s\"} %d\n", escapeLabel(cs.Interface), cs.PacketsReceived))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_capture_packets_dropped_total Packets dropped by the kernel or the interface, as reported by the capture backend.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_capture_packets_dropped_total counter\n")
+	for _, cs := range capStats {
+		safeIface := escapeLabel(cs.Interface)
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_capture_packets_dropped_total{interface=\"%s\",reason=\"kernel\"} %d\n", safeIface, cs.DroppedKernel))
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_capture_packets_dropped_total{interface=\"%s\",reason=\"interface\"} %d\n", safeIface, cs.DroppedInterface))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_capture_decode_failures_total Captured packets that could not be fully decoded.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_capture_decode_failures_total counter\n")
+	for _, cs := range capStats {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_capture_decode_failures_total{interface=\"%s\"} %d\n", escapeLabel(cs.Interface), cs.DecodeFailures))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_capture_restarts_total Times the capture handle was reopened after failing.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_capture_restarts_total counter\n")
+	for _, cs := range capStats {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_capture_restarts_total{interface=\"%s\"} %d\n", escapeLabel(cs.Interface), cs.Restarts))
+	}
+	sb.WriteString("\n")
+
+	collectorErrs := GetNetFlowCollectorErrors()
+	sb.WriteString("# HELP logs_exporter_netflow_collector_errors_total Flow export datagrams or templates the collector discarded, by kind (denied, malformed, panic, template_limit, exporter_limit, exporter_expired).\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_collector_errors_total counter\n")
+	for _, kind := range sortedKeys64(collectorErrs) {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_collector_errors_total{kind=\"%s\"} %d\n", kind, collectorErrs[kind]))
+	}
+	sb.WriteString("\n")
+
+	// NetFlow traffic counters (bounded by NetFlowMetricsOptions)
+	nfSummary := GetNetFlowSummary()
+	sb.WriteString("# HELP logs_exporter_netflow_bytes_total Bytes seen in flows by direction, protocol and service port.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_bytes_total counter\n")
+	for _, t := range nfSummary.Traffic {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_bytes_total{direction=\"%s\",protocol=\"%s\",service=\"%s\"} %d\n",
+			escapeLabel(t.Direction), escapeLabel(t.Protocol), t.Service, t.Bytes))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_packets_total Packets seen in flows by direction, protocol and service port.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_packets_total counter\n")
+	for _, t := range nfSummary.Traffic {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_packets_total{direction=\"%s\",protocol=\"%s\",service=\"%s\"} %d\n",
+			escapeLabel(t.Direction), escapeLabel(t.Protocol), t.Service, t.Packets))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_peer_bytes_total Bytes exchanged with the top remote peers; the rest are summed as peer=\"other\".\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_peer_bytes_total counter\n")
+	for _, p := range nfSummary.Peers {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_peer_bytes_total{peer=\"%s\"} %d\n", escapeLabel(p.Peer), p.Bytes))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_peer_packets_total Packets exchanged with the top remote peers; the rest are summed as peer=\"other\".\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_peer_packets_total counter\n")
+	for _, p := range nfSummary.Peers {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_peer_packets_total{peer=\"%s\"} %d\n", escapeLabel(p.Peer), p.Packets))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_process_bytes_total Bytes attributed to the top local processes; the rest are summed as process=\"other\".\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_process_bytes_total counter\n")
+	for _, pr := range nfSummary.Processes {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_process_bytes_total{process=\"%s\"} %d\n", escapeLabel(pr.Process), pr.Bytes))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_process_packets_total Packets attributed to the top local processes; the rest are summed as process=\"other\".\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_process_packets_total counter\n")
+	for _, pr := range nfSummary.Processes {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_process_packets_total{process=\"%s\"} %d\n", escapeLabel(pr.Process), pr.Packets))
+	}
+	sb.WriteString("\n")
+
+	if len(nfSummary.Countries) > 0 {
+		sb.WriteString("# HELP logs_exporter_netflow_country_bytes_total Bytes seen in flows by direction and remote country (GeoIP).\n")
+		sb.WriteString("# TYPE logs_exporter_netflow_country_bytes_total counter\n")
+		for _, g := range nfSummary.Countries {
+			sb.WriteString(fmt.Sprintf("logs_exporter_netflow_country_bytes_total{direction=\"%s\",country=\"%s\"} %d\n", escapeLabel(g.Direction), escapeLabel(g.Country), g.Bytes))
+		}
+		sb.WriteString("\n")
+
+		sb.WriteString("# HELP logs_exporter_netflow_asn_bytes_total Bytes seen in flows by direction and remote autonomous system, top-N plus org=\"other\".\n")
+		sb.WriteString("# TYPE logs_exporter_netflow_asn_bytes_total counter\n")
+		for _, g := range nfSummary.ASNs {
+			sb.WriteString(fmt.Sprintf("logs_exporter_netflow_asn_bytes_total{direction=\"%s\",asn=\"%d\",org=\"%s\"} %d\n", escapeLabel(g.Direction), g.ASN, escapeLabel(g.Org), g.Bytes))
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("# HELP logs_exporter_netflow_active_flows Flows seen within the active window, by protocol.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_active_flows gauge\n")
+	for _, proto := range sortedKeys(nfSummary.ActiveFlows) {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_active_flows{protocol=\"%s\"} %d\n", escapeLabel(proto), nfSummary.ActiveFlows[proto]))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_flows Flows in the flow cache.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_flows gauge\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_netflow_flows %d\n\n", nfSummary.TotalFlows))
+
+	sb.WriteString("# HELP logs_exporter_netflow_tcp_flows Flows in the flow cache by TCP connection state.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_tcp_flows gauge\n")
+	for _, state := range sortedKeys(nfSummary.TCPStates) {
+		sb.WriteString(fmt.Sprintf("logs_exporter_netflow_tcp_flows{state=\"%s\"} %d\n", state, nfSummary.TCPStates[state]))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_netflow_tcp_retransmissions_total Retransmitted TCP segments seen in flows.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_tcp_retransmissions_total counter\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_netflow_tcp_retransmissions_total %d\n\n", nfSummary.Retransmissions))
+
+	sb.WriteString("# HELP logs_exporter_netflow_tcp_out_of_order_total Out-of-order TCP segments seen in flows.\n")
+	sb.WriteString("# TYPE logs_exporter_netflow_tcp_out_of_order_total counter\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_netflow_tcp_out_of_order_total %d\n\n", nfSummary.OutOfOrder))
+
+	// DNS decoded from captured packets
+	dnsStats := GetDNSStats()
+	sb.WriteString("# HELP logs_exporter_dns_queries_total DNS queries seen on captured interfaces, by record type.\n")
+	sb.WriteString("# TYPE logs_exporter_dns_queries_total counter\n")
+	for _, t := range sortedKeys64(dnsStats.QueriesByType) {
+		sb.WriteString(fmt.Sprintf("logs_exporter_dns_queries_total{type=\"%s\"} %d\n", escapeLabel(t), dnsStats.QueriesByType[t]))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_dns_responses_total DNS responses seen on captured interfaces, by response code.\n")
+	sb.WriteString("# TYPE logs_exporter_dns_responses_total counter\n")
+	for _, rcode := range sortedKeys64(dnsStats.ResponsesByCode) {
+		sb.WriteString(fmt.Sprintf("logs_exporter_dns_responses_total{rcode=\"%s\"} %d\n", escapeLabel(rcode), dnsStats.ResponsesByCode[rcode]))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_dns_top_queried_names Estimated query counts of the most queried names.\n")
+	sb.WriteString("# TYPE logs_exporter_dns_top_queried_names gauge\n")
+	for _, n := range dnsStats.TopNames {
+		sb.WriteString(fmt.Sprintf("logs_exporter_dns_top_queried_names{name=\"%s\"} %d\n", escapeLabel(n.Name), n.Count))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_dns_cache_entries Address-to-name mappings in the DNS cache.\n")
+	sb.WriteString("# TYPE logs_exporter_dns_cache_entries gauge\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_dns_cache_entries %d\n\n", dnsStats.CachedNames))
+
 	// Windows-only (safely handle nils/empties)
 	for _, pf := range GetPageFileUsage() {
 		safeFile := strings.ReplaceAll(pf.PageFile, `"`, "")
@@ -168,3 +335,29 @@ func GenerateMetrics() string {
 func escapeQuotes(s string) string {
 	return strings.ReplaceAll(s, `"`, `\"`)
 }
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys64(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeLabel escapes a Prometheus label value. Unlike escapeQuotes it also
+// handles backslashes, which appear in Windows device names.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -3,20 +3,23 @@ package collectors
 import (
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 type NetFlowEntry struct {
 	Interface string    `json:"interface"`
-	Direction string    `json:"direction"` // inbound or outbound
+	Exporter  string    `json:"exporter,omitempty"` // set for flows received in collector mode
+	Direction string    `json:"direction"`          // see the Direction* constants
 	SrcIP     string    `json:"src_ip"`
 	DstIP     string    `json:"dst_ip"`
+	SrcName   string    `json:"src_name,omitempty"` // from DNS responses seen on the wire
+	DstName   string    `json:"dst_name,omitempty"`
 	SrcPort   uint16    `json:"src_port"`
 	DstPort   uint16    `json:"dst_port"`
 	Protocol  string    `json:"protocol"`
@@ -24,143 +27,318 @@ type NetFlowEntry struct {
 	Bytes     int       `json:"bytes"`
 	StartTime time.Time `json:"start_time"`
 	EndTime   time.Time `json:"end_time"`
+
+	// SamplingRate is N for 1-in-N sampled flows; Packets and Bytes are
+	// already scaled by it. Zero means unsampled.
+	SamplingRate int `json:"sampling_rate,omitempty"`
+
+	// PID and Process identify the local owner of the socket, when known.
+	PID     int32  `json:"pid,omitempty"`
+	Process string `json:"process,omitempty"`
+
+	// TCP tracking for locally captured flows. TCPFlags accumulates every
+	// flag seen; TCPState and HandshakeRTTMs describe the connection the
+	// flow belongs to.
+	TCPFlags        string  `json:"tcp_flags,omitempty"`
+	TCPState        string  `json:"tcp_state,omitempty"`
+	Retransmissions int     `json:"retransmissions,omitempty"`
+	OutOfOrder      int     `json:"out_of_order,omitempty"`
+	HandshakeRTTMs  float64 `json:"handshake_rtt_ms,omitempty"`
+
+	// GeoIP/ASN enrichment of the remote endpoint, when databases are
+	// configured.
+	RemoteCountry string `json:"remote_country,omitempty"`
+	RemoteCity    string `json:"remote_city,omitempty"`
+	RemoteASN     uint   `json:"remote_asn,omitempty"`
+	RemoteOrg     string `json:"remote_org,omitempty"`
+
+	// EndReason is set on flows that have expired from the cache; see the
+	// FlowEnd* constants.
+	EndReason string `json:"end_reason,omitempty"`
+
+	tcpFlagBits uint8
+	// Wall-clock times used for expiry.
+	createdAt time.Time
+	seenAt    time.Time
+	// socketGen is the socket table generation in which no owner was
+	// found for the flow; see attributeFlow.
+	socketGen uint64
 }
 
 var (
 	netflowMu     sync.Mutex
 	netflowBuffer = make(map[string]*NetFlowEntry)
-	localIPs      = getLocalIPs()
 )
 
-func getLocalIPs() map[string]bool {
-	ips := make(map[string]bool)
-	ifaces, _ := net.Interfaces()
-	for _, iface := range ifaces {
-		addrs, _ := iface.Addrs()
-		for _, addr := range addrs {
-			ipNet, ok := addr.(*net.IPNet)
-			if ok && ipNet.IP.To4() != nil {
-				ips[ipNet.IP.String()] = true
-			}
-		}
-	}
-	return ips
+func makeFlowKey(iface string, src, dst string, sport, dport uint16, proto string, dir string) string {
+	return strings.Join([]string{iface, src, dst, proto, dir, strconv.Itoa(int(sport)), strconv.Itoa(int(dport))}, "|")
 }
 
-func makeFlowKey(iface string, src, dst string, sport, dport uint16, proto string, dir string) string {
-	return strings.Join([]string{iface, src, dst, proto, dir, string(sport), string(dport)}, "|")
+// addFlow merges a decoded flow record into the buffer. Records for the same
+// tuple accumulate, so repeated exports from a router extend one entry.
+// Counters are already scaled, so the merged entry reports the coarsest
+// sampling rate of its records: it is no more exact than that.
+func addFlow(e NetFlowEntry) {
+	key := makeFlowKey(e.Exporter+e.Interface, e.SrcIP, e.DstIP, e.SrcPort, e.DstPort, e.Protocol, e.Direction)
+	enrichFlowGeo(&e)
+	countFlowTraffic(&e, e.Packets, e.Bytes)
+	now := time.Now()
+
+	netflowMu.Lock()
+	defer netflowMu.Unlock()
+
+	entry, ok := netflowBuffer[key]
+	if !ok {
+		e.createdAt, e.seenAt = now, now
+		netflowBuffer[key] = &e
+		return
+	}
+	entry.seenAt = now
+	entry.Packets += e.Packets
+	entry.Bytes += e.Bytes
+	if e.SamplingRate > entry.SamplingRate {
+		entry.SamplingRate = e.SamplingRate
+	}
+	if e.StartTime.Before(entry.StartTime) {
+		entry.StartTime = e.StartTime
+	}
+	if e.EndTime.After(entry.EndTime) {
+		entry.EndTime = e.EndTime
+	}
 }
 
-func updateFlow(entry *NetFlowEntry, length int) {
-	entry.Packets++
-	entry.Bytes += length
-	entry.EndTime = time.Now()
+func updateFlow(entry *NetFlowEntry, packets, bytes int, ts time.Time) {
+	entry.Packets += packets
+	entry.Bytes += bytes
+	entry.EndTime = ts
+	entry.seenAt = time.Now()
 }
 
-func CaptureNetFlowFromAll(override []string) {
-	ifaces := []pcap.Interface{}
-	log.Printf("Monitoring interfaces:")
-	for _, iface := range ifaces {
-		log.Println("- " + iface.Name)
+const (
+	captureStatsInterval = 5 * time.Second
+	captureRescan        = 30 * time.Second
+	reopenMinBackoff     = time.Second
+	reopenMaxBackoff     = 30 * time.Second
+)
+
+var (
+	capturingMu sync.Mutex
+	capturing   = make(map[string]bool)
+)
+
+// CaptureNetFlowFromAll starts a capture goroutine for each selected
+// interface (all interfaces when override is empty), opened with the
+// matching entry from opts. Named interfaces are captured even if they do
+// not exist yet; in "all" mode the device list is rescanned so adapters
+// that appear later (e.g. VPNs) are picked up.
+func CaptureNetFlowFromAll(override []string, opts []CaptureOptions) {
+	if len(override) > 0 {
+		log.Printf("Monitoring interfaces:")
+		for _, name := range override {
+			log.Println("- " + name)
+			startCapture(name, opts)
+		}
+		return
 	}
-	if len(override) == 0 {
-		all, err := pcap.FindAllDevs()
+
+	for {
+		all, err := captureInterfaceNames()
 		if err != nil {
 			log.Printf("Error getting interfaces: %v", err)
 			return
 		}
-		ifaces = all
-	} else {
-		for _, name := range override {
-			iface, err := pcap.FindAllDevs()
-			if err != nil {
-				continue
-			}
-			for _, dev := range iface {
-				if dev.Name == name {
-					ifaces = append(ifaces, dev)
-					break
-				}
-			}
+		for _, name := range all {
+			startCapture(name, opts)
 		}
+		time.Sleep(captureRescan)
 	}
+}
 
-	for _, iface := range ifaces {
-		go captureFromInterface(iface.Name)
+// startCapture launches the capture goroutines for name unless they are
+// already running: one per fanout worker, or a single one.
+func startCapture(name string, opts []CaptureOptions) {
+	capturingMu.Lock()
+	defer capturingMu.Unlock()
+
+	if capturing[name] {
+		return
+	}
+	capturing[name] = true
+	o := captureOptionsFor(name, opts)
+	workers := o.FanoutWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		go captureFromInterface(o, w)
+	}
+}
+
+// captureFromInterface keeps one interface captured for the lifetime of the
+// process, reopening it with backoff whenever the handle cannot be opened
+// or fails (for example when the interface goes away). Fanout workers are
+// reported separately in capture statistics as "<interface>#<worker>".
+func captureFromInterface(opts CaptureOptions, worker int) {
+	name := opts.Interface
+	if opts.FanoutWorkers > 1 {
+		name = name + "#" + strconv.Itoa(worker)
+	}
+	sampler := newPacketSampler(opts)
+	backoff := reopenMinBackoff
+	lastErr := ""
+	for {
+		started := time.Now()
+		err := captureUntilError(opts, worker, name, sampler)
+		setCaptureUp(name, false, err)
+		// Log state changes only; a missing adapter fails the same way on
+		// every retry.
+		if err.Error() != lastErr {
+			log.Printf("Capture on %s stopped: %v (retrying)", name, err)
+			lastErr = err.Error()
+		}
+
+		if time.Since(started) > reopenMaxBackoff {
+			backoff = reopenMinBackoff
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > reopenMaxBackoff {
+			backoff = reopenMaxBackoff
+		}
 	}
 }
 
-func captureFromInterface(name string) {
-	handle, err := pcap.OpenLive(name, 1600, true, pcap.BlockForever)
+// captureUntilError reads packets from a fresh handle until reading fails.
+// statsName is the key the handle's health is recorded under.
+func captureUntilError(opts CaptureOptions, worker int, statsName string, sampler *packetSampler) error {
+	handle, err := openCapture(opts, worker)
 	if err != nil {
-		log.Printf("Error opening interface %s: %v", name, err)
-		return
+		return err
 	}
 	defer handle.Close()
+	setCaptureUp(statsName, true, nil)
+	return readUntilError(handle, opts.Interface, statsName, sampler)
+}
 
-	src := gopacket.NewPacketSource(handle, handle.LinkType())
-	for packet := range src.Packets() {
-		networkLayer := packet.NetworkLayer()
-		if networkLayer == nil {
-			continue
+// readUntilError processes packets from handle until reading fails, polling
+// handle statistics between packets and once more before returning, so
+// drops counted just before the failure are not lost with the handle.
+func readUntilError(handle captureHandle, name, statsName string, sampler *packetSampler) error {
+	pollStats := func() {
+		if s, err := handle.Stats(); err == nil {
+			recordHandleStats(statsName, s)
+		}
+	}
+	linkType := handle.LinkType()
+	lastStats := time.Now()
+	for {
+		data, ci, err := handle.ReadPacketData()
+		switch {
+		case err == errReadTimeout:
+		case err != nil:
+			pollStats()
+			return err
+		case sampler.sample():
+			packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+			packet.Metadata().CaptureInfo = ci
+			if packet.ErrorLayer() != nil {
+				recordDecodeFailure(statsName)
+			}
+			processPacket(name, packet, sampler.rate())
 		}
 
-		var (
-			srcIP, dstIP string
-			proto        string
-			sport, dport uint16
-		)
-
-		// Safely handle IPv4 only
-		switch ipLayer := networkLayer.(type) {
-		case *layers.IPv4:
-			srcIP = ipLayer.SrcIP.String()
-			dstIP = ipLayer.DstIP.String()
-			proto = ipLayer.Protocol.String()
-		default:
-			continue // skip non-IPv4 (like IPv6)
+		if time.Since(lastStats) >= captureStatsInterval {
+			pollStats()
+			lastStats = time.Now()
 		}
+	}
+}
 
-		log.Printf("Packet captured on %s (src=%s, dst=%s)", name, srcIP, dstIP)
+// processPacket accounts one captured or replayed packet to its flow. Flow
+// times come from the capture timestamp so replayed files keep their
+// original timeline. rate is the sampling rate the packet stands for.
+func processPacket(name string, packet gopacket.Packet, rate int) {
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return
+	}
 
-		dir := "inbound"
-		if localIPs[srcIP] {
-			dir = "outbound"
-		}
+	var (
+		src, dst     net.IP
+		proto        string
+		sport, dport uint16
+	)
 
-		// Detect port and transport
-		if t := packet.TransportLayer(); t != nil {
-			switch layer := t.(type) {
-			case *layers.TCP:
-				sport, dport = uint16(layer.SrcPort), uint16(layer.DstPort)
-			case *layers.UDP:
-				sport, dport = uint16(layer.SrcPort), uint16(layer.DstPort)
-			}
+	switch ipLayer := networkLayer.(type) {
+	case *layers.IPv4:
+		src, dst = ipLayer.SrcIP, ipLayer.DstIP
+		proto = ipLayer.Protocol.String()
+	case *layers.IPv6:
+		src, dst = ipLayer.SrcIP, ipLayer.DstIP
+		proto = ipLayer.NextHeader.String()
+	default:
+		return
+	}
+	srcIP, dstIP := src.String(), dst.String()
+
+	dir := classifyFlow(src, dst)
+
+	// Detect port and transport
+	var tcp *layers.TCP
+	if t := packet.TransportLayer(); t != nil {
+		switch layer := t.(type) {
+		case *layers.TCP:
+			tcp = layer
+			sport, dport = uint16(layer.SrcPort), uint16(layer.DstPort)
+		case *layers.UDP:
+			sport, dport = uint16(layer.SrcPort), uint16(layer.DstPort)
 		}
+	}
 
-		key := makeFlowKey(name, srcIP, dstIP, sport, dport, proto, dir)
-		now := time.Now()
-
-		netflowMu.Lock()
-		if entry, ok := netflowBuffer[key]; ok {
-			updateFlow(entry, len(packet.Data()))
-		} else {
-			netflowBuffer[key] = &NetFlowEntry{
-				Interface: name,
-				Direction: dir,
-				SrcIP:     srcIP,
-				DstIP:     dstIP,
-				SrcPort:   sport,
-				DstPort:   dport,
-				Protocol:  proto,
-				Packets:   1,
-				Bytes:     len(packet.Data()),
-				StartTime: now,
-				EndTime:   now,
-			}
+	key := makeFlowKey(name, srcIP, dstIP, sport, dport, proto, dir)
+	ts := packet.Metadata().Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	processDNS(packet, ts)
+
+	packets, bytes := rate, len(packet.Data())*rate
+	sampling := 0
+	if rate > 1 {
+		sampling = rate
+	}
+
+	netflowMu.Lock()
+	if entry, ok := netflowBuffer[key]; ok {
+		updateFlow(entry, packets, bytes, ts)
+		attributeFlow(entry)
+	} else {
+		entry = &NetFlowEntry{
+			Interface: name,
+			Direction: dir,
+			SrcIP:     srcIP,
+			DstIP:     dstIP,
+			SrcPort:   sport,
+			DstPort:   dport,
+			Protocol:  proto,
+			Packets:   packets,
+			Bytes:     bytes,
+			StartTime: ts,
+			EndTime:   ts,
+
+			SamplingRate: sampling,
 		}
-		netflowMu.Unlock()
+		entry.createdAt = time.Now()
+		entry.seenAt = entry.createdAt
+		attributeFlow(entry)
+		enrichFlowGeo(entry)
+		netflowBuffer[key] = entry
+	}
+	countFlowTraffic(netflowBuffer[key], packets, bytes)
+	annotateFlowNames(netflowBuffer[key], ts)
+	if tcp != nil {
+		trackTCP(netflowBuffer[key], key, tcp, ts)
 	}
+	netflowMu.Unlock()
 }
 
 func GetNetFlowEntries() []NetFlowEntry {
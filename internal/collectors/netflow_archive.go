@@ -0,0 +1,191 @@
+package collectors
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const defaultArchiveMaxSizeMB = 100
+
+// FlowArchiveOptions configures the local archive of expired flows. Files
+// rotate by size and, optionally, by age; rotated files are kept for
+// MaxAgeDays and MaxBackups and can be gzip-compressed.
+type FlowArchiveOptions struct {
+	Path        string `json:"path"`         // e.g. "flows/flows.ndjson"; empty disables the archive
+	Format      string `json:"format"`       // "ndjson" (default) or "csv"
+	MaxSizeMB   int    `json:"max_size_mb"`  // rotate at this size, default 100
+	RotateEvery string `json:"rotate_every"` // also rotate files older than this, e.g. "1h"
+	MaxAgeDays  int    `json:"max_age_days"` // delete rotated files older than this, 0 = keep
+	MaxBackups  int    `json:"max_backups"`  // keep at most this many rotated files, 0 = keep
+	Compress    bool   `json:"compress"`     // gzip rotated files
+}
+
+// flowCSVHeader names the CSV columns, matching the JSON field names.
+var flowCSVHeader = []string{
+	"interface", "exporter", "direction", "src_ip", "dst_ip", "src_name", "dst_name",
+	"src_port", "dst_port", "protocol", "packets", "bytes", "start_time", "end_time",
+	"sampling_rate", "pid", "process", "tcp_flags", "tcp_state", "retransmissions",
+	"out_of_order", "handshake_rtt_ms", "remote_country", "remote_city", "remote_asn",
+	"remote_org", "end_reason",
+}
+
+// flowArchive writes flows through lumberjack. Size rotation is done here
+// rather than by lumberjack so that every CSV file starts with a header.
+type flowArchive struct {
+	mu      sync.Mutex
+	out     *lumberjack.Logger
+	csv     bool
+	maxSize int64
+	every   time.Duration
+	size    int64
+	opened  time.Time
+}
+
+var archive *flowArchive
+
+// OpenFlowArchive starts archiving expired flows. It is a no-op when no
+// path is configured, and needs flow expiry to be enabled.
+func OpenFlowArchive(o FlowArchiveOptions) error {
+	if o.Path == "" {
+		return nil
+	}
+	if !FlowExpiryEnabled() {
+		return fmt.Errorf("netflow_archive: flows never expire; set netflow_expiry timeouts")
+	}
+	a := &flowArchive{
+		maxSize: int64(o.MaxSizeMB) << 20,
+		opened:  time.Now(),
+	}
+	switch o.Format {
+	case "", "ndjson":
+	case "csv":
+		a.csv = true
+	default:
+		return fmt.Errorf("netflow_archive: unknown format %q (want ndjson or csv)", o.Format)
+	}
+	if o.MaxSizeMB < 0 || o.MaxAgeDays < 0 || o.MaxBackups < 0 {
+		return fmt.Errorf("netflow_archive: sizes and retention must not be negative")
+	}
+	if o.MaxSizeMB == 0 {
+		o.MaxSizeMB = defaultArchiveMaxSizeMB
+		a.maxSize = defaultArchiveMaxSizeMB << 20
+	}
+	if o.RotateEvery != "" {
+		d, err := time.ParseDuration(o.RotateEvery)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("netflow_archive: invalid rotate_every %q", o.RotateEvery)
+		}
+		a.every = d
+	}
+
+	// Continue an existing file; its size counts towards rotation.
+	if fi, err := os.Stat(o.Path); err == nil {
+		a.size = fi.Size()
+		a.opened = fi.ModTime()
+	}
+	a.out = &lumberjack.Logger{
+		Filename: o.Path,
+		// Larger than maxSize so that lumberjack never rotates on its own.
+		MaxSize:    o.MaxSizeMB + 1,
+		MaxAge:     o.MaxAgeDays,
+		MaxBackups: o.MaxBackups,
+		Compress:   o.Compress,
+	}
+	archive = a
+	RegisterFlowSink(a.write)
+	return nil
+}
+
+// CloseFlowArchive closes the current archive file.
+func CloseFlowArchive() {
+	if archive == nil {
+		return
+	}
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.out.Close()
+}
+
+// write appends one line per flow, rotating before a line would take the
+// file past its size limit or when the file is older than RotateEvery.
+func (a *flowArchive) write(flows []NetFlowEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.every > 0 && a.size > 0 && time.Since(a.opened) >= a.every {
+		a.rotate()
+	}
+	for i := range flows {
+		line, err := a.encode(&flows[i])
+		if err != nil {
+			log.Printf("Error encoding archived flow: %v", err)
+			continue
+		}
+		if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+			a.rotate()
+		}
+		if a.size == 0 && a.csv {
+			header, _ := encodeCSV(flowCSVHeader)
+			if !a.append(header) {
+				return
+			}
+		}
+		if !a.append(line) {
+			return
+		}
+	}
+}
+
+func (a *flowArchive) append(b []byte) bool {
+	n, err := a.out.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing flow archive: %v", err)
+		return false
+	}
+	return true
+}
+
+func (a *flowArchive) rotate() {
+	if err := a.out.Rotate(); err != nil {
+		log.Printf("Error rotating flow archive: %v", err)
+		return
+	}
+	a.size = 0
+	a.opened = time.Now()
+}
+
+func (a *flowArchive) encode(e *NetFlowEntry) ([]byte, error) {
+	if !a.csv {
+		b, err := json.Marshal(e)
+		return append(b, '\n'), err
+	}
+	return encodeCSV([]string{
+		e.Interface, e.Exporter, e.Direction, e.SrcIP, e.DstIP, e.SrcName, e.DstName,
+		strconv.Itoa(int(e.SrcPort)), strconv.Itoa(int(e.DstPort)), e.Protocol,
+		strconv.Itoa(e.Packets), strconv.Itoa(e.Bytes),
+		e.StartTime.Format(time.RFC3339Nano), e.EndTime.Format(time.RFC3339Nano),
+		strconv.Itoa(e.SamplingRate), strconv.Itoa(int(e.PID)), e.Process,
+		e.TCPFlags, e.TCPState, strconv.Itoa(e.Retransmissions), strconv.Itoa(e.OutOfOrder),
+		strconv.FormatFloat(e.HandshakeRTTMs, 'f', -1, 64),
+		e.RemoteCountry, e.RemoteCity, strconv.FormatUint(uint64(e.RemoteASN), 10), e.RemoteOrg,
+		e.EndReason,
+	})
+}
+
+func encodeCSV(record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(record)
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,196 @@
+package collectors
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestArchive opens an archive in a temporary directory with expiry
+// enabled and the sinks restored afterwards.
+func openTestArchive(t *testing.T, o FlowArchiveOptions) *flowArchive {
+	t.Helper()
+	setFlowTimeouts(t, time.Minute, 0)
+	useFlowSinks(t)
+	if err := OpenFlowArchive(o); err != nil {
+		t.Fatal(err)
+	}
+	a := archive
+	t.Cleanup(func() {
+		CloseFlowArchive()
+		archive = nil
+	})
+	return a
+}
+
+// archiveFiles returns the lines of the archive files in dir, current file
+// last.
+func archiveFiles(t *testing.T, dir, current string) [][]string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotated files are named by time; the current one goes last.
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == current || names[j] == current {
+			return names[j] == current && names[i] != current
+		}
+		return names[i] < names[j]
+	})
+	var files [][]string
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for s := bufio.NewScanner(f); s.Scan(); {
+			lines = append(lines, s.Text())
+		}
+		f.Close()
+		files = append(files, lines)
+	}
+	return files
+}
+
+func archivedFlow(peer string) NetFlowEntry {
+	e := outboundFlow(peer, 443, "curl", 1500)
+	e.Interface, e.EndReason = "eth0", FlowEndIdle
+	return e
+}
+
+func TestFlowCSVHeaderMatchesJSON(t *testing.T) {
+	var names []string
+	typ := reflect.TypeOf(NetFlowEntry{})
+	for i := 0; i < typ.NumField(); i++ {
+		if tag := typ.Field(i).Tag.Get("json"); tag != "" {
+			names = append(names, strings.Split(tag, ",")[0])
+		}
+	}
+	if !reflect.DeepEqual(names, flowCSVHeader) {
+		t.Errorf("CSV header %v\ndoes not match the JSON fields %v", flowCSVHeader, names)
+	}
+
+	a := &flowArchive{csv: true}
+	line, err := a.encode(&NetFlowEntry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := csv.NewReader(strings.NewReader(string(line))).Read()
+	if err != nil || len(row) != len(flowCSVHeader) {
+		t.Errorf("CSV row has %d columns, header %d (%v)", len(row), len(flowCSVHeader), err)
+	}
+}
+
+func TestFlowArchiveCSVRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flows.csv")
+	a := openTestArchive(t, FlowArchiveOptions{Path: path, Format: "csv"})
+	sample := archivedFlow("198.51.100.0")
+	line, _ := a.encode(&sample)
+	header, _ := encodeCSV(flowCSVHeader)
+	// Room for the header and two flows, but not three.
+	a.maxSize = int64(len(header)) + 5*int64(len(line))/2
+
+	// The expiry goroutine hands over a batch at a time; lumberjack names
+	// rotated files to the millisecond.
+	for i, peers := range [][]string{{"198.51.100.1", "198.51.100.2"}, {"198.51.100.3"}, {"198.51.100.4", "198.51.100.5"}} {
+		if i > 0 {
+			time.Sleep(2 * time.Millisecond)
+		}
+		var flows []NetFlowEntry
+		for _, p := range peers {
+			flows = append(flows, archivedFlow(p))
+		}
+		a.write(flows)
+	}
+
+	files := archiveFiles(t, dir, path)
+	if len(files) != 3 {
+		t.Fatalf("%d files, want 3: %q", len(files), files)
+	}
+	var peers []string
+	for _, lines := range files {
+		if len(lines) == 0 || lines[0] != strings.Join(flowCSVHeader, ",") {
+			t.Fatalf("file does not start with the header: %q", lines)
+		}
+		for _, l := range lines[1:] {
+			row, err := csv.NewReader(strings.NewReader(l)).Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			peers = append(peers, row[4])
+		}
+	}
+	want := []string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "198.51.100.4", "198.51.100.5"}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("archived %v, want %v", peers, want)
+	}
+
+	// Reopening continues the current file without a second header.
+	CloseFlowArchive()
+	a = openTestArchive(t, FlowArchiveOptions{Path: path, Format: "csv"})
+	a.write([]NetFlowEntry{archivedFlow("198.51.100.6")})
+	files = archiveFiles(t, dir, path)
+	current := files[len(files)-1]
+	if len(files) != 3 || len(current) != 3 || strings.Count(strings.Join(current, "\n"), "src_ip") != 1 {
+		t.Errorf("after reopening: %q", current)
+	}
+}
+
+func TestFlowArchiveRotateEvery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flows.ndjson")
+	a := openTestArchive(t, FlowArchiveOptions{Path: path, RotateEvery: "1h"})
+	a.write([]NetFlowEntry{archivedFlow("198.51.100.1")})
+	a.write([]NetFlowEntry{archivedFlow("198.51.100.2")})
+	if files := archiveFiles(t, dir, path); len(files) != 1 {
+		t.Fatalf("rotated before rotate_every: %q", files)
+	}
+
+	a.opened = time.Now().Add(-time.Hour)
+	a.write([]NetFlowEntry{archivedFlow("198.51.100.3")})
+	files := archiveFiles(t, dir, path)
+	if len(files) != 2 || len(files[0]) != 2 || len(files[1]) != 1 {
+		t.Fatalf("after rotate_every: %q", files)
+	}
+	var e NetFlowEntry
+	if err := json.Unmarshal([]byte(files[1][0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.DstIP != "198.51.100.3" || e.EndReason != FlowEndIdle || e.Bytes != 1500 {
+		t.Errorf("archived %+v", e)
+	}
+}
+
+func TestOpenFlowArchiveErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows")
+	setFlowTimeouts(t, 0, 0)
+	if err := OpenFlowArchive(FlowArchiveOptions{Path: path}); err == nil {
+		t.Error("archive opened without flow expiry")
+	}
+	setFlowTimeouts(t, time.Minute, 0)
+	useFlowSinks(t)
+	for _, o := range []FlowArchiveOptions{
+		{Path: path, Format: "xml"},
+		{Path: path, MaxSizeMB: -1},
+		{Path: path, MaxBackups: -1},
+		{Path: path, RotateEvery: "daily"},
+		{Path: path, RotateEvery: "0s"},
+	} {
+		if err := OpenFlowArchive(o); err == nil {
+			t.Errorf("OpenFlowArchive(%+v) succeeded, want an error", o)
+		}
+	}
+	if len(flowSinks) != 0 {
+		t.Errorf("a failed open registered a sink")
+	}
+}
@@ -0,0 +1,54 @@
+package collectors
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// bpfMaxInstructions is the kernel's limit for socket filters.
+const bpfMaxInstructions = 4096
+
+// parseRawBPF reads a precompiled filter, the instructions printed by
+// "tcpdump -ddd" joined with commas ("count,code jt jf k,..."), and reports
+// whether expr was in that format.
+func parseRawBPF(expr string) ([]bpf.RawInstruction, bool, error) {
+	parts := strings.Split(strings.TrimSpace(expr), ",")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || len(parts) < 2 {
+		return nil, false, nil
+	}
+	if n > bpfMaxInstructions {
+		return nil, true, fmt.Errorf("raw filter too long (%d instructions, at most %d)", n, bpfMaxInstructions)
+	}
+	if n != len(parts)-1 {
+		return nil, true, fmt.Errorf("raw filter declares %d instructions but has %d", n, len(parts)-1)
+	}
+	raw := make([]bpf.RawInstruction, 0, n)
+	for _, part := range parts[1:] {
+		f := strings.Fields(part)
+		if len(f) != 4 {
+			return nil, true, fmt.Errorf("raw instruction %q: want \"code jt jf k\"", part)
+		}
+		var v [4]uint64
+		for i, s := range f {
+			if v[i], err = strconv.ParseUint(s, 10, 32); err != nil {
+				return nil, true, fmt.Errorf("raw instruction %q: %v", part, err)
+			}
+		}
+		if v[0] > 0xffff || v[1] > 0xff || v[2] > 0xff {
+			return nil, true, fmt.Errorf("raw instruction %q out of range", part)
+		}
+		raw = append(raw, bpf.RawInstruction{Op: uint16(v[0]), Jt: uint8(v[1]), Jf: uint8(v[2]), K: uint32(v[3])})
+	}
+	prog, ok := bpf.Disassemble(raw)
+	if !ok {
+		return nil, true, fmt.Errorf("raw filter has unknown instructions")
+	}
+	if _, err := bpf.NewVM(prog); err != nil {
+		return nil, true, fmt.Errorf("raw filter: %v", err)
+	}
+	return raw, true, nil
+}
@@ -0,0 +1,119 @@
+package collectors
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// testPacket builds an Ethernet frame.
+func testPacket(t *testing.T, src, dst string, proto layers.IPProtocol, sport, dport uint16) []byte {
+	t.Helper()
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	var ls []gopacket.SerializableLayer
+	var network gopacket.NetworkLayer
+	ethType := layers.EthernetTypeIPv4
+	if srcIP.To4() != nil {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: srcIP.To4(), DstIP: dstIP.To4()}
+		ls, network = append(ls, ip), ip
+	} else {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: srcIP, DstIP: dstIP}
+		ls, network = append(ls, ip), ip
+		ethType = layers.EthernetTypeIPv6
+	}
+	switch proto {
+	case layers.IPProtocolTCP:
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), SYN: true, Window: 1024}
+		tcp.SetNetworkLayerForChecksum(network)
+		ls = append(ls, tcp)
+	case layers.IPProtocolUDP:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+		udp.SetNetworkLayerForChecksum(network)
+		ls = append(ls, udp)
+	case layers.IPProtocolICMPv4:
+		ls = append(ls, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(8, 0)})
+	}
+	ls = append(ls, gopacket.Payload("data"))
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: ethType,
+	}
+	ls = append([]gopacket.SerializableLayer{eth}, ls...)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func runFilter(t *testing.T, expr string, pkt []byte) bool {
+	t.Helper()
+	raw, ok, err := parseRawBPF(expr)
+	if !ok || err != nil {
+		t.Fatalf("parsing %q: %v", expr, err)
+	}
+	prog, ok := bpf.Disassemble(raw)
+	if !ok {
+		t.Fatalf("%q has unknown instructions", expr)
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("%q: %v", expr, err)
+	}
+	n, err := vm.Run(pkt)
+	if err != nil {
+		t.Fatalf("running %q: %v", expr, err)
+	}
+	return n > 0
+}
+
+func TestParseRawBPF(t *testing.T) {
+	// tcpdump -ddd ip; tcpdump -ddd tcp
+	const (
+		ip  = "4,40 0 0 12,21 0 1 2048,6 0 0 262144,6 0 0 0"
+		tcp = "12,40 0 0 12,21 0 5 34525,48 0 0 20,21 6 0 6,21 0 6 44,48 0 0 54,21 3 4 6,21 0 3 2048,48 0 0 23,21 0 1 6,6 0 0 262144,6 0 0 0"
+	)
+	tcp4 := testPacket(t, "10.0.0.1", "192.168.1.20", layers.IPProtocolTCP, 40000, 443)
+	udp4 := testPacket(t, "10.0.0.1", "8.8.8.8", layers.IPProtocolUDP, 5353, 53)
+	tcp6 := testPacket(t, "2001:db8::1", "2001:db8:1::2", layers.IPProtocolTCP, 22, 50000)
+	tests := []struct {
+		expr string
+		pkt  []byte
+		want bool
+	}{
+		{ip, tcp4, true},
+		{ip, tcp6, false},
+		{tcp, tcp4, true},
+		{tcp, tcp6, true},
+		{tcp, udp4, false},
+		{" " + ip + " ", udp4, true},
+	}
+	for _, tt := range tests {
+		if got := runFilter(t, tt.expr, tt.pkt); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"tcp", "not port 22", "", "4"} {
+		if _, ok, _ := parseRawBPF(expr); ok {
+			t.Errorf("%q: taken as a precompiled filter", expr)
+		}
+	}
+	for _, expr := range []string{
+		"3,40 0 0 12,6 0 0 0",   // wrong count
+		"1,6 0 0",               // missing field
+		"1,6 0 300 0",           // jump out of range
+		"2,21 0 9 2048,6 0 0 0", // jumps past the end
+		"1,65535 0 0 0",         // unknown opcode
+		"1,-6 0 0 0",            // not a number
+		"5000,6 0 0 0",          // too long
+	} {
+		if _, ok, err := parseRawBPF(expr); !ok || err == nil {
+			t.Errorf("%q: want an error", expr)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package collectors
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	defaultSnaplen = 1600
+	maxSnaplen     = 262144
+
+	// captureReadTimeout bounds each read so statistics can be polled on
+	// idle interfaces.
+	captureReadTimeout = 500 * time.Millisecond
+
+	maxFanoutWorkers = 64
+)
+
+// Capture backends.
+const (
+	BackendPcap     = "pcap"     // libpcap/Npcap, every platform
+	BackendAFPacket = "afpacket" // Linux AF_PACKET TPACKET_V3 ring, no libpcap
+)
+
+// fanoutTypes are the AF_PACKET fanout modes that can be configured.
+var fanoutTypes = map[string]bool{"hash": true, "lb": true, "cpu": true, "rollover": true, "random": true, "qm": true}
+
+// CaptureOptions configures how an interface is opened for flow capture.
+// An entry with Interface "*" applies to every interface that has no entry
+// of its own. Promiscuous mode is off unless explicitly requested.
+//
+// The afpacket backend can spread an interface over several sockets in one
+// PACKET_FANOUT group, each read by its own goroutine.
+type CaptureOptions struct {
+	Interface     string `json:"interface"`
+	BPFFilter     string `json:"bpf_filter"`     // e.g. "not port 22"
+	Snaplen       int    `json:"snaplen"`        // bytes per packet, default 1600
+	Promiscuous   bool   `json:"promiscuous"`    // default false
+	BufferSize    int    `json:"buffer_size"`    // kernel buffer in bytes, 0 = OS default
+	ImmediateMode bool   `json:"immediate_mode"` // deliver packets without buffering
+	SamplingMode  string `json:"sampling_mode"`  // "", "deterministic" (every Nth) or "random" (1/N chance)
+	SamplingRate  int    `json:"sampling_rate"`  // N for 1-in-N sampling
+	Backend       string `json:"backend"`        // "pcap" or "afpacket", default depends on the build
+	FanoutWorkers int    `json:"fanout_workers"` // afpacket: sockets per interface, default 1
+	FanoutGroup   int    `json:"fanout_group"`   // afpacket: PACKET_FANOUT group id, 0 = assigned by the kernel
+	FanoutType    string `json:"fanout_type"`    // afpacket: hash (default), lb, cpu, rollover, random or qm
+}
+
+// captureHandle is an open capture on one interface, whatever the backend.
+type captureHandle interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	Stats() (handleStats, error)
+	Close()
+}
+
+// handleStats are the counters of one open handle since it was opened.
+type handleStats struct {
+	Received         uint64
+	DroppedKernel    uint64
+	DroppedInterface uint64
+}
+
+// errReadTimeout is returned by handles when no packet arrived within
+// captureReadTimeout.
+var errReadTimeout = errors.New("capture read timeout")
+
+// ValidateCaptureOptions checks capture settings at startup so that typos
+// in filters or sizes are reported before any interface is opened.
+func ValidateCaptureOptions(opts []CaptureOptions) error {
+	seen := make(map[string]bool)
+	for _, o := range opts {
+		if o.Interface == "" {
+			return fmt.Errorf("netflow_capture: entry without interface (use \"*\" for all interfaces)")
+		}
+		if seen[o.Interface] {
+			return fmt.Errorf("netflow_capture[%s]: duplicate entry", o.Interface)
+		}
+		seen[o.Interface] = true
+
+		if o.Snaplen < 0 || o.Snaplen > maxSnaplen {
+			return fmt.Errorf("netflow_capture[%s]: snaplen %d out of range 0-%d", o.Interface, o.Snaplen, maxSnaplen)
+		}
+		if o.BufferSize < 0 {
+			return fmt.Errorf("netflow_capture[%s]: buffer_size must not be negative", o.Interface)
+		}
+		switch o.SamplingMode {
+		case "", "none":
+		case "deterministic", "random":
+			if o.SamplingRate < 1 {
+				return fmt.Errorf("netflow_capture[%s]: sampling_mode %q needs sampling_rate >= 1", o.Interface, o.SamplingMode)
+			}
+		default:
+			return fmt.Errorf("netflow_capture[%s]: unknown sampling_mode %q (want deterministic or random)", o.Interface, o.SamplingMode)
+		}
+		if err := validateBackend(o); err != nil {
+			return fmt.Errorf("netflow_capture[%s]: %v", o.Interface, err)
+		}
+		if o.BPFFilter != "" {
+			if _, err := compileBPFFilter(layers.LinkTypeEthernet, o.withDefaults().Snaplen, o.BPFFilter); err != nil {
+				return fmt.Errorf("netflow_capture[%s]: invalid bpf_filter %q: %v", o.Interface, o.BPFFilter, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateBackend checks the backend choice and its fanout settings.
+func validateBackend(o CaptureOptions) error {
+	o = o.withDefaults()
+	switch o.Backend {
+	case BackendPcap:
+		if !pcapAvailable {
+			return fmt.Errorf("backend %q is not available: built without libpcap", o.Backend)
+		}
+		if o.FanoutWorkers > 1 || o.FanoutGroup != 0 || o.FanoutType != "" {
+			return fmt.Errorf("fanout settings need backend %q", BackendAFPacket)
+		}
+		return nil
+	case BackendAFPacket:
+	default:
+		return fmt.Errorf("unknown backend %q (want %s or %s)", o.Backend, BackendPcap, BackendAFPacket)
+	}
+
+	if !afpacketAvailable {
+		return fmt.Errorf("backend %q is only available on Linux", o.Backend)
+	}
+	if o.FanoutWorkers < 1 || o.FanoutWorkers > maxFanoutWorkers {
+		return fmt.Errorf("fanout_workers %d out of range 1-%d", o.FanoutWorkers, maxFanoutWorkers)
+	}
+	if o.FanoutGroup < 0 || o.FanoutGroup > 0xffff {
+		return fmt.Errorf("fanout_group %d out of range 0-65535", o.FanoutGroup)
+	}
+	// The kernel only lets sockets bound to the same device share a group.
+	if o.Interface == "*" && o.FanoutGroup != 0 {
+		return fmt.Errorf("fanout_group cannot be shared by all interfaces; set it per interface or leave it 0")
+	}
+	if !fanoutTypes[o.FanoutType] {
+		return fmt.Errorf("unknown fanout_type %q (want hash, lb, cpu, rollover, random or qm)", o.FanoutType)
+	}
+	return nil
+}
+
+// captureOptionsFor returns the settings for one interface, falling back to
+// the "*" entry and then to the defaults.
+func captureOptionsFor(name string, opts []CaptureOptions) CaptureOptions {
+	var wildcard *CaptureOptions
+	for i := range opts {
+		switch opts[i].Interface {
+		case name:
+			return opts[i].withDefaults()
+		case "*":
+			wildcard = &opts[i]
+		}
+	}
+	if wildcard != nil {
+		o := *wildcard
+		o.Interface = name
+		return o.withDefaults()
+	}
+	return CaptureOptions{Interface: name}.withDefaults()
+}
+
+func (o CaptureOptions) withDefaults() CaptureOptions {
+	if o.Snaplen == 0 {
+		o.Snaplen = defaultSnaplen
+	}
+	if o.Backend == "" {
+		o.Backend = defaultCaptureBackend
+	}
+	if o.Backend == BackendAFPacket {
+		if o.FanoutWorkers == 0 {
+			o.FanoutWorkers = 1
+		}
+		if o.FanoutType == "" {
+			o.FanoutType = "hash"
+		}
+	}
+	return o
+}
+
+// packetSampler selects 1-in-N packets. Deterministic mode takes every Nth
+// packet; random mode takes each packet with probability 1/N, which avoids
+// aliasing with periodic traffic. Accepted packets stand for Rate packets.
+type packetSampler struct {
+	Rate int
+
+	random bool
+	count  uint64
+	rnd    *rand.Rand
+}
+
+// newPacketSampler returns nil when sampling is disabled.
+func newPacketSampler(o CaptureOptions) *packetSampler {
+	if o.SamplingRate <= 1 {
+		return nil
+	}
+	switch o.SamplingMode {
+	case "deterministic":
+		return &packetSampler{Rate: o.SamplingRate}
+	case "random":
+		return &packetSampler{
+			Rate:   o.SamplingRate,
+			random: true,
+			rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	}
+	return nil
+}
+
+// sample reports whether the next packet should be processed.
+func (s *packetSampler) sample() bool {
+	if s == nil {
+		return true
+	}
+	if s.random {
+		return s.rnd.Intn(s.Rate) == 0
+	}
+	s.count++
+	return s.count%uint64(s.Rate) == 0
+}
+
+// rate is the scale factor for accepted packets.
+func (s *packetSampler) rate() int {
+	if s == nil {
+		return 1
+	}
+	return s.Rate
+}
+
+// openCapture opens a live handle on the configured backend. worker is the
+// index of the socket within the interface's fanout group.
+func openCapture(o CaptureOptions, worker int) (captureHandle, error) {
+	if o.Backend == BackendAFPacket {
+		return openAFPacket(o, worker)
+	}
+	return openPcap(o)
+}
@@ -0,0 +1,334 @@
+//go:build linux
+// +build linux
+
+package collectors
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const afpacketAvailable = true
+
+// Ring geometry: 128 blocks of 512 KiB unless buffer_size says otherwise.
+const (
+	afpacketBlockSize    = 512 << 10
+	afpacketFrameSize    = 4096
+	afpacketNumBlocks    = 128
+	afpacketBlockTimeout = 64 // ms before a partly filled block is handed over
+)
+
+var afpacketFanoutTypes = map[string]int{
+	// Defragment before hashing so all fragments of a packet reach the
+	// same socket and land in the same flow.
+	"hash":     unix.PACKET_FANOUT_HASH | unix.PACKET_FANOUT_FLAG_DEFRAG,
+	"lb":       unix.PACKET_FANOUT_LB,
+	"cpu":      unix.PACKET_FANOUT_CPU,
+	"rollover": unix.PACKET_FANOUT_ROLLOVER,
+	"random":   unix.PACKET_FANOUT_RND,
+	"qm":       unix.PACKET_FANOUT_QM,
+}
+
+// afpacketHandle reads from a TPACKET_V3 memory-mapped ring, using only
+// system calls so that it builds without cgo.
+type afpacketHandle struct {
+	fd       int
+	ring     []byte
+	numBlock int
+	linkType layers.LinkType
+	snaplen  int
+	ifindex  int
+	group    string // interface whose fanout group the socket joined
+
+	block   int    // current block, owned by user space while pkts > 0
+	pkts    uint32 // packets left in the current block
+	pkt     int    // offset of the next packet in the ring
+	holding bool
+
+	received, dropped uint64 // the kernel resets its counters on every read
+}
+
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (h *afpacketHandle) blockStatus(block int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&h.ring[block*afpacketBlockSize+8]))
+}
+
+// ReadPacketData copies the next packet out of the ring, at most snaplen
+// bytes, which the socket filter already cuts packets to.
+func (h *afpacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	deadline := time.Now().Add(captureReadTimeout)
+	for {
+		if h.pkts > 0 {
+			return h.next()
+		}
+		if h.holding {
+			// Hand the block back to the kernel.
+			atomic.StoreUint32(h.blockStatus(h.block), unix.TP_STATUS_KERNEL)
+			h.holding = false
+			h.block = (h.block + 1) % h.numBlock
+		}
+		if atomic.LoadUint32(h.blockStatus(h.block))&unix.TP_STATUS_USER != 0 {
+			base := h.block * afpacketBlockSize
+			h.pkts = binary.NativeEndian.Uint32(h.ring[base+12:])
+			h.pkt = base + int(binary.NativeEndian.Uint32(h.ring[base+16:]))
+			h.holding = true
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, gopacket.CaptureInfo{}, errReadTimeout
+		}
+		fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN | unix.POLLERR}}
+		n, err := unix.Poll(fds, int(wait/time.Millisecond)+1)
+		if err != nil && err != unix.EINTR {
+			return nil, gopacket.CaptureInfo{}, os.NewSyscallError("poll", err)
+		}
+		if n > 0 && fds[0].Revents&unix.POLLERR != 0 {
+			// For example ENETDOWN once the interface is removed.
+			if e, _ := unix.GetsockoptInt(h.fd, unix.SOL_SOCKET, unix.SO_ERROR); e != 0 {
+				return nil, gopacket.CaptureInfo{}, unix.Errno(e)
+			}
+		}
+	}
+}
+
+// next reads the packet at h.pkt: a tpacket3_hdr followed, at its mac
+// offset, by the frame.
+func (h *afpacketHandle) next() ([]byte, gopacket.CaptureInfo, error) {
+	hdr := h.ring[h.pkt:]
+	ne := binary.NativeEndian
+	nextOffset := ne.Uint32(hdr[0:])
+	capLen := int(ne.Uint32(hdr[12:]))
+	mac := int(ne.Uint16(hdr[24:]))
+	if capLen > h.snaplen {
+		capLen = h.snaplen
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:      time.Unix(int64(ne.Uint32(hdr[4:])), int64(ne.Uint32(hdr[8:]))),
+		CaptureLength:  capLen,
+		Length:         int(ne.Uint32(hdr[16:])),
+		InterfaceIndex: h.ifindex,
+	}
+	data := append([]byte(nil), hdr[mac:mac+capLen]...)
+	h.pkts--
+	h.pkt += int(nextOffset)
+	return data, ci, nil
+}
+
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+func (h *afpacketHandle) Stats() (handleStats, error) {
+	s, err := unix.GetsockoptTpacketStatsV3(h.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	if err != nil {
+		return handleStats{}, err
+	}
+	h.received += uint64(s.Packets)
+	h.dropped += uint64(s.Drops)
+	return handleStats{Received: h.received, DroppedKernel: h.dropped}, nil
+}
+
+func (h *afpacketHandle) Close() {
+	if h.ring != nil {
+		unix.Munmap(h.ring)
+		h.ring = nil
+	}
+	unix.Close(h.fd)
+	if h.group != "" {
+		leaveFanoutGroup(h.group)
+		h.group = ""
+	}
+}
+
+// openAFPacket opens one AF_PACKET socket on the interface and, when the
+// interface is spread over several workers or a group is configured, joins
+// it to the interface's fanout group.
+func openAFPacket(o CaptureOptions, worker int) (captureHandle, error) {
+	iface, err := net.InterfaceByName(o.Interface)
+	if err != nil {
+		return nil, err
+	}
+	// Protocol 0 receives nothing until the socket is bound, once the
+	// ring and filter are in place.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	h := &afpacketHandle{fd: fd, linkType: afpacketLinkType(o.Interface), snaplen: o.Snaplen, ifindex: iface.Index}
+	if err := h.setup(o, iface.Index); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if o.FanoutWorkers > 1 || o.FanoutGroup != 0 {
+		if err := h.joinFanout(o); err != nil {
+			h.Close()
+			return nil, fmt.Errorf("worker %d: %v", worker, err)
+		}
+	}
+	return h, nil
+}
+
+func (h *afpacketHandle) setup(o CaptureOptions, ifindex int) error {
+	if err := unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("setting TPACKET_V3: %v", err)
+	}
+	h.numBlock = afpacketNumBlocks
+	if o.BufferSize > 0 {
+		if h.numBlock = o.BufferSize / afpacketBlockSize; h.numBlock < 1 {
+			h.numBlock = 1
+		}
+	}
+	timeout := afpacketBlockTimeout
+	if o.ImmediateMode {
+		// Hand over partially filled blocks after 1ms instead of 64ms.
+		timeout = 1
+	}
+	req := unix.TpacketReq3{
+		Block_size:     afpacketBlockSize,
+		Block_nr:       uint32(h.numBlock),
+		Frame_size:     afpacketFrameSize,
+		Frame_nr:       uint32(h.numBlock * afpacketBlockSize / afpacketFrameSize),
+		Retire_blk_tov: uint32(timeout),
+	}
+	if err := unix.SetsockoptTpacketReq3(h.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("setting up the ring (%d blocks): %v", h.numBlock, err)
+	}
+	ring, err := unix.Mmap(h.fd, 0, h.numBlock*afpacketBlockSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mapping the ring: %v", err)
+	}
+	h.ring = ring
+
+	// The filter also cuts packets to snaplen in the kernel; without
+	// bpf_filter it accepts everything.
+	filter, _ := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: uint32(o.Snaplen)}})
+	if o.BPFFilter != "" {
+		if filter, err = compileBPFFilter(h.linkType, o.Snaplen, o.BPFFilter); err != nil {
+			return fmt.Errorf("applying bpf_filter %q: %v", o.BPFFilter, err)
+		}
+	}
+	if err := attachBPF(h.fd, filter); err != nil {
+		return fmt.Errorf("applying bpf_filter %q: %v", o.BPFFilter, err)
+	}
+
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}
+	if err := unix.Bind(h.fd, sa); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+
+	// The membership belongs to the socket: the kernel takes the interface
+	// out of promiscuous mode once no socket asks for it any more.
+	if o.Promiscuous {
+		mreq := unix.PacketMreq{Ifindex: int32(ifindex), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(h.fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+			return fmt.Errorf("setting promiscuous mode: %v", err)
+		}
+	}
+	return nil
+}
+
+func attachBPF(fd int, filter []bpf.RawInstruction) error {
+	insns := make([]unix.SockFilter, len(filter))
+	for i, in := range filter {
+		insns[i] = unix.SockFilter{Code: in.Op, Jt: in.Jt, Jf: in.Jf, K: in.K}
+	}
+	prog := unix.SockFprog{Len: uint16(len(insns)), Filter: &insns[0]}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog)
+}
+
+// fanoutGroups holds the group the kernel assigned to each interface's
+// workers while any of their sockets is open, so that workers reopening
+// after an error rejoin it.
+var (
+	fanoutGroupsMu sync.Mutex
+	fanoutGroups   = map[string]*fanoutGroup{}
+)
+
+type fanoutGroup struct {
+	id      uint16
+	members int
+}
+
+// joinFanout joins fanout_group if set. Otherwise the first worker asks
+// the kernel for a group id no other socket uses, and the others join it,
+// so that unrelated processes can never share the group.
+func (h *afpacketHandle) joinFanout(o CaptureOptions) error {
+	mode := afpacketFanoutTypes[o.FanoutType]
+	if o.FanoutGroup != 0 {
+		err := unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, o.FanoutGroup|mode<<16)
+		if errors.Is(err, unix.EADDRINUSE) || errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("fanout group %d is in use with another fanout_type or interface", o.FanoutGroup)
+		}
+		if err != nil {
+			return fmt.Errorf("joining fanout group %d: %v", o.FanoutGroup, err)
+		}
+		return nil
+	}
+
+	fanoutGroupsMu.Lock()
+	defer fanoutGroupsMu.Unlock()
+	g := fanoutGroups[o.Interface]
+	if g != nil {
+		if err := unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(g.id)|mode<<16); err != nil {
+			return fmt.Errorf("joining fanout group %d: %v", g.id, err)
+		}
+	} else {
+		err := unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, (mode|unix.PACKET_FANOUT_FLAG_UNIQUEID)<<16)
+		if errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("the kernel cannot assign a fanout group id; set fanout_group")
+		}
+		if err != nil {
+			return fmt.Errorf("creating a fanout group: %v", err)
+		}
+		v, err := unix.GetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_FANOUT)
+		if err != nil {
+			return fmt.Errorf("reading the fanout group id: %v", err)
+		}
+		g = &fanoutGroup{id: uint16(v)}
+		fanoutGroups[o.Interface] = g
+	}
+	g.members++
+	h.group = o.Interface
+	return nil
+}
+
+func leaveFanoutGroup(iface string) {
+	fanoutGroupsMu.Lock()
+	defer fanoutGroupsMu.Unlock()
+	if g := fanoutGroups[iface]; g != nil {
+		if g.members--; g.members <= 0 {
+			delete(fanoutGroups, iface)
+		}
+	}
+}
+
+// afpacketLinkType maps the interface's ARPHRD type to the framing the
+// socket delivers. Tunnels and tun devices carry bare IP packets.
+func afpacketLinkType(name string) layers.LinkType {
+	b, err := os.ReadFile("/sys/class/net/" + name + "/type")
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	switch strings.TrimSpace(string(b)) {
+	case "65534", "768", "769", "776", "778": // none, tunnel, tunnel6, sit, ipgre
+		return layers.LinkTypeRaw
+	}
+	return layers.LinkTypeEthernet
+}
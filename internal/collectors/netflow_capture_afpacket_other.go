@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package collectors
+
+import "errors"
+
+const afpacketAvailable = false
+
+func openAFPacket(o CaptureOptions, worker int) (captureHandle, error) {
+	return nil, errors.New("backend afpacket is only available on Linux")
+}
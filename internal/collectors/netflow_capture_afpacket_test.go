@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package collectors
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// interfaceFlags reads the IFF_* flags of an interface from sysfs.
+func interfaceFlags(t *testing.T, name string) uint64 {
+	t.Helper()
+	b, err := os.ReadFile("/sys/class/net/" + name + "/flags")
+	if err != nil {
+		t.Skip(err)
+	}
+	flags, err := strconv.ParseUint(strings.TrimSpace(string(b)), 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
+
+func TestAFPacketPromiscuous(t *testing.T) {
+	const iffPromisc = 0x100
+	o := CaptureOptions{Interface: "lo", Backend: BackendAFPacket, Promiscuous: true}
+	if err := ValidateCaptureOptions([]CaptureOptions{o}); err != nil {
+		t.Fatal(err)
+	}
+	if interfaceFlags(t, "lo")&iffPromisc != 0 {
+		t.Skip("lo is already promiscuous")
+	}
+	h, err := openAFPacket(o.withDefaults(), 0)
+	if err != nil {
+		t.Skipf("cannot open an AF_PACKET socket: %v", err)
+	}
+	if interfaceFlags(t, "lo")&iffPromisc == 0 {
+		t.Error("lo is not promiscuous while the capture is open")
+	}
+	h.Close()
+	if interfaceFlags(t, "lo")&iffPromisc != 0 {
+		t.Error("lo is still promiscuous after the capture closed")
+	}
+}
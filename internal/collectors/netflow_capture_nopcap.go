@@ -0,0 +1,48 @@
+//go:build nopcap
+// +build nopcap
+
+package collectors
+
+import (
+	"errors"
+	"net"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// Builds tagged nopcap do not link libpcap, so that Linux binaries can be
+// built statically. Capture then goes through AF_PACKET only.
+const (
+	pcapAvailable         = false
+	defaultCaptureBackend = BackendAFPacket
+)
+
+var errNoPcap = errors.New("built without libpcap (nopcap tag)")
+
+func openPcap(o CaptureOptions) (captureHandle, error) {
+	return nil, errNoPcap
+}
+
+// compileBPFFilter accepts only precompiled filters (see parseRawBPF):
+// compiling filter expressions needs libpcap.
+func compileBPFFilter(linkType layers.LinkType, snaplen int, expr string) ([]bpf.RawInstruction, error) {
+	raw, ok, err := parseRawBPF(expr)
+	if !ok {
+		return nil, errors.New(`built without libpcap (nopcap tag): give the filter as "tcpdump -ddd" output joined with commas`)
+	}
+	return raw, err
+}
+
+// captureInterfaceNames lists the interfaces known to the OS.
+func captureInterfaceNames() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ifaces))
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	return names, nil
+}
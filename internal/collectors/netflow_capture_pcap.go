@@ -0,0 +1,127 @@
+//go:build !nopcap
+// +build !nopcap
+
+package collectors
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+const (
+	pcapAvailable         = true
+	defaultCaptureBackend = BackendPcap
+)
+
+// pcapHandle adapts a libpcap handle to captureHandle.
+type pcapHandle struct {
+	*pcap.Handle
+}
+
+func (h pcapHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := h.Handle.ReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		err = errReadTimeout
+	}
+	return data, ci, err
+}
+
+func (h pcapHandle) Stats() (handleStats, error) {
+	s, err := h.Handle.Stats()
+	if err != nil {
+		return handleStats{}, err
+	}
+	return handleStats{
+		Received:         uint64(s.PacketsReceived),
+		DroppedKernel:    uint64(s.PacketsDropped),
+		DroppedInterface: uint64(s.PacketsIfDropped),
+	}, nil
+}
+
+// openPcap opens a live pcap handle configured from opts.
+func openPcap(o CaptureOptions) (captureHandle, error) {
+	inactive, err := pcap.NewInactiveHandle(o.Interface)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err := inactive.SetSnapLen(o.Snaplen); err != nil {
+		return nil, fmt.Errorf("setting snaplen: %v", err)
+	}
+	if err := inactive.SetPromisc(o.Promiscuous); err != nil {
+		return nil, fmt.Errorf("setting promiscuous mode: %v", err)
+	}
+	if err := inactive.SetTimeout(captureReadTimeout); err != nil {
+		return nil, fmt.Errorf("setting timeout: %v", err)
+	}
+	if o.BufferSize > 0 {
+		if err := inactive.SetBufferSize(o.BufferSize); err != nil {
+			return nil, fmt.Errorf("setting buffer size: %v", err)
+		}
+	}
+	if o.ImmediateMode {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, fmt.Errorf("setting immediate mode: %v", err)
+		}
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+	if o.BPFFilter != "" {
+		if raw, ok, rawErr := parseRawBPF(o.BPFFilter); ok {
+			err = rawErr
+			if err == nil {
+				insns := make([]pcap.BPFInstruction, len(raw))
+				for i, in := range raw {
+					insns[i] = pcap.BPFInstruction{Code: in.Op, Jt: in.Jt, Jf: in.Jf, K: in.K}
+				}
+				err = handle.SetBPFInstructionFilter(insns)
+			}
+		} else {
+			err = handle.SetBPFFilter(o.BPFFilter)
+		}
+		if err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("applying bpf_filter %q: %v", o.BPFFilter, err)
+		}
+	}
+	return pcapHandle{handle}, nil
+}
+
+// compileBPFFilter compiles a tcpdump-style filter to classic BPF, so that
+// filters can be attached to sockets that libpcap did not open.
+// Precompiled filters are taken as they are; see parseRawBPF.
+func compileBPFFilter(linkType layers.LinkType, snaplen int, expr string) ([]bpf.RawInstruction, error) {
+	if raw, ok, err := parseRawBPF(expr); ok {
+		return raw, err
+	}
+	insns, err := pcap.CompileBPFFilter(linkType, snaplen, expr)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(insns))
+	for i, in := range insns {
+		raw[i] = bpf.RawInstruction{Op: in.Code, Jt: in.Jt, Jf: in.Jf, K: in.K}
+	}
+	return raw, nil
+}
+
+// captureInterfaceNames lists the interfaces pcap can open.
+func captureInterfaceNames() ([]string, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(devs))
+	for _, d := range devs {
+		names = append(names, d.Name)
+	}
+	return names, nil
+}
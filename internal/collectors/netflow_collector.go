@@ -0,0 +1,765 @@
+package collectors
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Flow export protocol versions as they appear in the first header field.
+const (
+	netflowV5   = 5
+	netflowV9   = 9
+	ipfixV10    = 10
+	sflowV5     = 5
+	maxDatagram = 65535
+	// maxExporterTemplates bounds the templates kept per exporter; further
+	// template IDs are ignored, so their data records are skipped.
+	maxExporterTemplates = 1024
+	// maxExporters bounds the exporters whose templates and sampling rates
+	// are kept. Templates from further exporters are ignored until others
+	// have been silent for exporterIdleTimeout and are forgotten.
+	maxExporters = 256
+	// exporterIdleTimeout is three times the 10 minute template refresh
+	// interval suggested by RFC 7011.
+	exporterIdleTimeout = 30 * time.Minute
+)
+
+// Information element IDs shared by NetFlow v9 and IPFIX.
+const (
+	ieOctetDeltaCount        = 1
+	iePacketDeltaCount       = 2
+	ieProtocolIdentifier     = 4
+	ieSourceTransportPort    = 7
+	ieSourceIPv4Address      = 8
+	ieIngressInterface       = 10
+	ieDestTransportPort      = 11
+	ieDestIPv4Address        = 12
+	ieEgressInterface        = 14
+	ieLastSwitched           = 21
+	ieFirstSwitched          = 22
+	ieSourceIPv6Address      = 27
+	ieDestIPv6Address        = 28
+	ieSamplingInterval       = 34
+	ieFlowDirection          = 61
+	ieOctetTotalCount        = 85
+	iePacketTotalCount       = 86
+	ieFlowStartSeconds       = 150
+	ieFlowEndSeconds         = 151
+	ieFlowStartMilliseconds  = 152
+	ieFlowEndMilliseconds    = 153
+	ieSamplingPacketInterval = 305
+)
+
+var errShortDatagram = errors.New("datagram too short")
+
+// templateField describes one field of a v9/IPFIX template.
+type templateField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+// flowTemplate is a decoded v9/IPFIX (options) template. Options templates
+// are kept so that their data records can be skipped cleanly.
+type flowTemplate struct {
+	fields  []templateField
+	options bool
+}
+
+// flowCollector decodes flow export datagrams received on one UDP socket.
+// Templates are scoped to the exporter address and observation domain, as
+// required by RFC 3954 and RFC 7011. Sampling rates announced in options
+// data are remembered per exporter and domain.
+type flowCollector struct {
+	exporters map[string]*exporterState
+	now       time.Time // receive time of the datagram being decoded
+	lastSweep time.Time
+}
+
+// exporterState is what the collector remembers about one exporter.
+type exporterState struct {
+	templates map[templateID]*flowTemplate
+	sampling  map[uint32]int // by observation domain
+	lastSeen  time.Time
+}
+
+type templateID struct {
+	domain uint32
+	id     uint16
+}
+
+func newFlowCollector() *flowCollector {
+	return &flowCollector{exporters: make(map[string]*exporterState)}
+}
+
+// touch notes a datagram from exporter and, at most once a minute, forgets
+// the exporters that have been silent for exporterIdleTimeout.
+func (c *flowCollector) touch(exporter string, now time.Time) {
+	c.now = now
+	if st := c.exporters[exporter]; st != nil {
+		st.lastSeen = now
+	}
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for name, st := range c.exporters {
+		if now.Sub(st.lastSeen) >= exporterIdleTimeout {
+			delete(c.exporters, name)
+			recordCollectorError("exporter_expired")
+		}
+	}
+}
+
+// state returns the state of exporter, creating it when create is set and
+// fewer than maxExporters are known. It returns nil otherwise.
+func (c *flowCollector) state(exporter string, create bool) *exporterState {
+	st := c.exporters[exporter]
+	if st != nil || !create {
+		return st
+	}
+	if len(c.exporters) >= maxExporters {
+		recordCollectorError("exporter_limit")
+		return nil
+	}
+	st = &exporterState{
+		templates: make(map[templateID]*flowTemplate),
+		sampling:  make(map[uint32]int),
+		lastSeen:  c.now,
+	}
+	c.exporters[exporter] = st
+	return st
+}
+
+// template returns a template learned from exporter, or nil.
+func (c *flowCollector) template(exporter string, domain uint32, id uint16) *flowTemplate {
+	if st := c.state(exporter, false); st != nil {
+		return st.templates[templateID{domain, id}]
+	}
+	return nil
+}
+
+var (
+	collectorMu      sync.Mutex
+	allowedExporters []*net.IPNet // empty: any exporter
+	collectorErrors  = make(map[string]uint64)
+	lastPanicLog     time.Time
+)
+
+// ConfigureFlowExporters limits the collector to datagrams from the given
+// addresses or CIDRs. With none, every exporter is accepted.
+func ConfigureFlowExporters(allowed []string) error {
+	nets := make([]*net.IPNet, 0, len(allowed))
+	for _, a := range allowed {
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return fmt.Errorf("netflow_exporters: invalid address or network %q", a)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		nets = append(nets, n)
+	}
+	collectorMu.Lock()
+	allowedExporters = nets
+	collectorMu.Unlock()
+	return nil
+}
+
+func exporterAllowed(ip net.IP) bool {
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+	if len(allowedExporters) == 0 {
+		return true
+	}
+	for _, n := range allowedExporters {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordCollectorError counts datagrams, templates or exporters the
+// collector discarded: "denied" (exporter not allowed), "malformed",
+// "panic" (a decoder bug, logged), "template_limit", "exporter_limit" and
+// "exporter_expired" (forgotten after exporterIdleTimeout).
+func recordCollectorError(kind string) {
+	collectorMu.Lock()
+	collectorErrors[kind]++
+	collectorMu.Unlock()
+}
+
+// GetNetFlowCollectorErrors returns the discard counts by kind.
+func GetNetFlowCollectorErrors() map[string]uint64 {
+	collectorMu.Lock()
+	defer collectorMu.Unlock()
+	out := make(map[string]uint64, len(collectorErrors))
+	for k, v := range collectorErrors {
+		out[k] = v
+	}
+	return out
+}
+
+// ListenNetFlow receives NetFlow v5/v9, IPFIX and sFlow v5 datagrams on each
+// UDP address and merges the decoded flows into the NetFlow buffer. The
+// protocol is detected per datagram, so one port can serve all of them.
+func ListenNetFlow(addrs []string) {
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Printf("Error starting NetFlow collector on %s: %v", addr, err)
+			continue
+		}
+		log.Printf("NetFlow collector listening on %s", addr)
+		go serveNetFlow(conn)
+	}
+}
+
+func serveNetFlow(conn net.PacketConn) {
+	defer conn.Close()
+
+	c := newFlowCollector()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("NetFlow collector on %s stopped: %v", conn.LocalAddr(), err)
+			return
+		}
+		exporter := addr.String()
+		if udp, ok := addr.(*net.UDPAddr); ok {
+			if !exporterAllowed(udp.IP) {
+				recordCollectorError("denied")
+				continue
+			}
+			exporter = udp.IP.String()
+		}
+		for _, e := range c.decode(exporter, buf[:n], time.Now()) {
+			addFlow(e)
+		}
+	}
+}
+
+// decode dispatches a datagram to the matching protocol decoder. Malformed
+// datagrams yield no entries rather than an error, since a single bad packet
+// from a router is not actionable; they are counted. A decoder panic is a
+// bug, but one that a crafted datagram must not turn into a crash: it is
+// counted and logged at most once a minute.
+func (c *flowCollector) decode(exporter string, data []byte, now time.Time) (entries []NetFlowEntry) {
+	defer func() {
+		if r := recover(); r != nil {
+			entries = nil
+			recordCollectorError("panic")
+			collectorMu.Lock()
+			logIt := time.Since(lastPanicLog) >= time.Minute
+			if logIt {
+				lastPanicLog = time.Now()
+			}
+			collectorMu.Unlock()
+			if logIt {
+				log.Printf("NetFlow collector: decoding a %d byte datagram from %s panicked: %v", len(data), exporter, r)
+			}
+		}
+	}()
+
+	c.touch(exporter, now)
+	if len(data) < 4 {
+		recordCollectorError("malformed")
+		return nil
+	}
+	var err error
+	switch binary.BigEndian.Uint16(data) {
+	case netflowV5:
+		entries, err = decodeNetFlowV5(exporter, data)
+	case netflowV9:
+		entries, err = c.decodeNetFlowV9(exporter, data)
+	case ipfixV10:
+		entries, err = c.decodeIPFIX(exporter, data, now)
+	case 0:
+		if binary.BigEndian.Uint32(data) == sflowV5 {
+			entries, err = decodeSFlow(exporter, data, now)
+		}
+	}
+	if err != nil {
+		recordCollectorError("malformed")
+		return nil
+	}
+	return entries
+}
+
+// decodeNetFlowV5 decodes the fixed-format v5 export.
+func decodeNetFlowV5(exporter string, data []byte) ([]NetFlowEntry, error) {
+	const headerLen, recordLen = 24, 48
+	if len(data) < headerLen {
+		return nil, errShortDatagram
+	}
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < headerLen+count*recordLen {
+		return nil, errShortDatagram
+	}
+	uptime := binary.BigEndian.Uint32(data[4:])
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(data[8:])), int64(binary.BigEndian.Uint32(data[12:])))
+	// The top two bits of the sampling field hold the sampling mode.
+	rate := int(binary.BigEndian.Uint16(data[22:]) & 0x3fff)
+
+	entries := make([]NetFlowEntry, 0, count)
+	for i := 0; i < count; i++ {
+		r := data[headerLen+i*recordLen:]
+		e := NetFlowEntry{
+			Exporter:  exporter,
+			Interface: ifIndexName(uint32(binary.BigEndian.Uint16(r[12:]))),
+			Direction: DirectionInbound,
+			SrcIP:     net.IP(r[0:4]).String(),
+			DstIP:     net.IP(r[4:8]).String(),
+			SrcPort:   binary.BigEndian.Uint16(r[32:]),
+			DstPort:   binary.BigEndian.Uint16(r[34:]),
+			Protocol:  layers.IPProtocol(r[38]).String(),
+			Packets:   int(binary.BigEndian.Uint32(r[16:])),
+			Bytes:     int(binary.BigEndian.Uint32(r[20:])),
+			StartTime: uptimeToTime(exportTime, uptime, binary.BigEndian.Uint32(r[24:])),
+			EndTime:   uptimeToTime(exportTime, uptime, binary.BigEndian.Uint32(r[28:])),
+		}
+		applySampling(&e, rate)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// decodeNetFlowV9 walks the flowsets of a v9 export, learning templates and
+// decoding data records for templates already seen.
+func (c *flowCollector) decodeNetFlowV9(exporter string, data []byte) ([]NetFlowEntry, error) {
+	const headerLen = 20
+	if len(data) < headerLen {
+		return nil, errShortDatagram
+	}
+	uptime := binary.BigEndian.Uint32(data[4:])
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(data[8:])), 0)
+	domain := binary.BigEndian.Uint32(data[16:])
+
+	var entries []NetFlowEntry
+	err := walkSets(data[headerLen:], func(id uint16, body []byte) error {
+		switch {
+		case id == 0:
+			return c.parseTemplates(exporter, domain, body, false, false)
+		case id == 1:
+			return c.parseV9OptionsTemplates(exporter, domain, body)
+		case id >= 256:
+			tmpl := c.template(exporter, domain, id)
+			if tmpl == nil {
+				return nil
+			}
+			records, err := decodeDataRecords(tmpl, body)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, c.entries(exporter, domain, records, exportTime, uptime)...)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// decodeIPFIX walks the sets of an IPFIX message.
+func (c *flowCollector) decodeIPFIX(exporter string, data []byte, now time.Time) ([]NetFlowEntry, error) {
+	const headerLen = 16
+	if len(data) < headerLen {
+		return nil, errShortDatagram
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if length < headerLen || length > len(data) {
+		return nil, errShortDatagram
+	}
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(data[4:])), 0)
+	domain := binary.BigEndian.Uint32(data[12:])
+
+	var entries []NetFlowEntry
+	err := walkSets(data[headerLen:length], func(id uint16, body []byte) error {
+		switch {
+		case id == 2:
+			return c.parseTemplates(exporter, domain, body, true, false)
+		case id == 3:
+			return c.parseTemplates(exporter, domain, body, true, true)
+		case id >= 256:
+			tmpl := c.template(exporter, domain, id)
+			if tmpl == nil {
+				return nil
+			}
+			records, err := decodeDataRecords(tmpl, body)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, c.entries(exporter, domain, records, exportTime, 0)...)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// walkSets iterates the (id, length)-prefixed sets shared by v9 and IPFIX.
+func walkSets(data []byte, fn func(id uint16, body []byte) error) error {
+	for len(data) >= 4 {
+		id := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < 4 || length > len(data) {
+			return errShortDatagram
+		}
+		if err := fn(id, data[4:length]); err != nil {
+			return err
+		}
+		data = data[length:]
+	}
+	return nil
+}
+
+// parseTemplates decodes a v9 template flowset or an IPFIX (options)
+// template set. IPFIX options templates carry an extra scope field count,
+// and IPFIX fields may carry an enterprise number.
+func (c *flowCollector) parseTemplates(exporter string, domain uint32, body []byte, ipfix, options bool) error {
+	hdr := 4
+	if options {
+		hdr = 6
+	}
+	for len(body) >= hdr {
+		id := binary.BigEndian.Uint16(body)
+		count := int(binary.BigEndian.Uint16(body[2:]))
+		if id < 256 {
+			// Set padding.
+			return nil
+		}
+		body = body[hdr:]
+		tmpl := &flowTemplate{options: options}
+		for i := 0; i < count; i++ {
+			if len(body) < 4 {
+				return errShortDatagram
+			}
+			f := templateField{id: binary.BigEndian.Uint16(body), length: binary.BigEndian.Uint16(body[2:])}
+			body = body[4:]
+			if ipfix && f.id&0x8000 != 0 {
+				if len(body) < 4 {
+					return errShortDatagram
+				}
+				f.id &^= 0x8000
+				f.enterprise = binary.BigEndian.Uint32(body)
+				body = body[4:]
+			}
+			tmpl.fields = append(tmpl.fields, f)
+		}
+		c.setTemplate(exporter, domain, id, tmpl)
+	}
+	return nil
+}
+
+// parseV9OptionsTemplates decodes v9 options templates, whose scope and
+// option sections are given as byte lengths rather than field counts.
+func (c *flowCollector) parseV9OptionsTemplates(exporter string, domain uint32, body []byte) error {
+	for len(body) >= 6 {
+		id := binary.BigEndian.Uint16(body)
+		scopeLen := int(binary.BigEndian.Uint16(body[2:]))
+		optionLen := int(binary.BigEndian.Uint16(body[4:]))
+		if id < 256 {
+			return nil
+		}
+		body = body[6:]
+		if len(body) < scopeLen+optionLen {
+			return errShortDatagram
+		}
+		tmpl := &flowTemplate{options: true}
+		for off := 0; off+4 <= scopeLen+optionLen; off += 4 {
+			tmpl.fields = append(tmpl.fields, templateField{
+				id:     binary.BigEndian.Uint16(body[off:]),
+				length: binary.BigEndian.Uint16(body[off+2:]),
+			})
+		}
+		c.setTemplate(exporter, domain, id, tmpl)
+		body = body[scopeLen+optionLen:]
+	}
+	return nil
+}
+
+// setTemplate learns or replaces a template, unless the exporter already
+// has maxExporterTemplates others or cannot be remembered.
+func (c *flowCollector) setTemplate(exporter string, domain uint32, id uint16, tmpl *flowTemplate) {
+	st := c.state(exporter, true)
+	if st == nil {
+		return
+	}
+	key := templateID{domain, id}
+	if _, ok := st.templates[key]; !ok && len(st.templates) >= maxExporterTemplates {
+		recordCollectorError("template_limit")
+		return
+	}
+	st.templates[key] = tmpl
+}
+
+// entries converts data records into flow entries, scaling them by the
+// record's own sampling interval or the one last announced in options data.
+func (c *flowCollector) entries(exporter string, domain uint32, records []flowRecord, exportTime time.Time, sysUptime uint32) []NetFlowEntry {
+	var entries []NetFlowEntry
+	for _, rec := range records {
+		rate := rec.samplingRate()
+		if rec.options {
+			if st := c.state(exporter, rate > 0); st != nil {
+				st.sampling[domain] = rate
+			}
+			continue
+		}
+		e, ok := rec.entry(exporter, exportTime, sysUptime)
+		if !ok {
+			continue
+		}
+		if st := c.state(exporter, false); rate == 0 && st != nil {
+			rate = st.sampling[domain]
+		}
+		applySampling(&e, rate)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// applySampling scales counters of a flow sampled 1-in-rate.
+func applySampling(e *NetFlowEntry, rate int) {
+	if rate <= 1 {
+		return
+	}
+	e.Packets *= rate
+	e.Bytes *= rate
+	e.SamplingRate = rate
+}
+
+// flowRecord holds the raw values of one data record keyed by IE id.
+// Enterprise-specific fields are not interpreted.
+type flowRecord struct {
+	options bool
+	values  map[uint16][]byte
+}
+
+// decodeDataRecords splits a data set into records according to its
+// template. Trailing bytes shorter than a record are set padding.
+func decodeDataRecords(tmpl *flowTemplate, body []byte) ([]flowRecord, error) {
+	var records []flowRecord
+	for len(body) > 0 {
+		rec := flowRecord{options: tmpl.options, values: make(map[uint16][]byte, len(tmpl.fields))}
+		rest := body
+		for _, f := range tmpl.fields {
+			n := int(f.length)
+			if f.length == 0xffff {
+				// IPFIX variable-length encoding.
+				if len(rest) < 1 {
+					return records, nil
+				}
+				n, rest = int(rest[0]), rest[1:]
+				if n == 255 {
+					if len(rest) < 2 {
+						return records, nil
+					}
+					n, rest = int(binary.BigEndian.Uint16(rest)), rest[2:]
+				}
+			}
+			if len(rest) < n {
+				return records, nil
+			}
+			if f.enterprise == 0 {
+				rec.values[f.id] = rest[:n]
+			}
+			rest = rest[n:]
+		}
+		if len(rest) == len(body) {
+			// Zero-length template; nothing more to decode.
+			return records, nil
+		}
+		records = append(records, rec)
+		body = rest
+	}
+	return records, nil
+}
+
+// entry converts a data record into a NetFlowEntry. Records without
+// addresses (e.g. options data) are skipped. sysUptime is zero for IPFIX,
+// which uses absolute timestamps.
+func (r flowRecord) entry(exporter string, exportTime time.Time, sysUptime uint32) (NetFlowEntry, bool) {
+	if r.options {
+		return NetFlowEntry{}, false
+	}
+	src, dst := r.ip(ieSourceIPv4Address), r.ip(ieDestIPv4Address)
+	if src == nil || dst == nil {
+		src, dst = r.ip(ieSourceIPv6Address), r.ip(ieDestIPv6Address)
+	}
+	if src == nil || dst == nil {
+		return NetFlowEntry{}, false
+	}
+
+	e := NetFlowEntry{
+		Exporter:  exporter,
+		Interface: ifIndexName(uint32(r.uint(ieIngressInterface))),
+		Direction: DirectionInbound,
+		SrcIP:     src.String(),
+		DstIP:     dst.String(),
+		SrcPort:   uint16(r.uint(ieSourceTransportPort)),
+		DstPort:   uint16(r.uint(ieDestTransportPort)),
+		Protocol:  layers.IPProtocol(r.uint(ieProtocolIdentifier)).String(),
+		Packets:   int(r.uint(iePacketDeltaCount)),
+		Bytes:     int(r.uint(ieOctetDeltaCount)),
+		StartTime: exportTime,
+		EndTime:   exportTime,
+	}
+	if r.uint(ieFlowDirection) == 1 {
+		e.Direction = DirectionOutbound
+		if out := r.uint(ieEgressInterface); out != 0 {
+			e.Interface = ifIndexName(uint32(out))
+		}
+	}
+	if e.Packets == 0 {
+		e.Packets = int(r.uint(iePacketTotalCount))
+	}
+	if e.Bytes == 0 {
+		e.Bytes = int(r.uint(ieOctetTotalCount))
+	}
+
+	switch {
+	case r.has(ieFlowStartMilliseconds):
+		e.StartTime = time.UnixMilli(int64(r.uint(ieFlowStartMilliseconds)))
+		e.EndTime = time.UnixMilli(int64(r.uint(ieFlowEndMilliseconds)))
+	case r.has(ieFlowStartSeconds):
+		e.StartTime = time.Unix(int64(r.uint(ieFlowStartSeconds)), 0)
+		e.EndTime = time.Unix(int64(r.uint(ieFlowEndSeconds)), 0)
+	case r.has(ieFirstSwitched) && sysUptime != 0:
+		e.StartTime = uptimeToTime(exportTime, sysUptime, uint32(r.uint(ieFirstSwitched)))
+		e.EndTime = uptimeToTime(exportTime, sysUptime, uint32(r.uint(ieLastSwitched)))
+	}
+	return e, true
+}
+
+func (r flowRecord) samplingRate() int {
+	if r.has(ieSamplingPacketInterval) {
+		return int(r.uint(ieSamplingPacketInterval))
+	}
+	return int(r.uint(ieSamplingInterval))
+}
+
+func (r flowRecord) has(id uint16) bool {
+	_, ok := r.values[id]
+	return ok
+}
+
+// uint decodes an unsigned field of any length up to 8 bytes; IPFIX allows
+// reduced-size encoding of counters.
+func (r flowRecord) uint(id uint16) uint64 {
+	var v uint64
+	b := r.values[id]
+	if len(b) > 8 {
+		b = b[len(b)-8:]
+	}
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (r flowRecord) ip(id uint16) net.IP {
+	b := r.values[id]
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil
+	}
+	return net.IP(b)
+}
+
+// decodeSFlow converts sFlow v5 flow samples into entries. sFlow reports
+// individual sampled packets, so each sample is scaled by its sampling rate.
+func decodeSFlow(exporter string, data []byte, now time.Time) ([]NetFlowEntry, error) {
+	var dg layers.SFlowDatagram
+	if err := dg.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+
+	var entries []NetFlowEntry
+	for _, sample := range dg.FlowSamples {
+		rate := int(sample.SamplingRate)
+		if rate == 0 {
+			rate = 1
+		}
+		base := NetFlowEntry{
+			Exporter:  exporter,
+			Interface: ifIndexName(sample.InputInterface),
+			Direction: DirectionInbound,
+			Packets:   rate,
+			StartTime: now,
+			EndTime:   now,
+		}
+		if rate > 1 {
+			base.SamplingRate = rate
+		}
+		for _, record := range sample.Records {
+			e := base
+			switch r := record.(type) {
+			case layers.SFlowRawPacketFlowRecord:
+				if !fillFromPacket(&e, r.Header) {
+					continue
+				}
+				e.Bytes = int(r.FrameLength) * rate
+			case layers.SFlowIpv4Record:
+				e.SrcIP, e.DstIP = r.IPSrc.String(), r.IPDst.String()
+				e.SrcPort, e.DstPort = uint16(r.PortSrc), uint16(r.PortDst)
+				e.Protocol = layers.IPProtocol(r.Protocol).String()
+				e.Bytes = int(r.Length) * rate
+			case layers.SFlowIpv6Record:
+				e.SrcIP, e.DstIP = r.IPSrc.String(), r.IPDst.String()
+				e.SrcPort, e.DstPort = uint16(r.PortSrc), uint16(r.PortDst)
+				e.Protocol = layers.IPProtocol(r.Protocol).String()
+				e.Bytes = int(r.Length) * rate
+			default:
+				continue
+			}
+			entries = append(entries, e)
+			// A sample may carry both a raw header and an IP record for the
+			// same packet; count it once.
+			break
+		}
+	}
+	return entries, nil
+}
+
+// fillFromPacket copies addresses and ports from a sampled packet header.
+func fillFromPacket(e *NetFlowEntry, packet gopacket.Packet) bool {
+	if packet == nil {
+		return false
+	}
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		e.SrcIP, e.DstIP, e.Protocol = ip.SrcIP.String(), ip.DstIP.String(), ip.Protocol.String()
+	case *layers.IPv6:
+		e.SrcIP, e.DstIP, e.Protocol = ip.SrcIP.String(), ip.DstIP.String(), ip.NextHeader.String()
+	default:
+		return false
+	}
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		e.SrcPort, e.DstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	case *layers.UDP:
+		e.SrcPort, e.DstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	}
+	return true
+}
+
+// uptimeToTime converts a router sysUptime timestamp (ms) into wall time
+// using the export header as reference.
+func uptimeToTime(exportTime time.Time, sysUptime, ts uint32) time.Time {
+	return exportTime.Add(-time.Duration(sysUptime-ts) * time.Millisecond)
+}
+
+func ifIndexName(index uint32) string {
+	return fmt.Sprintf("ifindex%d", index)
+}
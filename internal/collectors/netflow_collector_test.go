@@ -0,0 +1,214 @@
+package collectors
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// v9Datagram builds a NetFlow v9 export holding the given flowsets.
+func v9Datagram(flowsets ...[]byte) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b, netflowV9)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(flowsets)))
+	binary.BigEndian.PutUint32(b[4:], 60000)
+	binary.BigEndian.PutUint32(b[8:], 1714564800)
+	for _, fs := range flowsets {
+		b = append(b, fs...)
+	}
+	return b
+}
+
+// v9Flowset prefixes body with a flowset header.
+func v9Flowset(id uint16, body []byte) []byte {
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(body)))
+	return append(b, body...)
+}
+
+// v9Template describes a template of IPv4 addresses, ports, protocol and
+// counters, 21 bytes per record.
+func v9Template(id uint16) []byte {
+	fields := [][2]uint16{
+		{ieSourceIPv4Address, 4}, {ieDestIPv4Address, 4},
+		{ieSourceTransportPort, 2}, {ieDestTransportPort, 2},
+		{ieProtocolIdentifier, 1}, {iePacketDeltaCount, 4}, {ieOctetDeltaCount, 4},
+	}
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint16(b, f[0])
+		b = binary.BigEndian.AppendUint16(b, f[1])
+	}
+	return b
+}
+
+func v9Record(src, dst string, sport, dport uint16, packets, bytes uint32) []byte {
+	b := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	b = binary.BigEndian.AppendUint16(b, dport)
+	b = append(b, 6)
+	b = binary.BigEndian.AppendUint32(b, packets)
+	return binary.BigEndian.AppendUint32(b, bytes)
+}
+
+func collectorErrorDelta(t *testing.T) func(kind string) uint64 {
+	before := GetNetFlowCollectorErrors()
+	return func(kind string) uint64 {
+		return GetNetFlowCollectorErrors()[kind] - before[kind]
+	}
+}
+
+func TestFlowCollectorV9(t *testing.T) {
+	c := newFlowCollector()
+	now := time.Now()
+	if got := c.decode("192.0.2.1", v9Datagram(v9Flowset(0, v9Template(256))), now); len(got) != 0 {
+		t.Fatalf("template only: %d flows", len(got))
+	}
+	got := c.decode("192.0.2.1", v9Datagram(v9Flowset(256, v9Record("10.0.0.1", "10.0.0.2", 1234, 80, 3, 180))), now)
+	if len(got) != 1 {
+		t.Fatalf("got %d flows, want 1", len(got))
+	}
+	if e := got[0]; e.Exporter != "192.0.2.1" || e.SrcIP != "10.0.0.1" || e.DstPort != 80 || e.Packets != 3 || e.Bytes != 180 {
+		t.Errorf("flow: %+v", e)
+	}
+	// Templates are per exporter.
+	if got := c.decode("192.0.2.2", v9Datagram(v9Flowset(256, v9Record("10.0.0.1", "10.0.0.2", 1234, 80, 3, 180))), now); len(got) != 0 {
+		t.Errorf("another exporter's template was used: %+v", got)
+	}
+}
+
+func TestFlowCollectorMalformed(t *testing.T) {
+	delta := collectorErrorDelta(t)
+	c := newFlowCollector()
+	for _, d := range [][]byte{
+		{0, 9},
+		v9Datagram()[:10],
+		append(v9Datagram(), 0, 0, 0, 200), // flowset longer than the datagram
+	} {
+		if got := c.decode("192.0.2.1", d, time.Now()); got != nil {
+			t.Errorf("decode(%x) = %+v", d, got)
+		}
+	}
+	if n := delta("malformed"); n != 3 {
+		t.Errorf("%d malformed datagrams counted, want 3", n)
+	}
+}
+
+func TestFlowCollectorTemplateLimit(t *testing.T) {
+	delta := collectorErrorDelta(t)
+	c := newFlowCollector()
+	var body []byte
+	for id := 256; id < 256+maxExporterTemplates+10; id++ {
+		body = append(body, v9Template(uint16(id))...)
+		if len(body) > 60000 {
+			c.decode("192.0.2.1", v9Datagram(v9Flowset(0, body)), time.Now())
+			body = nil
+		}
+	}
+	c.decode("192.0.2.1", v9Datagram(v9Flowset(0, body)), time.Now())
+	if n := len(c.exporters["192.0.2.1"].templates); n != maxExporterTemplates {
+		t.Errorf("%d templates kept, want %d", n, maxExporterTemplates)
+	}
+	if n := delta("template_limit"); n != 10 {
+		t.Errorf("%d templates refused, want 10", n)
+	}
+
+	// Known templates may still be replaced, and other exporters are not
+	// affected.
+	c.decode("192.0.2.1", v9Datagram(v9Flowset(0, v9Template(256))), time.Now())
+	c.decode("192.0.2.2", v9Datagram(v9Flowset(0, v9Template(256))), time.Now())
+	if n := delta("template_limit"); n != 10 {
+		t.Errorf("%d templates refused, want 10", n)
+	}
+	if len(c.decode("192.0.2.2", v9Datagram(v9Flowset(256, v9Record("10.0.0.1", "10.0.0.2", 1, 2, 1, 60))), time.Now())) != 1 {
+		t.Error("second exporter's template was refused")
+	}
+}
+
+func TestConfigureFlowExporters(t *testing.T) {
+	t.Cleanup(func() { ConfigureFlowExporters(nil) })
+	if !exporterAllowed(net.ParseIP("203.0.113.9")) {
+		t.Error("no allow-list: exporter refused")
+	}
+	if err := ConfigureFlowExporters([]string{"192.0.2.0/24", "198.51.100.7", "2001:db8::1"}); err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"192.0.2.200":     true,
+		"198.51.100.7":    true,
+		"198.51.100.8":    false,
+		"2001:db8::1":     true,
+		"2001:db8::2":     false,
+		"203.0.113.9":     false,
+		"::ffff:c000:202": true, // 192.0.2.2 as a mapped address
+	} {
+		if got := exporterAllowed(net.ParseIP(ip)); got != want {
+			t.Errorf("exporterAllowed(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if err := ConfigureFlowExporters([]string{"router1"}); err == nil {
+		t.Error("host name: want an error")
+	}
+}
+
+func TestAddFlowKeepsSamplingRate(t *testing.T) {
+	resetFlows(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	flow := func(rate, packets int, at time.Duration) NetFlowEntry {
+		e := NetFlowEntry{Exporter: "192.0.2.1", Interface: "if1", Direction: DirectionInbound, SrcIP: "10.0.0.1", DstIP: "10.0.0.2",
+			SrcPort: 1234, DstPort: 80, Protocol: "TCP", Packets: packets, Bytes: packets * 100, StartTime: start.Add(at), EndTime: start.Add(at)}
+		applySampling(&e, rate)
+		return e
+	}
+	addFlow(flow(0, 5, 0))
+	addFlow(flow(100, 2, time.Minute))
+	addFlow(flow(10, 1, 2*time.Minute))
+
+	got := GetNetFlowEntries()
+	if len(got) != 1 {
+		t.Fatalf("got %d flows, want 1", len(got))
+	}
+	if e := got[0]; e.SamplingRate != 100 || e.Packets != 5+200+10 || !e.EndTime.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("merged flow: sampling %d, %d packets, end %v", e.SamplingRate, e.Packets, e.EndTime)
+	}
+}
+
+func TestFlowCollectorExporterLimit(t *testing.T) {
+	delta := collectorErrorDelta(t)
+	c := newFlowCollector()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	exporter := func(i int) string { return net.IPv4(10, 1, byte(i>>8), byte(i)).String() }
+	for i := 0; i < maxExporters+5; i++ {
+		c.decode(exporter(i), v9Datagram(v9Flowset(0, v9Template(256))), start)
+	}
+	if n := len(c.exporters); n != maxExporters {
+		t.Errorf("%d exporters kept, want %d", n, maxExporters)
+	}
+	if n := delta("exporter_limit"); n != 5 {
+		t.Errorf("%d exporters refused, want 5", n)
+	}
+	// A refused exporter's templates are ignored.
+	if got := c.decode("192.0.2.99", v9Datagram(v9Flowset(0, v9Template(256)), v9Flowset(256, v9Record("10.0.0.1", "10.0.0.2", 1, 2, 1, 60))), start); len(got) != 0 {
+		t.Errorf("refused exporter's template was used: %+v", got)
+	}
+
+	// The first exporter keeps talking; the others go silent and are
+	// forgotten, making room for new ones.
+	later := start.Add(exporterIdleTimeout)
+	c.decode(exporter(0), v9Datagram(), later.Add(-time.Minute))
+	c.decode("192.0.2.99", v9Datagram(v9Flowset(0, v9Template(256))), later)
+	if n := len(c.exporters); n != 2 {
+		t.Errorf("%d exporters after the idle ones expired, want 2", n)
+	}
+	if n := delta("exporter_expired"); n != maxExporters-1 {
+		t.Errorf("%d exporters expired, want %d", n, maxExporters-1)
+	}
+	for _, e := range []string{exporter(0), "192.0.2.99"} {
+		if got := c.decode(e, v9Datagram(v9Flowset(256, v9Record("10.0.0.1", "10.0.0.2", 1, 2, 1, 60))), later); len(got) != 1 {
+			t.Errorf("%s: template lost", e)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package collectors
+
+import (
+	"container/heap"
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dnsCacheMaxEntries = 10000
+	dnsCacheMaxTTL     = time.Hour
+	dnsMaxTrackedNames = 1000
+	dnsTopNames        = 10
+)
+
+// dnsName is a cached reverse mapping from an address to the name a client
+// resolved it from.
+type dnsName struct {
+	ip      string
+	name    string
+	expires time.Time
+}
+
+// DNSNameCount is the number of queries seen for one name.
+type DNSNameCount struct {
+	Name  string
+	Count uint64
+}
+
+// DNSStats summarises the DNS traffic decoded from captured packets.
+type DNSStats struct {
+	QueriesByType   map[string]uint64
+	ResponsesByCode map[string]uint64
+	TopNames        []DNSNameCount
+	CachedNames     int
+}
+
+var (
+	dnsMu sync.Mutex
+	// dnsCache indexes dnsOrder, which holds the mappings least recently
+	// stored first.
+	dnsCache     = make(map[string]*list.Element)
+	dnsOrder     = list.New()
+	dnsQueries   = make(map[string]uint64)
+	dnsResponses = make(map[string]uint64)
+	dnsNames     = newNameCounter(dnsMaxTrackedNames)
+)
+
+// nameCounter estimates the most frequent names in a stream with a fixed
+// number of counters (the space-saving algorithm): a name without a counter
+// takes over the smallest one and its count, so a name that becomes popular
+// late still rises to the top. Counts are exact until the table is full
+// and then overestimate by at most the count that was taken over.
+type nameCounter struct {
+	size  int
+	index map[string]*nameCount
+	heap  nameHeap // smallest count first
+}
+
+type nameCount struct {
+	name  string
+	count uint64
+	pos   int
+}
+
+type nameHeap []*nameCount
+
+func (h nameHeap) Len() int           { return len(h) }
+func (h nameHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h nameHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+func (h *nameHeap) Push(x interface{}) {
+	n := x.(*nameCount)
+	n.pos = len(*h)
+	*h = append(*h, n)
+}
+func (h *nameHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+func newNameCounter(size int) *nameCounter {
+	return &nameCounter{size: size, index: make(map[string]*nameCount, size)}
+}
+
+func (c *nameCounter) add(name string) {
+	if n, ok := c.index[name]; ok {
+		n.count++
+		heap.Fix(&c.heap, n.pos)
+		return
+	}
+	if len(c.heap) < c.size {
+		n := &nameCount{name: name, count: 1}
+		c.index[name] = n
+		heap.Push(&c.heap, n)
+		return
+	}
+	min := c.heap[0]
+	delete(c.index, min.name)
+	min.name = name
+	min.count++
+	c.index[name] = min
+	heap.Fix(&c.heap, 0)
+}
+
+// top returns the n highest counts, ties broken by name.
+func (c *nameCounter) top(n int) []DNSNameCount {
+	out := make([]DNSNameCount, 0, len(c.heap))
+	for _, nc := range c.heap {
+		out = append(out, DNSNameCount{Name: nc.name, Count: nc.count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// processDNS records DNS queries and learns address-to-name mappings from
+// responses. Answers are cached under the name that was asked for, so a
+// CNAME chain maps the final addresses back to the name the client used.
+func processDNS(packet gopacket.Packet, ts time.Time) {
+	layer := packet.Layer(layers.LayerTypeDNS)
+	if layer == nil {
+		return
+	}
+	dns := layer.(*layers.DNS)
+
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	if !dns.QR {
+		for _, q := range dns.Questions {
+			dnsQueries[q.Type.String()]++
+			dnsNames.add(strings.ToLower(string(q.Name)))
+		}
+		return
+	}
+
+	dnsResponses[dns.ResponseCode.String()]++
+	if dns.ResponseCode != layers.DNSResponseCodeNoErr || len(dns.Questions) == 0 {
+		return
+	}
+	asked := strings.ToLower(string(dns.Questions[0].Name))
+	for _, a := range dns.Answers {
+		if a.Type != layers.DNSTypeA && a.Type != layers.DNSTypeAAAA || a.IP == nil {
+			continue
+		}
+		ttl := time.Duration(a.TTL) * time.Second
+		if ttl > dnsCacheMaxTTL {
+			ttl = dnsCacheMaxTTL
+		}
+		cacheDNSName(dnsName{ip: a.IP.String(), name: asked, expires: ts.Add(ttl)})
+	}
+}
+
+// cacheDNSName stores a mapping. When the cache is full the mapping stored
+// longest ago makes room.
+func cacheDNSName(n dnsName) {
+	if e, ok := dnsCache[n.ip]; ok {
+		e.Value = n
+		dnsOrder.MoveToBack(e)
+		return
+	}
+	if dnsOrder.Len() >= dnsCacheMaxEntries {
+		oldest := dnsOrder.Front()
+		delete(dnsCache, oldest.Value.(dnsName).ip)
+		dnsOrder.Remove(oldest)
+	}
+	dnsCache[n.ip] = dnsOrder.PushBack(n)
+}
+
+// lookupDNSName returns the name an address was last resolved from, if the
+// record has not expired at time now.
+func lookupDNSName(ip string, now time.Time) string {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	e, ok := dnsCache[ip]
+	if !ok {
+		return ""
+	}
+	if n := e.Value.(dnsName); !now.After(n.expires) {
+		return n.name
+	}
+	return ""
+}
+
+// annotateFlowNames fills in hostnames for flow endpoints from the cache.
+func annotateFlowNames(e *NetFlowEntry, now time.Time) {
+	if e.SrcName == "" {
+		e.SrcName = lookupDNSName(e.SrcIP, now)
+	}
+	if e.DstName == "" {
+		e.DstName = lookupDNSName(e.DstIP, now)
+	}
+}
+
+// GetDNSStats returns query counts by type, response counts by rcode and
+// the most queried names, as estimated by a nameCounter.
+func GetDNSStats() DNSStats {
+	dnsMu.Lock()
+	defer dnsMu.Unlock()
+
+	stats := DNSStats{
+		QueriesByType:   make(map[string]uint64, len(dnsQueries)),
+		ResponsesByCode: make(map[string]uint64, len(dnsResponses)),
+		CachedNames:     len(dnsCache),
+	}
+	for k, v := range dnsQueries {
+		stats.QueriesByType[k] = v
+	}
+	for k, v := range dnsResponses {
+		stats.ResponsesByCode[k] = v
+	}
+	stats.TopNames = dnsNames.top(dnsTopNames)
+	return stats
+}
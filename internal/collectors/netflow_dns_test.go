@@ -0,0 +1,81 @@
+package collectors
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNameCounter(t *testing.T) {
+	c := newNameCounter(3)
+	for i := 0; i < 5; i++ {
+		c.add("a.example")
+	}
+	c.add("b.example")
+	c.add("b.example")
+	c.add("c.example")
+	want := []DNSNameCount{{"a.example", 5}, {"b.example", 2}, {"c.example", 1}}
+	if got := c.top(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("exact counts: got %v, want %v", got, want)
+	}
+
+	// A name that only becomes popular once the table is full takes over
+	// the smallest counter and climbs past the others.
+	for i := 0; i < 10; i++ {
+		c.add("late.example")
+	}
+	got := c.top(2)
+	if got[0].Name != "late.example" || got[0].Count < 10 || got[1].Name != "a.example" {
+		t.Errorf("after a late burst: %v", got)
+	}
+	if len(c.index) != 3 || len(c.heap) != 3 {
+		t.Errorf("%d names tracked, want 3", len(c.index))
+	}
+
+	// Ties are ordered by name.
+	ties := newNameCounter(5)
+	for _, n := range []string{"z", "y", "x"} {
+		ties.add(n)
+	}
+	if got := ties.top(2); !reflect.DeepEqual(got, []DNSNameCount{{"x", 1}, {"y", 1}}) {
+		t.Errorf("ties: %v", got)
+	}
+}
+
+func TestCacheDNSNameEvictsOldest(t *testing.T) {
+	dnsMu.Lock()
+	saved, savedOrder := dnsCache, dnsOrder
+	dnsMu.Unlock()
+	t.Cleanup(func() {
+		dnsMu.Lock()
+		dnsCache, dnsOrder = saved, savedOrder
+		dnsMu.Unlock()
+	})
+
+	now := time.Now()
+	later := now.Add(time.Hour)
+	dnsMu.Lock()
+	dnsCache, dnsOrder = make(map[string]*list.Element), list.New()
+	for i := 0; i < dnsCacheMaxEntries; i++ {
+		cacheDNSName(dnsName{ip: fmt.Sprintf("10.0.%d.%d", i/256, i%256), name: "old", expires: later})
+	}
+	// Refreshing the first address keeps it; the second is now the oldest.
+	cacheDNSName(dnsName{ip: "10.0.0.0", name: "refreshed", expires: later})
+	cacheDNSName(dnsName{ip: "192.0.2.1", name: "new", expires: later})
+	n := len(dnsCache)
+	dnsMu.Unlock()
+
+	if n != dnsCacheMaxEntries {
+		t.Errorf("%d entries, want %d", n, dnsCacheMaxEntries)
+	}
+	for ip, want := range map[string]string{"10.0.0.0": "refreshed", "10.0.0.1": "", "192.0.2.1": "new"} {
+		if got := lookupDNSName(ip, now); got != want {
+			t.Errorf("lookupDNSName(%s) = %q, want %q", ip, got, want)
+		}
+	}
+	if got := lookupDNSName("192.0.2.1", later.Add(time.Second)); got != "" {
+		t.Errorf("expired entry returned %q", got)
+	}
+}
@@ -0,0 +1,148 @@
+package collectors
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons a flow left the cache, reported as NetFlowEntry.EndReason.
+const (
+	FlowEndIdle     = "idle"     // no packets within the idle timeout
+	FlowEndActive   = "active"   // long-lived flow split at the active timeout
+	FlowEndShutdown = "shutdown" // flushed when the exporter stopped
+)
+
+const (
+	minExpirySweep = time.Second
+	maxExpirySweep = 10 * time.Second
+)
+
+// FlowExpiryOptions controls when flows leave the in-memory cache and are
+// handed to the flow sinks. Timeouts use wall-clock time, so replayed
+// captures expire by how long ago their packets were processed. With no
+// timeout set flows are kept for the lifetime of the process.
+type FlowExpiryOptions struct {
+	IdleTimeout   string `json:"idle_timeout"`   // e.g. "60s"
+	ActiveTimeout string `json:"active_timeout"` // e.g. "30m"
+}
+
+// FlowSink receives batches of expired flows. Sinks run on the expiry
+// goroutine, one after another, and must not block for long.
+type FlowSink func(flows []NetFlowEntry)
+
+var (
+	expiryMu      sync.Mutex
+	idleTimeout   time.Duration
+	activeTimeout time.Duration
+	flowSinks     []FlowSink
+	expiryOnce    sync.Once
+)
+
+// ConfigureFlowExpiry validates the timeouts and starts expiring flows
+// when at least one is set.
+func ConfigureFlowExpiry(o FlowExpiryOptions) error {
+	idle, err := parseFlowTimeout("idle_timeout", o.IdleTimeout)
+	if err != nil {
+		return err
+	}
+	active, err := parseFlowTimeout("active_timeout", o.ActiveTimeout)
+	if err != nil {
+		return err
+	}
+
+	expiryMu.Lock()
+	idleTimeout, activeTimeout = idle, active
+	expiryMu.Unlock()
+	if idle == 0 && active == 0 {
+		return nil
+	}
+
+	// Sweep often enough that flows leave within a quarter of the shortest
+	// timeout of expiring.
+	sweep := idle
+	if sweep == 0 || (active > 0 && active < sweep) {
+		sweep = active
+	}
+	sweep = min(max(sweep/4, minExpirySweep), maxExpirySweep)
+	expiryOnce.Do(func() {
+		go func() {
+			for {
+				time.Sleep(sweep)
+				expireFlows(time.Now(), false)
+			}
+		}()
+	})
+	return nil
+}
+
+func parseFlowTimeout(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("netflow_expiry: invalid %s %q", name, s)
+	}
+	return d, nil
+}
+
+// FlowExpiryEnabled reports whether flows are expired, and therefore
+// reach the flow sinks at all.
+func FlowExpiryEnabled() bool {
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+	return idleTimeout > 0 || activeTimeout > 0
+}
+
+// RegisterFlowSink adds a consumer of expired flows.
+func RegisterFlowSink(s FlowSink) {
+	expiryMu.Lock()
+	flowSinks = append(flowSinks, s)
+	expiryMu.Unlock()
+}
+
+// FlushNetFlows expires every cached flow, so that sinks see the flows
+// still in progress when the exporter stops. Without sinks it does nothing.
+func FlushNetFlows() {
+	expireFlows(time.Now(), true)
+}
+
+// expireFlows removes timed-out flows (all flows when all is set) from the
+// cache and passes them to the sinks, oldest first.
+func expireFlows(now time.Time, all bool) {
+	expiryMu.Lock()
+	idle, active := idleTimeout, activeTimeout
+	sinks := flowSinks
+	expiryMu.Unlock()
+	if len(sinks) == 0 && all {
+		return
+	}
+
+	var expired []NetFlowEntry
+	netflowMu.Lock()
+	for key, e := range netflowBuffer {
+		switch {
+		case all:
+			e.EndReason = FlowEndShutdown
+		case idle > 0 && now.Sub(e.seenAt) >= idle:
+			e.EndReason = FlowEndIdle
+		case active > 0 && now.Sub(e.createdAt) >= active:
+			e.EndReason = FlowEndActive
+		default:
+			continue
+		}
+		expired = append(expired, *e)
+		delete(netflowBuffer, key)
+	}
+	netflowMu.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].StartTime.Before(expired[j].StartTime) })
+	for _, s := range sinks {
+		s(expired)
+	}
+}
@@ -0,0 +1,136 @@
+package collectors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useFlowSinks replaces the flow sinks for a test.
+func useFlowSinks(t *testing.T, sinks ...FlowSink) {
+	t.Helper()
+	expiryMu.Lock()
+	saved := flowSinks
+	flowSinks = sinks
+	expiryMu.Unlock()
+	t.Cleanup(func() {
+		expiryMu.Lock()
+		flowSinks = saved
+		expiryMu.Unlock()
+	})
+}
+
+// agedFlow adds a flow that started created ago and last saw a packet
+// seen ago.
+func agedFlow(t *testing.T, now time.Time, peer string, created, seen time.Duration) {
+	t.Helper()
+	e := outboundFlow(peer, 443, "", 100)
+	e.StartTime, e.EndTime = now.Add(-created), now.Add(-seen)
+	addFlow(e)
+	netflowMu.Lock()
+	defer netflowMu.Unlock()
+	for _, b := range netflowBuffer {
+		if b.DstIP == peer {
+			b.createdAt, b.seenAt = e.StartTime, e.EndTime
+			return
+		}
+	}
+	t.Fatalf("flow to %s not cached", peer)
+}
+
+func TestExpireFlows(t *testing.T) {
+	resetFlows(t)
+	resetFlowMetrics(t, NetFlowMetricsOptions{})
+	setFlowTimeouts(t, time.Minute, 30*time.Minute)
+	var batches [][]NetFlowEntry
+	useFlowSinks(t, func(flows []NetFlowEntry) { batches = append(batches, flows) })
+
+	now := time.Now()
+	agedFlow(t, now, "198.51.100.1", 2*time.Minute, 2*time.Minute)   // idle
+	agedFlow(t, now, "198.51.100.2", 40*time.Minute, 10*time.Second) // active
+	agedFlow(t, now, "198.51.100.3", 40*time.Minute, 5*time.Minute)  // both: idle wins
+	agedFlow(t, now, "198.51.100.4", 10*time.Minute, 10*time.Second) // neither
+	agedFlow(t, now, "198.51.100.5", 59*time.Second, 59*time.Second) // neither
+
+	ended := func(flows []NetFlowEntry) map[string]string {
+		m := make(map[string]string)
+		for _, f := range flows {
+			m[f.DstIP] = f.EndReason
+		}
+		return m
+	}
+	expireFlows(now, false)
+	if len(batches) != 1 {
+		t.Fatalf("sinks called %d times, want once", len(batches))
+	}
+	want := map[string]string{"198.51.100.1": FlowEndIdle, "198.51.100.2": FlowEndActive, "198.51.100.3": FlowEndIdle}
+	if got := ended(batches[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("expired %v, want %v", got, want)
+	}
+	for i := 1; i < len(batches[0]); i++ {
+		if batches[0][i].StartTime.Before(batches[0][i-1].StartTime) {
+			t.Errorf("batch not oldest first: %v", batches[0])
+		}
+	}
+	if n := len(GetNetFlowEntries()); n != 2 {
+		t.Errorf("%d flows left in the cache, want 2", n)
+	}
+
+	// Nothing more to expire: the sinks are not called.
+	expireFlows(now, false)
+	if len(batches) != 1 {
+		t.Errorf("sinks called for an empty batch")
+	}
+
+	FlushNetFlows()
+	want = map[string]string{"198.51.100.4": FlowEndShutdown, "198.51.100.5": FlowEndShutdown}
+	if len(batches) != 2 || !reflect.DeepEqual(ended(batches[1]), want) {
+		t.Errorf("flush: %v", batches[1:])
+	}
+	if n := len(GetNetFlowEntries()); n != 0 {
+		t.Errorf("%d flows left after the flush", n)
+	}
+}
+
+func TestExpireFlowsTimeoutsOff(t *testing.T) {
+	resetFlows(t)
+	resetFlowMetrics(t, NetFlowMetricsOptions{})
+	useFlowSinks(t)
+	now := time.Now()
+
+	// Only the active timeout: idle flows stay.
+	setFlowTimeouts(t, 0, time.Hour)
+	agedFlow(t, now, "198.51.100.1", 2*time.Hour, 2*time.Hour)
+	agedFlow(t, now, "198.51.100.2", 30*time.Minute, 30*time.Minute)
+	expireFlows(now, false)
+	if got := GetNetFlowEntries(); len(got) != 1 || got[0].DstIP != "198.51.100.2" {
+		t.Errorf("active timeout only: %v", got)
+	}
+
+	// Without sinks a sweep still evicts flows, a flush keeps them.
+	setFlowTimeouts(t, time.Minute, 0)
+	FlushNetFlows()
+	if n := len(GetNetFlowEntries()); n != 1 {
+		t.Errorf("flush without sinks left %d flows, want 1", n)
+	}
+	expireFlows(now, false)
+	if n := len(GetNetFlowEntries()); n != 0 {
+		t.Errorf("sweep without sinks left %d flows", n)
+	}
+}
+
+func TestConfigureFlowExpiryErrors(t *testing.T) {
+	setFlowTimeouts(t, 0, 0)
+	for _, o := range []FlowExpiryOptions{
+		{IdleTimeout: "soon"},
+		{IdleTimeout: "-1s"},
+		{IdleTimeout: "1m", ActiveTimeout: "1 hour"},
+	} {
+		if err := ConfigureFlowExpiry(o); err == nil {
+			t.Errorf("ConfigureFlowExpiry(%+v) succeeded, want an error", o)
+		}
+	}
+	if FlowExpiryEnabled() {
+		t.Error("a failed configuration enabled expiry")
+	}
+}
@@ -0,0 +1,133 @@
+package collectors
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const geoCacheMaxEntries = 10000
+
+// GeoIPOptions points at MaxMind-format databases on local disk. Either
+// database may be omitted. Lookups never leave the host.
+type GeoIPOptions struct {
+	CityDB       string `json:"city_db"`       // GeoLite2/GeoIP2 City or Country database
+	ASNDB        string `json:"asn_db"`        // GeoLite2/GeoIP2 ASN database
+	MetricLabels bool   `json:"metric_labels"` // export traffic by country and ASN
+}
+
+// geoInfo is the enrichment for one address.
+type geoInfo struct {
+	Country string
+	City    string
+	ASN     uint
+	Org     string
+}
+
+type geoCityRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+type geoASNRecord struct {
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+var (
+	geoMu      sync.Mutex
+	geoCity    *maxminddb.Reader
+	geoASN     *maxminddb.Reader
+	geoLabels  bool
+	geoCache   = make(map[string]geoInfo)
+	geoEnabled bool
+)
+
+// OpenGeoIP loads the configured databases. It is a no-op when neither
+// database is set.
+func OpenGeoIP(o GeoIPOptions) error {
+	geoMu.Lock()
+	defer geoMu.Unlock()
+
+	if o.CityDB != "" {
+		r, err := maxminddb.Open(o.CityDB)
+		if err != nil {
+			return fmt.Errorf("opening city database %s: %v", o.CityDB, err)
+		}
+		geoCity = r
+	}
+	if o.ASNDB != "" {
+		r, err := maxminddb.Open(o.ASNDB)
+		if err != nil {
+			return fmt.Errorf("opening ASN database %s: %v", o.ASNDB, err)
+		}
+		geoASN = r
+	}
+	geoEnabled = geoCity != nil || geoASN != nil
+	geoLabels = geoEnabled && o.MetricLabels
+	return nil
+}
+
+// lookupGeo returns the enrichment for ip, consulting the cache first. The
+// cache is cleared when full rather than tracking recency; lookups are
+// cheap to redo.
+func lookupGeo(ip string) (geoInfo, bool) {
+	geoMu.Lock()
+	defer geoMu.Unlock()
+
+	if !geoEnabled {
+		return geoInfo{}, false
+	}
+	if info, ok := geoCache[ip]; ok {
+		return info, true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return geoInfo{}, false
+	}
+
+	var info geoInfo
+	if geoCity != nil {
+		var rec geoCityRecord
+		if err := geoCity.Lookup(addr, &rec); err == nil {
+			info.Country = rec.Country.ISOCode
+			info.City = rec.City.Names["en"]
+		}
+	}
+	if geoASN != nil {
+		var rec geoASNRecord
+		if err := geoASN.Lookup(addr, &rec); err == nil {
+			info.ASN, info.Org = rec.ASN, rec.Org
+		}
+	}
+
+	if len(geoCache) >= geoCacheMaxEntries {
+		geoCache = make(map[string]geoInfo)
+	}
+	geoCache[ip] = info
+	return info, true
+}
+
+// enrichFlowGeo annotates the remote endpoint of a flow.
+func enrichFlowGeo(e *NetFlowEntry) {
+	info, ok := lookupGeo(remotePeer(e))
+	if !ok {
+		return
+	}
+	e.RemoteCountry = info.Country
+	e.RemoteCity = info.City
+	e.RemoteASN = info.ASN
+	e.RemoteOrg = info.Org
+}
+
+func geoMetricLabels() bool {
+	geoMu.Lock()
+	defer geoMu.Unlock()
+	return geoLabels
+}
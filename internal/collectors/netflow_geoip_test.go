@@ -0,0 +1,234 @@
+package collectors
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbValue encodes v in the MaxMind DB data format. Only the types the
+// test databases use are supported.
+func mmdbValue(v any) []byte {
+	control := func(typ byte, size int) []byte {
+		if size < 29 {
+			return []byte{typ<<5 | byte(size)}
+		}
+		return []byte{typ<<5 | 29, byte(size - 29)} // sizes up to 284
+	}
+	unsigned := func(typ byte, n uint64) []byte {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		i := 0
+		for i < 8 && b[i] == 0 {
+			i++
+		}
+		return append(control(typ, 8-i), b[i:]...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case uint16:
+		return unsigned(5, uint64(v))
+	case uint32:
+		return unsigned(6, uint64(v))
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := control(7, len(v))
+		for _, k := range keys {
+			b = append(b, mmdbValue(k)...)
+			b = append(b, mmdbValue(v[k])...)
+		}
+		return b
+	}
+	panic("mmdbValue: unsupported type")
+}
+
+// writeTestMMDB writes an IPv4 MaxMind DB mapping each CIDR to its record
+// and returns its path.
+func writeTestMMDB(t *testing.T, networks map[string]map[string]any) string {
+	t.Helper()
+	// Build the search tree: node 0 is the root, a record is a child node,
+	// or a data offset once a network's prefix has been walked.
+	type node struct{ child [2]int } // -1: no data, < -1: -(data index)-2
+	nodes := []node{{[2]int{-1, -1}}}
+	var data [][]byte
+	cidrs := make([]string, 0, len(networks))
+	for c := range networks {
+		cidrs = append(cidrs, c)
+	}
+	sort.Strings(cidrs)
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := n.Mask.Size()
+		ip := n.IP.To4()
+		cur := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[cur].child[bit] = -len(data) - 2
+				break
+			}
+			if nodes[cur].child[bit] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[cur].child[bit] = len(nodes) - 1
+			}
+			cur = nodes[cur].child[bit]
+		}
+		data = append(data, mmdbValue(networks[c]))
+	}
+
+	count := len(nodes)
+	var offsets []int
+	var section []byte
+	for _, d := range data {
+		offsets = append(offsets, len(section))
+		section = append(section, d...)
+	}
+	var db []byte
+	for _, n := range nodes {
+		for _, c := range n.child {
+			r := count // no data
+			if c >= 0 {
+				r = c
+			} else if c < -1 {
+				r = count + 16 + offsets[-c-2]
+			}
+			db = append(db, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, section...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, mmdbValue(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"database_type":               "Test",
+		"ip_version":                  uint16(4),
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useGeoIP opens databases for a test, closing them and clearing the cache
+// when it ends.
+func useGeoIP(t *testing.T, o GeoIPOptions) {
+	t.Helper()
+	t.Cleanup(func() {
+		geoMu.Lock()
+		defer geoMu.Unlock()
+		for _, r := range []*maxminddb.Reader{geoCity, geoASN} {
+			if r != nil {
+				r.Close()
+			}
+		}
+		geoCity, geoASN, geoEnabled, geoLabels = nil, nil, false, false
+		geoCache = make(map[string]geoInfo)
+	})
+	if err := OpenGeoIP(o); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testGeoDB(t *testing.T) string {
+	return writeTestMMDB(t, map[string]map[string]any{
+		"203.0.113.0/24": {
+			"country":                        map[string]any{"iso_code": "AU"},
+			"city":                           map[string]any{"names": map[string]any{"en": "Sydney", "de": "Sydney"}},
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example Net",
+		},
+		"198.51.100.128/25": {
+			"country":                        map[string]any{"iso_code": "DE"},
+			"autonomous_system_number":       uint32(64501),
+			"autonomous_system_organization": "Other Net",
+		},
+	})
+}
+
+func TestLookupGeo(t *testing.T) {
+	if _, ok := lookupGeo("203.0.113.9"); ok {
+		t.Fatal("lookup succeeded without databases")
+	}
+
+	db := testGeoDB(t)
+	useGeoIP(t, GeoIPOptions{CityDB: db, ASNDB: db})
+	for _, tt := range []struct {
+		ip   string
+		want geoInfo
+		ok   bool
+	}{
+		{"203.0.113.9", geoInfo{"AU", "Sydney", 64500, "Example Net"}, true},
+		{"198.51.100.200", geoInfo{"DE", "", 64501, "Other Net"}, true},
+		{"198.51.100.20", geoInfo{}, true}, // outside the /25
+		{"2001:db8::1", geoInfo{}, true},   // an IPv4-only database
+		{"not an address", geoInfo{}, false},
+	} {
+		got, ok := lookupGeo(tt.ip)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lookupGeo(%s) = %+v, %v; want %+v, %v", tt.ip, got, ok, tt.want, tt.ok)
+		}
+	}
+	if geoMetricLabels() {
+		t.Error("metric labels on without metric_labels")
+	}
+
+	e := outboundFlow("203.0.113.9", 443, "", 100)
+	enrichFlowGeo(&e)
+	if e.RemoteCountry != "AU" || e.RemoteCity != "Sydney" || e.RemoteASN != 64500 || e.RemoteOrg != "Example Net" {
+		t.Errorf("enriched flow: %+v", e)
+	}
+}
+
+func TestLookupGeoASNOnly(t *testing.T) {
+	useGeoIP(t, GeoIPOptions{ASNDB: testGeoDB(t), MetricLabels: true})
+	if got, _ := lookupGeo("203.0.113.9"); got != (geoInfo{ASN: 64500, Org: "Example Net"}) {
+		t.Errorf("lookupGeo = %+v", got)
+	}
+	if !geoMetricLabels() {
+		t.Error("metric labels off with metric_labels")
+	}
+	if err := OpenGeoIP(GeoIPOptions{CityDB: filepath.Join(t.TempDir(), "missing.mmdb")}); err == nil {
+		t.Error("opening a missing database succeeded")
+	}
+}
+
+func TestGeoCacheReset(t *testing.T) {
+	useGeoIP(t, GeoIPOptions{CityDB: testGeoDB(t)})
+	lookupGeo("203.0.113.9")
+	for i := 1; len(geoCache) < geoCacheMaxEntries; i++ {
+		lookupGeo("10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256))
+	}
+	if _, ok := geoCache["203.0.113.9"]; !ok {
+		t.Fatal("first lookup not cached")
+	}
+
+	// The next new address finds the cache full and starts it afresh.
+	if got, _ := lookupGeo("203.0.113.10"); got.Country != "AU" {
+		t.Errorf("lookup after reset = %+v", got)
+	}
+	if len(geoCache) != 1 {
+		t.Errorf("%d cache entries after the reset, want 1", len(geoCache))
+	}
+	if got, _ := lookupGeo("203.0.113.9"); got.City != "Sydney" {
+		t.Errorf("lookup of an evicted address = %+v", got)
+	}
+}
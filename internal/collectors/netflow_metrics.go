@@ -0,0 +1,443 @@
+package collectors
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NetFlowMetricsOptions bounds the label cardinality of the aggregate flow
+// metrics. Zero values fall back to the defaults.
+type NetFlowMetricsOptions struct {
+	TopPeers     int    `json:"top_peers"`     // remote peers listed individually, default 10
+	TopProcesses int    `json:"top_processes"` // local processes listed individually, default 10
+	MaxServices  int    `json:"max_services"`  // distinct service ports, default 20
+	ServicePorts []int  `json:"service_ports"` // ports above 1023 to report as services
+	ActiveWindow string `json:"active_window"` // flows seen within this window are active, default "60s"
+}
+
+// NetFlowTraffic is the traffic of one direction/protocol/service group.
+type NetFlowTraffic struct {
+	Direction string
+	Protocol  string
+	Service   string
+	Packets   uint64
+	Bytes     uint64
+}
+
+// NetFlowPeer is the traffic exchanged with one remote address. The
+// aggregate of peers beyond the top-N limit has Peer "other".
+type NetFlowPeer struct {
+	Peer    string
+	Packets uint64
+	Bytes   uint64
+}
+
+// NetFlowProcess is the traffic attributed to one local process name.
+// Unattributed flows are reported as "unknown" and processes beyond the
+// top-N limit as "other".
+type NetFlowProcess struct {
+	Process string
+	Packets uint64
+	Bytes   uint64
+}
+
+// NetFlowGeo is the traffic of one direction to or from one remote
+// country or autonomous system.
+type NetFlowGeo struct {
+	Direction string
+	Country   string
+	ASN       uint
+	Org       string
+	Packets   uint64
+	Bytes     uint64
+}
+
+// NetFlowSummary holds the flow traffic counters and a snapshot of the
+// flow cache for GenerateMetrics. Traffic, Peers, Processes, Countries,
+// ASNs, Retransmissions and OutOfOrder count every packet seen since
+// startup, so they keep growing when flows expire from the cache.
+type NetFlowSummary struct {
+	Traffic     []NetFlowTraffic
+	Peers       []NetFlowPeer
+	Processes   []NetFlowProcess
+	ActiveFlows map[string]int // by protocol
+	TotalFlows  int
+
+	TCPStates       map[string]int // flows by TCP connection state
+	Retransmissions uint64
+	OutOfOrder      uint64
+
+	// Filled only when GeoIP metric labels are enabled. ASNs are limited to
+	// the top-N peers setting, with the rest summed under ASN 0 "other".
+	Countries []NetFlowGeo
+	ASNs      []NetFlowGeo
+}
+
+// maxMetricLabels bounds the label values ranked for each folded counter;
+// when it is reached the lower half, by bytes, is forgotten.
+const maxMetricLabels = 4096
+
+// metricGroup holds the labels of a folded counter that are never folded,
+// such as direction and protocol.
+type metricGroup [2]string
+
+type seriesKey struct {
+	group metricGroup
+	label string
+}
+
+type packetCount struct {
+	packets, bytes uint64
+}
+
+type labelRank struct {
+	bytes    uint64 // since first seen, for ranking
+	promoted bool
+}
+
+// foldedCounter counts packets and bytes per group and label value, giving
+// only the top n label values by bytes a series of their own; the others
+// are summed into the group's "other" series. Label values are ranked when
+// the metrics are written, and a promoted value only counts from then on,
+// so that every series, "other" included, only ever grows.
+type foldedCounter struct {
+	n      int
+	labels map[string]*labelRank
+	series map[seriesKey]*packetCount
+	other  map[metricGroup]*packetCount
+}
+
+func newFoldedCounter(n int) *foldedCounter {
+	return &foldedCounter{
+		n:      n,
+		labels: make(map[string]*labelRank),
+		series: make(map[seriesKey]*packetCount),
+		other:  make(map[metricGroup]*packetCount),
+	}
+}
+
+func (c *foldedCounter) add(group metricGroup, label string, packets, bytes uint64) {
+	target := c.other[group]
+	if label != "other" {
+		l, ok := c.labels[label]
+		if !ok {
+			if len(c.labels) >= maxMetricLabels {
+				c.forget()
+			}
+			l = &labelRank{}
+			c.labels[label] = l
+		}
+		l.bytes += bytes
+		if l.promoted {
+			target = c.series[seriesKey{group, label}]
+			if target == nil {
+				target = &packetCount{}
+				c.series[seriesKey{group, label}] = target
+			}
+		}
+	}
+	if target == nil {
+		target = &packetCount{}
+		c.other[group] = target
+	}
+	target.packets += packets
+	target.bytes += bytes
+}
+
+// forget drops the lower half of the label values that are not promoted.
+// Their traffic has already been counted under "other".
+func (c *foldedCounter) forget() {
+	var ranked []string
+	for label, l := range c.labels {
+		if !l.promoted {
+			ranked = append(ranked, label)
+		}
+	}
+	c.sort(ranked)
+	for _, label := range ranked[len(ranked)/2:] {
+		delete(c.labels, label)
+	}
+}
+
+// sort orders labels by bytes, largest first, breaking ties by label.
+func (c *foldedCounter) sort(labels []string) {
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := c.labels[labels[i]].bytes, c.labels[labels[j]].bytes
+		if a != b {
+			return a > b
+		}
+		return labels[i] < labels[j]
+	})
+}
+
+// rank promotes the top n label values and demotes the rest. A demoted
+// value counts under "other" again; its series keeps its last value for
+// one more scrape, so nothing it counted is lost, and is then dropped.
+func (c *foldedCounter) rank() {
+	labels := make([]string, 0, len(c.labels))
+	for label := range c.labels {
+		labels = append(labels, label)
+	}
+	c.sort(labels)
+	demoted := make(map[string]bool)
+	for i, label := range labels {
+		l := c.labels[label]
+		if l.promoted && i >= c.n {
+			demoted[label] = true
+		}
+		l.promoted = i < c.n
+	}
+	for k := range c.series {
+		if l := c.labels[k.label]; (l == nil || !l.promoted) && !demoted[k.label] {
+			delete(c.series, k)
+		}
+	}
+}
+
+// each calls fn for every series, with label "other" for the folded ones.
+func (c *foldedCounter) each(fn func(group metricGroup, label string, n packetCount)) {
+	for k, n := range c.series {
+		fn(k.group, k.label, *n)
+	}
+	for group, n := range c.other {
+		fn(group, "other", *n)
+	}
+}
+
+var (
+	netflowMetricsMu   sync.Mutex
+	netflowMetricsOpts = NetFlowMetricsOptions{}.withDefaults()
+	netflowCounters    = newFlowCounters(netflowMetricsOpts)
+)
+
+// flowCounters are the traffic counters behind NetFlowSummary.
+type flowCounters struct {
+	services  map[int]bool // extra service ports
+	traffic   *foldedCounter
+	peers     *foldedCounter
+	processes *foldedCounter
+	countries map[metricGroup]*packetCount
+	asns      *foldedCounter
+	asnOrgs   map[string]string
+
+	retransmissions, outOfOrder uint64
+}
+
+func newFlowCounters(o NetFlowMetricsOptions) *flowCounters {
+	c := &flowCounters{
+		services:  make(map[int]bool, len(o.ServicePorts)),
+		traffic:   newFoldedCounter(o.MaxServices),
+		peers:     newFoldedCounter(o.TopPeers),
+		processes: newFoldedCounter(o.TopProcesses),
+		countries: make(map[metricGroup]*packetCount),
+		asns:      newFoldedCounter(o.TopPeers),
+		asnOrgs:   make(map[string]string),
+	}
+	for _, p := range o.ServicePorts {
+		c.services[p] = true
+	}
+	return c
+}
+
+// SetNetFlowMetricsOptions replaces the cardinality limits used by
+// GetNetFlowSummary and restarts the traffic counters.
+func SetNetFlowMetricsOptions(o NetFlowMetricsOptions) {
+	netflowMetricsMu.Lock()
+	netflowMetricsOpts = o.withDefaults()
+	netflowCounters = newFlowCounters(netflowMetricsOpts)
+	netflowMetricsMu.Unlock()
+}
+
+func (o NetFlowMetricsOptions) withDefaults() NetFlowMetricsOptions {
+	if o.TopPeers <= 0 {
+		o.TopPeers = 10
+	}
+	if o.TopProcesses <= 0 {
+		o.TopProcesses = 10
+	}
+	if o.MaxServices <= 0 {
+		o.MaxServices = 20
+	}
+	if _, err := time.ParseDuration(o.ActiveWindow); err != nil {
+		o.ActiveWindow = "60s"
+	}
+	return o
+}
+
+// serviceName maps a flow to its service port: the lower of the two ports
+// when it is well known (<= 1023) or explicitly configured, else "other".
+func serviceName(e *NetFlowEntry, extra map[int]bool) string {
+	for _, p := range []uint16{min(e.SrcPort, e.DstPort), max(e.SrcPort, e.DstPort)} {
+		if p != 0 && (p <= 1023 || extra[int(p)]) {
+			return strconv.Itoa(int(p))
+		}
+	}
+	return "other"
+}
+
+// countFlowTraffic adds packets and bytes of flow e to the traffic
+// counters. It is called for every packet or record merged into the flow
+// cache, once the flow has been attributed and enriched.
+func countFlowTraffic(e *NetFlowEntry, packets, bytes int) {
+	withGeo := geoMetricLabels()
+	p, b := uint64(packets), uint64(bytes)
+
+	netflowMetricsMu.Lock()
+	defer netflowMetricsMu.Unlock()
+
+	c := netflowCounters
+	c.traffic.add(metricGroup{e.Direction, e.Protocol}, serviceName(e, c.services), p, b)
+	c.peers.add(metricGroup{}, remotePeer(e), p, b)
+	process := e.Process
+	if process == "" {
+		process = "unknown"
+	}
+	c.processes.add(metricGroup{}, process, p, b)
+
+	if withGeo {
+		country := e.RemoteCountry
+		if country == "" {
+			country = "unknown"
+		}
+		n, ok := c.countries[metricGroup{e.Direction, country}]
+		if !ok {
+			n = &packetCount{}
+			c.countries[metricGroup{e.Direction, country}] = n
+		}
+		n.packets += p
+		n.bytes += b
+
+		asn := strconv.FormatUint(uint64(e.RemoteASN), 10)
+		if e.RemoteOrg != "" {
+			c.asnOrgs[asn] = e.RemoteOrg
+		}
+		c.asns.add(metricGroup{e.Direction}, asn, p, b)
+	}
+}
+
+// countTCPAnomaly counts a retransmitted or out-of-order TCP segment.
+func countTCPAnomaly(retransmission bool) {
+	netflowMetricsMu.Lock()
+	if retransmission {
+		netflowCounters.retransmissions++
+	} else {
+		netflowCounters.outOfOrder++
+	}
+	netflowMetricsMu.Unlock()
+}
+
+// GetNetFlowSummary returns the traffic counters, folded to the configured
+// limits, and the active flows and TCP states of the flow cache.
+func GetNetFlowSummary() NetFlowSummary {
+	netflowMetricsMu.Lock()
+	opts := netflowMetricsOpts
+	c := netflowCounters
+	c.traffic.rank()
+	c.peers.rank()
+	c.processes.rank()
+	c.asns.rank()
+
+	var summary NetFlowSummary
+	c.traffic.each(func(g metricGroup, label string, n packetCount) {
+		summary.Traffic = append(summary.Traffic, NetFlowTraffic{Direction: g[0], Protocol: g[1], Service: label, Packets: n.packets, Bytes: n.bytes})
+	})
+	c.peers.each(func(_ metricGroup, label string, n packetCount) {
+		summary.Peers = append(summary.Peers, NetFlowPeer{Peer: label, Packets: n.packets, Bytes: n.bytes})
+	})
+	c.processes.each(func(_ metricGroup, label string, n packetCount) {
+		summary.Processes = append(summary.Processes, NetFlowProcess{Process: label, Packets: n.packets, Bytes: n.bytes})
+	})
+	for g, n := range c.countries {
+		summary.Countries = append(summary.Countries, NetFlowGeo{Direction: g[0], Country: g[1], Packets: n.packets, Bytes: n.bytes})
+	}
+	c.asns.each(func(g metricGroup, label string, n packetCount) {
+		geo := NetFlowGeo{Direction: g[0], Org: "other", Packets: n.packets, Bytes: n.bytes}
+		if label != "other" {
+			asn, _ := strconv.ParseUint(label, 10, 32)
+			geo.ASN, geo.Org = uint(asn), c.asnOrgs[label]
+		}
+		summary.ASNs = append(summary.ASNs, geo)
+	})
+	summary.Retransmissions = c.retransmissions
+	summary.OutOfOrder = c.outOfOrder
+	netflowMetricsMu.Unlock()
+
+	sortNetFlowSummary(&summary)
+
+	window, _ := time.ParseDuration(opts.ActiveWindow)
+	cutoff := time.Now().Add(-window)
+	entries := GetNetFlowEntries()
+	summary.ActiveFlows = make(map[string]int)
+	summary.TotalFlows = len(entries)
+	summary.TCPStates = make(map[string]int)
+	for i := range entries {
+		e := &entries[i]
+		if e.EndTime.After(cutoff) {
+			summary.ActiveFlows[e.Protocol]++
+		}
+		if e.TCPState != "" {
+			summary.TCPStates[e.TCPState]++
+		}
+	}
+	return summary
+}
+
+// sortNetFlowSummary orders traffic by its labels and the top-N lists by
+// bytes, largest first, with "other" last. Ties are broken by label.
+func sortNetFlowSummary(s *NetFlowSummary) {
+	sort.Slice(s.Traffic, func(i, j int) bool {
+		a, b := s.Traffic[i], s.Traffic[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Service < b.Service
+	})
+	sort.Slice(s.Peers, func(i, j int) bool {
+		a, b := s.Peers[i], s.Peers[j]
+		return byBytes(a.Peer == "other", b.Peer == "other", a.Bytes, b.Bytes, a.Peer, b.Peer)
+	})
+	sort.Slice(s.Processes, func(i, j int) bool {
+		a, b := s.Processes[i], s.Processes[j]
+		return byBytes(a.Process == "other", b.Process == "other", a.Bytes, b.Bytes, a.Process, b.Process)
+	})
+	sort.Slice(s.Countries, func(i, j int) bool {
+		a, b := s.Countries[i], s.Countries[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Country != b.Country {
+			return a.Country < b.Country
+		}
+		return a.Direction < b.Direction
+	})
+	sort.Slice(s.ASNs, func(i, j int) bool {
+		a, b := s.ASNs[i], s.ASNs[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if oa, ob := a.Org == "other" && a.ASN == 0, b.Org == "other" && b.ASN == 0; oa != ob {
+			return ob
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.ASN < b.ASN
+	})
+}
+
+// byBytes reports whether a sorts before b: "other" last, then by bytes,
+// largest first, then by label.
+func byBytes(otherA, otherB bool, bytesA, bytesB uint64, labelA, labelB string) bool {
+	if otherA != otherB {
+		return otherB
+	}
+	if bytesA != bytesB {
+		return bytesA > bytesB
+	}
+	return labelA < labelB
+}
@@ -0,0 +1,142 @@
+package collectors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// resetFlowMetrics restarts the traffic counters with o for a test.
+func resetFlowMetrics(t *testing.T, o NetFlowMetricsOptions) {
+	t.Helper()
+	SetNetFlowMetricsOptions(o)
+	t.Cleanup(func() { SetNetFlowMetricsOptions(NetFlowMetricsOptions{}) })
+}
+
+func outboundFlow(peer string, port uint16, process string, bytes int) NetFlowEntry {
+	now := time.Now()
+	return NetFlowEntry{Direction: DirectionOutbound, SrcIP: "192.0.2.10", DstIP: peer, SrcPort: 40000, DstPort: port,
+		Protocol: "TCP", Process: process, Packets: 1, Bytes: bytes, StartTime: now, EndTime: now}
+}
+
+func TestNetFlowSummaryTies(t *testing.T) {
+	resetFlows(t)
+	resetFlowMetrics(t, NetFlowMetricsOptions{TopPeers: 2, TopProcesses: 2, MaxServices: 2})
+
+	add := func() {
+		for i, peer := range []string{"198.51.100.4", "198.51.100.2", "198.51.100.3", "198.51.100.1"} {
+			addFlow(outboundFlow(peer, []uint16{25, 22, 53, 21}[i], []string{"d", "b", "c", "a"}[i], 100))
+		}
+	}
+	add()
+	GetNetFlowSummary()
+	add()
+
+	// Every label has the same byte count, so the cut is made by label.
+	// The promoted labels count from the first scrape on.
+	for run := 0; run < 5; run++ {
+		s := GetNetFlowSummary()
+		peers := []NetFlowPeer{{"198.51.100.1", 1, 100}, {"198.51.100.2", 1, 100}, {"other", 6, 600}}
+		if !reflect.DeepEqual(s.Peers, peers) {
+			t.Fatalf("peers: %v", s.Peers)
+		}
+		procs := []NetFlowProcess{{"a", 1, 100}, {"b", 1, 100}, {"other", 6, 600}}
+		if !reflect.DeepEqual(s.Processes, procs) {
+			t.Fatalf("processes: %v", s.Processes)
+		}
+		var services []string
+		for _, tr := range s.Traffic {
+			services = append(services, tr.Service)
+		}
+		if !reflect.DeepEqual(services, []string{"21", "22", "other"}) {
+			t.Fatalf("services: %v", services)
+		}
+	}
+}
+
+func TestNetFlowSummaryMonotonic(t *testing.T) {
+	resetFlows(t)
+	resetFlowMetrics(t, NetFlowMetricsOptions{TopPeers: 1})
+
+	// Between two scrapes the series grow by exactly the bytes sent, a
+	// demoted peer included.
+	var sent uint64
+	last := make(map[string]uint64)
+	check := func(step string) {
+		t.Helper()
+		s := GetNetFlowSummary()
+		var grown uint64
+		seen := make(map[string]uint64)
+		for _, p := range s.Peers {
+			if p.Bytes < last[p.Peer] {
+				t.Errorf("%s: peer %s went down from %d to %d", step, p.Peer, last[p.Peer], p.Bytes)
+			}
+			grown += p.Bytes - last[p.Peer]
+			seen[p.Peer] = p.Bytes
+		}
+		if grown != sent {
+			t.Errorf("%s: series grew by %d bytes, want %d: %v", step, grown, sent, s.Peers)
+		}
+		if s.Peers[len(s.Peers)-1].Peer != "other" {
+			t.Errorf("%s: other is not last: %v", step, s.Peers)
+		}
+		last, sent = seen, 0
+	}
+	send := func(peer string, bytes int) {
+		addFlow(outboundFlow(peer, 443, "", bytes))
+		sent += uint64(bytes)
+	}
+
+	send("198.51.100.1", 1000)
+	check("first peer")
+	send("198.51.100.1", 1000)
+	send("198.51.100.2", 5000)
+	check("second peer overtakes")
+	send("198.51.100.1", 1000)
+	send("198.51.100.2", 1000)
+	check("after the swap")
+
+	// Expiry empties the flow cache but not the counters.
+	setFlowTimeouts(t, time.Minute, 0)
+	expireFlows(time.Now().Add(time.Hour), false)
+	if n := len(GetNetFlowEntries()); n != 0 {
+		t.Fatalf("%d flows left after expiry", n)
+	}
+	check("after expiry")
+	if s := GetNetFlowSummary(); s.TotalFlows != 0 {
+		t.Errorf("TotalFlows = %d after expiry", s.TotalFlows)
+	}
+}
+
+// setFlowTimeouts sets the expiry timeouts for a test without starting the
+// expiry goroutine.
+func setFlowTimeouts(t *testing.T, idle, active time.Duration) {
+	t.Helper()
+	expiryMu.Lock()
+	savedIdle, savedActive := idleTimeout, activeTimeout
+	idleTimeout, activeTimeout = idle, active
+	expiryMu.Unlock()
+	t.Cleanup(func() {
+		expiryMu.Lock()
+		idleTimeout, activeTimeout = savedIdle, savedActive
+		expiryMu.Unlock()
+	})
+}
+
+func TestFoldedCounterForgets(t *testing.T) {
+	c := newFoldedCounter(1)
+	c.add(metricGroup{}, "big", 1, 1000)
+	c.rank()
+	for i := 0; i < maxMetricLabels+10; i++ {
+		c.add(metricGroup{}, string(rune('a'+i%26))+time.Duration(i).String(), 1, 1)
+	}
+	if len(c.labels) > maxMetricLabels {
+		t.Errorf("%d labels kept, want at most %d", len(c.labels), maxMetricLabels)
+	}
+	if !c.labels["big"].promoted {
+		t.Error("promoted label was forgotten")
+	}
+	if n := c.other[metricGroup{}]; n.packets != maxMetricLabels+11 {
+		t.Errorf("other counted %d packets, want %d", n.packets, maxMetricLabels+11)
+	}
+}
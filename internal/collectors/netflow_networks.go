@@ -0,0 +1,141 @@
+package collectors
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Flow directions assigned to locally captured packets.
+const (
+	DirectionInbound  = "inbound"        // remote -> this host
+	DirectionOutbound = "outbound"       // this host -> remote
+	DirectionInternal = "internal"       // neither end is this host, both inside the internal networks
+	DirectionTransit  = "transit"        // neither end is this host (forwarded or mirrored)
+	DirectionLoopback = "local-loopback" // loopback addresses or this host to itself
+)
+
+const defaultLocalRefresh = time.Minute
+
+// NetworkOptions controls how captured flows are classified.
+type NetworkOptions struct {
+	InternalNetworks []string `json:"internal_networks"` // CIDRs, e.g. "10.0.0.0/8"
+	LocalRefresh     string   `json:"local_refresh"`     // re-read local addresses, default "1m"
+}
+
+var (
+	networksMu sync.RWMutex
+	localIPs   = getLocalIPs()
+	internal   []*net.IPNet
+	refreshing sync.Once
+)
+
+// ConfigureNetworks validates the internal network list and starts the
+// periodic refresh of local addresses, so that DHCP changes and adapters
+// that come and go are reflected in flow directions.
+func ConfigureNetworks(o NetworkOptions) error {
+	nets := make([]*net.IPNet, 0, len(o.InternalNetworks))
+	for _, cidr := range o.InternalNetworks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("netflow_networks: invalid internal network %q: %v", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	refresh := defaultLocalRefresh
+	if o.LocalRefresh != "" {
+		d, err := time.ParseDuration(o.LocalRefresh)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("netflow_networks: invalid local_refresh %q", o.LocalRefresh)
+		}
+		refresh = d
+	}
+
+	networksMu.Lock()
+	internal = nets
+	networksMu.Unlock()
+
+	refreshing.Do(func() {
+		go func() {
+			for {
+				time.Sleep(refresh)
+				ips := getLocalIPs()
+				networksMu.Lock()
+				localIPs = ips
+				networksMu.Unlock()
+			}
+		}()
+	})
+	return nil
+}
+
+// getLocalIPs returns the IPv4 and IPv6 addresses of all interfaces.
+func getLocalIPs() map[string]bool {
+	ips := make(map[string]bool)
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ips[ipNet.IP.String()] = true
+			}
+		}
+	}
+	return ips
+}
+
+func isLocalIP(ip string) bool {
+	networksMu.RLock()
+	defer networksMu.RUnlock()
+	return localIPs[ip]
+}
+
+func isInternalIP(ip net.IP) bool {
+	networksMu.RLock()
+	defer networksMu.RUnlock()
+	for _, n := range internal {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyFlow decides the direction of a packet relative to this host.
+// This host's own traffic is inbound or outbound even when the peer is in
+// the internal networks; internal is left for traffic between other hosts.
+func classifyFlow(src, dst net.IP) string {
+	srcLocal, dstLocal := isLocalIP(src.String()), isLocalIP(dst.String())
+	switch {
+	case src.IsLoopback() || dst.IsLoopback() || (srcLocal && dstLocal):
+		return DirectionLoopback
+	case srcLocal:
+		return DirectionOutbound
+	case dstLocal:
+		return DirectionInbound
+	case isInternalIP(src) && isInternalIP(dst):
+		return DirectionInternal
+	}
+	return DirectionTransit
+}
+
+// localEndpoint returns the side of a flow that belongs to this host; for
+// flows where neither or both ends are local it returns the source.
+func localEndpoint(e *NetFlowEntry) (string, uint16) {
+	if e.Direction == DirectionOutbound || (e.Exporter == "" && isLocalIP(e.SrcIP)) {
+		return e.SrcIP, e.SrcPort
+	}
+	if e.Direction == DirectionInbound || (e.Exporter == "" && isLocalIP(e.DstIP)) {
+		return e.DstIP, e.DstPort
+	}
+	return e.SrcIP, e.SrcPort
+}
+
+// remotePeer returns the far end of a flow relative to this host.
+func remotePeer(e *NetFlowEntry) string {
+	if ip, _ := localEndpoint(e); ip == e.SrcIP {
+		return e.DstIP
+	}
+	return e.SrcIP
+}
@@ -0,0 +1,96 @@
+package collectors
+
+import (
+	"net"
+	"testing"
+)
+
+// setNetworks replaces this host's addresses and the internal networks for
+// a test.
+func setNetworks(t *testing.T, local []string, cidrs ...string) {
+	t.Helper()
+	networksMu.Lock()
+	savedLocal, savedInternal := localIPs, internal
+	localIPs, internal = make(map[string]bool), nil
+	for _, ip := range local {
+		localIPs[ip] = true
+	}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			networksMu.Unlock()
+			t.Fatal(err)
+		}
+		internal = append(internal, n)
+	}
+	networksMu.Unlock()
+	t.Cleanup(func() {
+		networksMu.Lock()
+		localIPs, internal = savedLocal, savedInternal
+		networksMu.Unlock()
+	})
+}
+
+func TestClassifyFlow(t *testing.T) {
+	setNetworks(t, []string{"10.0.0.5", "192.0.2.10", "fd00::5"}, "10.0.0.0/8", "fd00::/8")
+	tests := []struct {
+		src, dst string
+		want     string
+	}{
+		{"127.0.0.1", "127.0.0.1", DirectionLoopback},
+		{"::1", "::1", DirectionLoopback},
+		{"10.0.0.5", "192.0.2.10", DirectionLoopback}, // this host to itself
+		{"10.0.0.5", "127.0.0.1", DirectionLoopback},
+
+		// This host's traffic is inbound or outbound, internal peer or not.
+		{"10.0.0.5", "10.0.0.9", DirectionOutbound},
+		{"10.0.0.9", "10.0.0.5", DirectionInbound},
+		{"fd00::5", "fd00::9", DirectionOutbound},
+		{"192.0.2.10", "198.51.100.1", DirectionOutbound},
+		{"198.51.100.1", "10.0.0.5", DirectionInbound},
+
+		// Other hosts' traffic, as seen on a mirror port.
+		{"10.0.0.8", "10.0.0.9", DirectionInternal},
+		{"fd00::8", "fd00::9", DirectionInternal},
+		{"10.0.0.8", "198.51.100.1", DirectionTransit},
+		{"198.51.100.1", "198.51.100.2", DirectionTransit},
+	}
+	for _, tt := range tests {
+		if got := classifyFlow(net.ParseIP(tt.src), net.ParseIP(tt.dst)); got != tt.want {
+			t.Errorf("classifyFlow(%s, %s) = %s, want %s", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
+
+func TestRemotePeer(t *testing.T) {
+	setNetworks(t, []string{"10.0.0.5"})
+	for _, tt := range []struct {
+		e    NetFlowEntry
+		want string
+	}{
+		{NetFlowEntry{Direction: DirectionOutbound, SrcIP: "10.0.0.5", DstIP: "198.51.100.1"}, "198.51.100.1"},
+		{NetFlowEntry{Direction: DirectionInbound, SrcIP: "198.51.100.1", DstIP: "10.0.0.5"}, "198.51.100.1"},
+		// Without a direction this host's address decides for captured
+		// flows; for exported ones the source is taken as the near end.
+		{NetFlowEntry{SrcIP: "198.51.100.1", DstIP: "10.0.0.5"}, "198.51.100.1"},
+		{NetFlowEntry{Exporter: "192.0.2.1", SrcIP: "198.51.100.1", DstIP: "10.0.0.5"}, "10.0.0.5"},
+		{NetFlowEntry{Direction: DirectionTransit, SrcIP: "198.51.100.1", DstIP: "198.51.100.2"}, "198.51.100.2"},
+	} {
+		if got := remotePeer(&tt.e); got != tt.want {
+			t.Errorf("remotePeer(%s -> %s, %q) = %s, want %s", tt.e.SrcIP, tt.e.DstIP, tt.e.Direction, got, tt.want)
+		}
+	}
+}
+
+func TestConfigureNetworksErrors(t *testing.T) {
+	for _, o := range []NetworkOptions{
+		{InternalNetworks: []string{"10.0.0.0"}},
+		{InternalNetworks: []string{"10.0.0.0/33"}},
+		{LocalRefresh: "often"},
+		{LocalRefresh: "-1m"},
+	} {
+		if err := ConfigureNetworks(o); err == nil {
+			t.Errorf("ConfigureNetworks(%+v) succeeded, want an error", o)
+		}
+	}
+}
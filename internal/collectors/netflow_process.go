@@ -0,0 +1,137 @@
+package collectors
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	psnet "github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// socketOwner is the process that owns a local socket.
+type socketOwner struct {
+	PID  int32
+	Name string
+}
+
+var (
+	socketMu     sync.RWMutex
+	socketTable  = make(map[string]socketOwner)
+	socketGen    = uint64(1) // bumped by every refresh of socketTable
+	socketOnce   sync.Once
+	processNames = make(map[int32]string) // only touched by the refresher
+)
+
+// StartProcessAttribution refreshes the OS socket table every interval so
+// that captured flows can be matched to the owning PID and process name.
+// Lookups never block on the refresh; flows seen before their socket shows
+// up are attributed on a packet after the next refresh.
+func StartProcessAttribution(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	socketOnce.Do(func() {
+		go func() {
+			for {
+				refreshSocketTable()
+				time.Sleep(interval)
+			}
+		}()
+	})
+}
+
+func refreshSocketTable() {
+	conns, err := psnet.Connections("inet")
+	if err != nil {
+		log.Printf("Error reading socket table: %v", err)
+		return
+	}
+
+	table := make(map[string]socketOwner, len(conns))
+	alive := make(map[int32]bool)
+	for _, c := range conns {
+		if c.Pid == 0 {
+			continue
+		}
+		proto := "TCP"
+		if c.Type == syscall.SOCK_DGRAM {
+			proto = "UDP"
+		}
+		name, ok := processNames[c.Pid]
+		if !ok {
+			if p, err := process.NewProcess(c.Pid); err == nil {
+				name, _ = p.Name()
+			}
+			processNames[c.Pid] = name
+		}
+		alive[c.Pid] = true
+		table[socketKey(proto, c.Laddr.IP, uint16(c.Laddr.Port))] = socketOwner{PID: c.Pid, Name: name}
+	}
+	for pid := range processNames {
+		if !alive[pid] {
+			delete(processNames, pid)
+		}
+	}
+
+	socketMu.Lock()
+	socketTable = table
+	socketGen++
+	socketMu.Unlock()
+}
+
+func socketKey(proto, ip string, port uint16) string {
+	return proto + "|" + ip + "|" + strconv.Itoa(int(port))
+}
+
+// lookupSocketOwner finds the process bound to a local endpoint, falling
+// back to sockets bound to the wildcard address.
+func lookupSocketOwner(proto, ip string, port uint16) (socketOwner, bool) {
+	if port == 0 {
+		return socketOwner{}, false
+	}
+	wildcard := "0.0.0.0"
+	if strings.Contains(ip, ":") {
+		wildcard = "::"
+	}
+
+	socketMu.RLock()
+	defer socketMu.RUnlock()
+	for _, addr := range []string{ip, wildcard, "*"} {
+		if o, ok := socketTable[socketKey(proto, addr, port)]; ok {
+			return o, true
+		}
+	}
+	// IPv4 traffic to dual-stack sockets shows up under "::".
+	if net.ParseIP(ip).To4() != nil {
+		if o, ok := socketTable[socketKey(proto, "::", port)]; ok {
+			return o, true
+		}
+	}
+	return socketOwner{}, false
+}
+
+// attributeFlow fills in the owning process of a locally captured flow.
+// It runs for every packet with netflowMu held, so a flow whose socket is
+// not in the table is only looked up again once the table is refreshed.
+func attributeFlow(e *NetFlowEntry) {
+	if e.PID != 0 {
+		return
+	}
+	socketMu.RLock()
+	gen := socketGen
+	socketMu.RUnlock()
+	if e.socketGen == gen {
+		return
+	}
+	ip, port := localEndpoint(e)
+	if o, ok := lookupSocketOwner(e.Protocol, ip, port); ok {
+		e.PID, e.Process = o.PID, o.Name
+		return
+	}
+	e.socketGen = gen
+}
@@ -0,0 +1,77 @@
+package collectors
+
+import "testing"
+
+// setSocketTable installs table as a refresh would, restoring the previous
+// table when the test ends.
+func setSocketTable(t *testing.T, table map[string]socketOwner) {
+	t.Helper()
+	socketMu.Lock()
+	saved := socketTable
+	socketTable = table
+	socketGen++
+	socketMu.Unlock()
+	t.Cleanup(func() {
+		socketMu.Lock()
+		socketTable = saved
+		socketGen++
+		socketMu.Unlock()
+	})
+}
+
+func TestLookupSocketOwner(t *testing.T) {
+	setSocketTable(t, map[string]socketOwner{
+		socketKey("TCP", "192.0.2.10", 443): {PID: 10, Name: "bound"},
+		socketKey("TCP", "0.0.0.0", 22):     {PID: 22, Name: "sshd"},
+		socketKey("TCP", "::", 80):          {PID: 80, Name: "dualstack"},
+		socketKey("UDP", "*", 53):           {PID: 53, Name: "resolver"},
+		socketKey("UDP", "::", 123):         {PID: 123, Name: "ntpd"},
+	})
+	for _, tt := range []struct {
+		proto, ip string
+		port      uint16
+		want      int32
+	}{
+		{"TCP", "192.0.2.10", 443, 10},
+		{"TCP", "192.0.2.11", 443, 0}, // bound to another address
+		{"UDP", "192.0.2.10", 443, 0}, // another protocol
+		{"TCP", "192.0.2.10", 22, 22},
+		{"TCP", "2001:db8::1", 22, 0}, // IPv4 wildcard only
+		{"TCP", "192.0.2.10", 80, 80},
+		{"TCP", "2001:db8::1", 80, 80},
+		{"UDP", "192.0.2.10", 53, 53},
+		{"UDP", "192.0.2.10", 123, 123},
+		{"TCP", "192.0.2.10", 0, 0},
+	} {
+		o, ok := lookupSocketOwner(tt.proto, tt.ip, tt.port)
+		if o.PID != tt.want || ok != (tt.want != 0) {
+			t.Errorf("lookupSocketOwner(%s, %s, %d) = %+v, %v; want PID %d", tt.proto, tt.ip, tt.port, o, ok, tt.want)
+		}
+	}
+}
+
+func TestAttributeFlowRetriesAfterRefresh(t *testing.T) {
+	setSocketTable(t, map[string]socketOwner{})
+	e := outboundFlow("198.51.100.1", 443, "", 100)
+
+	attributeFlow(&e)
+	if e.PID != 0 || e.socketGen == 0 {
+		t.Fatalf("after a miss: PID %d, generation %d", e.PID, e.socketGen)
+	}
+
+	// The socket shows up, but until the table is refreshed the flow is
+	// not looked up again.
+	socketMu.Lock()
+	socketTable[socketKey("TCP", "192.0.2.10", 40000)] = socketOwner{PID: 42, Name: "curl"}
+	socketMu.Unlock()
+	attributeFlow(&e)
+	if e.PID != 0 {
+		t.Fatalf("looked up again within the same table generation")
+	}
+
+	setSocketTable(t, map[string]socketOwner{socketKey("TCP", "192.0.2.10", 40000): {PID: 42, Name: "curl"}})
+	attributeFlow(&e)
+	if e.PID != 42 || e.Process != "curl" {
+		t.Errorf("after the refresh: PID %d, process %q", e.PID, e.Process)
+	}
+}
@@ -0,0 +1,264 @@
+package collectors
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NetFlowQuery selects, orders and aggregates flow entries. Zero-valued
+// fields do not filter.
+type NetFlowQuery struct {
+	Interface string
+	Direction string
+	Protocol  string
+	IP        *net.IPNet // either endpoint
+	SrcIP     *net.IPNet
+	DstIP     *net.IPNet
+	Port      int // either endpoint; -1 for any
+	Since     time.Time
+	Until     time.Time
+	SortBy    string // "bytes", "packets", "duration", "start" or "retransmissions"; "bytes", "packets" or "flows" with GroupBy
+	Limit     int
+	GroupBy   string
+}
+
+// NetFlowGroup is one bucket of a group-by query.
+type NetFlowGroup struct {
+	Key     string `json:"key"`
+	Flows   int    `json:"flows"`
+	Packets int    `json:"packets"`
+	Bytes   int    `json:"bytes"`
+}
+
+var (
+	netflowSortFields      = map[string]bool{"bytes": true, "packets": true, "duration": true, "start": true, "retransmissions": true}
+	netflowGroupSortFields = map[string]bool{"bytes": true, "packets": true, "flows": true}
+)
+
+var netflowGroupFields = map[string]func(e *NetFlowEntry) string{
+	"interface": func(e *NetFlowEntry) string { return e.Interface },
+	"direction": func(e *NetFlowEntry) string { return e.Direction },
+	"protocol":  func(e *NetFlowEntry) string { return e.Protocol },
+	"src_ip":    func(e *NetFlowEntry) string { return e.SrcIP },
+	"dst_ip":    func(e *NetFlowEntry) string { return e.DstIP },
+	"remote_ip": func(e *NetFlowEntry) string { return remotePeer(e) },
+	"src_name":  func(e *NetFlowEntry) string { return e.SrcName },
+	"dst_name":  func(e *NetFlowEntry) string { return e.DstName },
+	"src_port":  func(e *NetFlowEntry) string { return strconv.Itoa(int(e.SrcPort)) },
+	"dst_port":  func(e *NetFlowEntry) string { return strconv.Itoa(int(e.DstPort)) },
+	"process":   func(e *NetFlowEntry) string { return e.Process },
+	"tcp_state": func(e *NetFlowEntry) string { return e.TCPState },
+	"country":   func(e *NetFlowEntry) string { return e.RemoteCountry },
+	"asn":       func(e *NetFlowEntry) string { return strconv.FormatUint(uint64(e.RemoteASN), 10) },
+}
+
+// ParseNetFlowQuery builds a query from /netflow URL parameters:
+// interface, direction, protocol, ip, src, dst (address or CIDR), port,
+// since, until (RFC 3339 or a duration relative to now such as "15m"),
+// sort, limit (alias top) and group_by.
+func ParseNetFlowQuery(v url.Values) (NetFlowQuery, error) {
+	q := NetFlowQuery{
+		Interface: v.Get("interface"),
+		Direction: v.Get("direction"),
+		Protocol:  v.Get("protocol"),
+		Port:      -1,
+		SortBy:    v.Get("sort"),
+		GroupBy:   v.Get("group_by"),
+	}
+
+	var err error
+	for param, dst := range map[string]**net.IPNet{"ip": &q.IP, "src": &q.SrcIP, "dst": &q.DstIP} {
+		if s := v.Get(param); s != "" {
+			if *dst, err = parseIPOrCIDR(s); err != nil {
+				return q, fmt.Errorf("invalid %s %q: %v", param, s, err)
+			}
+		}
+	}
+	if s := v.Get("port"); s != "" {
+		if q.Port, err = strconv.Atoi(s); err != nil || q.Port < 0 || q.Port > 65535 {
+			return q, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = parseQueryTime(s); err != nil {
+			return q, fmt.Errorf("invalid since %q: %v", s, err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = parseQueryTime(s); err != nil {
+			return q, fmt.Errorf("invalid until %q: %v", s, err)
+		}
+	}
+	limit := v.Get("limit")
+	if limit == "" {
+		limit = v.Get("top")
+	}
+	if limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	if q.GroupBy != "" && netflowGroupFields[q.GroupBy] == nil {
+		return q, fmt.Errorf("invalid group_by %q", q.GroupBy)
+	}
+	switch {
+	case q.SortBy == "":
+	case q.GroupBy == "" && !netflowSortFields[q.SortBy]:
+		return q, fmt.Errorf("invalid sort %q (want bytes, packets, duration, start or retransmissions)", q.SortBy)
+	case q.GroupBy != "" && !netflowGroupSortFields[q.SortBy]:
+		return q, fmt.Errorf("invalid sort %q with group_by (want bytes, packets or flows)", q.SortBy)
+	}
+	return q, nil
+}
+
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address")
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Match reports whether e passes every filter of q. A flow matches a time
+// window if it overlaps it.
+func (q *NetFlowQuery) Match(e *NetFlowEntry) bool {
+	switch {
+	case q.Interface != "" && e.Interface != q.Interface:
+		return false
+	case q.Direction != "" && e.Direction != q.Direction:
+		return false
+	case q.Protocol != "" && !strings.EqualFold(e.Protocol, q.Protocol):
+		return false
+	case q.Port >= 0 && int(e.SrcPort) != q.Port && int(e.DstPort) != q.Port:
+		return false
+	case !q.Since.IsZero() && e.EndTime.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && e.StartTime.After(q.Until):
+		return false
+	case q.SrcIP != nil && !netContains(q.SrcIP, e.SrcIP):
+		return false
+	case q.DstIP != nil && !netContains(q.DstIP, e.DstIP):
+		return false
+	case q.IP != nil && !netContains(q.IP, e.SrcIP) && !netContains(q.IP, e.DstIP):
+		return false
+	}
+	return true
+}
+
+func netContains(n *net.IPNet, s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && n.Contains(ip)
+}
+
+// QueryNetFlowEntries returns the matching flows, sorted in descending
+// order of q.SortBy, then by interface and address tuple, and truncated to
+// q.Limit.
+func QueryNetFlowEntries(q NetFlowQuery) []NetFlowEntry {
+	result := []NetFlowEntry{}
+	for _, e := range GetNetFlowEntries() {
+		if q.Match(&e) {
+			result = append(result, e)
+		}
+	}
+
+	key := func(e *NetFlowEntry) int64 {
+		switch q.SortBy {
+		case "":
+			return 0
+		case "packets":
+			return int64(e.Packets)
+		case "duration":
+			return int64(e.EndTime.Sub(e.StartTime))
+		case "start":
+			return e.StartTime.UnixNano()
+		case "retransmissions":
+			return int64(e.Retransmissions)
+		}
+		return int64(e.Bytes)
+	}
+	flowKey := func(e *NetFlowEntry) string {
+		return makeFlowKey(e.Exporter+e.Interface, e.SrcIP, e.DstIP, e.SrcPort, e.DstPort, e.Protocol, e.Direction)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := &result[i], &result[j]
+		if ka, kb := key(a), key(b); ka != kb {
+			return ka > kb
+		}
+		return flowKey(a) < flowKey(b)
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result
+}
+
+// GroupNetFlowEntries aggregates the flows matching q by q.GroupBy. Groups
+// are ordered by bytes unless q.SortBy names packets or flows, then by key,
+// and truncated to q.Limit.
+func GroupNetFlowEntries(q NetFlowQuery) []NetFlowGroup {
+	keyOf := netflowGroupFields[q.GroupBy]
+	if keyOf == nil {
+		return []NetFlowGroup{}
+	}
+
+	groups := make(map[string]*NetFlowGroup)
+	for _, e := range GetNetFlowEntries() {
+		if !q.Match(&e) {
+			continue
+		}
+		k := keyOf(&e)
+		g, ok := groups[k]
+		if !ok {
+			g = &NetFlowGroup{Key: k}
+			groups[k] = g
+		}
+		g.Flows++
+		g.Packets += e.Packets
+		g.Bytes += e.Bytes
+	}
+
+	result := make([]NetFlowGroup, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, *g)
+	}
+	value := func(g *NetFlowGroup) int {
+		switch q.SortBy {
+		case "packets":
+			return g.Packets
+		case "flows":
+			return g.Flows
+		}
+		return g.Bytes
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := &result[i], &result[j]
+		if va, vb := value(a), value(b); va != vb {
+			return va > vb
+		}
+		return a.Key < b.Key
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[:q.Limit]
+	}
+	return result
+}
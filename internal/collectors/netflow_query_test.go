@@ -0,0 +1,52 @@
+package collectors
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseNetFlowQuerySort(t *testing.T) {
+	for query, ok := range map[string]bool{
+		"sort=bytes":                    true,
+		"sort=duration":                 true,
+		"sort=flows":                    false,
+		"sort=flows&group_by=remote_ip": true,
+		"sort=packets&group_by=process": true,
+		"sort=duration&group_by=asn":    false,
+		"sort=size":                     false,
+	} {
+		v, _ := url.ParseQuery(query)
+		if _, err := ParseNetFlowQuery(v); (err == nil) != ok {
+			t.Errorf("%s: err = %v, want ok = %v", query, err, ok)
+		}
+	}
+}
+
+func TestQueryNetFlowTies(t *testing.T) {
+	resetFlows(t)
+	for _, peer := range []string{"198.51.100.3", "198.51.100.1", "198.51.100.2", "198.51.100.4"} {
+		for _, port := range []uint16{443, 80} {
+			addFlow(outboundFlow(peer, port, "", 100))
+		}
+	}
+
+	for run := 0; run < 5; run++ {
+		var got []string
+		for _, e := range QueryNetFlowEntries(NetFlowQuery{Port: -1, SortBy: "bytes", Limit: 3}) {
+			got = append(got, e.DstIP+":"+e.Protocol+":"+strconv.Itoa(int(e.DstPort)))
+		}
+		if want := []string{"198.51.100.1:TCP:443", "198.51.100.1:TCP:80", "198.51.100.2:TCP:443"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("flows: %v, want %v", got, want)
+		}
+
+		var keys []string
+		for _, g := range GroupNetFlowEntries(NetFlowQuery{Port: -1, GroupBy: "remote_ip", SortBy: "flows", Limit: 2}) {
+			keys = append(keys, g.Key)
+		}
+		if want := []string{"198.51.100.1", "198.51.100.2"}; !reflect.DeepEqual(keys, want) {
+			t.Fatalf("groups: %v, want %v", keys, want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package collectors
+
+import (
+	"testing"
+	"time"
+)
+
+// resetFlows empties the flow buffer for a test and again when it ends.
+func resetFlows(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		netflowMu.Lock()
+		netflowBuffer = make(map[string]*NetFlowEntry)
+		netflowMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// testdata/flows.pcap holds a DNS lookup of www.example.com from
+// 192.0.2.10, followed by a TCP connection to the answer, 198.51.100.20:443:
+// handshake, 100 bytes up, 200 bytes down and a FIN from the client.
+func TestReplayPcapFile(t *testing.T) {
+	resetFlows(t)
+	if err := ReplayPcapFile("testdata/flows.pcap", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	flows := make(map[string]NetFlowEntry)
+	for _, e := range GetNetFlowEntries() {
+		flows[e.SrcIP+">"+e.DstIP+"/"+e.Protocol] = e
+	}
+	if len(flows) != 4 {
+		t.Fatalf("got %d flows, want 4: %+v", len(flows), flows)
+	}
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	up, ok := flows["192.0.2.10>198.51.100.20/TCP"]
+	if !ok {
+		t.Fatal("no client to server flow")
+	}
+	if up.Interface != "pcap:flows.pcap" || up.SrcPort != 40000 || up.DstPort != 443 {
+		t.Errorf("client flow: %+v", up)
+	}
+	if up.Packets != 4 || up.Bytes != 334 {
+		t.Errorf("client flow: %d packets, %d bytes, want 4 and 334", up.Packets, up.Bytes)
+	}
+	if !up.StartTime.Equal(base.Add(20*time.Millisecond)) || !up.EndTime.Equal(base.Add(90*time.Millisecond)) {
+		t.Errorf("client flow: %v - %v, want the capture timestamps", up.StartTime, up.EndTime)
+	}
+	if up.DstName != "www.example.com" {
+		t.Errorf("client flow: destination name %q, want the DNS answer", up.DstName)
+	}
+	if up.TCPFlags != "FIN,SYN,PSH,ACK" || up.HandshakeRTTMs != 25 || up.SamplingRate != 0 {
+		t.Errorf("client flow: flags %q, handshake %vms, sampling %d", up.TCPFlags, up.HandshakeRTTMs, up.SamplingRate)
+	}
+
+	down := flows["198.51.100.20>192.0.2.10/TCP"]
+	if down.Packets != 2 || down.Bytes != 314 || down.SrcName != "www.example.com" {
+		t.Errorf("server flow: %+v", down)
+	}
+	if q := flows["192.0.2.10>198.51.100.53/UDP"]; q.Packets != 1 || q.DstPort != 53 {
+		t.Errorf("DNS query flow: %+v", q)
+	}
+}
+
+func TestReplayPcapFileErrors(t *testing.T) {
+	resetFlows(t)
+	if err := ReplayPcapFile("testdata/missing.pcap", 0); err == nil {
+		t.Error("missing file: want an error")
+	}
+	if err := ReplayPcapFile("netflow_replay_test.go", 0); err == nil {
+		t.Error("not a capture file: want an error")
+	}
+	if n := len(GetNetFlowEntries()); n != 0 {
+		t.Errorf("%d flows after failed replays", n)
+	}
+}
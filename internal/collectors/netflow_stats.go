@@ -0,0 +1,97 @@
+package collectors
+
+import (
+	"sort"
+	"sync"
+)
+
+// CaptureStats reports the health of one capture interface. Kernel and
+// interface counters come from the capture backend and are accumulated
+// across reopens; DroppedInterface is only reported by pcap. Fanout
+// workers appear as "<interface>#<worker>".
+type CaptureStats struct {
+	Interface        string
+	Up               bool
+	PacketsReceived  uint64
+	DroppedKernel    uint64
+	DroppedInterface uint64
+	DecodeFailures   uint64
+	Restarts         uint64
+	LastError        string
+}
+
+// captureCounters holds the running totals for one interface. base holds
+// the totals of previous handles, since handle counters restart on reopen.
+type captureCounters struct {
+	stats  CaptureStats
+	base   CaptureStats
+	opened bool
+}
+
+var (
+	captureMu    sync.Mutex
+	captureState = make(map[string]*captureCounters)
+)
+
+func captureCountersFor(name string) *captureCounters {
+	c, ok := captureState[name]
+	if !ok {
+		c = &captureCounters{stats: CaptureStats{Interface: name}}
+		captureState[name] = c
+	}
+	return c
+}
+
+// setCaptureUp records a capture goroutine opening or losing its handle.
+func setCaptureUp(name string, up bool, err error) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	c := captureCountersFor(name)
+	if up {
+		if c.opened {
+			c.stats.Restarts++
+		}
+		c.opened = true
+	} else {
+		// Fold the closed handle's counters into the base.
+		c.base.PacketsReceived = c.stats.PacketsReceived
+		c.base.DroppedKernel = c.stats.DroppedKernel
+		c.base.DroppedInterface = c.stats.DroppedInterface
+	}
+	c.stats.Up = up
+	if err != nil {
+		c.stats.LastError = err.Error()
+	}
+}
+
+// recordHandleStats updates the counters from the current handle's totals.
+func recordHandleStats(name string, s handleStats) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	c := captureCountersFor(name)
+	c.stats.PacketsReceived = c.base.PacketsReceived + s.Received
+	c.stats.DroppedKernel = c.base.DroppedKernel + s.DroppedKernel
+	c.stats.DroppedInterface = c.base.DroppedInterface + s.DroppedInterface
+}
+
+func recordDecodeFailure(name string) {
+	captureMu.Lock()
+	captureCountersFor(name).stats.DecodeFailures++
+	captureMu.Unlock()
+}
+
+// GetCaptureStats returns the capture health of every interface that has
+// been opened or attempted, sorted by name.
+func GetCaptureStats() []CaptureStats {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	result := make([]CaptureStats, 0, len(captureState))
+	for _, c := range captureState {
+		result = append(result, c.stats)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Interface < result[j].Interface })
+	return result
+}
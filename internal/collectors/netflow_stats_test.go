@@ -0,0 +1,56 @@
+package collectors
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// failingHandle reports its counters and then fails the first read, like
+// an interface that went away.
+type failingHandle struct{ stats handleStats }
+
+func (h *failingHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, errors.New("interface went down")
+}
+func (h *failingHandle) LinkType() layers.LinkType   { return layers.LinkTypeEthernet }
+func (h *failingHandle) Stats() (handleStats, error) { return h.stats, nil }
+func (h *failingHandle) Close()                      {}
+
+func TestReadUntilErrorPollsStats(t *testing.T) {
+	const name = "test0"
+	t.Cleanup(func() {
+		captureMu.Lock()
+		delete(captureState, name)
+		captureMu.Unlock()
+	})
+
+	for _, h := range []*failingHandle{
+		{handleStats{Received: 100, DroppedKernel: 7}},
+		{handleStats{Received: 10, DroppedKernel: 1, DroppedInterface: 2}},
+	} {
+		setCaptureUp(name, true, nil)
+		err := readUntilError(h, "eth0", name, nil)
+		setCaptureUp(name, false, err)
+		if err == nil {
+			t.Fatal("readUntilError returned nil")
+		}
+	}
+
+	got := GetCaptureStats()
+	for _, s := range got {
+		if s.Interface != name {
+			continue
+		}
+		if s.Up || s.PacketsReceived != 110 || s.DroppedKernel != 8 || s.DroppedInterface != 2 || s.Restarts != 1 {
+			t.Errorf("stats: %+v", s)
+		}
+		if s.LastError != "interface went down" {
+			t.Errorf("last error %q", s.LastError)
+		}
+		return
+	}
+	t.Errorf("no stats for %s: %+v", name, got)
+}
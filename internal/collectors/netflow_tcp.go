@@ -0,0 +1,243 @@
+package collectors
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// tcpFlagNames is indexed by the bit recorded in NetFlowEntry.tcpFlagBits.
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG"}
+
+// TCP connection states reported on flows.
+const (
+	tcpStateSynSent     = "syn_sent"
+	tcpStateSynReceived = "syn_received"
+	tcpStateEstablished = "established"
+	tcpStateClosing     = "closing"
+	tcpStateClosed      = "closed"
+	tcpStateReset       = "reset"
+	tcpStateHalfOpen    = "half_open"
+)
+
+const (
+	// Handshakes not completed within this time are reported as half-open.
+	tcpHalfOpenTimeout = 10 * time.Second
+	// Idle connections are forgotten after this time.
+	tcpConnIdleTimeout = 5 * time.Minute
+	// Reordering window used until a handshake RTT is known.
+	tcpDefaultReorderWindow = 3 * time.Millisecond
+	// At most this many connections are tracked; segments of further
+	// connections only contribute their flags.
+	tcpMaxConns = 65536
+)
+
+// tcpDirection is the sequence state of one side of a connection.
+type tcpDirection struct {
+	seen    bool
+	nextSeq uint32    // highest sequence number sent plus one
+	lastTS  time.Time // when nextSeq last advanced
+	flowKey string
+	fin     bool
+}
+
+// tcpConn tracks both directions of a TCP connection so that handshake and
+// teardown, which span two unidirectional flows, can be followed.
+type tcpConn struct {
+	dirs     [2]tcpDirection
+	state    string
+	synAt    time.Time
+	synAckAt time.Time
+	rtt      time.Duration
+	// Wall-clock bookkeeping for the sweeper; packet timestamps may be
+	// historical when replaying a capture.
+	lastSeen    time.Time
+	handshakeAt time.Time
+}
+
+var (
+	// tcpConns is guarded by netflowMu, like the flow buffer it annotates.
+	tcpConns     = make(map[string]*tcpConn)
+	tcpSweepOnce sync.Once
+)
+
+// tcpConnKey orders the endpoints so both directions share one key. The
+// returned index is the direction of the packet within the connection.
+func tcpConnKey(iface, src, dst string, sport, dport uint16) (string, int) {
+	a := src + "|" + strconv.Itoa(int(sport))
+	b := dst + "|" + strconv.Itoa(int(dport))
+	if a > b {
+		return iface + "|" + b + "|" + a, 1
+	}
+	return iface + "|" + a + "|" + b, 0
+}
+
+func tcpFlagBits(t *layers.TCP) uint8 {
+	var f uint8
+	// Same order as tcpFlagNames.
+	for bit, set := range []bool{t.FIN, t.SYN, t.RST, t.PSH, t.ACK, t.URG} {
+		if set {
+			f |= 1 << bit
+		}
+	}
+	return f
+}
+
+func formatTCPFlags(f uint8) string {
+	var names []string
+	for bit, name := range tcpFlagNames {
+		if f&(1<<bit) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// seqLess compares sequence numbers with wraparound (RFC 1982).
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// trackTCP updates the connection state for a TCP segment and copies the
+// result onto the segment's flow. Sequence numbers are only followed for
+// unsampled flows, where every segment is seen. Must be called with
+// netflowMu held.
+func trackTCP(entry *NetFlowEntry, flowKey string, t *layers.TCP, ts time.Time) {
+	tcpSweepOnce.Do(func() { go sweepTCPConns() })
+
+	flags := tcpFlagBits(t)
+	entry.tcpFlagBits |= flags
+	entry.TCPFlags = formatTCPFlags(entry.tcpFlagBits)
+
+	key, dir := tcpConnKey(entry.Interface, entry.SrcIP, entry.DstIP, entry.SrcPort, entry.DstPort)
+	conn, ok := tcpConns[key]
+	if ok && t.SYN && !t.ACK && (conn.state == tcpStateReset || conn.state == tcpStateClosing || conn.state == tcpStateClosed) {
+		// The ports were reused for a new connection.
+		ok = false
+	}
+	if !ok {
+		if _, known := tcpConns[key]; !known && len(tcpConns) >= tcpMaxConns {
+			return
+		}
+		conn = &tcpConn{}
+		tcpConns[key] = conn
+	}
+	conn.lastSeen = time.Now()
+	d := &conn.dirs[dir]
+	d.flowKey = flowKey
+
+	switch {
+	case t.RST:
+		conn.state = tcpStateReset
+	case t.SYN && !t.ACK:
+		if conn.synAt.IsZero() {
+			conn.synAt, conn.handshakeAt = ts, conn.lastSeen
+		}
+		conn.state = tcpStateSynSent
+	case t.SYN && t.ACK:
+		if conn.synAckAt.IsZero() {
+			conn.synAckAt = ts
+			if conn.handshakeAt.IsZero() {
+				conn.handshakeAt = conn.lastSeen
+			}
+			if !conn.synAt.IsZero() {
+				// Seen from the client: SYN to SYN-ACK.
+				conn.rtt = ts.Sub(conn.synAt)
+			}
+		}
+		conn.state = tcpStateSynReceived
+	case t.FIN:
+		d.fin = true
+		conn.state = tcpStateClosing
+		if conn.dirs[0].fin && conn.dirs[1].fin {
+			conn.state = tcpStateClosed
+		}
+	case t.ACK && (conn.state == tcpStateSynReceived || conn.state == tcpStateHalfOpen):
+		if conn.rtt == 0 && !conn.synAckAt.IsZero() {
+			// Seen from the server: SYN-ACK to the final ACK.
+			conn.rtt = ts.Sub(conn.synAckAt)
+		}
+		conn.state = tcpStateEstablished
+	case conn.state == "" && t.ACK:
+		// Connection was already open when capture started.
+		conn.state = tcpStateEstablished
+	}
+
+	// Sequence space consumed by this segment; SYN and FIN count as one.
+	length := uint32(len(t.Payload))
+	if t.SYN || t.FIN {
+		length++
+	}
+	// A keepalive repeats the last byte sent, or carries none, one below
+	// the next sequence number.
+	keepalive := d.seen && length <= 1 && !t.SYN && !t.FIN && t.Seq == d.nextSeq-1
+	if length > 0 && entry.SamplingRate == 0 && !keepalive {
+		end := t.Seq + length
+		switch {
+		case !d.seen:
+			d.seen, d.nextSeq, d.lastTS = true, end, ts
+		case seqLess(t.Seq, d.nextSeq):
+			// Data below the high-water mark either fills a hole left by
+			// reordering or repeats data already sent.
+			window := conn.rtt
+			if window == 0 {
+				window = tcpDefaultReorderWindow
+			}
+			if ts.Sub(d.lastTS) < window {
+				entry.OutOfOrder++
+				countTCPAnomaly(false)
+			} else {
+				entry.Retransmissions++
+				countTCPAnomaly(true)
+			}
+			if seqLess(d.nextSeq, end) {
+				d.nextSeq, d.lastTS = end, ts
+			}
+		default:
+			d.nextSeq, d.lastTS = end, ts
+		}
+	}
+
+	applyTCPConn(entry, conn)
+	// Keep the reverse flow's view of the shared state current.
+	if other := netflowBuffer[conn.dirs[1-dir].flowKey]; other != nil {
+		applyTCPConn(other, conn)
+	}
+}
+
+func applyTCPConn(e *NetFlowEntry, conn *tcpConn) {
+	e.TCPState = conn.state
+	if conn.rtt > 0 {
+		e.HandshakeRTTMs = float64(conn.rtt) / float64(time.Millisecond)
+	}
+}
+
+// sweepTCPConns marks stalled handshakes as half-open and forgets idle
+// connections.
+func sweepTCPConns() {
+	for {
+		time.Sleep(tcpHalfOpenTimeout)
+		now := time.Now()
+
+		netflowMu.Lock()
+		for key, conn := range tcpConns {
+			if now.Sub(conn.lastSeen) > tcpConnIdleTimeout {
+				delete(tcpConns, key)
+				continue
+			}
+			stalled := conn.state == tcpStateSynSent || conn.state == tcpStateSynReceived
+			if stalled && now.Sub(conn.handshakeAt) > tcpHalfOpenTimeout {
+				conn.state = tcpStateHalfOpen
+				for _, d := range conn.dirs {
+					if e := netflowBuffer[d.flowKey]; e != nil {
+						applyTCPConn(e, conn)
+					}
+				}
+			}
+		}
+		netflowMu.Unlock()
+	}
+}
@@ -0,0 +1,145 @@
+package collectors
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// tcpTest feeds segments of one connection to trackTCP, keeping a flow
+// entry per direction as processPacket would.
+type tcpTest struct {
+	t     *testing.T
+	start time.Time
+	flows map[bool]*NetFlowEntry // by "sent by the client"
+}
+
+func newTCPTest(t *testing.T, sampling int) *tcpTest {
+	resetFlows(t)
+	netflowMu.Lock()
+	saved := tcpConns
+	tcpConns = make(map[string]*tcpConn)
+	netflowMu.Unlock()
+	t.Cleanup(func() {
+		netflowMu.Lock()
+		tcpConns = saved
+		netflowMu.Unlock()
+	})
+
+	tt := &tcpTest{t: t, start: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), flows: make(map[bool]*NetFlowEntry)}
+	for _, client := range []bool{true, false} {
+		e := &NetFlowEntry{Interface: "eth0", SrcIP: "192.0.2.10", DstIP: "198.51.100.20", SrcPort: 40000, DstPort: 443, Protocol: "TCP", SamplingRate: sampling}
+		if !client {
+			e.SrcIP, e.DstIP, e.SrcPort, e.DstPort = e.DstIP, e.SrcIP, e.DstPort, e.SrcPort
+		}
+		tt.flows[client] = e
+		netflowBuffer[tt.key(client)] = e
+	}
+	return tt
+}
+
+func (tt *tcpTest) key(client bool) string {
+	e := tt.flows[client]
+	return makeFlowKey(e.Interface, e.SrcIP, e.DstIP, e.SrcPort, e.DstPort, e.Protocol, e.Direction)
+}
+
+// send passes a segment at offset at; flags is a subset of "SAFR" (SYN,
+// ACK, FIN, RST).
+func (tt *tcpTest) send(client bool, at time.Duration, flags string, seq uint32, payload int) {
+	seg := &layers.TCP{Seq: seq}
+	for _, f := range flags {
+		switch f {
+		case 'S':
+			seg.SYN = true
+		case 'A':
+			seg.ACK = true
+		case 'F':
+			seg.FIN = true
+		case 'R':
+			seg.RST = true
+		}
+	}
+	seg.Payload = make([]byte, payload)
+	netflowMu.Lock()
+	trackTCP(tt.flows[client], tt.key(client), seg, tt.start.Add(at))
+	netflowMu.Unlock()
+}
+
+func (tt *tcpTest) handshake(at time.Duration, rtt time.Duration) {
+	tt.send(true, at, "S", 999, 0)
+	tt.send(false, at+rtt, "SA", 4999, 0)
+	tt.send(true, at+rtt+time.Millisecond, "A", 1000, 0)
+}
+
+func TestTrackTCPKeepalive(t *testing.T) {
+	tt := newTCPTest(t, 0)
+	tt.handshake(0, 20*time.Millisecond)
+	tt.send(true, 100*time.Millisecond, "A", 1000, 100)
+	// Keepalives, with and without a garbage byte, repeat seq 1099.
+	tt.send(true, 60*time.Second, "A", 1099, 0)
+	tt.send(true, 120*time.Second, "A", 1099, 1)
+	if e := tt.flows[true]; e.Retransmissions != 0 || e.OutOfOrder != 0 {
+		t.Errorf("keepalives counted: %d retransmissions, %d out of order", e.Retransmissions, e.OutOfOrder)
+	}
+	tt.send(true, 121*time.Second, "A", 1000, 100)
+	if e := tt.flows[true]; e.Retransmissions != 1 {
+		t.Errorf("retransmissions = %d, want 1", e.Retransmissions)
+	}
+}
+
+func TestTrackTCPSampled(t *testing.T) {
+	tt := newTCPTest(t, 100)
+	tt.handshake(0, 20*time.Millisecond)
+	tt.send(true, 100*time.Millisecond, "A", 1000, 100)
+	tt.send(true, 900*time.Millisecond, "A", 500, 100)
+	if e := tt.flows[true]; e.Retransmissions != 0 || e.OutOfOrder != 0 {
+		t.Errorf("sampled flow: %d retransmissions, %d out of order", e.Retransmissions, e.OutOfOrder)
+	}
+	if e := tt.flows[true]; e.TCPState != tcpStateEstablished || e.HandshakeRTTMs != 20 {
+		t.Errorf("sampled flow: state %q, handshake %vms", e.TCPState, e.HandshakeRTTMs)
+	}
+}
+
+func TestTrackTCPPortReuse(t *testing.T) {
+	for _, end := range []string{"R", "FA"} {
+		t.Run(end, func(t *testing.T) {
+			tt := newTCPTest(t, 0)
+			tt.handshake(0, 20*time.Millisecond)
+			tt.send(true, time.Second, end, 1000, 0)
+			if end == "FA" {
+				tt.send(false, time.Second, end, 5000, 0)
+			}
+
+			tt.handshake(5*time.Second, 50*time.Millisecond)
+			e := tt.flows[true]
+			if e.TCPState != tcpStateEstablished || e.HandshakeRTTMs != 50 {
+				t.Errorf("reused ports: state %q, handshake %vms, want established and 50ms", e.TCPState, e.HandshakeRTTMs)
+			}
+			if e.Retransmissions != 0 {
+				t.Errorf("reused ports: %d retransmissions", e.Retransmissions)
+			}
+		})
+	}
+}
+
+func TestTrackTCPMaxConns(t *testing.T) {
+	tt := newTCPTest(t, 0)
+	netflowMu.Lock()
+	for i := 0; i < tcpMaxConns; i++ {
+		tcpConns[strconv.Itoa(i)] = &tcpConn{}
+	}
+	netflowMu.Unlock()
+
+	tt.handshake(0, 20*time.Millisecond)
+	netflowMu.Lock()
+	n := len(tcpConns)
+	netflowMu.Unlock()
+	if n != tcpMaxConns {
+		t.Errorf("%d connections tracked, want %d", n, tcpMaxConns)
+	}
+	if e := tt.flows[true]; e.TCPFlags != "SYN,ACK" || e.TCPState != "" {
+		t.Errorf("untracked connection: flags %q, state %q", e.TCPFlags, e.TCPState)
+	}
+}
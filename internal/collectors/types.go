@@ -23,3 +23,17 @@ type EventLogStats struct {
 	InformationCount uint64
 	OtherCount       uint64
 }
+
+// PageFileUsage holds page file usage data (Windows-only).
+type PageFileUsage struct {
+	PageFile string
+	UsagePct float64
+}
+
+// ServiceInfo holds Windows service information.
+type ServiceInfo struct {
+	Name       string
+	Display    string
+	StateValue int
+	StartValue int
+}
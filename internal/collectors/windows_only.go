@@ -59,20 +59,6 @@ func GetThermalZoneTemps() []ThermalZoneTemp {
 	}
 }
 
-// PageFileUsage holds page file usage data (Windows-only).
-type PageFileUsage struct {
-	PageFile string
-	UsagePct float64
-}
-
-// ServiceInfo holds Windows service information.
-type ServiceInfo struct {
-	Name       string
-	Display    string
-	StateValue int
-	StartValue int
-}
-
 // GetPageFileUsage returns example page file usage data.
 func GetPageFileUsage() []PageFileUsage {
 	return []PageFileUsage{
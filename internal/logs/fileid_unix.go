@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package logs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func openFile(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+// fileID identifies a file independently of its name, so that a rotated
+// file can be recognised after it has been renamed.
+func fileID(f *os.File) (string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	return statID(fi)
+}
+
+func pathID(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return statID(fi)
+}
+
+func statID(fi os.FileInfo) (string, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no inode for %s", fi.Name())
+	}
+	return fmt.Sprintf("%x:%x", st.Dev, st.Ino), nil
+}
@@ -0,0 +1,525 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalSource is Record.Source for entries from the systemd journal.
+const JournalSource = "journal"
+
+const (
+	defaultCursorFile   = "journal_cursor"
+	journalPollInterval = 250 * time.Millisecond
+)
+
+// JournalOptions configures the systemd journal input. Entries are read
+// from the journal files directly; journalctl, in export format, reads
+// them instead when the files cannot be opened or use a compression this
+// reader does not support (XZ or LZ4).
+type JournalOptions struct {
+	Enabled     bool     `json:"enabled"`
+	Units       []string `json:"units"`       // systemd units, e.g. "nginx.service"; empty reads all
+	Identifiers []string `json:"identifiers"` // SYSLOG_IDENTIFIER values
+	Priority    string   `json:"priority"`    // most verbose priority read, e.g. "warning" or "4"
+	StartAt     string   `json:"start_at"`    // "end" (default) or "beginning", without a saved cursor
+	CursorFile  string   `json:"cursor_file"` // default "journal_cursor", relative to the executable
+	Reader      string   `json:"reader"`      // "auto" (default), "files" or "journalctl"
+	Directory   string   `json:"directory"`   // journal files; default this machine's in /var/log/journal and /run/log/journal
+	Journalctl  string   `json:"journalctl"`  // default "journalctl" from PATH
+}
+
+// journalFields maps journal fields to record fields.
+var journalFields = map[string]string{
+	"_SYSTEMD_UNIT":     "unit",
+	"SYSLOG_IDENTIFIER": "identifier",
+	"_PID":              "pid",
+	"_COMM":             "comm",
+	"_HOSTNAME":         "hostname",
+	"_TRANSPORT":        "transport",
+	"PRIORITY":          "priority",
+}
+
+// journalReader follows the journal files, or journalctl, and
+// acknowledges entries by saving their cursor.
+type journalReader struct {
+	opts     JournalOptions
+	dirs     []string
+	units    []string
+	useFiles bool
+	fallback bool // switch to journalctl if the files are unsupported
+	out      chan<- Record
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	acked   string        // cursor of the last acknowledged entry
+	ackedAt journalCursor // its position, to ignore acks arriving late
+	saved   string        // cursor last written to CursorFile
+	resumed string        // cursor of the last entry sent, to restart after
+}
+
+// withDefaults checks the options and fills in defaults; unit names are
+// completed as journalUnits does.
+func (o JournalOptions) withDefaults() (JournalOptions, error) {
+	if runtime.GOOS != "linux" {
+		return o, fmt.Errorf("logs.journal: the journal input is only supported on Linux")
+	}
+	switch o.StartAt {
+	case "":
+		o.StartAt = "end"
+	case "end", "beginning":
+	default:
+		return o, fmt.Errorf("logs.journal: unknown start_at %q (want end or beginning)", o.StartAt)
+	}
+	if o.Priority != "" {
+		if _, ok := journalPriority(o.Priority); !ok {
+			return o, fmt.Errorf("logs.journal: unknown priority %q", o.Priority)
+		}
+	}
+	switch o.Reader {
+	case "":
+		o.Reader = "auto"
+	case "auto", "files", "journalctl":
+	default:
+		return o, fmt.Errorf("logs.journal: unknown reader %q (want auto, files or journalctl)", o.Reader)
+	}
+	if o.CursorFile == "" {
+		o.CursorFile = defaultCursorFile
+	}
+	o.CursorFile = stateFile(o.CursorFile)
+	if o.Journalctl == "" {
+		o.Journalctl = "journalctl"
+	}
+	units, err := journalUnits(o.Units)
+	if err != nil {
+		return o, err
+	}
+	o.Units = units
+	return o, nil
+}
+
+func startJournal(o JournalOptions, out chan<- Record) (*journalReader, error) {
+	o, err := o.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	j := &journalReader{opts: o, units: o.Units, out: out, stop: make(chan struct{}), done: make(chan struct{})}
+	j.dirs = journalDirs()
+	if o.Directory != "" {
+		j.dirs = []string{o.Directory}
+	}
+	_, lookErr := exec.LookPath(o.Journalctl)
+	switch o.Reader {
+	case "auto":
+		j.useFiles = journalFilesReadable(j.dirs)
+		if !j.useFiles && lookErr != nil {
+			return nil, fmt.Errorf("logs.journal: no readable journal files in %s, and %v", strings.Join(j.dirs, ", "), lookErr)
+		}
+		j.fallback = lookErr == nil
+	case "files":
+		j.useFiles = true
+	case "journalctl":
+		if lookErr != nil {
+			return nil, fmt.Errorf("logs.journal: %v", lookErr)
+		}
+	}
+	if b, err := os.ReadFile(o.CursorFile); err == nil {
+		j.acked = strings.TrimSpace(string(b))
+		j.ackedAt, _ = parseJournalCursor(j.acked)
+		j.saved, j.resumed = j.acked, j.acked
+	}
+	go j.run()
+	go j.saveEvery(positionsSyncEvery)
+	return j, nil
+}
+
+// journalUnits completes unit names as journalctl does, adding ".service"
+// to names without a type, and checks the patterns.
+func journalUnits(units []string) ([]string, error) {
+	var out []string
+	for _, u := range units {
+		if !strings.Contains(u, ".") {
+			u += ".service"
+		}
+		if _, err := path.Match(u, ""); err != nil {
+			return nil, fmt.Errorf("logs.journal: invalid unit %q: %v", u, err)
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// journalPriority converts a priority name or number to its number.
+func journalPriority(p string) (int, bool) {
+	if n, err := strconv.Atoi(p); err == nil && n >= 0 && n < len(syslogSeverities) {
+		return n, true
+	}
+	for i, name := range syslogSeverities {
+		if name == p {
+			return i, true
+		}
+	}
+	switch p {
+	case "emergency":
+		return 0, true
+	case "critical":
+		return 2, true
+	case "error":
+		return 3, true
+	}
+	return 0, false
+}
+
+// args builds the journalctl command line, resuming after cursor if set.
+func (j *journalReader) args(cursor string) []string {
+	args := []string{"--output=export", "--follow", "--no-pager"}
+	switch {
+	case cursor != "":
+		args = append(args, "--after-cursor="+cursor)
+	case j.opts.StartAt == "beginning":
+		args = append(args, "--no-tail")
+	default:
+		args = append(args, "--lines=0")
+	}
+	for _, u := range j.opts.Units {
+		args = append(args, "--unit="+u)
+	}
+	for _, id := range j.opts.Identifiers {
+		args = append(args, "--identifier="+id)
+	}
+	if j.opts.Priority != "" {
+		p, _ := journalPriority(j.opts.Priority)
+		args = append(args, "--priority="+strconv.Itoa(p))
+	}
+	return args
+}
+
+// run keeps reading, restarting after the last entry sent when the
+// reader fails.
+func (j *journalReader) run() {
+	defer close(j.done)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		var err error
+		if j.useFiles {
+			err = j.readFiles()
+		} else {
+			err = j.follow()
+		}
+		if j.stopping() {
+			return
+		}
+		if j.useFiles && j.fallback && errors.Is(err, errJournalUnsupported) {
+			log.Printf("Reading the journal through journalctl: %v", err)
+			j.useFiles = false
+			continue
+		}
+		recordJournalRestart()
+		if j.useFiles {
+			log.Printf("Error reading the journal files: %v (restarting)", err)
+		} else {
+			log.Printf("journalctl exited: %v (restarting)", err)
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-j.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// readFiles polls the journal files and sends their new entries until it
+// fails or the reader stops.
+func (j *journalReader) readFiles() error {
+	j.mu.Lock()
+	cursor := j.resumed
+	j.mu.Unlock()
+	js := newJournalFiles(j.dirs, cursor, j.opts.StartAt == "end")
+	defer js.close()
+	t := time.NewTicker(journalPollInterval)
+	defer t.Stop()
+	for {
+		err := js.poll(func(entry map[string]string) bool {
+			return !j.matches(entry) || j.send(entry)
+		})
+		if err != nil || j.stopping() {
+			return err
+		}
+		select {
+		case <-j.stop:
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// matches applies the units, identifiers and priority options to an entry
+// from the files; journalctl applies them itself. Units match as with
+// journalctl --unit, including systemd's messages about the unit.
+func (j *journalReader) matches(entry map[string]string) bool {
+	if len(j.units) > 0 && !matchesUnit(j.units, entry) {
+		return false
+	}
+	if len(j.opts.Identifiers) > 0 && !containsString(j.opts.Identifiers, entry["SYSLOG_IDENTIFIER"]) {
+		return false
+	}
+	if j.opts.Priority != "" {
+		max, _ := journalPriority(j.opts.Priority)
+		p, err := strconv.Atoi(entry["PRIORITY"])
+		if err != nil || p > max {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesUnit(units []string, entry map[string]string) bool {
+	for _, field := range []string{"_SYSTEMD_UNIT", "UNIT", "OBJECT_SYSTEMD_UNIT", "COREDUMP_UNIT"} {
+		v, ok := entry[field]
+		if !ok {
+			continue
+		}
+		for _, u := range units {
+			if ok, _ := path.Match(u, v); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// send passes an entry on, first waiting while an acknowledging sink is
+// behind. It returns false once the reader is stopping.
+func (j *journalReader) send(entry map[string]string) bool {
+	r := journalRecord(entry)
+	cursor := entry["__CURSOR"]
+	if cursor != "" {
+		r.ack = func() { j.ack(cursor) }
+		if !waitForSinks(j.stop) {
+			return false
+		}
+	}
+	select {
+	case j.out <- r:
+		recordJournalEntry()
+		j.mu.Lock()
+		j.resumed = cursor
+		j.mu.Unlock()
+		return true
+	case <-j.stop:
+		return false
+	}
+}
+
+// follow runs journalctl once and sends its entries until it exits.
+func (j *journalReader) follow() error {
+	j.mu.Lock()
+	cmd := exec.Command(j.opts.Journalctl, j.args(j.resumed)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		j.mu.Unlock()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		j.mu.Unlock()
+		return err
+	}
+	j.cmd = cmd
+	j.mu.Unlock()
+
+	er := newExportReader(stdout)
+	for {
+		entry, err := er.next()
+		if err != nil {
+			stdout.Close()
+			werr := cmd.Wait()
+			if err == io.EOF {
+				err = werr
+			}
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = fmt.Errorf("%v: %s", err, msg)
+			}
+			return err
+		}
+		if !j.send(entry) {
+			stdout.Close()
+			cmd.Wait()
+			return nil
+		}
+	}
+}
+
+// journalRecord converts an entry to a record: MESSAGE is the line and
+// the fields in journalFields are kept.
+func journalRecord(entry map[string]string) Record {
+	r := Record{Time: time.Now(), Source: JournalSource, Line: entry["MESSAGE"]}
+	if us, err := strconv.ParseInt(entry["__REALTIME_TIMESTAMP"], 10, 64); err == nil {
+		r.Time = time.UnixMicro(us)
+	}
+	for from, to := range journalFields {
+		if v, ok := entry[from]; ok {
+			setField(&r, to, v)
+		}
+	}
+	if p, err := strconv.Atoi(entry["PRIORITY"]); err == nil && p >= 0 && p < len(syslogSeverities) {
+		setField(&r, "severity", syslogSeverities[p])
+	}
+	return r
+}
+
+// ack records cursor as acknowledged unless a later entry already is;
+// sinks may acknowledge out of order.
+func (j *journalReader) ack(cursor string) {
+	at, ok := parseJournalCursor(cursor)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if ok && j.acked != "" && j.ackedAt.covers(at.seqnumID, at.seqnum, at.realtime) {
+		return
+	}
+	j.acked, j.ackedAt = cursor, at
+}
+
+// saveCursor writes the last acknowledged cursor if it changed.
+func (j *journalReader) saveCursor() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.acked == j.saved {
+		return
+	}
+	tmp := j.opts.CursorFile + ".tmp"
+	err := os.WriteFile(tmp, []byte(j.acked+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, j.opts.CursorFile)
+	}
+	if err != nil {
+		log.Printf("Error saving journal cursor: %v", err)
+		return
+	}
+	j.saved = j.acked
+}
+
+func (j *journalReader) saveEvery(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-t.C:
+			j.saveCursor()
+		}
+	}
+}
+
+func (j *journalReader) stopping() bool {
+	select {
+	case <-j.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops reading and saves the cursor.
+func (j *journalReader) Close() {
+	close(j.stop)
+	j.mu.Lock()
+	if j.cmd != nil && j.cmd.Process != nil {
+		j.cmd.Process.Kill()
+	}
+	j.mu.Unlock()
+	<-j.done
+	j.saveCursor()
+}
+
+// savePositions saves the cursor; see SavePositions.
+func (j *journalReader) savePositions() {
+	j.saveCursor()
+}
+
+var errExportFormat = errors.New("invalid journal export format")
+
+// exportReader reads entries in the journal export format, as written by
+// "journalctl -o export": "NAME=value" lines, or for binary values the
+// name, a newline, a little-endian 64-bit length, the data and a newline.
+// Entries end with an empty line.
+type exportReader struct {
+	br *bufio.Reader
+}
+
+func newExportReader(r io.Reader) *exportReader {
+	return &exportReader{br: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// next returns the next entry, or io.EOF after the last one.
+func (e *exportReader) next() (map[string]string, error) {
+	entry := make(map[string]string)
+	for {
+		line, err := e.br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && len(entry) > 0 && line == "" {
+				return entry, nil
+			}
+			if err == io.EOF && line != "" {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = line[:len(line)-1]
+		if line == "" {
+			if len(entry) == 0 {
+				continue
+			}
+			return entry, nil
+		}
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			entry[line[:eq]] = line[eq+1:]
+			continue
+		}
+		var size uint64
+		if err := binary.Read(e.br, binary.LittleEndian, &size); err != nil {
+			return nil, errExportFormat
+		}
+		if size > 64<<20 {
+			return nil, errExportFormat
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(e.br, data); err != nil || data[size] != '\n' {
+			return nil, errExportFormat
+		}
+		entry[line] = string(data[:size])
+	}
+}
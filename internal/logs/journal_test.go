@@ -0,0 +1,385 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestExportReader(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/journal.export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	er := newExportReader(bytes.NewReader(fixture))
+	first, err := er.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first["MESSAGE"] != "upstream timed out (110: Connection timed out)" || first["_SYSTEMD_UNIT"] != "nginx.service" || len(first) != 6 {
+		t.Errorf("first entry = %v", first)
+	}
+	second, err := er.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"__CURSOR":             "s=739f5ad3e0bb4b2a9b6b0a0d0e6c1f11;i=1b;b=2f4c7b0c1d2e4f5a8b9c0d1e2f3a4b5c;m=3b9aca10;t=5f2a1b3c4d5f6;x=8877665544332211",
+		"__REALTIME_TIMESTAMP": "1672574400000016",
+		"_SYSTEMD_UNIT":        "app.service",
+		"MESSAGE":              "panic: runtime error\n\ngoroutine 1 [running]:",
+		"EMPTY":                "",
+	}
+	if !reflect.DeepEqual(second, want) {
+		t.Errorf("binary entry = %q, want %q", second, want)
+	}
+	if _, err := er.next(); err != io.EOF {
+		t.Errorf("after the last entry: %v, want EOF", err)
+	}
+
+	binaryAt := bytes.Index(fixture, []byte("MESSAGE\n"))
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"truncated line", fixture[:bytes.Index(fixture, []byte("PRIORITY"))+4], io.ErrUnexpectedEOF},
+		{"truncated size", fixture[:binaryAt+12], errExportFormat},
+		{"truncated binary value", fixture[:binaryAt+30], errExportFormat},
+		{"binary value without newline", append(fixture[:binaryAt+16+44:binaryAt+16+44], 'x'), errExportFormat},
+		{"over the size cap", binaryField("MESSAGE", 64<<20+1, ""), errExportFormat},
+	}
+	for _, tt := range tests {
+		er := newExportReader(bytes.NewReader(tt.input))
+		var err error
+		for err == nil {
+			_, err = er.next()
+		}
+		if err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// binaryField encodes a field in the export format's binary form with the
+// given declared size.
+func binaryField(name string, size uint64, value string) []byte {
+	var b bytes.Buffer
+	b.WriteString(name + "\n")
+	binary.Write(&b, binary.LittleEndian, size)
+	b.WriteString(value)
+	return b.Bytes()
+}
+
+// testJournal builds a journal file the way journald appends to one: the
+// entry's data objects, the entry, then its offset in an entry array.
+// Arrays hold two entries so that files span several.
+type testJournal struct {
+	b       []byte
+	compact bool
+	array   uint64 // offset of the last entry array
+	used    int    // entries in it
+	n       uint64
+}
+
+func newTestJournal(fileID, seqnumID byte, compact bool) *testJournal {
+	w := &testJournal{b: make([]byte, 208), compact: compact}
+	copy(w.b, journalSignature)
+	flags := uint32(journalCompressedZstd)
+	if compact {
+		flags |= journalCompact
+	}
+	binary.LittleEndian.PutUint32(w.b[12:], flags)
+	w.b[16] = 1 // online
+	copy(w.b[24:40], bytes.Repeat([]byte{fileID}, 16))
+	copy(w.b[72:88], bytes.Repeat([]byte{seqnumID}, 16))
+	binary.LittleEndian.PutUint64(w.b[88:], 208)
+	return w
+}
+
+func (w *testJournal) put(off uint64, v uint64) {
+	binary.LittleEndian.PutUint64(w.b[off:], v)
+}
+
+func (w *testJournal) object(typ, flags byte, payload []byte) uint64 {
+	off := uint64(len(w.b))
+	hdr := make([]byte, objectHeaderSize)
+	hdr[0], hdr[1] = typ, flags
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(objectHeaderSize+len(payload)))
+	w.b = append(append(w.b, hdr...), payload...)
+	for len(w.b)%8 != 0 {
+		w.b = append(w.b, 0)
+	}
+	return off
+}
+
+func (w *testJournal) itemSize() int {
+	if w.compact {
+		return 4
+	}
+	return 8
+}
+
+// add appends an entry. Fields longer than 64 bytes are compressed with
+// zstd, as journald compresses large fields.
+func (w *testJournal) add(seqnum, realtime uint64, fields ...string) {
+	dataHeader := make([]byte, 48)
+	if w.compact {
+		dataHeader = make([]byte, 56)
+	}
+	var items []uint64
+	for _, f := range fields {
+		var flags byte
+		payload := []byte(f)
+		if len(f) > 64 {
+			enc, _ := zstd.NewWriter(nil)
+			payload, flags = enc.EncodeAll(payload, nil), objectCompressedZstd
+		}
+		items = append(items, w.object(objectData, flags, append(append([]byte{}, dataHeader...), payload...)))
+	}
+	entry := make([]byte, entryHeaderSize-objectHeaderSize)
+	binary.LittleEndian.PutUint64(entry[0:], seqnum)
+	binary.LittleEndian.PutUint64(entry[8:], realtime)
+	binary.LittleEndian.PutUint64(entry[16:], seqnum*1000)
+	copy(entry[24:40], bytes.Repeat([]byte{0xbb}, 16))
+	binary.LittleEndian.PutUint64(entry[40:], seqnum^0xff)
+	for _, off := range items {
+		if w.compact {
+			entry = binary.LittleEndian.AppendUint32(entry, uint32(off))
+		} else {
+			entry = binary.LittleEndian.AppendUint64(entry, off)
+			entry = binary.LittleEndian.AppendUint64(entry, 0)
+		}
+	}
+	entryAt := w.object(objectEntry, 0, entry)
+
+	if w.array == 0 || w.used == 2 {
+		array := w.object(objectEntryArray, 0, make([]byte, 8+2*w.itemSize()))
+		if w.array == 0 {
+			w.put(176, array)
+		} else {
+			w.put(w.array+16, array)
+		}
+		w.array, w.used = array, 0
+	}
+	item := w.array + arrayHeaderSize + uint64(w.used*w.itemSize())
+	if w.compact {
+		binary.LittleEndian.PutUint32(w.b[item:], uint32(entryAt))
+	} else {
+		w.put(item, entryAt)
+	}
+	w.used++
+	w.n++
+	w.put(152, w.n)
+	w.put(160, seqnum)
+	w.put(192, realtime)
+}
+
+func (w *testJournal) write(t *testing.T, path string) {
+	t.Helper()
+	w.put(96, uint64(len(w.b)-208))
+	if err := os.WriteFile(path, w.b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pollMessages polls and returns the MESSAGE of each entry.
+func pollMessages(t *testing.T, js *journalFiles) ([]string, []map[string]string) {
+	t.Helper()
+	var msgs []string
+	var entries []map[string]string
+	err := js.poll(func(e map[string]string) bool {
+		msgs = append(msgs, e["MESSAGE"])
+		entries = append(entries, e)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs, entries
+}
+
+func TestJournalFiles(t *testing.T) {
+	for _, compact := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compact=%v", compact), func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "0123456789abcdef")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			active := filepath.Join(dir, "system.journal")
+			long := "MESSAGE=" + strings.Repeat("long line ", 20)
+			w := newTestJournal(1, 0xaa, compact)
+			w.add(1, 1000, "MESSAGE=one", "PRIORITY=6")
+			w.add(2, 2000, "MESSAGE=two\nlines", "_SYSTEMD_UNIT=app.service")
+			w.add(3, 3000, long)
+			w.write(t, active)
+
+			js := newJournalFiles([]string{root}, "", false)
+			defer js.close()
+			msgs, entries := pollMessages(t, js)
+			want := []string{"one", "two\nlines", long[len("MESSAGE="):]}
+			if !reflect.DeepEqual(msgs, want) {
+				t.Fatalf("messages %q, want %q", msgs, want)
+			}
+			id := strings.Repeat("aa", 16)
+			if c := entries[0]["__CURSOR"]; c != "s="+id+";i=1;b="+strings.Repeat("bb", 16)+";m=3e8;t=3e8;x=fe" {
+				t.Errorf("cursor = %s", c)
+			}
+			if entries[0]["__REALTIME_TIMESTAMP"] != "1000" || entries[0]["PRIORITY"] != "6" {
+				t.Errorf("entry = %v", entries[0])
+			}
+			cursor2 := entries[1]["__CURSOR"]
+
+			// The file grows; only the new entries are read.
+			w.add(4, 4000, "MESSAGE=four")
+			w.add(5, 5000, "MESSAGE=five")
+			w.write(t, active)
+			if msgs, _ := pollMessages(t, js); !reflect.DeepEqual(msgs, []string{"four", "five"}) {
+				t.Errorf("after growing: %q", msgs)
+			}
+
+			// journald archives the file and starts a new one in the same
+			// sequence.
+			w.b[16] = journalStateArchived
+			w.write(t, active)
+			if err := os.Rename(active, filepath.Join(dir, "system@"+id+"-1-1.journal")); err != nil {
+				t.Fatal(err)
+			}
+			w2 := newTestJournal(2, 0xaa, compact)
+			w2.add(6, 6000, "MESSAGE=six")
+			w2.write(t, active)
+			if msgs, _ := pollMessages(t, js); !reflect.DeepEqual(msgs, []string{"six"}) {
+				t.Errorf("after rotating: %q", msgs)
+			}
+			if len(js.files) != 1 {
+				t.Errorf("%d files open, want only the active one", len(js.files))
+			}
+
+			resumed := newJournalFiles([]string{root}, cursor2, false)
+			defer resumed.close()
+			if msgs, _ := pollMessages(t, resumed); !reflect.DeepEqual(msgs, []string{long[len("MESSAGE="):], "four", "five", "six"}) {
+				t.Errorf("resumed after entry 2: %q", msgs)
+			}
+
+			atEnd := newJournalFiles([]string{root}, "", true)
+			defer atEnd.close()
+			if msgs, _ := pollMessages(t, atEnd); len(msgs) != 0 {
+				t.Errorf("starting at the end read %q", msgs)
+			}
+			w2.add(7, 7000, "MESSAGE=seven")
+			w2.write(t, active)
+			if msgs, _ := pollMessages(t, atEnd); !reflect.DeepEqual(msgs, []string{"seven"}) {
+				t.Errorf("after starting at the end: %q", msgs)
+			}
+		})
+	}
+}
+
+func TestJournalFilesMerge(t *testing.T) {
+	dir := t.TempDir()
+	system := newTestJournal(1, 0xaa, true)
+	user := newTestJournal(2, 0xaa, true)
+	system.add(1, 100, "MESSAGE=1")
+	user.add(2, 200, "MESSAGE=2")
+	system.add(3, 300, "MESSAGE=3")
+	system.add(4, 400, "MESSAGE=4")
+	user.add(5, 500, "MESSAGE=5")
+	system.write(t, filepath.Join(dir, "system.journal"))
+	user.write(t, filepath.Join(dir, "user-1000.journal"))
+
+	js := newJournalFiles([]string{dir}, "", false)
+	defer js.close()
+	if msgs, _ := pollMessages(t, js); !reflect.DeepEqual(msgs, []string{"1", "2", "3", "4", "5"}) {
+		t.Errorf("merged %q", msgs)
+	}
+}
+
+func TestJournalFilesUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestJournal(1, 0xaa, true)
+	w.add(1, 100, "MESSAGE=lz4")
+	// Mark the data object as LZ4 compressed.
+	w.b[208+1] = objectCompressedLZ4
+	w.write(t, filepath.Join(dir, "system.journal"))
+
+	js := newJournalFiles([]string{dir}, "", false)
+	defer js.close()
+	err := js.poll(func(map[string]string) bool { return true })
+	if !errors.Is(err, errJournalUnsupported) {
+		t.Errorf("got %v, want errJournalUnsupported", err)
+	}
+
+	bad := newTestJournal(1, 0xaa, true)
+	binary.LittleEndian.PutUint32(bad.b[12:], 1<<10)
+	bad.write(t, filepath.Join(dir, "system.journal"))
+	if err := newJournalFiles([]string{dir}, "", false).poll(func(map[string]string) bool { return true }); !errors.Is(err, errJournalUnsupported) {
+		t.Errorf("unknown flags: got %v, want errJournalUnsupported", err)
+	}
+}
+
+func TestJournalFilesCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestJournal(1, 0xaa, true)
+	w.add(1, 100, "MESSAGE=ok")
+	w.add(2, 200, "MESSAGE=broken")
+	// Point the second entry's array slot past the end of the file.
+	binary.LittleEndian.PutUint32(w.b[w.array+arrayHeaderSize+4:], 1<<20)
+	w.write(t, filepath.Join(dir, "system.journal"))
+
+	js := newJournalFiles([]string{dir}, "", false)
+	defer js.close()
+	if msgs, _ := pollMessages(t, js); !reflect.DeepEqual(msgs, []string{"ok"}) {
+		t.Errorf("read %q, want the entry before the corruption", msgs)
+	}
+	if len(js.files) != 0 {
+		t.Error("the corrupt file is still read")
+	}
+}
+
+func TestJournalAckInOrder(t *testing.T) {
+	j := &journalReader{}
+	cursor := func(i int) string {
+		return fmt.Sprintf("s=%s;i=%x;b=%s;m=1;t=%x;x=0", strings.Repeat("aa", 16), i, strings.Repeat("bb", 16), 1000+i)
+	}
+	for _, step := range []struct{ ack, want int }{{5, 5}, {3, 5}, {5, 5}, {7, 7}, {6, 7}} {
+		j.ack(cursor(step.ack))
+		if j.acked != cursor(step.want) {
+			t.Errorf("after acking %d: acked %s, want %d", step.ack, j.acked, step.want)
+		}
+	}
+}
+
+func TestJournalMatches(t *testing.T) {
+	units, err := journalUnits([]string{"nginx", "app-*.service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &journalReader{opts: JournalOptions{Identifiers: []string{"nginx", "app"}, Priority: "warning"}, units: units}
+	tests := []struct {
+		entry map[string]string
+		want  bool
+	}{
+		{map[string]string{"_SYSTEMD_UNIT": "nginx.service", "SYSLOG_IDENTIFIER": "nginx", "PRIORITY": "3"}, true},
+		{map[string]string{"_SYSTEMD_UNIT": "app-1.service", "SYSLOG_IDENTIFIER": "app", "PRIORITY": "4"}, true},
+		{map[string]string{"UNIT": "nginx.service", "SYSLOG_IDENTIFIER": "nginx", "PRIORITY": "4"}, true},
+		{map[string]string{"_SYSTEMD_UNIT": "nginx.service", "SYSLOG_IDENTIFIER": "nginx", "PRIORITY": "6"}, false},
+		{map[string]string{"_SYSTEMD_UNIT": "nginx.service", "SYSLOG_IDENTIFIER": "nginx"}, false},
+		{map[string]string{"_SYSTEMD_UNIT": "sshd.service", "SYSLOG_IDENTIFIER": "nginx", "PRIORITY": "3"}, false},
+		{map[string]string{"_SYSTEMD_UNIT": "nginx.service", "SYSLOG_IDENTIFIER": "other", "PRIORITY": "3"}, false},
+	}
+	for _, tt := range tests {
+		if got := j.matches(tt.entry); got != tt.want {
+			t.Errorf("matches(%v) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
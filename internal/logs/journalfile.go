@@ -0,0 +1,642 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Journal files are read directly, following the format systemd documents
+// as "Journal File Format": a header, then objects aligned to 8 bytes. Only
+// entry arrays, entries and data objects are used; the hash tables are not
+// needed to read entries in order.
+
+const (
+	journalHeaderSize = 208 // up to tail_entry_monotonic, present in every version
+	objectHeaderSize  = 16
+	entryHeaderSize   = 64
+	arrayHeaderSize   = 24
+	maxJournalObject  = 64<<20 + 72 // matches the export reader's field limit
+
+	objectData       = 1
+	objectEntry      = 3
+	objectEntryArray = 6
+
+	// Incompatible header flags.
+	journalCompressedXZ   = 1 << 0
+	journalCompressedLZ4  = 1 << 1
+	journalKeyedHash      = 1 << 2
+	journalCompressedZstd = 1 << 3
+	journalCompact        = 1 << 4
+	journalKnownFlags     = journalCompressedXZ | journalCompressedLZ4 | journalKeyedHash | journalCompressedZstd | journalCompact
+
+	// Object flags.
+	objectCompressedXZ   = 1 << 0
+	objectCompressedLZ4  = 1 << 1
+	objectCompressedZstd = 1 << 2
+
+	journalStateArchived = 2
+
+	// arrayReadItems bounds how much of an entry array is read at once.
+	arrayReadItems = 4096
+)
+
+var journalSignature = []byte("LPKSHHRH")
+
+var (
+	// errJournalUnsupported means the files use a feature this reader lacks,
+	// such as XZ or LZ4 compression; journalctl can read them instead.
+	errJournalUnsupported = errors.New("unsupported journal file")
+	errJournalCorrupt     = errors.New("corrupt journal file")
+)
+
+type journalHeader struct {
+	flags        uint32 // incompatible flags
+	state        uint8
+	fileID       string
+	seqnumID     string
+	end          uint64 // header_size + arena_size
+	entryArray   uint64 // offset of the first entry array
+	nEntries     uint64
+	tailSeqnum   uint64
+	tailRealtime uint64
+}
+
+func parseJournalHeader(b []byte) (journalHeader, error) {
+	var h journalHeader
+	if len(b) < journalHeaderSize || !bytes.Equal(b[:8], journalSignature) {
+		return h, errJournalCorrupt
+	}
+	le := binary.LittleEndian
+	h.flags = le.Uint32(b[12:])
+	if h.flags&^journalKnownFlags != 0 {
+		return h, fmt.Errorf("%w: incompatible flags %#x", errJournalUnsupported, h.flags)
+	}
+	h.state = b[16]
+	h.fileID = hex.EncodeToString(b[24:40])
+	h.seqnumID = hex.EncodeToString(b[72:88])
+	h.end = le.Uint64(b[88:]) + le.Uint64(b[96:])
+	h.nEntries = le.Uint64(b[152:])
+	h.tailSeqnum = le.Uint64(b[160:])
+	h.entryArray = le.Uint64(b[176:])
+	h.tailRealtime = le.Uint64(b[192:])
+	return h, nil
+}
+
+// journalCursor is the position of an entry, as in journalctl's cursors.
+type journalCursor struct {
+	seqnumID string
+	seqnum   uint64
+	realtime uint64
+}
+
+// parseJournalCursor reads the sequence number ID and number and the
+// realtime timestamp from a cursor such as "s=…;i=1f;b=…;m=…;t=5f…;x=…".
+func parseJournalCursor(s string) (journalCursor, bool) {
+	var c journalCursor
+	var seqnum, realtime bool
+	for _, kv := range strings.Split(s, ";") {
+		k, v, _ := strings.Cut(kv, "=")
+		var err error
+		switch k {
+		case "s":
+			c.seqnumID = v
+		case "i":
+			c.seqnum, err = strconv.ParseUint(v, 16, 64)
+			seqnum = err == nil
+		case "t":
+			c.realtime, err = strconv.ParseUint(v, 16, 64)
+			realtime = err == nil
+		}
+	}
+	return c, (c.seqnumID != "" && seqnum) || realtime
+}
+
+// covers reports whether an entry is at or before c: by sequence number
+// within the same sequence, otherwise by time.
+func (c journalCursor) covers(seqnumID string, seqnum, realtime uint64) bool {
+	if c.seqnumID != "" && c.seqnumID == seqnumID {
+		return seqnum <= c.seqnum
+	}
+	return realtime <= c.realtime
+}
+
+// journalEntry is an entry whose data has not been read yet.
+type journalEntry struct {
+	file      *journalFile
+	seqnumID  string
+	seqnum    uint64
+	realtime  uint64
+	monotonic uint64
+	bootID    string
+	xorHash   uint64
+	items     []uint64 // offsets of the entry's data objects
+}
+
+func (e *journalEntry) position() journalCursor {
+	return journalCursor{seqnumID: e.seqnumID, seqnum: e.seqnum, realtime: e.realtime}
+}
+
+func (e *journalEntry) cursor() string {
+	return fmt.Sprintf("s=%s;i=%x;b=%s;m=%x;t=%x;x=%x", e.seqnumID, e.seqnum, e.bootID, e.monotonic, e.realtime, e.xorHash)
+}
+
+// before orders entries from different files: by sequence number within
+// the same sequence, otherwise by time.
+func (e *journalEntry) before(o *journalEntry) bool {
+	if e.seqnumID == o.seqnumID {
+		return e.seqnum < o.seqnum
+	}
+	return e.realtime < o.realtime
+}
+
+// fields reads the entry's data as an export-style map, with __CURSOR and
+// __REALTIME_TIMESTAMP added.
+func (e *journalEntry) fields() (map[string]string, error) {
+	m := make(map[string]string, len(e.items)+2)
+	for _, off := range e.items {
+		payload, err := e.file.data(off)
+		if err != nil {
+			return nil, err
+		}
+		if eq := bytes.IndexByte(payload, '='); eq > 0 {
+			m[string(payload[:eq])] = string(payload[eq+1:])
+		}
+	}
+	m["__CURSOR"] = e.cursor()
+	m["__REALTIME_TIMESTAMP"] = strconv.FormatUint(e.realtime, 10)
+	return m, nil
+}
+
+// journalFile walks the entry arrays of one journal file. New entries are
+// appended to the last array, or to a new array linked from it, so the
+// walk resumes where it stopped when the file grows.
+type journalFile struct {
+	path string
+	f    *os.File
+	info os.FileInfo
+	hdr  journalHeader
+
+	array  uint64   // offset of the current entry array, 0 before the first
+	next   int      // index in the current array of the next entry
+	items  []uint64 // entry offsets from the current array, starting at base
+	base   int
+	walked uint64 // entries returned so far
+	head   *journalEntry
+}
+
+func openJournalFile(path string) (*journalFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	jf := &journalFile{path: path, f: f, info: info}
+	if err := jf.readHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return jf, nil
+}
+
+func (jf *journalFile) readHeader() error {
+	b := make([]byte, journalHeaderSize)
+	if _, err := jf.f.ReadAt(b, 0); err != nil {
+		return fmt.Errorf("%s: %w", jf.path, errJournalCorrupt)
+	}
+	h, err := parseJournalHeader(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", jf.path, err)
+	}
+	jf.hdr = h
+	return nil
+}
+
+func (jf *journalFile) compact() bool { return jf.hdr.flags&journalCompact != 0 }
+
+// exhausted reports whether every entry the header counts has been
+// returned.
+func (jf *journalFile) exhausted() bool {
+	return jf.head == nil && jf.walked >= jf.hdr.nEntries
+}
+
+// readObject reads the object at off, checking its type. If want is
+// smaller than the object only the first want bytes are returned.
+func (jf *journalFile) readObject(off uint64, typ byte, want uint64) ([]byte, byte, error) {
+	var oh [objectHeaderSize]byte
+	if off%8 != 0 || off+objectHeaderSize > jf.hdr.end {
+		return nil, 0, fmt.Errorf("%s: object offset %d: %w", jf.path, off, errJournalCorrupt)
+	}
+	if _, err := jf.f.ReadAt(oh[:], int64(off)); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", jf.path, errJournalCorrupt)
+	}
+	size := binary.LittleEndian.Uint64(oh[8:])
+	if oh[0] != typ || size < objectHeaderSize || size > maxJournalObject || off+size > jf.hdr.end {
+		return nil, 0, fmt.Errorf("%s: object at %d: %w", jf.path, off, errJournalCorrupt)
+	}
+	if want == 0 || want > size {
+		want = size
+	}
+	b := make([]byte, want)
+	if _, err := jf.f.ReadAt(b, int64(off)); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", jf.path, errJournalCorrupt)
+	}
+	return b, oh[1], nil
+}
+
+// loadArray reads the items of the current entry array from index next,
+// returning the offset of the following array once this one is full.
+func (jf *journalFile) loadArray() (uint64, error) {
+	itemSize := uint64(8)
+	if jf.compact() {
+		itemSize = 4
+	}
+	hdr, _, err := jf.readObject(jf.array, objectEntryArray, arrayHeaderSize)
+	if err != nil || len(hdr) < arrayHeaderSize {
+		return 0, fmt.Errorf("%s: entry array at %d: %w", jf.path, jf.array, errJournalCorrupt)
+	}
+	capacity := int((binary.LittleEndian.Uint64(hdr[8:]) - arrayHeaderSize) / itemSize)
+	nextArray := binary.LittleEndian.Uint64(hdr[16:])
+	jf.items, jf.base = jf.items[:0], jf.next
+	n := capacity - jf.next
+	if n > arrayReadItems {
+		n = arrayReadItems
+	}
+	if n <= 0 {
+		return nextArray, nil
+	}
+	b := make([]byte, uint64(n)*itemSize)
+	if _, err := jf.f.ReadAt(b, int64(jf.array+arrayHeaderSize+uint64(jf.next)*itemSize)); err != nil {
+		return 0, fmt.Errorf("%s: %w", jf.path, errJournalCorrupt)
+	}
+	for i := 0; i < n; i++ {
+		var off uint64
+		if itemSize == 4 {
+			off = uint64(binary.LittleEndian.Uint32(b[i*4:]))
+		} else {
+			off = binary.LittleEndian.Uint64(b[i*8:])
+		}
+		if off == 0 {
+			// Unused slots; the array has room for later entries.
+			return 0, nil
+		}
+		jf.items = append(jf.items, off)
+	}
+	if jf.next+n < capacity {
+		return 0, nil
+	}
+	return nextArray, nil
+}
+
+// peek returns the next entry without consuming it, or nil if there is
+// none yet.
+func (jf *journalFile) peek() (*journalEntry, error) {
+	if jf.head != nil || jf.walked >= jf.hdr.nEntries {
+		return jf.head, nil
+	}
+	for jf.next-jf.base >= len(jf.items) {
+		if jf.array == 0 {
+			if jf.hdr.entryArray == 0 {
+				return nil, nil
+			}
+			jf.array = jf.hdr.entryArray
+		}
+		nextArray, err := jf.loadArray()
+		if err != nil {
+			return nil, err
+		}
+		if jf.next-jf.base < len(jf.items) {
+			break
+		}
+		if nextArray == 0 {
+			return nil, nil
+		}
+		if nextArray <= jf.array {
+			return nil, fmt.Errorf("%s: entry array loop: %w", jf.path, errJournalCorrupt)
+		}
+		jf.array, jf.next, jf.items, jf.base = nextArray, 0, jf.items[:0], 0
+	}
+	e, err := jf.readEntry(jf.items[jf.next-jf.base])
+	if err != nil {
+		return nil, err
+	}
+	jf.head = e
+	return e, nil
+}
+
+// advance consumes the entry returned by peek.
+func (jf *journalFile) advance() {
+	jf.head = nil
+	jf.next++
+	jf.walked++
+}
+
+func (jf *journalFile) readEntry(off uint64) (*journalEntry, error) {
+	b, _, err := jf.readObject(off, objectEntry, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < entryHeaderSize {
+		return nil, fmt.Errorf("%s: entry at %d: %w", jf.path, off, errJournalCorrupt)
+	}
+	le := binary.LittleEndian
+	e := &journalEntry{
+		file:      jf,
+		seqnumID:  jf.hdr.seqnumID,
+		seqnum:    le.Uint64(b[16:]),
+		realtime:  le.Uint64(b[24:]),
+		monotonic: le.Uint64(b[32:]),
+		bootID:    hex.EncodeToString(b[40:56]),
+		xorHash:   le.Uint64(b[56:]),
+	}
+	items := b[entryHeaderSize:]
+	if jf.compact() {
+		for i := 0; i+4 <= len(items); i += 4 {
+			e.items = append(e.items, uint64(le.Uint32(items[i:])))
+		}
+	} else {
+		for i := 0; i+16 <= len(items); i += 16 {
+			e.items = append(e.items, le.Uint64(items[i:]))
+		}
+	}
+	return e, nil
+}
+
+// data returns the payload of the data object at off, "FIELD=value",
+// decompressing it if needed.
+func (jf *journalFile) data(off uint64) ([]byte, error) {
+	b, flags, err := jf.readObject(off, objectData, 0)
+	if err != nil {
+		return nil, err
+	}
+	start := 64
+	if jf.compact() {
+		start = 72
+	}
+	if len(b) < start {
+		return nil, fmt.Errorf("%s: data at %d: %w", jf.path, off, errJournalCorrupt)
+	}
+	payload := b[start:]
+	switch {
+	case flags&objectCompressedZstd != 0:
+		payload, err = zstdDecoder().DecodeAll(payload, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: data at %d: %v", jf.path, off, err)
+		}
+	case flags&(objectCompressedXZ|objectCompressedLZ4) != 0:
+		return nil, fmt.Errorf("%w: %s: compressed with flags %#x", errJournalUnsupported, jf.path, flags)
+	}
+	return payload, nil
+}
+
+func (jf *journalFile) close() {
+	jf.f.Close()
+}
+
+var (
+	zstdOnce sync.Once
+	zstdDec  *zstd.Decoder
+)
+
+// zstdDecoder returns a shared decoder; DecodeAll is safe for concurrent
+// use.
+func zstdDecoder() *zstd.Decoder {
+	zstdOnce.Do(func() {
+		zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxJournalObject))
+	})
+	return zstdDec
+}
+
+// journalFiles follows the journal files in a set of directories,
+// merging their entries in order.
+type journalFiles struct {
+	patterns []string
+	files    map[string]*journalFile // by file ID, which survives renames
+	done     map[string]bool         // paths of archived files read to the end, or unreadable
+	after    journalCursor           // the last entry returned or skipped
+	atEnd    bool                    // start after the newest entry on the first poll
+}
+
+// journalDirs returns the directories journalctl reads by default: the
+// persistent and volatile journals of this machine.
+func journalDirs() []string {
+	var dirs []string
+	id, _ := os.ReadFile("/etc/machine-id")
+	for _, root := range []string{"/var/log/journal", "/run/log/journal"} {
+		if m := strings.TrimSpace(string(id)); m != "" {
+			dirs = append(dirs, filepath.Join(root, m))
+		} else {
+			dirs = append(dirs, root)
+		}
+	}
+	return dirs
+}
+
+// newJournalFiles starts after cursor, or if it is empty at the beginning
+// or, with atEnd, after the newest entry.
+func newJournalFiles(dirs []string, cursor string, atEnd bool) *journalFiles {
+	js := &journalFiles{files: map[string]*journalFile{}, done: map[string]bool{}}
+	for _, d := range dirs {
+		js.patterns = append(js.patterns, filepath.Join(d, "*.journal"), filepath.Join(d, "*", "*.journal"))
+	}
+	if c, ok := parseJournalCursor(cursor); ok {
+		js.after = c
+	} else {
+		js.atEnd = atEnd
+	}
+	return js
+}
+
+// journalFilesReadable reports whether any journal file in dirs can be
+// opened.
+func journalFilesReadable(dirs []string) bool {
+	js := newJournalFiles(dirs, "", false)
+	for _, p := range js.paths() {
+		if jf, err := openJournalFile(p); err == nil {
+			jf.close()
+			return true
+		}
+	}
+	return false
+}
+
+func (js *journalFiles) paths() []string {
+	var paths []string
+	for _, pattern := range js.patterns {
+		m, _ := filepath.Glob(pattern)
+		paths = append(paths, m...)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// scan opens new files. Files that cannot be read are skipped, as
+// journalctl does, except for unsupported ones.
+func (js *journalFiles) scan() error {
+	byPath := make(map[string]*journalFile, len(js.files))
+	for _, jf := range js.files {
+		byPath[jf.path] = jf
+	}
+	present := map[string]bool{}
+	for _, p := range js.paths() {
+		present[p] = true
+		if js.done[p] {
+			continue
+		}
+		if jf := byPath[p]; jf != nil {
+			if info, err := os.Stat(p); err == nil && os.SameFile(info, jf.info) {
+				continue
+			}
+		}
+		jf, err := openJournalFile(p)
+		if err != nil {
+			if errors.Is(err, errJournalUnsupported) {
+				return err
+			}
+			if !os.IsPermission(err) {
+				log.Printf("Skipping journal file: %v", err)
+			}
+			js.done[p] = true
+			continue
+		}
+		if old := js.files[jf.hdr.fileID]; old != nil {
+			// Renamed, as when journald archives the active file.
+			old.path, old.info = jf.path, jf.info
+			jf.close()
+			continue
+		}
+		js.files[jf.hdr.fileID] = jf
+	}
+	for p := range js.done {
+		if !present[p] {
+			delete(js.done, p)
+		}
+	}
+	return nil
+}
+
+// poll sends the entries written since the last poll to emit, in order,
+// stopping early if emit returns false.
+func (js *journalFiles) poll(emit func(map[string]string) bool) error {
+	if err := js.scan(); err != nil {
+		return err
+	}
+	// Entries are appended in sequence across all files. Reading no
+	// further than the newest entry each file had before any was read
+	// keeps an entry from another file from arriving out of order later.
+	limits := map[string]uint64{}
+	var newest *journalFile
+	for id, jf := range js.files {
+		if err := jf.readHeader(); err != nil {
+			if err = js.drop(id, jf, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if jf.hdr.tailSeqnum > limits[jf.hdr.seqnumID] {
+			limits[jf.hdr.seqnumID] = jf.hdr.tailSeqnum
+		}
+		if newest == nil || jf.hdr.tailRealtime > newest.hdr.tailRealtime {
+			newest = jf
+		}
+	}
+	if js.atEnd {
+		js.atEnd = false
+		js.after = journalCursor{realtime: uint64(time.Now().UnixMicro())}
+		if newest != nil {
+			js.after = journalCursor{seqnumID: newest.hdr.seqnumID, seqnum: newest.hdr.tailSeqnum, realtime: newest.hdr.tailRealtime}
+		}
+	}
+	for id, jf := range js.files {
+		if jf.hdr.state == journalStateArchived && jf.walked == 0 && js.after.covers(jf.hdr.seqnumID, jf.hdr.tailSeqnum, jf.hdr.tailRealtime) {
+			js.finish(id, jf)
+		}
+	}
+
+	for {
+		var first *journalFile
+		for id, jf := range js.files {
+			e, err := jf.peek()
+			for err == nil && e != nil && js.after.covers(e.seqnumID, e.seqnum, e.realtime) {
+				jf.advance()
+				e, err = jf.peek()
+			}
+			if err != nil {
+				if err = js.drop(id, jf, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if e == nil || e.seqnum > limits[e.seqnumID] {
+				continue
+			}
+			if first == nil || e.before(first.head) {
+				first = jf
+			}
+		}
+		if first == nil {
+			break
+		}
+		e := first.head
+		first.advance()
+		js.after = e.position()
+		fields, err := e.fields()
+		if err != nil {
+			if err = js.drop(first.hdr.fileID, first, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if !emit(fields) {
+			return nil
+		}
+	}
+
+	for id, jf := range js.files {
+		if jf.hdr.state == journalStateArchived && jf.exhausted() {
+			js.finish(id, jf)
+		}
+	}
+	return nil
+}
+
+// drop stops reading a corrupt file, as journalctl skips it. Other errors
+// are returned.
+func (js *journalFiles) drop(id string, jf *journalFile, err error) error {
+	if !errors.Is(err, errJournalCorrupt) {
+		return err
+	}
+	log.Printf("Skipping the rest of journal file %s: %v", jf.path, err)
+	js.finish(id, jf)
+	return nil
+}
+
+// finish closes a file that will not change again.
+func (js *journalFiles) finish(id string, jf *journalFile) {
+	js.done[jf.path] = true
+	jf.close()
+	delete(js.files, id)
+}
+
+func (js *journalFiles) close() {
+	for id, jf := range js.files {
+		jf.close()
+		delete(js.files, id)
+	}
+}
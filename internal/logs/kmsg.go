@@ -0,0 +1,244 @@
+package logs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KmsgSource is Record.Source for kernel log records.
+const KmsgSource = "kmsg"
+
+// KmsgOptions configures the kernel log input (Linux only).
+type KmsgOptions struct {
+	Enabled bool   `json:"enabled"`
+	StartAt string `json:"start_at"` // "end" (default) or "beginning" of the kernel ring buffer
+	Path    string `json:"path"`     // default "/dev/kmsg"
+}
+
+// kmsgRecord is one /dev/kmsg record: "pri,seq,usec,flags;message"
+// followed by " KEY=value" dictionary lines.
+type kmsgRecord struct {
+	Priority int
+	Seq      uint64
+	Uptime   time.Duration // since boot
+	Message  string
+	Dict     map[string]string
+}
+
+// parseKmsg parses one record as returned by a read of /dev/kmsg.
+func parseKmsg(b []byte) (kmsgRecord, bool) {
+	var r kmsgRecord
+	semi := bytes.IndexByte(b, ';')
+	if semi < 0 {
+		return r, false
+	}
+	header := strings.Split(string(b[:semi]), ",")
+	if len(header) < 3 {
+		return r, false
+	}
+	pri, err1 := strconv.Atoi(header[0])
+	seq, err2 := strconv.ParseUint(header[1], 10, 64)
+	usec, err3 := strconv.ParseInt(header[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return r, false
+	}
+	r.Priority, r.Seq, r.Uptime = pri, seq, time.Duration(usec)*time.Microsecond
+
+	lines := strings.Split(strings.TrimRight(string(b[semi+1:]), "\n"), "\n")
+	r.Message = unescapeKmsg(lines[0])
+	for _, l := range lines[1:] {
+		if !strings.HasPrefix(l, " ") {
+			continue
+		}
+		if eq := strings.IndexByte(l, '='); eq > 1 {
+			if r.Dict == nil {
+				r.Dict = make(map[string]string)
+			}
+			r.Dict[l[1:eq]] = unescapeKmsg(l[eq+1:])
+		}
+	}
+	return r, true
+}
+
+// unescapeKmsg decodes the \xNN escapes the kernel uses for non-printable
+// bytes.
+func unescapeKmsg(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Kernel events detected in kmsg messages.
+var (
+	oomKillRE  = regexp.MustCompile(`(?:Out of memory|Memory cgroup out of memory): Killed process (\d+) \(([^)]*)\)`)
+	segfaultRE = regexp.MustCompile(`^(\S+)\[(\d+)\]: segfault at `)
+	hungTaskRE = regexp.MustCompile(`^INFO: task (.+):(\d+) blocked for more than \d+ seconds`)
+	mceRE      = regexp.MustCompile(`^mce: \[Hardware Error\]|Machine check events logged`)
+	edacRE     = regexp.MustCompile(`^EDAC (\S+?):? .*\b(CE|UE)\b`)
+	ioErrorRE  = regexp.MustCompile(`I/O error|critical medium error|critical target error`)
+	ioDeviceRE = regexp.MustCompile(`\bdev(?:ice)? ([\w.-]+?)[,:]? `)
+)
+
+// kernelEvent classifies a message, returning the event name and the
+// fields that describe it, or "" for ordinary messages.
+func kernelEvent(msg string) (string, map[string]string) {
+	if m := oomKillRE.FindStringSubmatch(msg); m != nil {
+		return "oom_kill", map[string]string{"pid": m[1], "process": m[2]}
+	}
+	if m := segfaultRE.FindStringSubmatch(msg); m != nil {
+		return "segfault", map[string]string{"process": m[1], "pid": m[2]}
+	}
+	if m := hungTaskRE.FindStringSubmatch(msg); m != nil {
+		return "hung_task", map[string]string{"process": m[1], "pid": m[2]}
+	}
+	if mceRE.MatchString(msg) {
+		return "hardware_error", map[string]string{"hw_source": "mce", "hw_type": "unknown"}
+	}
+	if m := edacRE.FindStringSubmatch(msg); m != nil {
+		kind := "corrected"
+		if m[2] == "UE" {
+			kind = "uncorrected"
+		}
+		return "hardware_error", map[string]string{"hw_source": "edac", "hw_type": kind, "device": m[1]}
+	}
+	if ioErrorRE.MatchString(msg) {
+		f := map[string]string{}
+		if m := ioDeviceRE.FindStringSubmatch(msg + " "); m != nil {
+			f["device"] = m[1]
+		}
+		return "io_error", f
+	}
+	return "", nil
+}
+
+// kmsgReader sends kernel log records until closed.
+type kmsgReader struct {
+	f        io.ReadCloser
+	out      chan<- Record
+	stop     chan struct{}
+	done     chan struct{}
+	bootTime time.Time
+}
+
+func (o KmsgOptions) withDefaults() (KmsgOptions, error) {
+	switch o.StartAt {
+	case "":
+		o.StartAt = "end"
+	case "end", "beginning":
+	default:
+		return o, fmt.Errorf("logs.kmsg: unknown start_at %q (want end or beginning)", o.StartAt)
+	}
+	if o.Path == "" {
+		o.Path = "/dev/kmsg"
+	}
+	return o, nil
+}
+
+func startKmsg(o KmsgOptions, out chan<- Record) (*kmsgReader, error) {
+	o, err := o.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	f, bootTime, err := openKmsg(o.Path, o.StartAt == "end")
+	if err != nil {
+		return nil, fmt.Errorf("logs.kmsg: %v", err)
+	}
+	k := &kmsgReader{f: f, out: out, stop: make(chan struct{}), done: make(chan struct{}), bootTime: bootTime}
+	setKernelStarted()
+	go k.run()
+	return k, nil
+}
+
+func (k *kmsgReader) run() {
+	defer close(k.done)
+	// A read returns one record; records are at most about 8 KiB.
+	buf := make([]byte, 16<<10)
+	for {
+		n, err := k.f.Read(buf)
+		if err != nil {
+			select {
+			case <-k.stop:
+				return
+			default:
+			}
+			if errors.Is(err, errKmsgOverwritten) {
+				// Records were overwritten before we read them; carry on
+				// with the oldest one still there.
+				recordKernelMissed()
+				continue
+			}
+			log.Printf("Error reading kernel log: %v", err)
+			return
+		}
+		rec, ok := parseKmsg(buf[:n])
+		if !ok {
+			continue
+		}
+		if !k.send(k.record(rec)) {
+			return
+		}
+	}
+}
+
+// record converts a kmsg record and counts the kernel event it reports.
+func (k *kmsgReader) record(rec kmsgRecord) Record {
+	r := Record{Time: k.bootTime.Add(rec.Uptime), Source: KmsgSource, Line: rec.Message}
+	severity := syslogSeverities[rec.Priority&7]
+	facility := "kern"
+	if f := rec.Priority >> 3; f < len(syslogFacilities) {
+		facility = syslogFacilities[f]
+	}
+	r.Fields = map[string]string{
+		"seq":      strconv.FormatUint(rec.Seq, 10),
+		"severity": severity,
+		"facility": facility,
+	}
+	for key, to := range map[string]string{"SUBSYSTEM": "subsystem", "DEVICE": "device"} {
+		if v, ok := rec.Dict[key]; ok {
+			r.Fields[to] = v
+		}
+	}
+	if event, fields := kernelEvent(rec.Message); event != "" {
+		r.Fields["event"] = event
+		for key, v := range fields {
+			r.Fields[key] = v
+		}
+		recordKernelEvent(event, r.Fields)
+	}
+	return r
+}
+
+func (k *kmsgReader) send(r Record) bool {
+	select {
+	case k.out <- r:
+		return true
+	case <-k.stop:
+		return false
+	}
+}
+
+// Close stops reading.
+func (k *kmsgReader) Close() {
+	close(k.stop)
+	k.f.Close()
+	<-k.done
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package logs
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errKmsgOverwritten is returned by a read of /dev/kmsg when the next
+// record was overwritten in the ring buffer.
+var errKmsgOverwritten error = syscall.EPIPE
+
+// openKmsg opens the kernel log, positioned at its end if end is set, and
+// returns the boot time that record timestamps are relative to.
+func openKmsg(path string, end bool) (io.ReadCloser, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if end {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, time.Time{}, err
+		}
+	}
+	// Record timestamps follow the monotonic clock, which stops while
+	// the system is suspended.
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	return f, time.Now().Add(-time.Duration(ts.Nano())).Round(0), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package logs
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var errKmsgOverwritten = errors.New("kernel log records overwritten")
+
+func openKmsg(path string, end bool) (io.ReadCloser, time.Time, error) {
+	return nil, time.Time{}, errors.New("the kernel log input is only supported on Linux")
+}
@@ -0,0 +1,162 @@
+package logs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseKmsg(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want kmsgRecord
+		ok   bool
+	}{
+		{
+			name: "plain",
+			in:   "6,1234,5678901,-;EXT4-fs (sda1): mounted filesystem with ordered data mode\n",
+			want: kmsgRecord{Priority: 6, Seq: 1234, Uptime: 5678901 * time.Microsecond,
+				Message: "EXT4-fs (sda1): mounted filesystem with ordered data mode"},
+			ok: true,
+		},
+		{
+			name: "dictionary",
+			in:   "6,339,5140900,-;usb 1-1: new high-speed USB device number 2 using xhci_hcd\n SUBSYSTEM=usb\n DEVICE=c189:1\n",
+			want: kmsgRecord{Priority: 6, Seq: 339, Uptime: 5140900 * time.Microsecond,
+				Message: "usb 1-1: new high-speed USB device number 2 using xhci_hcd",
+				Dict:    map[string]string{"SUBSYSTEM": "usb", "DEVICE": "c189:1"}},
+			ok: true,
+		},
+		{
+			name: "caller field",
+			in:   "30,2001,90000000,-,caller=T1;systemd[1]: Started Journal Service.\n",
+			want: kmsgRecord{Priority: 30, Seq: 2001, Uptime: 90 * time.Second, Message: "systemd[1]: Started Journal Service."},
+			ok:   true,
+		},
+		{
+			name: "escapes",
+			in:   "4,99,1000,c;name \\x1b[31mred\\x1b[0m tab\\x09end \\xZZ \\x4\n NAME=a\\x3db\n",
+			want: kmsgRecord{Priority: 4, Seq: 99, Uptime: time.Millisecond,
+				Message: "name \x1b[31mred\x1b[0m tab\tend \\xZZ \\x4",
+				Dict:    map[string]string{"NAME": "a=b"}},
+			ok: true,
+		},
+		{
+			name: "continuation lines without a key are ignored",
+			in:   "6,5,6,-;message\nnot indented=1\n =no key\n",
+			want: kmsgRecord{Priority: 6, Seq: 5, Uptime: 6 * time.Microsecond, Message: "message"},
+			ok:   true,
+		},
+		{name: "no header", in: "just a message\n"},
+		{name: "short header", in: "6,1;message\n"},
+		{name: "bad priority", in: "x,1,2,-;message\n"},
+		{name: "bad sequence", in: "6,-1,2,-;message\n"},
+		{name: "bad timestamp", in: "6,1,soon,-;message\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseKmsg([]byte(tt.in))
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKernelEvent(t *testing.T) {
+	tests := []struct {
+		msg    string
+		event  string
+		fields map[string]string
+	}{
+		{
+			"Out of memory: Killed process 1234 (java) total-vm:8123456kB, anon-rss:4012345kB, file-rss:0kB, shmem-rss:0kB, UID:1000 pgtables:9000kB oom_score_adj:0",
+			"oom_kill", map[string]string{"pid": "1234", "process": "java"},
+		},
+		{
+			"Memory cgroup out of memory: Killed process 5678 (python3) total-vm:512000kB, anon-rss:262144kB, file-rss:4096kB, shmem-rss:0kB, UID:0 pgtables:600kB oom_score_adj:0",
+			"oom_kill", map[string]string{"pid": "5678", "process": "python3"},
+		},
+		{
+			"nginx[4321]: segfault at 0 ip 00007f3a2b1c4d5e sp 00007ffd1e2f3a40 error 4 in libc.so.6[7f3a2b000000+195000] likely on CPU 2 (core 2, socket 0)",
+			"segfault", map[string]string{"process": "nginx", "pid": "4321"},
+		},
+		{
+			"INFO: task kworker/u16:2:123 blocked for more than 120 seconds.",
+			"hung_task", map[string]string{"process": "kworker/u16:2", "pid": "123"},
+		},
+		{
+			"INFO: task jbd2/sda1-8:312 blocked for more than 122 seconds.",
+			"hung_task", map[string]string{"process": "jbd2/sda1-8", "pid": "312"},
+		},
+		{
+			"mce: [Hardware Error]: CPU 0: Machine Check: 0 Bank 4: b200000000070f0f",
+			"hardware_error", map[string]string{"hw_source": "mce", "hw_type": "unknown"},
+		},
+		{
+			"mce: 3 Machine check events logged",
+			"hardware_error", map[string]string{"hw_source": "mce", "hw_type": "unknown"},
+		},
+		{
+			"EDAC MC0: 1 CE memory read error on CPU_SrcID#0_Ha#0_Chan#1_DIMM#0 (channel:1 slot:0 page:0x12345 offset:0x0 grain:32 syndrome:0x0)",
+			"hardware_error", map[string]string{"hw_source": "edac", "hw_type": "corrected", "device": "MC0"},
+		},
+		{
+			"EDAC MC1: 1 UE memory read error on CPU_SrcID#1_Ha#0_Chan#0_DIMM#1 (channel:0 slot:1 page:0x0 offset:0x0 grain:32)",
+			"hardware_error", map[string]string{"hw_source": "edac", "hw_type": "uncorrected", "device": "MC1"},
+		},
+		{
+			"blk_update_request: I/O error, dev sda, sector 123456 op 0x0:(READ) flags 0x80700 phys_seg 1 prio class 0",
+			"io_error", map[string]string{"device": "sda"},
+		},
+		{
+			"Buffer I/O error on dev sdb1, logical block 0, async page read",
+			"io_error", map[string]string{"device": "sdb1"},
+		},
+		{
+			"critical medium error, dev nvme0n1, sector 2048 op 0x0:(READ) flags 0x0 phys_seg 1 prio class 2",
+			"io_error", map[string]string{"device": "nvme0n1"},
+		},
+		{
+			"XFS (dm-0): metadata I/O error in \"xfs_trans_read_buf_map\" at daddr 0x2 len 1 error 5",
+			"io_error", map[string]string{},
+		},
+		{"EDAC sbridge: Seeking for: PCI ID 8086:2fa0", "", nil},
+		{"usb 1-1: new high-speed USB device number 2 using xhci_hcd", "", nil},
+		{"task kworker/0:1 blocked for more than 120 seconds.", "", nil},
+		{"systemd[1]: segfault handler installed", "", nil},
+	}
+	for _, tt := range tests {
+		event, fields := kernelEvent(tt.msg)
+		if event != tt.event || !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("kernelEvent(%q) = %q, %v; want %q, %v", tt.msg, event, fields, tt.event, tt.fields)
+		}
+	}
+}
+
+func TestKmsgRecord(t *testing.T) {
+	boot := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	k := &kmsgReader{bootTime: boot}
+	rec, ok := parseKmsg([]byte("3,77,2500000,-;Out of memory: Killed process 99 (stress) total-vm:1kB\n SUBSYSTEM=memory\n"))
+	if !ok {
+		t.Fatal("parseKmsg failed")
+	}
+	r := k.record(rec)
+	if r.Source != KmsgSource || !r.Time.Equal(boot.Add(2500*time.Millisecond)) {
+		t.Errorf("source %q, time %v", r.Source, r.Time)
+	}
+	want := map[string]string{"seq": "77", "severity": "err", "facility": "kern", "subsystem": "memory",
+		"event": "oom_kill", "pid": "99", "process": "stress"}
+	if !reflect.DeepEqual(r.Fields, want) {
+		t.Errorf("fields %v, want %v", r.Fields, want)
+	}
+
+	rec, _ = parseKmsg([]byte("14,78,2600000,-;hello from user space\n"))
+	if r := k.record(rec); r.Fields["facility"] != "user" || r.Fields["severity"] != "info" || r.Fields["event"] != "" {
+		t.Errorf("user message fields %v", r.Fields)
+	}
+}
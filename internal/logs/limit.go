@@ -0,0 +1,219 @@
+package logs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxLimitKeys bounds the buckets of a rate_limit stage and the
+	// sources a dedup stage remembers; idle ones are evicted first.
+	maxLimitKeys         = 10000
+	defaultDedupInterval = 30 * time.Second
+)
+
+// rateLimiter drops records beyond a token-bucket rate per source, or per
+// value of a key field.
+type rateLimiter struct {
+	rate     float64 // tokens per second
+	burst    float64
+	key      string
+	pipeline string
+	buckets  map[string]*bucket
+	now      func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(o StageOptions) (*rateLimiter, error) {
+	if o.Rate <= 0 {
+		return nil, fmt.Errorf("rate_limit needs a positive rate")
+	}
+	burst := float64(o.Burst)
+	if burst < 1 {
+		burst = math.Max(1, o.Rate)
+	}
+	return &rateLimiter{rate: o.Rate, burst: burst, key: o.Key, buckets: make(map[string]*bucket), now: time.Now}, nil
+}
+
+func (l *rateLimiter) setPipeline(name string) { l.pipeline = name }
+
+func (l *rateLimiter) process(r Record) []Record {
+	key := r.Source
+	if l.key != "" {
+		key = r.Fields[l.key]
+	}
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxLimitKeys {
+			l.evict(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		recordDropped(l.pipeline, "rate_limit")
+		return nil
+	}
+	b.tokens--
+	return []Record{r}
+}
+
+// evict removes buckets that have refilled, which behave like new ones,
+// or failing that all of them.
+func (l *rateLimiter) evict(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	if len(l.buckets) >= maxLimitKeys {
+		l.buckets = make(map[string]*bucket)
+	}
+}
+
+// sampler keeps a fraction of records: at random, or when a key field is
+// set by a hash of its value, so that all records sharing a value (a
+// request or trace ID) are kept or dropped together. Kept records carry
+// sample_rate so that counts can be scaled back up.
+type sampler struct {
+	ratio    float64
+	key      string
+	pipeline string
+	rand     *rand.Rand
+}
+
+func newSampler(o StageOptions) (*sampler, error) {
+	if o.SampleRate <= 0 || o.SampleRate > 1 {
+		return nil, fmt.Errorf("sample needs sample_rate in (0, 1]")
+	}
+	return &sampler{ratio: o.SampleRate, key: o.Key, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+}
+
+func (s *sampler) setPipeline(name string) { s.pipeline = name }
+
+func (s *sampler) process(r Record) []Record {
+	var keep bool
+	if s.key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(r.Fields[s.key]))
+		keep = float64(mix64(h.Sum64())>>11)/(1<<53) < s.ratio
+	} else {
+		keep = s.rand.Float64() < s.ratio
+	}
+	if !keep {
+		recordDropped(s.pipeline, "sample")
+		return nil
+	}
+	setField(&r, "sample_rate", strconv.FormatFloat(s.ratio, 'g', -1, 64))
+	return []Record{r}
+}
+
+// mix64 spreads the bits of an FNV hash, whose high bits vary little for
+// short keys such as numeric IDs (the splitmix64 finalizer).
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// dedup collapses consecutive identical lines from a source: the first is
+// passed on, repeats are held back and replaced by one record saying
+// "last message repeated N times", emitted when a different line arrives
+// or the repeats have gone on for the interval.
+type dedup struct {
+	interval time.Duration
+	pipeline string
+	last     map[string]*repeats
+	now      func() time.Time
+}
+
+type repeats struct {
+	rec   Record // the last repeat seen
+	line  string
+	count int
+	since time.Time
+}
+
+func newDedup(o StageOptions) (*dedup, error) {
+	d := &dedup{interval: defaultDedupInterval, last: make(map[string]*repeats), now: time.Now}
+	if o.Timeout != "" {
+		v, err := time.ParseDuration(o.Timeout)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", o.Timeout)
+		}
+		d.interval = v
+	}
+	return d, nil
+}
+
+func (d *dedup) setPipeline(name string) { d.pipeline = name }
+
+func (d *dedup) process(r Record) []Record {
+	p := d.last[r.Source]
+	if p != nil && p.line == r.Line {
+		if p.count == 0 {
+			p.since = d.now()
+		}
+		p.count++
+		p.rec = r
+		recordDropped(d.pipeline, "dedup")
+		return nil
+	}
+	var out []Record
+	if p != nil && p.count > 0 {
+		out = append(out, p.summary())
+	}
+	if p == nil && len(d.last) >= maxLimitKeys {
+		for src, q := range d.last {
+			if q.count == 0 {
+				delete(d.last, src)
+			}
+		}
+	}
+	d.last[r.Source] = &repeats{line: r.Line}
+	return append(out, r)
+}
+
+func (d *dedup) flush(now time.Time, all bool) []Record {
+	var out []Record
+	for src, p := range d.last {
+		if p.count > 0 && (all || now.Sub(p.since) >= d.interval) {
+			out = append(out, p.summary())
+		}
+		if all {
+			delete(d.last, src)
+		}
+	}
+	return out
+}
+
+// summary returns the "repeated" record for the held repeats and resets
+// the count, keeping the line so later repeats are still collapsed. It
+// carries the ack of the last repeat: positions within a source only move
+// forward, so that ack covers the earlier repeats too.
+func (p *repeats) summary() Record {
+	r := p.rec
+	r.Line = fmt.Sprintf("last message repeated %d times", p.count)
+	fields := make(map[string]string, len(r.Fields)+1)
+	for k, v := range r.Fields {
+		fields[k] = v
+	}
+	fields["repeated"] = strconv.Itoa(p.count)
+	r.Fields = fields
+	p.count = 0
+	return r
+}
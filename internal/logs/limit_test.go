@@ -0,0 +1,193 @@
+package logs
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// clock is a settable time source for the stages that read the time.
+type clock struct{ t time.Time }
+
+func newClock() *clock                   { return &clock{t: time.Unix(1700000000, 0)} }
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func keyed(field, value string) Record {
+	return Record{Source: "app.log", Fields: map[string]string{field: value}}
+}
+
+func passed(s stage, r Record) bool { return len(s.process(r)) == 1 }
+
+func TestRateLimiterRefill(t *testing.T) {
+	c := newClock()
+	l := mustStage(t, StageOptions{Type: "rate_limit", Rate: 2, Burst: 3, Key: "user"}).(*rateLimiter)
+	l.now = c.now
+
+	steps := []struct {
+		after time.Duration
+		user  string
+		want  bool
+	}{
+		{0, "alice", true}, {0, "alice", true}, {0, "alice", true},
+		{0, "alice", false},                      // burst used up
+		{0, "bob", true},                         // a bucket per key
+		{250 * time.Millisecond, "alice", false}, // half a token
+		{250 * time.Millisecond, "alice", true},  // one token
+		{250 * time.Millisecond, "alice", false},
+		{time.Hour, "alice", true}, // refilled to the burst, not beyond
+		{0, "alice", true}, {0, "alice", true},
+		{0, "alice", false},
+	}
+	for i, s := range steps {
+		c.advance(s.after)
+		if got := passed(l, keyed("user", s.user)); got != s.want {
+			t.Errorf("step %d (%s): passed %v, want %v", i, s.user, got, s.want)
+		}
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	c := newClock()
+	l := mustStage(t, StageOptions{Type: "rate_limit", Rate: 1, Burst: 2, Key: "user"}).(*rateLimiter)
+	l.now = c.now
+
+	fill := func() {
+		for i := len(l.buckets); i < maxLimitKeys; i++ {
+			passed(l, keyed("user", strconv.Itoa(i)))
+		}
+	}
+	l.process(keyed("user", "hot"))
+	l.process(keyed("user", "hot"))
+	fill()
+
+	// A second later the other buckets have refilled and are evicted, the
+	// drained one is kept.
+	c.advance(time.Second)
+	passed(l, keyed("user", "new"))
+	if len(l.buckets) != 2 || l.buckets["hot"] == nil {
+		t.Fatalf("%d buckets kept after eviction, want hot and new", len(l.buckets))
+	}
+	if !passed(l, keyed("user", "hot")) || passed(l, keyed("user", "hot")) {
+		t.Error("hot bucket lost its state in the eviction")
+	}
+
+	// With no bucket refilled, all of them go.
+	fill()
+	passed(l, keyed("user", "newer"))
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets kept, want 1", len(l.buckets))
+	}
+}
+
+func TestSamplerByKey(t *testing.T) {
+	a := mustStage(t, StageOptions{Type: "sample", SampleRate: 0.25, Key: "request_id"})
+	b := mustStage(t, StageOptions{Type: "sample", SampleRate: 0.25, Key: "request_id"})
+
+	// Every record of a request is kept or dropped, by any stage alike.
+	kept := 0
+	const n = 10000
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		out := a.process(keyed("request_id", id))
+		for j := 0; j < 3; j++ {
+			if again := passed(a, keyed("request_id", id)); again != (len(out) == 1) {
+				t.Fatalf("request %s: kept %v, then %v", id, len(out) == 1, again)
+			}
+		}
+		if other := passed(b, keyed("request_id", id)); other != (len(out) == 1) {
+			t.Fatalf("request %s: kept %v by one stage, %v by the other", id, len(out) == 1, other)
+		}
+		if len(out) == 1 {
+			kept++
+			if got := out[0].Fields["sample_rate"]; got != "0.25" {
+				t.Fatalf("sample_rate = %q", got)
+			}
+		}
+	}
+	if kept < n*22/100 || kept > n*28/100 {
+		t.Errorf("kept %d of %d sequential IDs, want about a quarter", kept, n)
+	}
+}
+
+func TestSamplerOptions(t *testing.T) {
+	all := mustStage(t, StageOptions{Type: "sample", SampleRate: 1})
+	for i := 0; i < 100; i++ {
+		if !passed(all, keyed("request_id", "x")) {
+			t.Fatal("sample_rate 1 dropped a record")
+		}
+	}
+	for _, rate := range []float64{0, -0.5, 1.5} {
+		if _, err := newStage(StageOptions{Type: "sample", SampleRate: rate}); err == nil {
+			t.Errorf("sample_rate %v accepted", rate)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	c := newClock()
+	d := mustStage(t, StageOptions{Type: "dedup", Timeout: "10s"}).(*dedup)
+	d.now = c.now
+
+	var acked []int
+	in := []Record{
+		{Source: "a.log", Line: "disk full"},
+		{Source: "a.log", Line: "disk full"},
+		{Source: "b.log", Line: "disk full"}, // another source
+		{Source: "a.log", Line: "disk full"},
+		{Source: "a.log", Line: "disk ok"},
+	}
+	var out []Record
+	for i, r := range in {
+		i := i
+		r.ack = func() { acked = append(acked, i) }
+		out = append(out, d.process(r)...)
+	}
+	var got []string
+	for _, r := range out {
+		got = append(got, r.Source+": "+r.Line)
+	}
+	want := []string{"a.log: disk full", "b.log: disk full", "a.log: last message repeated 2 times", "a.log: disk ok"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	summary := out[2]
+	if summary.Fields["repeated"] != "2" {
+		t.Errorf("repeated = %q", summary.Fields["repeated"])
+	}
+	// The summary carries the ack of the last repeat it stands for.
+	summary.Ack()
+	if !reflect.DeepEqual(acked, []int{3}) {
+		t.Errorf("summary acked %v, want [3]", acked)
+	}
+}
+
+func TestDedupFlush(t *testing.T) {
+	c := newClock()
+	d := mustStage(t, StageOptions{Type: "dedup", Timeout: "10s"}).(*dedup)
+	d.now = c.now
+
+	processAll(d, lines("a.log", "x", "x", "x"))
+	c.advance(5 * time.Second)
+	if out := d.flush(c.now(), false); len(out) != 0 {
+		t.Fatalf("flushed %+v before the interval", out)
+	}
+	c.advance(5 * time.Second)
+	out := d.flush(c.now(), false)
+	if len(out) != 1 || out[0].Line != "last message repeated 2 times" {
+		t.Fatalf("flushed %+v after the interval", out)
+	}
+
+	// Repeats after the summary are still collapsed, and counted afresh.
+	if got := processAll(d, lines("a.log", "x")); len(got) != 0 {
+		t.Errorf("repeat after the summary passed: %q", got)
+	}
+	out = d.flush(c.now(), true)
+	if len(out) != 1 || out[0].Line != "last message repeated 1 times" {
+		t.Errorf("final flush: %+v", out)
+	}
+	if len(d.last) != 0 {
+		t.Errorf("%d sources left after the final flush", len(d.last))
+	}
+}
@@ -0,0 +1,362 @@
+package logs
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaxSeries = 1000
+	// summaryWindow observations per series are kept for quantiles.
+	summaryWindow = 1024
+)
+
+var (
+	defaultBuckets   = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	defaultQuantiles = []float64{.5, .9, .99}
+
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// MetricRule derives a metric from the records of matching sources, after
+// their pipeline has run. Named groups of Match are available as fields
+// alongside those set by the pipeline.
+type MetricRule struct {
+	Name      string    `json:"name"`       // metric name, e.g. "app_requests_total"
+	Help      string    `json:"help"`       // HELP text
+	Type      string    `json:"type"`       // counter (default), histogram or summary
+	Sources   []string  `json:"sources"`    // glob patterns matched against Record.Source; empty matches all
+	Match     string    `json:"match"`      // regex the line must match; empty matches every line
+	Labels    []string  `json:"labels"`     // fields used as labels, e.g. ["status"]
+	Value     string    `json:"value"`      // numeric field observed, or added to a counter; counters count lines without it
+	Buckets   []float64 `json:"buckets"`    // histogram buckets, default .005 to 10
+	Quantiles []float64 `json:"quantiles"`  // summary quantiles over the last 1024 observations, default .5, .9, .99
+	MaxSeries int       `json:"max_series"` // label combinations kept, default 1000
+}
+
+// series is the state of one label combination.
+type series struct {
+	labels  []string
+	count   uint64
+	sum     float64
+	buckets []uint64  // histogram: cumulative counts per bucket
+	window  []float64 // summary: recent observations, a ring
+	next    int
+}
+
+type metricRule struct {
+	MetricRule
+	match *regexp.Regexp
+
+	series  map[string]*series
+	dropped map[string]uint64 // by reason
+}
+
+var (
+	rulesMu     sync.Mutex
+	metricRules []*metricRule
+)
+
+func newMetricRule(o MetricRule) (*metricRule, error) {
+	if !metricNameRE.MatchString(o.Name) {
+		return nil, fmt.Errorf("logs.metrics: invalid metric name %q", o.Name)
+	}
+	r := &metricRule{MetricRule: o, series: make(map[string]*series), dropped: make(map[string]uint64)}
+	switch r.Type {
+	case "":
+		r.Type = "counter"
+	case "counter":
+	case "histogram", "summary":
+		if r.Value == "" {
+			return nil, fmt.Errorf("logs.metrics[%s]: %s needs a value field", o.Name, r.Type)
+		}
+	default:
+		return nil, fmt.Errorf("logs.metrics[%s]: unknown type %q (want counter, histogram or summary)", o.Name, r.Type)
+	}
+	for _, src := range r.Sources {
+		if _, err := filepath.Match(src, ""); err != nil {
+			return nil, fmt.Errorf("logs.metrics[%s]: invalid source pattern %q: %v", o.Name, src, err)
+		}
+	}
+	for _, l := range r.Labels {
+		if !labelNameRE.MatchString(l) || l == "le" || l == "quantile" {
+			return nil, fmt.Errorf("logs.metrics[%s]: invalid label %q", o.Name, l)
+		}
+	}
+	if r.Match != "" {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("logs.metrics[%s]: invalid match: %v", o.Name, err)
+		}
+		r.match = re
+	}
+	if r.Type == "histogram" {
+		if len(r.Buckets) == 0 {
+			r.Buckets = defaultBuckets
+		}
+		r.Buckets = append([]float64(nil), r.Buckets...)
+		sort.Float64s(r.Buckets)
+	}
+	if r.Type == "summary" {
+		if len(r.Quantiles) == 0 {
+			r.Quantiles = defaultQuantiles
+		}
+		for _, q := range r.Quantiles {
+			if q < 0 || q > 1 {
+				return nil, fmt.Errorf("logs.metrics[%s]: quantile %v out of range", o.Name, q)
+			}
+		}
+	}
+	if r.MaxSeries <= 0 {
+		r.MaxSeries = defaultMaxSeries
+	}
+	if r.Help == "" {
+		r.Help = "Derived from logs."
+	}
+	return r, nil
+}
+
+// exposedNames returns the metric names the rule writes.
+func (r *metricRule) exposedNames() []string {
+	switch r.Type {
+	case "histogram":
+		return []string{r.Name + "_bucket", r.Name + "_sum", r.Name + "_count"}
+	case "summary":
+		return []string{r.Name, r.Name + "_sum", r.Name + "_count"}
+	}
+	return []string{r.Name}
+}
+
+// newMetricRules builds the rules; it fails if any rule is invalid or
+// writes a metric another rule or the exporter itself writes.
+func newMetricRules(opts []MetricRule) ([]*metricRule, error) {
+	rules := make([]*metricRule, 0, len(opts))
+	owners := make(map[string]string) // exposed name -> rule
+	for _, o := range opts {
+		r, err := newMetricRule(o)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(r.Name, "logs_exporter_") {
+			return nil, fmt.Errorf("logs.metrics[%s]: the logs_exporter_ prefix is reserved for the exporter's own metrics", r.Name)
+		}
+		for _, name := range r.exposedNames() {
+			if owner, ok := owners[name]; ok {
+				return nil, fmt.Errorf("logs.metrics[%s]: metric %s is also written by rule %s", r.Name, name, owner)
+			}
+		}
+		for _, name := range r.exposedNames() {
+			owners[name] = r.Name
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// configureMetricRules replaces the rules; it fails without changing them
+// if newMetricRules does.
+func configureMetricRules(opts []MetricRule) error {
+	rules, err := newMetricRules(opts)
+	if err != nil {
+		return err
+	}
+	rulesMu.Lock()
+	metricRules = rules
+	rulesMu.Unlock()
+	return nil
+}
+
+// observeRecord is the sink that applies the metric rules.
+func observeRecord(rec Record) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	for _, r := range metricRules {
+		r.observe(rec)
+	}
+}
+
+func (r *metricRule) matchesSource(source string) bool {
+	if len(r.Sources) == 0 {
+		return true
+	}
+	for _, pattern := range r.Sources {
+		if ok, _ := filepath.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *metricRule) observe(rec Record) {
+	if !r.matchesSource(rec.Source) {
+		return
+	}
+	field := func(name string) string { return rec.Fields[name] }
+	if r.match != nil {
+		m := r.match.FindStringSubmatch(rec.Line)
+		if m == nil {
+			return
+		}
+		names := r.match.SubexpNames()
+		field = func(name string) string {
+			for i, n := range names {
+				if n == name && i > 0 {
+					return m[i]
+				}
+			}
+			return rec.Fields[name]
+		}
+	}
+
+	v := 1.0
+	if r.Value != "" {
+		f, err := strconv.ParseFloat(strings.TrimSpace(field(r.Value)), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			r.dropped["not_numeric"]++
+			return
+		}
+		v = f
+	}
+	if r.Type == "counter" && v < 0 {
+		r.dropped["negative"]++
+		return
+	}
+
+	labels := make([]string, len(r.Labels))
+	for i, l := range r.Labels {
+		labels[i] = field(l)
+	}
+	key := strings.Join(labels, "\x00")
+	s, ok := r.series[key]
+	if !ok {
+		if len(r.series) >= r.MaxSeries {
+			r.dropped["max_series"]++
+			return
+		}
+		s = &series{labels: labels}
+		if r.Type == "histogram" {
+			s.buckets = make([]uint64, len(r.Buckets))
+		}
+		r.series[key] = s
+	}
+
+	s.count++
+	s.sum += v
+	switch r.Type {
+	case "histogram":
+		for i, b := range r.Buckets {
+			if v <= b {
+				s.buckets[i]++
+			}
+		}
+	case "summary":
+		if len(s.window) < summaryWindow {
+			s.window = append(s.window, v)
+		} else {
+			s.window[s.next] = v
+			s.next = (s.next + 1) % summaryWindow
+		}
+	}
+}
+
+// labelString formats the rule's labels for s, plus an extra pair if set.
+func (r *metricRule) labelString(s *series, extraName, extraValue string) string {
+	var parts []string
+	for i, l := range r.Labels {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", l, escapeLabel(s.labels[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeRuleMetrics writes the derived metrics and the rule self-metrics.
+func writeRuleMetrics(sb *strings.Builder) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	if len(metricRules) == 0 {
+		return
+	}
+
+	for _, r := range metricRules {
+		keys := make([]string, 0, len(r.series))
+		for k := range r.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n", r.Name, strings.ReplaceAll(r.Help, "\n", " ")))
+		sb.WriteString(fmt.Sprintf("# TYPE %s %s\n", r.Name, r.Type))
+		for _, k := range keys {
+			s := r.series[k]
+			switch r.Type {
+			case "counter":
+				sb.WriteString(fmt.Sprintf("%s%s %s\n", r.Name, r.labelString(s, "", ""), formatFloat(s.sum)))
+			case "histogram":
+				for i, b := range r.Buckets {
+					sb.WriteString(fmt.Sprintf("%s_bucket%s %d\n", r.Name, r.labelString(s, "le", formatFloat(b)), s.buckets[i]))
+				}
+				sb.WriteString(fmt.Sprintf("%s_bucket%s %d\n", r.Name, r.labelString(s, "le", "+Inf"), s.count))
+				sb.WriteString(fmt.Sprintf("%s_sum%s %s\n", r.Name, r.labelString(s, "", ""), formatFloat(s.sum)))
+				sb.WriteString(fmt.Sprintf("%s_count%s %d\n", r.Name, r.labelString(s, "", ""), s.count))
+			case "summary":
+				sorted := append([]float64(nil), s.window...)
+				sort.Float64s(sorted)
+				for _, q := range r.Quantiles {
+					sb.WriteString(fmt.Sprintf("%s%s %s\n", r.Name, r.labelString(s, "quantile", formatFloat(q)), formatFloat(quantile(sorted, q))))
+				}
+				sb.WriteString(fmt.Sprintf("%s_sum%s %s\n", r.Name, r.labelString(s, "", ""), formatFloat(s.sum)))
+				sb.WriteString(fmt.Sprintf("%s_count%s %d\n", r.Name, r.labelString(s, "", ""), s.count))
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("# HELP logs_exporter_log_metric_series Label combinations held by each log metric rule.\n")
+	sb.WriteString("# TYPE logs_exporter_log_metric_series gauge\n")
+	for _, r := range metricRules {
+		sb.WriteString(fmt.Sprintf("logs_exporter_log_metric_series{rule=\"%s\"} %d\n", r.Name, len(r.series)))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_log_metric_skipped_total Matching records a log metric rule could not use, by reason (not_numeric, negative, max_series).\n")
+	sb.WriteString("# TYPE logs_exporter_log_metric_skipped_total counter\n")
+	for _, r := range metricRules {
+		reasons := make([]string, 0, len(r.dropped))
+		for k := range r.dropped {
+			reasons = append(reasons, k)
+		}
+		sort.Strings(reasons)
+		for _, k := range reasons {
+			sb.WriteString(fmt.Sprintf("logs_exporter_log_metric_skipped_total{rule=\"%s\",reason=\"%s\"} %d\n", r.Name, k, r.dropped[k]))
+		}
+	}
+	sb.WriteString("\n")
+}
+
+// quantile returns the q-quantile of sorted values by nearest rank.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
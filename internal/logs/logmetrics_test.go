@@ -0,0 +1,177 @@
+package logs
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useRules configures metric rules for a test.
+func useRules(t *testing.T, rules ...MetricRule) {
+	t.Helper()
+	if err := configureMetricRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { configureMetricRules(nil) })
+}
+
+func scrapeRules() string {
+	var sb strings.Builder
+	writeRuleMetrics(&sb)
+	return sb.String()
+}
+
+// checkLines reports the wanted lines missing from the scrape.
+func checkLines(t *testing.T, out string, want ...string) {
+	t.Helper()
+	have := make(map[string]bool)
+	for _, l := range strings.Split(out, "\n") {
+		have[l] = true
+	}
+	for _, l := range want {
+		if !have[l] {
+			t.Errorf("missing %q in:\n%s", l, out)
+		}
+	}
+}
+
+func TestMetricRuleCounters(t *testing.T) {
+	useRules(t,
+		MetricRule{Name: "app_errors_total", Sources: []string{"/var/log/app/*.log"}, Match: `\bERROR\b`},
+		MetricRule{Name: "app_requests_total", Labels: []string{"status"}},
+		MetricRule{Name: "app_bytes_total", Match: `bytes=(?P<bytes>\d+)`, Value: "bytes", Labels: []string{"method"}},
+	)
+	for _, rec := range []Record{
+		{Source: "/var/log/app/a.log", Line: "ERROR disk full", Fields: map[string]string{"status": "500"}},
+		{Source: "/var/log/app/b.log", Line: "ERROR timeout", Fields: map[string]string{"status": "504"}},
+		{Source: "/var/log/other.log", Line: "ERROR elsewhere", Fields: map[string]string{"status": "500"}},
+		{Source: "/var/log/app/a.log", Line: "INFO GET bytes=100", Fields: map[string]string{"status": "200", "method": "GET"}},
+		{Source: "/var/log/app/a.log", Line: "INFO GET bytes=50", Fields: map[string]string{"status": "200", "method": "GET"}},
+		{Source: "/var/log/app/a.log", Line: "INFO POST bytes=7", Fields: map[string]string{"status": "201", "method": "POST"}},
+	} {
+		observeRecord(rec)
+	}
+	checkLines(t, scrapeRules(),
+		"# TYPE app_errors_total counter",
+		"app_errors_total 2",
+		`app_requests_total{status="200"} 2`,
+		`app_requests_total{status="500"} 2`,
+		`app_requests_total{status="504"} 1`,
+		`app_bytes_total{method="GET"} 150`,
+		`app_bytes_total{method="POST"} 7`,
+		`logs_exporter_log_metric_series{rule="app_requests_total"} 4`,
+	)
+}
+
+func TestMetricRuleHistogram(t *testing.T) {
+	useRules(t, MetricRule{Name: "app_request_seconds", Type: "histogram", Match: `took=(?P<took>\S+)s`,
+		Value: "took", Buckets: []float64{1, 0.1, 0.5}})
+	for _, took := range []string{"0.05", "0.1", "0.3", "0.7", "2"} {
+		observeRecord(Record{Source: "app.log", Line: "took=" + took + "s"})
+	}
+	checkLines(t, scrapeRules(),
+		"# TYPE app_request_seconds histogram",
+		`app_request_seconds_bucket{le="0.1"} 2`,
+		`app_request_seconds_bucket{le="0.5"} 3`,
+		`app_request_seconds_bucket{le="1"} 4`,
+		`app_request_seconds_bucket{le="+Inf"} 5`,
+		"app_request_seconds_sum 3.15",
+		"app_request_seconds_count 5",
+	)
+}
+
+func TestMetricRuleSummary(t *testing.T) {
+	useRules(t, MetricRule{Name: "app_latency", Type: "summary", Value: "ms", Quantiles: []float64{0, 0.5, 0.9, 1}})
+	observe := func(v int) {
+		observeRecord(Record{Source: "app.log", Fields: map[string]string{"ms": strconv.Itoa(v)}})
+	}
+	for v := 100; v >= 1; v-- {
+		observe(v)
+	}
+	checkLines(t, scrapeRules(),
+		"# TYPE app_latency summary",
+		`app_latency{quantile="0"} 1`,
+		`app_latency{quantile="0.5"} 50`,
+		`app_latency{quantile="0.9"} 90`,
+		`app_latency{quantile="1"} 100`,
+		"app_latency_sum 5050",
+		"app_latency_count 100",
+	)
+
+	// Once the window is full the oldest observations are replaced, while
+	// the sum and count cover every observation.
+	for i := 0; i < summaryWindow; i++ {
+		observe(1000)
+	}
+	observe(2000)
+	checkLines(t, scrapeRules(),
+		`app_latency{quantile="0"} 1000`,
+		`app_latency{quantile="0.5"} 1000`,
+		`app_latency{quantile="1"} 2000`,
+		"app_latency_sum "+formatFloat(5050+summaryWindow*1000+2000),
+		"app_latency_count "+strconv.Itoa(100+summaryWindow+1),
+	)
+}
+
+func TestMetricRuleSkips(t *testing.T) {
+	useRules(t,
+		MetricRule{Name: "app_bytes_total", Value: "bytes", Labels: []string{"user"}, MaxSeries: 2},
+		MetricRule{Name: "app_seconds", Type: "histogram", Value: "took"},
+	)
+	for _, fields := range []map[string]string{
+		{"bytes": "10", "user": "a", "took": "0.2"},
+		{"bytes": "NaN", "user": "a", "took": "Inf"},
+		{"bytes": "lots", "user": "a", "took": "-1"}, // histograms take negative values
+		{"bytes": "-5", "user": "a"},
+		{"bytes": " 1 ", "user": "b"},
+		{"bytes": "1", "user": "c"},
+		{"bytes": "1", "user": "d"},
+	} {
+		observeRecord(Record{Source: "app.log", Fields: fields})
+	}
+	checkLines(t, scrapeRules(),
+		`app_bytes_total{user="a"} 10`,
+		`app_bytes_total{user="b"} 1`,
+		`logs_exporter_log_metric_series{rule="app_bytes_total"} 2`,
+		`logs_exporter_log_metric_skipped_total{rule="app_bytes_total",reason="max_series"} 2`,
+		`logs_exporter_log_metric_skipped_total{rule="app_bytes_total",reason="negative"} 1`,
+		`logs_exporter_log_metric_skipped_total{rule="app_bytes_total",reason="not_numeric"} 2`,
+		`logs_exporter_log_metric_skipped_total{rule="app_seconds",reason="not_numeric"} 5`,
+		"app_seconds_count 2",
+	)
+}
+
+func TestConfigureMetricRulesErrors(t *testing.T) {
+	useRules(t, MetricRule{Name: "kept_total"})
+	for _, rules := range [][]MetricRule{
+		{{Name: "bad-name"}},
+		{{Name: "x", Type: "gauge"}},
+		{{Name: "x", Type: "histogram"}},
+		{{Name: "x", Labels: []string{"le"}}},
+		{{Name: "x", Match: "("}},
+		{{Name: "x", Sources: []string{"["}}},
+		{{Name: "x", Type: "summary", Value: "v", Quantiles: []float64{1.5}}},
+		{{Name: "x"}, {Name: "x"}},
+		{{Name: "logs_exporter_log_lines_read_total"}},
+		{{Name: "logs_exporter_custom_total"}},
+		{{Name: "x", Type: "histogram", Value: "v"}, {Name: "x_count"}},
+		{{Name: "x_bucket"}, {Name: "x", Type: "histogram", Value: "v"}},
+		{{Name: "x", Type: "summary", Value: "v"}, {Name: "x_sum"}},
+		{{Name: "x", Type: "summary", Value: "v"}, {Name: "x", Type: "histogram", Value: "v"}},
+	} {
+		if err := configureMetricRules(rules); err == nil {
+			t.Errorf("configureMetricRules(%+v) succeeded, want an error", rules)
+		}
+	}
+	if len(metricRules) != 1 || metricRules[0].Name != "kept_total" {
+		t.Errorf("a failed configuration replaced the rules")
+	}
+
+	// Distinct names that only look alike are fine.
+	useRules(t,
+		MetricRule{Name: "x", Type: "histogram", Value: "v"},
+		MetricRule{Name: "x_bucket_total"},
+		MetricRule{Name: "y", Type: "summary", Value: "v"},
+		MetricRule{Name: "y_bucket"},
+	)
+}
@@ -0,0 +1,150 @@
+package logs
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultQueryLimit = 1000
+
+// LogQuery filters buffered records. Zero values match everything.
+type LogQuery struct {
+	Since, Until time.Time
+	Sources      []string // glob patterns, as in pipeline sources
+	Severity     int      // records at this severity or more severe; -1 for any
+	Contains     string   // case-insensitive substring of the line
+	Regexp       *regexp.Regexp
+	After        uint64 // only records with a greater Seq
+	Limit        int    // the newest this many; 0 for all
+}
+
+// ParseLogQuery builds a query from URL parameters:
+//
+//	since, until  RFC 3339 time, or a duration back from now such as "15m"
+//	source        glob pattern, may be repeated
+//	severity      syslog severity or level name, or number, e.g. "warning", "warn" or "4"
+//	q             substring of the line, ignoring case
+//	regex         regular expression the line must match
+//	after         sequence number of the last record already seen
+//	limit         at most this many records, the newest; default 1000, 0 for all
+func ParseLogQuery(v url.Values) (LogQuery, error) {
+	q := LogQuery{Severity: -1, Sources: v["source"], Contains: v.Get("q"), Limit: defaultQueryLimit}
+
+	var err error
+	for _, src := range q.Sources {
+		if _, err := filepath.Match(src, ""); err != nil {
+			return q, fmt.Errorf("invalid source %q: %v", src, err)
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = parseQueryTime(s); err != nil {
+			return q, fmt.Errorf("invalid since %q: %v", s, err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = parseQueryTime(s); err != nil {
+			return q, fmt.Errorf("invalid until %q: %v", s, err)
+		}
+	}
+	if s := v.Get("severity"); s != "" {
+		var ok bool
+		if q.Severity, ok = severityRank(s); !ok {
+			return q, fmt.Errorf("invalid severity %q", s)
+		}
+	}
+	if s := v.Get("regex"); s != "" {
+		if q.Regexp, err = regexp.Compile(s); err != nil {
+			return q, fmt.Errorf("invalid regex %q: %v", s, err)
+		}
+	}
+	if s := v.Get("after"); s != "" {
+		if q.After, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return q, fmt.Errorf("invalid after %q", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	return q, nil
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Match reports whether e passes every filter of q.
+func (q *LogQuery) Match(e *RecentRecord) bool {
+	switch {
+	case e.Seq <= q.After:
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && e.Time.After(q.Until):
+		return false
+	case len(q.Sources) > 0 && !matchesAny(q.Sources, e.Source):
+		return false
+	case q.Severity >= 0 && !severityAtLeast(e.Fields, q.Severity):
+		return false
+	case q.Contains != "" && !strings.Contains(strings.ToLower(e.Line), strings.ToLower(q.Contains)):
+		return false
+	case q.Regexp != nil && !q.Regexp.MatchString(e.Line):
+		return false
+	}
+	return true
+}
+
+func matchesAny(patterns []string, source string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// levelSeverities maps the level names common in application logs to
+// syslog severities.
+var levelSeverities = map[string]int{
+	"fatal":         0,
+	"panic":         0,
+	"warn":          4,
+	"information":   6,
+	"informational": 6,
+	"trace":         7,
+}
+
+// severityRank converts a severity or level name, in any case, or a
+// number to a syslog severity.
+func severityRank(s string) (int, bool) {
+	s = strings.ToLower(s)
+	if n, ok := journalPriority(s); ok {
+		return n, true
+	}
+	n, ok := levelSeverities[s]
+	return n, ok
+}
+
+// severityAtLeast reports whether the record's severity field, or failing
+// that its level field, is max or more severe. Records without either do
+// not match.
+func severityAtLeast(fields map[string]string, max int) bool {
+	for _, name := range []string{"severity", "level"} {
+		v := fields[name]
+		if v == "" {
+			continue
+		}
+		n, ok := severityRank(v)
+		return ok && n <= max
+	}
+	return false
+}
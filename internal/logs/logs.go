@@ -0,0 +1,405 @@
+// Package logs collects log records from local files, the systemd journal,
+// the kernel log and the syslog receiver, runs them through the configured pipelines and hands them to
+// the sinks.
+package logs
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recordQueueSize = 1024
+	// sinkQueueSize is how many records an acknowledging sink may fall
+	// behind before inputs that can read records again are held back and
+	// records from the others are no longer queued for it. The queue has
+	// room beyond that for records already read when inputs are held.
+	sinkQueueSize = 10000
+	sinkHeadroom  = 2 * recordQueueSize
+	// flushInterval is how often stages that hold records back, such as
+	// multiline, are checked for records that have waited long enough.
+	flushInterval = 500 * time.Millisecond
+)
+
+// Options configures log collection.
+type Options struct {
+	Files     TailOptions       `json:"files"`
+	Journal   JournalOptions    `json:"journal"`
+	Kmsg      KmsgOptions       `json:"kmsg"`
+	Syslog    SyslogOptions     `json:"syslog"`
+	Pipelines []PipelineOptions `json:"pipelines"`
+	Metrics   []MetricRule      `json:"metrics"`
+	Recent    RecentOptions     `json:"recent"`
+}
+
+// Sink receives every record, in the order records were read. Sinks that
+// do not acknowledge are called from the dispatching goroutine and must not
+// block; acknowledging sinks each run on their own goroutine and queue.
+type Sink func(r Record)
+
+type sink struct {
+	fn      Sink
+	acks    bool
+	queue   chan Record // acknowledging sinks only
+	pending int64       // records queued or being handed to fn
+}
+
+var (
+	sinksMu sync.Mutex
+	sinks   []*sink
+
+	inputs       []logInput
+	pipelines    []*pipeline
+	records      chan Record
+	dispatchDone chan struct{}
+	// abort is closed when Stop gives up waiting, so that dispatch no
+	// longer waits for room in a sink queue.
+	abort chan struct{}
+)
+
+// logInput is a running input that sends records until it is closed.
+type logInput interface {
+	Close()
+}
+
+// RegisterSink adds a sink. A sink registered with acks set acknowledges
+// each record itself once it has been delivered (see Record.Ack); a record
+// is acknowledged to its input when every such sink has done so. Without
+// acknowledging sinks records are acknowledged as soon as they have been
+// handed to all sinks.
+//
+// An acknowledging sink may block, for instance while its destination is
+// unreachable, without holding back the other sinks. Once it is
+// sinkQueueSize records behind, inputs whose records are read again after
+// a restart (files, the journal) wait, and records from the other inputs
+// (syslog, the kernel log) are not passed to it and are counted as
+// dropped.
+func RegisterSink(s Sink, acks bool) {
+	sk := &sink{fn: s, acks: acks}
+	if acks {
+		sk.queue = make(chan Record, sinkQueueSize+sinkHeadroom)
+		go sk.run()
+		setSinkQueued()
+	}
+	sinksMu.Lock()
+	sinks = append(sinks, sk)
+	sinksMu.Unlock()
+}
+
+func (s *sink) run() {
+	for r := range s.queue {
+		s.fn(r)
+		atomic.AddInt64(&s.pending, -1)
+	}
+}
+
+// sinksBehind reports whether an acknowledging sink has sinkQueueSize
+// records waiting.
+func sinksBehind() bool {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	for _, s := range sinks {
+		if s.acks && len(s.queue) >= sinkQueueSize {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForSinks holds back an input whose records can be read again while
+// an acknowledging sink is behind. It returns false if stop is closed
+// first.
+func waitForSinks(stop <-chan struct{}) bool {
+	for sinksBehind() {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// sinksIdle reports whether every acknowledging sink has been handed all
+// its queued records.
+func sinksIdle() bool {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	for _, s := range sinks {
+		if s.acks && atomic.LoadInt64(&s.pending) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks o as Start would, without opening files, listeners or
+// the journal, so that configuration errors can be reported at startup.
+// Options of inputs that are not enabled are not checked.
+func Validate(o Options) error {
+	for i, po := range o.Pipelines {
+		if _, err := newPipeline(po, i); err != nil {
+			return err
+		}
+	}
+	if _, err := newMetricRules(o.Metrics); err != nil {
+		return err
+	}
+	if len(o.Files.Paths) > 0 {
+		if _, _, err := o.Files.withDefaults(); err != nil {
+			return err
+		}
+	}
+	if o.Journal.Enabled {
+		if _, err := o.Journal.withDefaults(); err != nil {
+			return err
+		}
+	}
+	if o.Kmsg.Enabled {
+		if _, err := o.Kmsg.withDefaults(); err != nil {
+			return err
+		}
+	}
+	if o.Syslog.enabled() {
+		if _, _, err := o.Syslog.withDefaults(); err != nil {
+			return err
+		}
+	}
+	if o.Recent.Enabled {
+		if _, err := o.Recent.withDefaults(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start begins collecting logs. It is a no-op when no input is configured.
+func Start(o Options) error {
+	if len(o.Files.Paths) == 0 && !o.Journal.Enabled && !o.Kmsg.Enabled && !o.Syslog.enabled() {
+		return nil
+	}
+	ps := make([]*pipeline, 0, len(o.Pipelines))
+	for i, po := range o.Pipelines {
+		p, err := newPipeline(po, i)
+		if err != nil {
+			return err
+		}
+		ps = append(ps, p)
+	}
+	if err := configureMetricRules(o.Metrics); err != nil {
+		return err
+	}
+	var t *Tailer
+	if len(o.Files.Paths) > 0 {
+		var err error
+		if t, err = NewTailer(o.Files); err != nil {
+			return err
+		}
+	}
+
+	out := make(chan Record, recordQueueSize)
+	var started []logInput
+	if o.Journal.Enabled {
+		j, err := startJournal(o.Journal, out)
+		if err != nil {
+			return err
+		}
+		started = append(started, j)
+		log.Printf("Reading the systemd journal")
+	}
+	if o.Kmsg.Enabled {
+		k, err := startKmsg(o.Kmsg, out)
+		if err != nil {
+			closeInputs(started)
+			return err
+		}
+		started = append(started, k)
+		log.Printf("Reading the kernel log")
+	}
+	if o.Syslog.enabled() {
+		s, err := startSyslog(o.Syslog, out)
+		if err != nil {
+			closeInputs(started)
+			return err
+		}
+		started = append(started, s)
+		log.Printf("Receiving syslog: udp=%q tcp=%q tls=%q", o.Syslog.UDP, o.Syslog.TCP, o.Syslog.TLS)
+	}
+	if t != nil {
+		go t.Run(out)
+		started = append(started, t)
+		log.Printf("Tailing logs: %v", o.Files.Paths)
+	}
+
+	if len(o.Metrics) > 0 {
+		RegisterSink(observeRecord, false)
+	}
+	if o.Recent.Enabled {
+		b, err := openRecent(o.Recent)
+		if err != nil {
+			closeInputs(started)
+			return err
+		}
+		recent = b
+	}
+	inputs, pipelines, records = started, ps, out
+	dispatchDone, abort = make(chan struct{}), make(chan struct{})
+	go dispatch(records)
+	return nil
+}
+
+// Stop stops the inputs and returns once every record read has been handed
+// to the sinks, or after timeout. Records not handed to an acknowledging
+// sink by then are not acknowledged, so they are read again after a
+// restart. Call SavePositions after the sinks have been drained.
+func Stop(timeout time.Duration) {
+	if records == nil {
+		return
+	}
+	deadline := time.After(timeout)
+	closeInputs(inputs)
+	close(records)
+	drained := false
+	select {
+	case <-dispatchDone:
+		drained = sinksDrained(deadline)
+	case <-deadline:
+		close(abort)
+		<-dispatchDone
+	}
+	if !drained {
+		log.Printf("Log records not handed to every sink before shutdown")
+	}
+	if recent != nil {
+		recent.close()
+	}
+}
+
+// sinksDrained waits until every acknowledging sink has been handed its
+// queued records, or deadline passes.
+func sinksDrained(deadline <-chan time.Time) bool {
+	for !sinksIdle() {
+		select {
+		case <-deadline:
+			return false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+func closeInputs(ins []logInput) {
+	for _, in := range ins {
+		in.Close()
+	}
+}
+
+// SavePositions persists the positions and cursors acknowledged so far.
+func SavePositions() {
+	for _, in := range inputs {
+		if p, ok := in.(interface{ savePositions() }); ok {
+			p.savePositions()
+		}
+	}
+}
+
+// dispatch runs records through their pipeline and delivers the results
+// to the sinks in the order they were read. Records still held by the
+// pipelines are delivered when in is closed.
+func dispatch(in <-chan Record) {
+	defer close(dispatchDone)
+	tick := time.NewTicker(flushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case r, ok := <-in:
+			if !ok {
+				for _, p := range pipelines {
+					deliverAll(p.flush(time.Now(), true))
+				}
+				return
+			}
+			if p := pipelineFor(r.Source); p != nil {
+				deliverAll(p.process(r))
+			} else {
+				deliver(r)
+			}
+		case now := <-tick.C:
+			for _, p := range pipelines {
+				deliverAll(p.flush(now, false))
+			}
+		}
+	}
+}
+
+func pipelineFor(source string) *pipeline {
+	for _, p := range pipelines {
+		if p.matches(source) {
+			return p
+		}
+	}
+	return nil
+}
+
+func deliverAll(recs []Record) {
+	for _, r := range recs {
+		deliver(r)
+	}
+}
+
+// deliver adds one record to the recent buffer and hands it to every sink:
+// directly to those that do not acknowledge, through its queue to each that
+// does. The buffer is fed whatever state the sinks are in, so that /logs
+// keeps working while a destination is unreachable.
+func deliver(r Record) {
+	if recent != nil {
+		recent.add(r)
+	}
+
+	sinksMu.Lock()
+	current := sinks
+	sinksMu.Unlock()
+
+	ackers := 0
+	for _, s := range current {
+		if s.acks {
+			ackers++
+		}
+	}
+	if ackers > 1 && r.ack != nil {
+		r.ack = ackAfter(ackers, r.ack)
+	}
+	for _, s := range current {
+		if !s.acks {
+			s.fn(r)
+			continue
+		}
+		// Records that cannot be read again are dropped rather than
+		// holding back inputs that would then lose records themselves.
+		if r.ack == nil && len(s.queue) >= sinkQueueSize {
+			recordSinkDropped()
+			continue
+		}
+		atomic.AddInt64(&s.pending, 1)
+		select {
+		case s.queue <- r:
+		case <-abort:
+			atomic.AddInt64(&s.pending, -1)
+		}
+	}
+	if ackers == 0 {
+		r.Ack()
+	}
+}
+
+// ackAfter returns an ack function that calls ack on its n-th call.
+func ackAfter(n int, ack func()) func() {
+	remaining := int32(n)
+	return func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			ack()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package logs
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Options{
+		Files:     TailOptions{Paths: []string{"/var/log/*.log"}, PollInterval: "2s"},
+		Kmsg:      KmsgOptions{Enabled: true, StartAt: "beginning"},
+		Syslog:    SyslogOptions{UDP: ":514", ReadTimeout: "1m"},
+		Pipelines: []PipelineOptions{{Stages: []StageOptions{{Type: "json"}}}},
+		Metrics:   []MetricRule{{Name: "app_errors_total", Type: "counter"}},
+		Recent:    RecentOptions{Enabled: true},
+	}
+	if err := Validate(valid); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	// Options of inputs that are off are not checked.
+	if err := Validate(Options{Files: TailOptions{StartAt: "middle"}, Kmsg: KmsgOptions{StartAt: "middle"}}); err != nil {
+		t.Errorf("disabled inputs: %v", err)
+	}
+
+	for name, o := range map[string]Options{
+		"pipeline":     {Pipelines: []PipelineOptions{{Stages: []StageOptions{{Type: "xml"}}}}},
+		"metrics":      {Metrics: []MetricRule{{Name: "logs_exporter_lines_total", Type: "counter"}}},
+		"files":        {Files: TailOptions{Paths: []string{"/var/log/*.log"}, PollInterval: "often"}},
+		"journal":      {Journal: JournalOptions{Enabled: true, Reader: "socket"}},
+		"journal unit": {Journal: JournalOptions{Enabled: true, Units: []string{"app-["}}},
+		"kmsg":         {Kmsg: KmsgOptions{Enabled: true, StartAt: "middle"}},
+		"syslog":       {Syslog: SyslogOptions{TCP: ":514", ReadTimeout: "-1s"}},
+		"syslog tls":   {Syslog: SyslogOptions{TLS: ":6514"}},
+		"recent":       {Recent: RecentOptions{Enabled: true, MaxRecords: -1}},
+	} {
+		if err := Validate(o); err == nil {
+			t.Errorf("%s: Validate succeeded, want an error", name)
+		}
+	}
+	if runtime.GOOS == "linux" {
+		if err := Validate(Options{Journal: JournalOptions{Enabled: true, Priority: "err", Units: []string{"nginx"}}}); err != nil {
+			t.Errorf("journal: %v", err)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package logs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fileStats are the tailing counters of one path.
+type fileStats struct {
+	lines     uint64
+	bytes     uint64
+	errors    uint64
+	rotations map[string]uint64 // by kind: rename, truncate, catch_up
+}
+
+// pipelineStats are the counters of one pipeline.
+type pipelineStats struct {
+	records    uint64
+	failures   map[string]uint64 // by stage type
+	redactions map[string]uint64 // by detector or rule name
+	dropped    map[string]uint64 // by reason
+}
+
+// syslogKey labels syslog message counts.
+type syslogKey struct {
+	transport, facility, severity string
+}
+
+var (
+	statsMu        sync.Mutex
+	tailStats      = make(map[string]*fileStats)
+	filesWatched   int
+	pipelineCounts = make(map[string]*pipelineStats)
+	syslogMessages = make(map[syslogKey]uint64)
+	syslogErrors   = make(map[[2]string]uint64) // by transport and kind
+
+	journalEntries  uint64
+	journalRestarts uint64
+	journalStarted  bool
+
+	// kernelEvents counts kmsg events by event and label value (process,
+	// device or source/type); kernelMissed counts overwritten records.
+	kernelEvents  = make(map[string]map[string]uint64)
+	kernelMissed  uint64
+	kernelStarted bool
+
+	followSkipped uint64
+
+	// sinkDropped counts records not queued for an acknowledging sink
+	// that was behind; sinkQueued is set once such a sink exists.
+	sinkDropped uint64
+	sinkQueued  bool
+)
+
+// maxKernelLabels bounds the label values kept per kernel event; further
+// values are counted as "other".
+const maxKernelLabels = 200
+
+// kernelMetrics are the metrics derived from kmsg events, in output order.
+var kernelMetrics = []struct {
+	event, name, help, label string
+}{
+	{"oom_kill", "logs_exporter_kernel_oom_kills_total", "Processes killed by the OOM killer, by victim process name.", "process"},
+	{"segfault", "logs_exporter_kernel_segfaults_total", "Segmentation faults reported by the kernel, by process name.", "process"},
+	{"io_error", "logs_exporter_kernel_io_errors_total", "Block device I/O errors reported by the kernel, by device.", "device"},
+	{"hung_task", "logs_exporter_kernel_hung_tasks_total", "Hung task warnings, by task name.", "process"},
+	{"hardware_error", "logs_exporter_kernel_hardware_errors_total", "Machine check (mce) and EDAC memory errors, by source and type.", ""},
+}
+
+func fileStatsFor(path string) *fileStats {
+	s, ok := tailStats[path]
+	if !ok {
+		s = &fileStats{rotations: make(map[string]uint64)}
+		tailStats[path] = s
+	}
+	return s
+}
+
+func recordLineRead(path string) {
+	statsMu.Lock()
+	fileStatsFor(path).lines++
+	statsMu.Unlock()
+}
+
+func recordBytesRead(path string, n int) {
+	statsMu.Lock()
+	fileStatsFor(path).bytes += uint64(n)
+	statsMu.Unlock()
+}
+
+func recordRotation(path, kind string) {
+	statsMu.Lock()
+	fileStatsFor(path).rotations[kind]++
+	statsMu.Unlock()
+}
+
+// recordTailError counts a read error. Errors are not logged, since a
+// missing or unreadable file fails the same way on every poll.
+func recordTailError(path string, err error) {
+	statsMu.Lock()
+	fileStatsFor(path).errors++
+	statsMu.Unlock()
+}
+
+func pipelineStatsFor(name string) *pipelineStats {
+	s, ok := pipelineCounts[name]
+	if !ok {
+		s = &pipelineStats{
+			failures:   make(map[string]uint64),
+			redactions: make(map[string]uint64),
+			dropped:    make(map[string]uint64),
+		}
+		pipelineCounts[name] = s
+	}
+	return s
+}
+
+func recordPipelineInput(name string) {
+	statsMu.Lock()
+	pipelineStatsFor(name).records++
+	statsMu.Unlock()
+}
+
+func recordParseFailure(name, stage string) {
+	statsMu.Lock()
+	pipelineStatsFor(name).failures[stage]++
+	statsMu.Unlock()
+}
+
+func recordRedaction(pipeline, detector string) {
+	statsMu.Lock()
+	pipelineStatsFor(pipeline).redactions[detector]++
+	statsMu.Unlock()
+}
+
+// recordDropped counts a record a pipeline stage discarded.
+func recordDropped(pipeline, reason string) {
+	statsMu.Lock()
+	pipelineStatsFor(pipeline).dropped[reason]++
+	statsMu.Unlock()
+}
+
+// recordSyslogMessage counts a received message; facility and severity are
+// empty for messages without a priority.
+func recordSyslogMessage(transport, facility, severity string) {
+	if facility == "" {
+		facility, severity = "none", "none"
+	}
+	statsMu.Lock()
+	syslogMessages[syslogKey{transport, facility, severity}]++
+	statsMu.Unlock()
+}
+
+func recordSyslogError(transport, kind string) {
+	statsMu.Lock()
+	syslogErrors[[2]string{transport, kind}]++
+	statsMu.Unlock()
+}
+
+func recordJournalEntry() {
+	statsMu.Lock()
+	journalEntries++
+	journalStarted = true
+	statsMu.Unlock()
+}
+
+func recordJournalRestart() {
+	statsMu.Lock()
+	journalRestarts++
+	journalStarted = true
+	statsMu.Unlock()
+}
+
+// recordKernelEvent counts an event detected in the kernel log, labelled
+// from its fields.
+func recordKernelEvent(event string, fields map[string]string) {
+	label := fields["hw_source"] + "\x00" + fields["hw_type"]
+	for _, m := range kernelMetrics {
+		if m.event == event && m.label != "" {
+			label = fields[m.label]
+		}
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	kernelStarted = true
+	counts, ok := kernelEvents[event]
+	if !ok {
+		counts = make(map[string]uint64)
+		kernelEvents[event] = counts
+	}
+	if _, seen := counts[label]; !seen && len(counts) >= maxKernelLabels {
+		label = "other"
+	}
+	counts[label]++
+}
+
+func recordKernelMissed() {
+	statsMu.Lock()
+	kernelMissed++
+	kernelStarted = true
+	statsMu.Unlock()
+}
+
+// setKernelStarted makes the kernel metrics appear, at zero, once the
+// kmsg input runs.
+func setKernelStarted() {
+	statsMu.Lock()
+	kernelStarted = true
+	statsMu.Unlock()
+}
+
+func recordSinkDropped() {
+	statsMu.Lock()
+	sinkDropped++
+	statsMu.Unlock()
+}
+
+func setSinkQueued() {
+	statsMu.Lock()
+	sinkQueued = true
+	statsMu.Unlock()
+}
+
+// recordFollowSkipped counts a record not sent to a /logs follower whose
+// queue was full.
+func recordFollowSkipped() {
+	statsMu.Lock()
+	followSkipped++
+	statsMu.Unlock()
+}
+
+func setFilesWatched(n int) {
+	statsMu.Lock()
+	filesWatched = n
+	statsMu.Unlock()
+}
+
+// GenerateMetrics returns the log collection metrics in Prometheus text
+// format, to be appended to the collectors' output.
+func GenerateMetrics() string {
+	var sb strings.Builder
+	statsMu.Lock()
+	writeTailMetrics(&sb)
+	writePipelineMetrics(&sb)
+	writeSyslogMetrics(&sb)
+	writeJournalMetrics(&sb)
+	writeKernelMetrics(&sb)
+	writeSinkMetrics(&sb)
+	statsMu.Unlock()
+	writeRuleMetrics(&sb)
+	writeRecentMetrics(&sb)
+	return sb.String()
+}
+
+func writeTailMetrics(sb *strings.Builder) {
+	if len(tailStats) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(tailStats))
+	for p := range tailStats {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	sb.WriteString("# HELP logs_exporter_log_files_watched Log files currently tailed.\n")
+	sb.WriteString("# TYPE logs_exporter_log_files_watched gauge\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_log_files_watched %d\n\n", filesWatched))
+
+	sb.WriteString("# HELP logs_exporter_log_lines_read_total Lines read from each tailed file.\n")
+	sb.WriteString("# TYPE logs_exporter_log_lines_read_total counter\n")
+	for _, p := range paths {
+		sb.WriteString(fmt.Sprintf("logs_exporter_log_lines_read_total{path=\"%s\"} %d\n", escapeLabel(p), tailStats[p].lines))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_log_bytes_read_total Bytes read from each tailed file.\n")
+	sb.WriteString("# TYPE logs_exporter_log_bytes_read_total counter\n")
+	for _, p := range paths {
+		sb.WriteString(fmt.Sprintf("logs_exporter_log_bytes_read_total{path=\"%s\"} %d\n", escapeLabel(p), tailStats[p].bytes))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_log_read_errors_total Errors opening or reading each tailed file.\n")
+	sb.WriteString("# TYPE logs_exporter_log_read_errors_total counter\n")
+	for _, p := range paths {
+		sb.WriteString(fmt.Sprintf("logs_exporter_log_read_errors_total{path=\"%s\"} %d\n", escapeLabel(p), tailStats[p].errors))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_log_rotations_total Rotations detected per file, by kind (rename, truncate, catch_up).\n")
+	sb.WriteString("# TYPE logs_exporter_log_rotations_total counter\n")
+	for _, p := range paths {
+		kinds := make([]string, 0, len(tailStats[p].rotations))
+		for k := range tailStats[p].rotations {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			sb.WriteString(fmt.Sprintf("logs_exporter_log_rotations_total{path=\"%s\",kind=\"%s\"} %d\n", escapeLabel(p), k, tailStats[p].rotations[k]))
+		}
+	}
+	sb.WriteString("\n")
+}
+
+func writePipelineMetrics(sb *strings.Builder) {
+	if len(pipelineCounts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(pipelineCounts))
+	for n := range pipelineCounts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	sb.WriteString("# HELP logs_exporter_log_pipeline_records_total Records entering each pipeline.\n")
+	sb.WriteString("# TYPE logs_exporter_log_pipeline_records_total counter\n")
+	for _, n := range names {
+		sb.WriteString(fmt.Sprintf("logs_exporter_log_pipeline_records_total{pipeline=\"%s\"} %d\n", escapeLabel(n), pipelineCounts[n].records))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP logs_exporter_log_parse_failures_total Records a parser stage could not parse, by pipeline and stage type.\n")
+	sb.WriteString("# TYPE logs_exporter_log_parse_failures_total counter\n")
+	for _, n := range names {
+		stages := make([]string, 0, len(pipelineCounts[n].failures))
+		for st := range pipelineCounts[n].failures {
+			stages = append(stages, st)
+		}
+		sort.Strings(stages)
+		for _, st := range stages {
+			sb.WriteString(fmt.Sprintf("logs_exporter_log_parse_failures_total{pipeline=\"%s\",stage=\"%s\"} %d\n", escapeLabel(n), st, pipelineCounts[n].failures[st]))
+		}
+	}
+	sb.WriteString("\n")
+
+	writePipelineCounter(sb, names, "logs_exporter_log_redactions_total",
+		"Values redacted, by pipeline and detector or rule.", "detector",
+		func(ps *pipelineStats) map[string]uint64 { return ps.redactions })
+	writePipelineCounter(sb, names, "logs_exporter_log_records_dropped_total",
+		"Records discarded by pipeline stages, by pipeline and reason.", "reason",
+		func(ps *pipelineStats) map[string]uint64 { return ps.dropped })
+}
+
+// writePipelineCounter writes a per-pipeline counter keyed by label.
+func writePipelineCounter(sb *strings.Builder, names []string, name, help, label string, counts func(*pipelineStats) map[string]uint64) {
+	sb.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+	sb.WriteString(fmt.Sprintf("# TYPE %s counter\n", name))
+	for _, n := range names {
+		m := counts(pipelineCounts[n])
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sb.WriteString(fmt.Sprintf("%s{pipeline=\"%s\",%s=\"%s\"} %d\n", name, escapeLabel(n), label, escapeLabel(k), m[k]))
+		}
+	}
+	sb.WriteString("\n")
+}
+
+func writeSyslogMetrics(sb *strings.Builder) {
+	if len(syslogMessages) == 0 && len(syslogErrors) == 0 {
+		return
+	}
+	keys := make([]syslogKey, 0, len(syslogMessages))
+	for k := range syslogMessages {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.transport != b.transport {
+			return a.transport < b.transport
+		}
+		if a.facility != b.facility {
+			return a.facility < b.facility
+		}
+		return a.severity < b.severity
+	})
+	sb.WriteString("# HELP logs_exporter_syslog_messages_total Syslog messages received, by transport, facility and severity.\n")
+	sb.WriteString("# TYPE logs_exporter_syslog_messages_total counter\n")
+	for _, k := range keys {
+		sb.WriteString(fmt.Sprintf("logs_exporter_syslog_messages_total{transport=\"%s\",facility=\"%s\",severity=\"%s\"} %d\n", k.transport, k.facility, k.severity, syslogMessages[k]))
+	}
+	sb.WriteString("\n")
+
+	errKeys := make([][2]string, 0, len(syslogErrors))
+	for k := range syslogErrors {
+		errKeys = append(errKeys, k)
+	}
+	sort.Slice(errKeys, func(i, j int) bool {
+		if errKeys[i][0] != errKeys[j][0] {
+			return errKeys[i][0] < errKeys[j][0]
+		}
+		return errKeys[i][1] < errKeys[j][1]
+	})
+	sb.WriteString("# HELP logs_exporter_syslog_errors_total Syslog receive errors, by transport and kind (read, accept, handshake, timeout, rejected, framing, too_long, parse).\n")
+	sb.WriteString("# TYPE logs_exporter_syslog_errors_total counter\n")
+	for _, k := range errKeys {
+		sb.WriteString(fmt.Sprintf("logs_exporter_syslog_errors_total{transport=\"%s\",kind=\"%s\"} %d\n", k[0], k[1], syslogErrors[k]))
+	}
+	sb.WriteString("\n")
+}
+
+func writeJournalMetrics(sb *strings.Builder) {
+	if !journalStarted {
+		return
+	}
+	sb.WriteString("# HELP logs_exporter_journal_entries_total Journal entries read.\n")
+	sb.WriteString("# TYPE logs_exporter_journal_entries_total counter\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_journal_entries_total %d\n\n", journalEntries))
+	sb.WriteString("# HELP logs_exporter_journal_restarts_total Times the journal reader failed and was restarted.\n")
+	sb.WriteString("# TYPE logs_exporter_journal_restarts_total counter\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_journal_restarts_total %d\n\n", journalRestarts))
+}
+
+func writeKernelMetrics(sb *strings.Builder) {
+	if !kernelStarted {
+		return
+	}
+	for _, m := range kernelMetrics {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n", m.name, m.help))
+		sb.WriteString(fmt.Sprintf("# TYPE %s counter\n", m.name))
+		counts := kernelEvents[m.event]
+		labels := make([]string, 0, len(counts))
+		for l := range counts {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			if m.label == "" {
+				src, typ, _ := strings.Cut(l, "\x00")
+				sb.WriteString(fmt.Sprintf("%s{source=\"%s\",type=\"%s\"} %d\n", m.name, escapeLabel(src), escapeLabel(typ), counts[l]))
+			} else {
+				sb.WriteString(fmt.Sprintf("%s{%s=\"%s\"} %d\n", m.name, m.label, escapeLabel(l), counts[l]))
+			}
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("# HELP logs_exporter_kernel_records_missed_total Times kernel log records were overwritten before they were read.\n")
+	sb.WriteString("# TYPE logs_exporter_kernel_records_missed_total counter\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_kernel_records_missed_total %d\n\n", kernelMissed))
+}
+
+func writeSinkMetrics(sb *strings.Builder) {
+	if !sinkQueued {
+		return
+	}
+	sb.WriteString("# HELP logs_exporter_log_sink_dropped_total Syslog and kernel records not passed to a log sink that had fallen behind.\n")
+	sb.WriteString("# TYPE logs_exporter_log_sink_dropped_total counter\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_log_sink_dropped_total %d\n\n", sinkDropped))
+}
+
+// writeRecentMetrics takes statsMu itself: the buffer counts records
+// under its own lock, which is held while calling recordFollowSkipped.
+func writeRecentMetrics(sb *strings.Builder) {
+	if recent == nil {
+		return
+	}
+	sb.WriteString("# HELP logs_exporter_log_buffer_records Records held in memory for search on /logs.\n")
+	sb.WriteString("# TYPE logs_exporter_log_buffer_records gauge\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_log_buffer_records %d\n\n", recent.size()))
+	statsMu.Lock()
+	skipped := followSkipped
+	statsMu.Unlock()
+	sb.WriteString("# HELP logs_exporter_log_follow_skipped_total Records not sent to /logs followers that fell behind.\n")
+	sb.WriteString("# TYPE logs_exporter_log_follow_skipped_total counter\n")
+	sb.WriteString(fmt.Sprintf("logs_exporter_log_follow_skipped_total %d\n\n", skipped))
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
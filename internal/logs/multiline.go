@@ -0,0 +1,111 @@
+package logs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMultilineMaxLines = 500
+	defaultMultilineTimeout  = 2 * time.Second
+)
+
+// multiline joins lines that belong to one event, such as a stack trace,
+// into a single record. Lines are grouped per source.
+type multiline struct {
+	start    *regexp.Regexp
+	indent   bool
+	maxLines int
+	timeout  time.Duration
+
+	pending map[string]*pendingRecord
+}
+
+type pendingRecord struct {
+	lines []Record
+	last  time.Time // when the last line was added
+}
+
+func newMultiline(o StageOptions) (*multiline, error) {
+	if o.Start == "" && !o.Indent {
+		return nil, fmt.Errorf("multiline needs start or indent")
+	}
+	m := &multiline{
+		indent:   o.Indent,
+		maxLines: o.MaxLines,
+		timeout:  defaultMultilineTimeout,
+		pending:  make(map[string]*pendingRecord),
+	}
+	if o.Start != "" {
+		re, err := regexp.Compile(o.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start pattern: %v", err)
+		}
+		m.start = re
+	}
+	if m.maxLines <= 0 {
+		m.maxLines = defaultMultilineMaxLines
+	}
+	if o.Timeout != "" {
+		d, err := time.ParseDuration(o.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", o.Timeout)
+		}
+		m.timeout = d
+	}
+	return m, nil
+}
+
+// continues reports whether line belongs to the record before it.
+func (m *multiline) continues(line string) bool {
+	if m.indent && line != "" && (line[0] == ' ' || line[0] == '\t') {
+		return true
+	}
+	if m.start != nil {
+		return !m.start.MatchString(line)
+	}
+	return false
+}
+
+func (m *multiline) process(r Record) []Record {
+	p := m.pending[r.Source]
+	if p != nil && m.continues(r.Line) && len(p.lines) < m.maxLines {
+		p.lines = append(p.lines, r)
+		p.last = time.Now()
+		return nil
+	}
+	var out []Record
+	if p != nil {
+		out = append(out, join(p.lines))
+	}
+	m.pending[r.Source] = &pendingRecord{lines: []Record{r}, last: time.Now()}
+	return out
+}
+
+func (m *multiline) flush(now time.Time, all bool) []Record {
+	var out []Record
+	for src, p := range m.pending {
+		if all || now.Sub(p.last) >= m.timeout {
+			out = append(out, join(p.lines))
+			delete(m.pending, src)
+		}
+	}
+	return out
+}
+
+// join combines lines into the first one, which keeps its time and fields.
+func join(lines []Record) Record {
+	r := lines[0]
+	if len(lines) == 1 {
+		return r
+	}
+	text := make([]string, len(lines))
+	for i, l := range lines {
+		text[i] = l.Line
+	}
+	r.Line = strings.Join(text, "\n")
+	r.ack = mergeAcks(lines)
+	return r
+}
@@ -0,0 +1,223 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// regexParser sets a field for each named group of a pattern.
+type regexParser struct {
+	re     *regexp.Regexp
+	field  string
+	prefix string
+}
+
+func newRegexParser(o StageOptions) (*regexParser, error) {
+	if o.Pattern == "" {
+		return nil, fmt.Errorf("regex needs a pattern")
+	}
+	re, err := regexp.Compile(o.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		named = named || name != ""
+	}
+	if !named {
+		return nil, fmt.Errorf("pattern %q has no named groups", o.Pattern)
+	}
+	return &regexParser{re: re, field: o.Field, prefix: o.Prefix}, nil
+}
+
+func (p *regexParser) parse(r *Record) bool {
+	text, ok := input(*r, p.field)
+	if !ok {
+		return false
+	}
+	m := p.re.FindStringSubmatchIndex(text)
+	if m == nil {
+		return false
+	}
+	for i, name := range p.re.SubexpNames() {
+		if name != "" && m[2*i] >= 0 {
+			setField(r, p.prefix+name, text[m[2*i]:m[2*i+1]])
+		}
+	}
+	return true
+}
+
+// combinedPattern matches the NCSA combined log format written by nginx
+// and Apache; the referer and user agent are optional, which also covers
+// the common log format.
+const combinedPattern = `^(?P<remote_addr>\S+) \S+ (?P<remote_user>\S+) \[(?P<time_local>[^\]]+)\] ` +
+	`"(?P<method>[A-Z]+) (?P<path>[^ "]*)(?: (?P<protocol>[^"]*))?" (?P<status>\d{3}) (?P<body_bytes_sent>\d+|-)` +
+	`(?: "(?P<referer>[^"]*)" "(?P<user_agent>[^"]*)")?`
+
+var combinedRE = regexp.MustCompile(combinedPattern)
+
+func newCombinedParser(o StageOptions) *regexParser {
+	return &regexParser{re: combinedRE, field: o.Field, prefix: o.Prefix}
+}
+
+// jsonParser sets a field for each member of a JSON object. Nested objects
+// are flattened with dotted names; arrays are kept as JSON text.
+type jsonParser struct {
+	field  string
+	prefix string
+}
+
+func (p *jsonParser) parse(r *Record) bool {
+	text, ok := input(*r, p.field)
+	if !ok {
+		return false
+	}
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") {
+		return false
+	}
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return false
+	}
+	flattenJSON(r, p.prefix, obj)
+	return true
+}
+
+func flattenJSON(r *Record, prefix string, obj map[string]interface{}) {
+	for k, v := range obj {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenJSON(r, prefix+k+".", v)
+		case string:
+			setField(r, prefix+k, v)
+		case json.Number:
+			setField(r, prefix+k, v.String())
+		case bool:
+			setField(r, prefix+k, strconv.FormatBool(v))
+		case nil:
+			setField(r, prefix+k, "")
+		default:
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.Encode(v)
+			setField(r, prefix+k, strings.TrimSuffix(buf.String(), "\n"))
+		}
+	}
+}
+
+// logfmtParser reads key=value pairs. Values may be double-quoted with Go
+// escapes; a key without "=" is set to "true".
+type logfmtParser struct {
+	field  string
+	prefix string
+}
+
+func (p *logfmtParser) parse(r *Record) bool {
+	text, ok := input(*r, p.field)
+	if !ok {
+		return false
+	}
+	pairs, ok := parseLogfmt(text)
+	if !ok {
+		return false
+	}
+	for _, kv := range pairs {
+		setField(r, p.prefix+kv[0], kv[1])
+	}
+	return true
+}
+
+// parseLogfmt splits text into key/value pairs. It fails on text without a
+// single key=value pair, so that free text is not taken for flags.
+func parseLogfmt(text string) ([][2]string, bool) {
+	var pairs [][2]string
+	sawValue := false
+	i := 0
+	for i < len(text) {
+		for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+			i++
+		}
+		if i >= len(text) {
+			break
+		}
+		start := i
+		for i < len(text) && text[i] != '=' && text[i] != ' ' && text[i] != '\t' {
+			i++
+		}
+		key := text[start:i]
+		if key == "" || strings.ContainsRune(key, '"') {
+			return nil, false
+		}
+		if i >= len(text) || text[i] != '=' {
+			pairs = append(pairs, [2]string{key, "true"})
+			continue
+		}
+		i++ // '='
+		var value string
+		if i < len(text) && text[i] == '"' {
+			end := closingQuote(text, i)
+			if end < 0 {
+				return nil, false
+			}
+			v, err := strconv.Unquote(text[i : end+1])
+			if err != nil {
+				return nil, false
+			}
+			value, i = v, end+1
+		} else {
+			start := i
+			for i < len(text) && !unicode.IsSpace(rune(text[i])) {
+				i++
+			}
+			value = text[start:i]
+		}
+		pairs = append(pairs, [2]string{key, value})
+		sawValue = true
+	}
+	return pairs, sawValue
+}
+
+// closingQuote returns the index of the quote that ends the string
+// starting at text[open], or -1.
+func closingQuote(text string, open int) int {
+	for i := open + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// syslogParser reads RFC 5424 and RFC 3164 messages, with or without the
+// leading priority.
+type syslogParser struct {
+	field  string
+	prefix string
+}
+
+func (p *syslogParser) parse(r *Record) bool {
+	text, ok := input(*r, p.field)
+	if !ok {
+		return false
+	}
+	m, ok := parseSyslog(text)
+	if !ok {
+		return false
+	}
+	for k, v := range m.fields() {
+		setField(r, p.prefix+k, v)
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package logs
+
+import (
+	"reflect"
+	"testing"
+)
+
+// parseLine runs a parse stage over one line and returns the record's
+// fields and whether it parsed.
+func parseLine(t *testing.T, o StageOptions, line string) (map[string]string, bool) {
+	t.Helper()
+	s := mustStage(t, o).(*parseStage)
+	r := Record{Line: line}
+	ok := s.parse(&r)
+	return r.Fields, ok
+}
+
+func TestParsers(t *testing.T) {
+	tests := []struct {
+		name string
+		opts StageOptions
+		line string
+		want map[string]string // nil: the line must not parse
+	}{
+		{
+			name: "regex named groups",
+			opts: StageOptions{Type: "regex", Pattern: `^(?P<level>[A-Z]+) \[(?P<thread>[^\]]+)\] (?P<msg>.*)`},
+			line: "WARN [main] disk almost full",
+			want: map[string]string{"level": "WARN", "thread": "main", "msg": "disk almost full"},
+		},
+		{
+			name: "regex optional group unset",
+			opts: StageOptions{Type: "regex", Pattern: `^(?P<a>\w+)(?: (?P<b>\d+))?$`, Prefix: "x_"},
+			line: "word",
+			want: map[string]string{"x_a": "word"},
+		},
+		{
+			name: "regex no match",
+			opts: StageOptions{Type: "regex", Pattern: `^(?P<n>\d+)$`},
+			line: "abc",
+		},
+		{
+			name: "json nested and typed",
+			opts: StageOptions{Type: "json"},
+			line: `{"level":"error","status":502,"ok":false,"user":{"id":"u1","geo":{"cc":"DE"}},"tags":["a","b"],"gone":null,"big":12345678901234567890}`,
+			want: map[string]string{
+				"level": "error", "status": "502", "ok": "false", "user.id": "u1", "user.geo.cc": "DE",
+				"tags": `["a","b"]`, "gone": "", "big": "12345678901234567890",
+			},
+		},
+		{
+			name: "json not an object",
+			opts: StageOptions{Type: "json"},
+			line: `["a"]`,
+		},
+		{
+			name: "json truncated",
+			opts: StageOptions{Type: "json"},
+			line: `{"level":"info"`,
+		},
+		{
+			name: "logfmt",
+			opts: StageOptions{Type: "logfmt"},
+			line: `ts=2024-05-01T12:00:00Z level=info msg="user \"bob\" logged in" dry_run duration=1.5ms`,
+			want: map[string]string{
+				"ts": "2024-05-01T12:00:00Z", "level": "info", "msg": `user "bob" logged in`,
+				"dry_run": "true", "duration": "1.5ms",
+			},
+		},
+		{
+			name: "logfmt free text",
+			opts: StageOptions{Type: "logfmt"},
+			line: "just some words",
+		},
+		{
+			name: "logfmt unterminated quote",
+			opts: StageOptions{Type: "logfmt"},
+			line: `msg="oops`,
+		},
+		{
+			name: "combined",
+			opts: StageOptions{Type: "combined"},
+			line: `203.0.113.7 - alice [10/Oct/2023:13:55:36 +0200] "GET /api/items?id=3 HTTP/1.1" 200 2326 "https://example.com/" "curl/8.0"`,
+			want: map[string]string{
+				"remote_addr": "203.0.113.7", "remote_user": "alice", "time_local": "10/Oct/2023:13:55:36 +0200",
+				"method": "GET", "path": "/api/items?id=3", "protocol": "HTTP/1.1", "status": "200",
+				"body_bytes_sent": "2326", "referer": "https://example.com/", "user_agent": "curl/8.0",
+			},
+		},
+		{
+			name: "common log format",
+			opts: StageOptions{Type: "apache"},
+			line: `127.0.0.1 - - [10/Oct/2023:13:55:36 -0700] "POST /login HTTP/1.0" 401 -`,
+			want: map[string]string{
+				"remote_addr": "127.0.0.1", "remote_user": "-", "time_local": "10/Oct/2023:13:55:36 -0700",
+				"method": "POST", "path": "/login", "protocol": "HTTP/1.0", "status": "401", "body_bytes_sent": "-",
+			},
+		},
+		{
+			name: "combined garbage",
+			opts: StageOptions{Type: "nginx"},
+			line: "not an access log line",
+		},
+		{
+			name: "syslog rfc5424 with structured data",
+			opts: StageOptions{Type: "syslog"},
+			line: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Appli\"cation"][origin ip="192.0.2.1"] ` + "\ufeff" + `An application event`,
+			want: map[string]string{
+				"priority": "165", "facility": "local4", "severity": "notice",
+				"timestamp": "2003-10-11T22:14:15.003Z", "hostname": "mymachine.example.com",
+				"app_name": "evntslog", "msg_id": "ID47",
+				"sd.exampleSDID@32473.iut": "3", "sd.exampleSDID@32473.eventSource": `Appli"cation`,
+				"sd.origin.ip": "192.0.2.1", "message": "An application event",
+			},
+		},
+		{
+			name: "syslog rfc5424 without structured data",
+			opts: StageOptions{Type: "syslog", Prefix: "s_"},
+			line: `<34>1 - host app 1234 - - started`,
+			want: map[string]string{
+				"s_priority": "34", "s_facility": "auth", "s_severity": "crit",
+				"s_hostname": "host", "s_app_name": "app", "s_proc_id": "1234", "s_message": "started",
+			},
+		},
+		{
+			name: "syslog rfc3164 from a file, without priority",
+			opts: StageOptions{Type: "syslog"},
+			line: `2024-05-01T12:00:00+02:00 web1 sshd[811]: Accepted publickey for root`,
+			want: map[string]string{
+				"timestamp": "2024-05-01T12:00:00+02:00", "hostname": "web1",
+				"app_name": "sshd", "proc_id": "811", "message": "Accepted publickey for root",
+			},
+		},
+		{
+			name: "syslog rfc3164 to a local socket, without hostname",
+			opts: StageOptions{Type: "syslog"},
+			line: `<13>2024-05-01T12:00:00Z cron[42]: job done`,
+			want: map[string]string{
+				"priority": "13", "facility": "user", "severity": "notice",
+				"timestamp": "2024-05-01T12:00:00Z", "app_name": "cron", "proc_id": "42", "message": "job done",
+			},
+		},
+		{
+			name: "syslog priority with an invalid header",
+			opts: StageOptions{Type: "syslog"},
+			line: `<11>whatever this is`,
+			want: map[string]string{"priority": "11", "facility": "user", "severity": "err", "message": "whatever this is"},
+		},
+		{
+			name: "syslog not syslog",
+			opts: StageOptions{Type: "syslog"},
+			line: `hello world`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseLine(t, tt.opts, tt.line)
+			if tt.want == nil {
+				if ok {
+					t.Errorf("parsed %q as %v, want a failure", tt.line, got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("failed to parse %q", tt.line)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParserReadsField(t *testing.T) {
+	s := mustStage(t, StageOptions{Type: "logfmt", Field: "msg", Prefix: "kv."}).(*parseStage)
+	r := Record{Line: "ignored", Fields: map[string]string{"msg": "a=1 b=two"}}
+	if !s.parse(&r) {
+		t.Fatal("did not parse the field")
+	}
+	want := map[string]string{"msg": "a=1 b=two", "kv.a": "1", "kv.b": "two"}
+	if !reflect.DeepEqual(r.Fields, want) {
+		t.Errorf("got %v, want %v", r.Fields, want)
+	}
+	if s.parse(&Record{Line: "a=1"}) {
+		t.Error("parsed a record without the field")
+	}
+}
+
+func TestSyslogRFC3164Timestamp(t *testing.T) {
+	m, ok := parseSyslog("<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8")
+	if !ok {
+		t.Fatal("did not parse")
+	}
+	if m.Timestamp.Month() != 10 || m.Timestamp.Day() != 11 || m.Timestamp.Hour() != 22 {
+		t.Errorf("timestamp = %v", m.Timestamp)
+	}
+	if m.Hostname != "mymachine" || m.AppName != "su" || m.Message != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Errorf("parsed %+v", m)
+	}
+	if m.Facility() != "auth" || m.Severity() != "crit" {
+		t.Errorf("facility %s severity %s", m.Facility(), m.Severity())
+	}
+}
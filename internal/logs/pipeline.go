@@ -0,0 +1,307 @@
+package logs
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// PipelineOptions is a list of stages applied to the records of the
+// sources it matches. A record goes through the first pipeline whose
+// sources match it, or through none.
+type PipelineOptions struct {
+	Name    string         `json:"name"`    // used in metrics, default "pipeline<N>"
+	Sources []string       `json:"sources"` // glob patterns matched against Record.Source; empty matches all
+	Stages  []StageOptions `json:"stages"`
+}
+
+// StageOptions configures one stage. Type selects the stage; the other
+// settings apply to the stages noted.
+type StageOptions struct {
+	// multiline, regex, json, logfmt, combined (alias nginx, apache), syslog,
+	// timestamp, drop_fields, keep_fields, rename_fields, redact,
+	// rate_limit, sample, dedup
+	Type string `json:"type"`
+
+	// multiline: a line matching Start begins a new record, and with Indent
+	// lines starting with whitespace continue the previous one. Records are
+	// emitted when the next one starts or after Timeout without new lines.
+	Start    string `json:"start"`
+	Indent   bool   `json:"indent"`
+	MaxLines int    `json:"max_lines"` // default 500
+	Timeout  string `json:"timeout"`   // default "2s"
+
+	// regex: named groups become fields.
+	Pattern string `json:"pattern"`
+
+	// Parsers read Field instead of the line when set. Prefix is prepended
+	// to the names of the fields they add.
+	Field  string `json:"field"`
+	Prefix string `json:"prefix"`
+
+	// timestamp: Field (default "timestamp") is parsed with the first
+	// matching layout: Go layouts or rfc3339, rfc3164, common, unix,
+	// unix_ms. Location applies to layouts without a zone, default Local.
+	Layouts  []string `json:"layouts"`
+	Location string   `json:"location"`
+
+	// drop_fields, keep_fields: field names. rename_fields: old -> new.
+	Fields []string          `json:"fields"`
+	Rename map[string]string `json:"rename"`
+
+	// redact: the line and every field are searched with Detectors
+	// (default all: email, ipv4, ipv6, credit_card, bearer, aws_key) and
+	// Rules; a card number without separators needs a card network prefix.
+	// Mode "mask" (default) replaces matches with a marker, "hash"
+	// with an HMAC-SHA256 of the value keyed by HashKey ("env:NAME" reads
+	// it from the environment), and "drop" discards the record.
+	Detectors []string     `json:"detectors"`
+	Rules     []RedactRule `json:"rules"`
+	Mode      string       `json:"mode"`
+	HashKey   string       `json:"hash_key"`
+
+	// rate_limit: a token bucket of Rate records per second and Burst
+	// per source, or per value of the Key field. sample: keep SampleRate
+	// of records, at random or consistently by the hash of Key. dedup:
+	// collapse repeated lines into "last message repeated N times", at
+	// least every Timeout (default "30s").
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+	Key        string  `json:"key"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// stage transforms one record into zero or more records. Stages that
+// combine records pass the acks of the records they consume on to the
+// record they emit (see mergeAcks). Records a stage drops are not
+// acknowledged: acknowledging them ahead of records still in flight could
+// move a position past those, so the next record delivered from the same
+// input covers them instead.
+type stage interface {
+	process(r Record) []Record
+}
+
+// flusher is a stage that holds records back, such as multiline. flush
+// returns the records held longer than the stage's timeout, or all of
+// them when all is set.
+type flusher interface {
+	flush(now time.Time, all bool) []Record
+}
+
+type pipeline struct {
+	name    string
+	sources []string
+	stages  []stage
+}
+
+// newPipeline builds a pipeline; index numbers unnamed pipelines.
+func newPipeline(o PipelineOptions, index int) (*pipeline, error) {
+	p := &pipeline{name: o.Name, sources: o.Sources}
+	if p.name == "" {
+		p.name = fmt.Sprintf("pipeline%d", index)
+	}
+	for _, src := range o.Sources {
+		if _, err := filepath.Match(src, ""); err != nil {
+			return nil, fmt.Errorf("logs.pipelines[%s]: invalid source pattern %q: %v", p.name, src, err)
+		}
+	}
+	for i, so := range o.Stages {
+		s, err := newStage(so)
+		if err != nil {
+			return nil, fmt.Errorf("logs.pipelines[%s].stages[%d]: %v", p.name, i, err)
+		}
+		if ps, ok := s.(*parseStage); ok {
+			name, stageType := p.name, so.Type
+			ps.onFail = func() { recordParseFailure(name, stageType) }
+		}
+		if c, ok := s.(interface{ setPipeline(string) }); ok {
+			c.setPipeline(p.name)
+		}
+		p.stages = append(p.stages, s)
+	}
+	return p, nil
+}
+
+func newStage(o StageOptions) (stage, error) {
+	var p parser
+	switch o.Type {
+	case "multiline":
+		return newMultiline(o)
+	case "drop_fields":
+		return dropFields(o.Fields), nil
+	case "keep_fields":
+		return keepFields(o.Fields), nil
+	case "rename_fields":
+		return renameFields(o.Rename), nil
+	case "redact":
+		return newRedactor(o)
+	case "rate_limit":
+		return newRateLimiter(o)
+	case "sample":
+		return newSampler(o)
+	case "dedup":
+		return newDedup(o)
+	case "regex":
+		rp, err := newRegexParser(o)
+		if err != nil {
+			return nil, err
+		}
+		p = rp
+	case "json":
+		p = &jsonParser{field: o.Field, prefix: o.Prefix}
+	case "logfmt":
+		p = &logfmtParser{field: o.Field, prefix: o.Prefix}
+	case "combined", "nginx", "apache":
+		p = newCombinedParser(o)
+	case "syslog":
+		p = &syslogParser{field: o.Field, prefix: o.Prefix}
+	case "timestamp":
+		tp, err := newTimestampParser(o)
+		if err != nil {
+			return nil, err
+		}
+		p = tp
+	case "":
+		return nil, fmt.Errorf("stage type is required")
+	default:
+		return nil, fmt.Errorf("unknown stage type %q", o.Type)
+	}
+	return &parseStage{parser: p}, nil
+}
+
+func (p *pipeline) matches(source string) bool {
+	if len(p.sources) == 0 {
+		return true
+	}
+	for _, pattern := range p.sources {
+		if ok, _ := filepath.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// process runs r through the stages.
+func (p *pipeline) process(r Record) []Record {
+	recordPipelineInput(p.name)
+	return p.run(0, []Record{r})
+}
+
+// flush empties the stages that hold records back, passing what they
+// release through the stages after them.
+func (p *pipeline) flush(now time.Time, all bool) []Record {
+	var out []Record
+	for i, s := range p.stages {
+		if f, ok := s.(flusher); ok {
+			if held := f.flush(now, all); len(held) > 0 {
+				out = append(out, p.run(i+1, held)...)
+			}
+		}
+	}
+	return out
+}
+
+func (p *pipeline) run(from int, recs []Record) []Record {
+	for i := from; i < len(p.stages) && len(recs) > 0; i++ {
+		var next []Record
+		for _, r := range recs {
+			next = append(next, p.stages[i].process(r)...)
+		}
+		recs = next
+	}
+	return recs
+}
+
+// mergeAcks returns an ack that acknowledges each record in recs, in
+// order, for a record that replaces them.
+func mergeAcks(recs []Record) func() {
+	acks := make([]func(), 0, len(recs))
+	for _, r := range recs {
+		if r.ack != nil {
+			acks = append(acks, r.ack)
+		}
+	}
+	switch len(acks) {
+	case 0:
+		return nil
+	case 1:
+		return acks[0]
+	}
+	return func() {
+		for _, ack := range acks {
+			ack()
+		}
+	}
+}
+
+// parser adds fields to a record, or reports that the record did not
+// have the expected format. Records that fail to parse pass on unchanged.
+type parser interface {
+	parse(r *Record) bool
+}
+
+type parseStage struct {
+	parser
+	onFail func()
+}
+
+func (s *parseStage) process(r Record) []Record {
+	if !s.parse(&r) && s.onFail != nil {
+		s.onFail()
+	}
+	return []Record{r}
+}
+
+// setField sets a field, allocating the map on first use.
+func setField(r *Record, name, value string) {
+	if r.Fields == nil {
+		r.Fields = make(map[string]string)
+	}
+	r.Fields[name] = value
+}
+
+// input returns the text a parser reads: the named field, or the line.
+func input(r Record, field string) (string, bool) {
+	if field == "" {
+		return r.Line, true
+	}
+	v, ok := r.Fields[field]
+	return v, ok
+}
+
+type dropFields []string
+
+func (d dropFields) process(r Record) []Record {
+	for _, f := range d {
+		delete(r.Fields, f)
+	}
+	return []Record{r}
+}
+
+type keepFields []string
+
+func (k keepFields) process(r Record) []Record {
+	if len(r.Fields) == 0 {
+		return []Record{r}
+	}
+	kept := make(map[string]string, len(k))
+	for _, f := range k {
+		if v, ok := r.Fields[f]; ok {
+			kept[f] = v
+		}
+	}
+	r.Fields = kept
+	return []Record{r}
+}
+
+type renameFields map[string]string
+
+func (m renameFields) process(r Record) []Record {
+	for from, to := range m {
+		if v, ok := r.Fields[from]; ok {
+			delete(r.Fields, from)
+			r.Fields[to] = v
+		}
+	}
+	return []Record{r}
+}
@@ -0,0 +1,197 @@
+package logs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustStage(t *testing.T, o StageOptions) stage {
+	t.Helper()
+	s, err := newStage(o)
+	if err != nil {
+		t.Fatalf("newStage(%+v): %v", o, err)
+	}
+	return s
+}
+
+// lines returns records for the given lines from one source.
+func lines(source string, text ...string) []Record {
+	recs := make([]Record, len(text))
+	for i, l := range text {
+		recs[i] = Record{Time: time.Unix(int64(i), 0), Source: source, Line: l}
+	}
+	return recs
+}
+
+func processAll(s stage, recs []Record) []string {
+	var out []string
+	for _, r := range recs {
+		for _, o := range s.process(r) {
+			out = append(out, o.Line)
+		}
+	}
+	return out
+}
+
+func TestMultiline(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   StageOptions
+		input  []string
+		want   []string // emitted while processing
+		flushd []string // left for the final flush
+	}{
+		{
+			name:   "start pattern",
+			opts:   StageOptions{Type: "multiline", Start: `^\d{4}-`},
+			input:  []string{"2024-05-01 first", "continued", "more", "2024-05-01 second", "2024-05-01 third"},
+			want:   []string{"2024-05-01 first\ncontinued\nmore", "2024-05-01 second"},
+			flushd: []string{"2024-05-01 third"},
+		},
+		{
+			name:   "indent",
+			opts:   StageOptions{Type: "multiline", Indent: true},
+			input:  []string{"Exception in thread main", "\tat a.b(C.java:1)", "  at d.e(F.java:2)", "next"},
+			want:   []string{"Exception in thread main\n\tat a.b(C.java:1)\n  at d.e(F.java:2)"},
+			flushd: []string{"next"},
+		},
+		{
+			name:   "max lines",
+			opts:   StageOptions{Type: "multiline", Indent: true, MaxLines: 2},
+			input:  []string{"head", " one", " two", " three"},
+			want:   []string{"head\n one"},
+			flushd: []string{" two\n three"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mustStage(t, tt.opts).(*multiline)
+			got := processAll(m, lines("app.log", tt.input...))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("emitted %q, want %q", got, tt.want)
+			}
+			var flushed []string
+			for _, r := range m.flush(time.Now(), true) {
+				flushed = append(flushed, r.Line)
+			}
+			if !reflect.DeepEqual(flushed, tt.flushd) {
+				t.Errorf("flushed %q, want %q", flushed, tt.flushd)
+			}
+		})
+	}
+}
+
+func TestMultilineFlushTimeout(t *testing.T) {
+	m := mustStage(t, StageOptions{Type: "multiline", Indent: true, Timeout: "1s"}).(*multiline)
+	processAll(m, lines("a.log", "first", " cont"))
+	processAll(m, lines("b.log", "other"))
+
+	if out := m.flush(time.Now(), false); len(out) != 0 {
+		t.Fatalf("flushed %d records before the timeout", len(out))
+	}
+	out := m.flush(time.Now().Add(2*time.Second), false)
+	got := map[string]string{}
+	for _, r := range out {
+		got[r.Source] = r.Line
+	}
+	want := map[string]string{"a.log": "first\n cont", "b.log": "other"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flushed %q, want %q", got, want)
+	}
+	if len(m.pending) != 0 {
+		t.Errorf("%d sources still pending", len(m.pending))
+	}
+}
+
+func TestMultilineMergesAcks(t *testing.T) {
+	m := mustStage(t, StageOptions{Type: "multiline", Indent: true}).(*multiline)
+	var acked []int
+	recs := lines("a.log", "head", " one", " two")
+	for i := range recs {
+		i := i
+		recs[i].ack = func() { acked = append(acked, i) }
+	}
+	processAll(m, recs)
+	out := m.flush(time.Now(), true)
+	if len(out) != 1 {
+		t.Fatalf("got %d records, want 1", len(out))
+	}
+	out[0].Ack()
+	if !reflect.DeepEqual(acked, []int{0, 1, 2}) {
+		t.Errorf("acked %v, want [0 1 2]", acked)
+	}
+}
+
+func TestFieldStages(t *testing.T) {
+	fields := func() map[string]string {
+		return map[string]string{"a": "1", "b": "2", "c": "3"}
+	}
+	tests := []struct {
+		opts StageOptions
+		want map[string]string
+	}{
+		{StageOptions{Type: "drop_fields", Fields: []string{"a", "missing"}}, map[string]string{"b": "2", "c": "3"}},
+		{StageOptions{Type: "keep_fields", Fields: []string{"a", "c", "missing"}}, map[string]string{"a": "1", "c": "3"}},
+		{StageOptions{Type: "rename_fields", Rename: map[string]string{"a": "x", "missing": "y"}}, map[string]string{"x": "1", "b": "2", "c": "3"}},
+	}
+	for _, tt := range tests {
+		out := mustStage(t, tt.opts).process(Record{Line: "l", Fields: fields()})
+		if len(out) != 1 || !reflect.DeepEqual(out[0].Fields, tt.want) {
+			t.Errorf("%s: got %+v, want fields %v", tt.opts.Type, out, tt.want)
+		}
+	}
+}
+
+func TestPipelineParseFailures(t *testing.T) {
+	p, err := newPipeline(PipelineOptions{
+		Name:    "test_failures",
+		Sources: []string{"/var/log/app/*.log"},
+		Stages: []StageOptions{
+			{Type: "json"},
+			{Type: "logfmt"},
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.matches("/var/log/app/x.log") || p.matches("/var/log/other.log") {
+		t.Errorf("source matching is wrong")
+	}
+	for _, line := range []string{`{"level":"info"}`, `level=warn msg=hi`, `free text`} {
+		p.process(Record{Source: "/var/log/app/x.log", Line: line})
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	st := pipelineCounts["test_failures"]
+	if st == nil {
+		t.Fatal("no counters for the pipeline")
+	}
+	if st.records != 3 {
+		t.Errorf("records = %d, want 3", st.records)
+	}
+	// The JSON line is not logfmt and the logfmt line is not JSON; the
+	// free text is neither.
+	want := map[string]uint64{"json": 2, "logfmt": 2}
+	if !reflect.DeepEqual(st.failures, want) {
+		t.Errorf("failures = %v, want %v", st.failures, want)
+	}
+}
+
+func TestNewStageErrors(t *testing.T) {
+	for _, o := range []StageOptions{
+		{},
+		{Type: "nope"},
+		{Type: "multiline"},
+		{Type: "multiline", Start: "("},
+		{Type: "multiline", Indent: true, Timeout: "soon"},
+		{Type: "regex"},
+		{Type: "regex", Pattern: `\d+`},
+		{Type: "timestamp", Location: "Nowhere/City"},
+	} {
+		if _, err := newStage(o); err == nil {
+			t.Errorf("newStage(%+v) succeeded, want an error", o)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package logs
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// position is how far a file has been delivered.
+type position struct {
+	ID          string `json:"id"`
+	Offset      int64  `json:"offset"`
+	Fingerprint string `json:"fingerprint,omitempty"` // hex of the file's first bytes
+}
+
+// positions is the persisted table of delivered offsets, keyed by path.
+type positions struct {
+	file string
+
+	mu      sync.Mutex
+	pos     map[string]position
+	current map[string]string // ID of the file each path names now
+	dirty   bool
+}
+
+// stateFile resolves a relative positions or cursor file against the
+// executable's directory, as the config file is, so that a service does
+// not depend on the directory it was started from.
+func stateFile(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Error determining executable path: %v", err)
+		return name
+	}
+	return filepath.Join(filepath.Dir(exe), name)
+}
+
+// loadPositions reads the positions file. A missing file is an empty
+// table; an unreadable one is logged and replaced.
+func loadPositions(file string) *positions {
+	p := &positions{file: file, pos: make(map[string]position), current: make(map[string]string)}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading log positions %s: %v", file, err)
+		}
+		return p
+	}
+	if err := json.Unmarshal(b, &p.pos); err != nil {
+		log.Printf("Ignoring corrupt log positions %s: %v", file, err)
+		p.pos = make(map[string]position)
+	}
+	return p
+}
+
+func (p *positions) get(path string) (position, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pos, ok := p.pos[path]
+	return pos, ok
+}
+
+// opened records which file a path names now.
+func (p *positions) opened(path, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current[path] = id
+}
+
+// set records a delivered offset. Offsets only move forward within a file;
+// a different ID, or different leading bytes after a copytruncate, means
+// the path now holds new content. Acks for lines of a file that has since
+// been renamed away arrive late and must not replace the position of the
+// file that took its name.
+func (p *positions) set(path string, pos position) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.pos[path]
+	if ok && old.ID != pos.ID && pos.ID != p.current[path] {
+		return
+	}
+	if ok && old.Offset >= pos.Offset && sameContent(old, pos) {
+		return
+	}
+	p.pos[path] = pos
+	p.dirty = true
+}
+
+func (p *positions) forget(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.current, path)
+	if _, ok := p.pos[path]; ok {
+		delete(p.pos, path)
+		p.dirty = true
+	}
+}
+
+// save writes the table if it changed, replacing the file atomically.
+func (p *positions) save() error {
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(p.pos, "", "  ")
+	p.dirty = false
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := p.file + ".tmp"
+	err = os.WriteFile(tmp, b, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, p.file)
+	}
+	if err != nil {
+		// Try again on the next save.
+		p.mu.Lock()
+		p.dirty = true
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// sameContent reports whether two positions refer to the same file
+// content. Fingerprints grow with the file, so one only has to be a prefix
+// of the other.
+func sameContent(a, b position) bool {
+	if a.ID != b.ID {
+		return false
+	}
+	if len(a.Fingerprint) > len(b.Fingerprint) {
+		a, b = b, a
+	}
+	return strings.HasPrefix(b.Fingerprint, a.Fingerprint)
+}
@@ -0,0 +1,371 @@
+package logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRecentRecords = 10000
+	defaultRecentSizeMB  = 64
+	followQueueSize      = 256
+	rotateRetry          = 10 * time.Second
+)
+
+// RecentOptions configures the buffer of recently delivered records that
+// is searched on /logs. Records are kept in memory and, when Path is set,
+// also in two files of up to half of MaxSizeMB each, so that searches can
+// reach further back and the buffer survives restarts.
+type RecentOptions struct {
+	Enabled    bool   `json:"enabled"`
+	MaxRecords int    `json:"max_records"` // records kept in memory, default 10000
+	Path       string `json:"path"`        // e.g. "recent_logs.ndjson"; empty keeps records in memory only
+	MaxSizeMB  int    `json:"max_size_mb"` // size of both files together, default 64
+}
+
+// RecentRecord is a buffered record. Seq numbers records in the order they
+// were delivered, across restarts when the buffer has a file.
+type RecentRecord struct {
+	Seq uint64 `json:"seq"`
+	Record
+}
+
+// recentBuffer is a ring of the last records delivered, with followers
+// that receive new records as they arrive.
+type recentBuffer struct {
+	mu        sync.Mutex
+	ring      []RecentRecord
+	head      int // index of the oldest record once the ring is full
+	max       int
+	seq       uint64 // of the last record added
+	file      *recentFile
+	followers map[*follower]bool
+}
+
+var recent *recentBuffer
+
+// follower receives the records matching its query; records that arrive
+// while its queue is full are skipped rather than holding back the inputs.
+type follower struct {
+	q  *LogQuery
+	ch chan RecentRecord
+}
+
+func (o RecentOptions) withDefaults() (RecentOptions, error) {
+	if o.MaxRecords < 0 || o.MaxSizeMB < 0 {
+		return o, fmt.Errorf("logs.recent: sizes must not be negative")
+	}
+	if o.MaxRecords == 0 {
+		o.MaxRecords = defaultRecentRecords
+	}
+	if o.MaxSizeMB == 0 {
+		o.MaxSizeMB = defaultRecentSizeMB
+	}
+	return o, nil
+}
+
+func openRecent(o RecentOptions) (*recentBuffer, error) {
+	o, err := o.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	b := &recentBuffer{max: o.MaxRecords, followers: make(map[*follower]bool)}
+	if o.Path == "" {
+		return b, nil
+	}
+	f := &recentFile{path: o.Path, maxSize: int64(o.MaxSizeMB) << 19}
+	// Refill the ring from the files, which hold the newest records last.
+	for _, name := range []string{f.path + ".1", f.path} {
+		if err := scanRecentFile(name, func(e RecentRecord) { b.push(e) }); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("logs.recent: %v", err)
+		}
+	}
+	if err := f.open(); err != nil {
+		return nil, fmt.Errorf("logs.recent: %v", err)
+	}
+	b.file = f
+	return b, nil
+}
+
+// add buffers a delivered record; dispatch calls it before handing the
+// record to the sinks.
+func (b *recentBuffer) add(r Record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := RecentRecord{Seq: b.seq + 1, Record: r}
+	b.push(e)
+	if b.file != nil {
+		b.file.append(e)
+	}
+	for f := range b.followers {
+		if !f.q.Match(&e) {
+			continue
+		}
+		select {
+		case f.ch <- e:
+		default:
+			recordFollowSkipped()
+		}
+	}
+}
+
+func (b *recentBuffer) push(e RecentRecord) {
+	b.seq = e.Seq
+	if len(b.ring) < b.max {
+		b.ring = append(b.ring, e)
+		return
+	}
+	b.ring[b.head] = e
+	b.head = (b.head + 1) % b.max
+}
+
+// at returns the i-th oldest record in memory.
+func (b *recentBuffer) at(i int) *RecentRecord {
+	return &b.ring[(b.head+i)%len(b.ring)]
+}
+
+func (b *recentBuffer) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.ring)
+}
+
+// query returns the newest records matching q, oldest first. Memory is
+// searched first; the files only when memory does not hold enough matches.
+func (b *recentBuffer) query(q *LogQuery) []RecentRecord {
+	b.mu.Lock()
+	var newest []RecentRecord // newest first
+	for i := len(b.ring) - 1; i >= 0 && (q.Limit == 0 || len(newest) < q.Limit); i-- {
+		if e := b.at(i); q.Match(e) {
+			newest = append(newest, *e)
+		}
+	}
+	oldest := b.seq + 1
+	if len(b.ring) > 0 {
+		oldest = b.at(0).Seq
+	}
+	var files []snapshotFile
+	if b.file != nil && (q.Limit == 0 || len(newest) < q.Limit) && q.After+1 < oldest {
+		files = b.file.snapshot()
+	}
+	b.mu.Unlock()
+
+	var older []RecentRecord
+	if len(files) > 0 {
+		older = scanRecentFiles(files, q, oldest, q.Limit-len(newest))
+	}
+	out := make([]RecentRecord, 0, len(older)+len(newest))
+	out = append(out, older...)
+	for i := len(newest) - 1; i >= 0; i-- {
+		out = append(out, newest[i])
+	}
+	return out
+}
+
+// follow registers a follower for q.
+func (b *recentBuffer) follow(q *LogQuery) *follower {
+	f := &follower{q: q, ch: make(chan RecentRecord, followQueueSize)}
+	b.mu.Lock()
+	b.followers[f] = true
+	b.mu.Unlock()
+	return f
+}
+
+func (b *recentBuffer) unfollow(f *follower) {
+	b.mu.Lock()
+	delete(b.followers, f)
+	b.mu.Unlock()
+}
+
+func (b *recentBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file != nil {
+		b.file.close()
+	}
+}
+
+// RecentEnabled reports whether records are being buffered for search.
+func RecentEnabled() bool {
+	return recent != nil
+}
+
+// QueryRecent returns the buffered records matching q, oldest first. When
+// q has a limit, the newest that many are returned.
+func QueryRecent(q LogQuery) []RecentRecord {
+	if recent == nil {
+		return nil
+	}
+	return recent.query(&q)
+}
+
+// FollowRecent returns the buffered records matching q, as QueryRecent
+// does, and a channel of the matching records delivered from then on. A
+// follower that falls behind by more than a few hundred records misses
+// some. An After beyond the last record, as after a restart of a buffer
+// without a file, is ignored. Call cancel when done.
+func FollowRecent(q LogQuery) (backlog []RecentRecord, records <-chan RecentRecord, cancel func()) {
+	if recent == nil {
+		return nil, nil, func() {}
+	}
+	recent.mu.Lock()
+	if q.After > recent.seq {
+		q.After = 0
+	}
+	recent.mu.Unlock()
+	// Follow first so that no record falls between the backlog and the
+	// channel; the handler skips records it has already sent.
+	f := recent.follow(&q)
+	return recent.query(&q), f.ch, func() { recent.unfollow(f) }
+}
+
+// recentFile appends records as NDJSON to path, moving it to path.1 when
+// it reaches maxSize so that the two files hold the newest records.
+type recentFile struct {
+	path    string
+	maxSize int64
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	retryAt time.Time // of a rotation that failed
+}
+
+func (f *recentFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f, f.w, f.size = file, bufio.NewWriterSize(file, 64<<10), fi.Size()
+	return nil
+}
+
+func (f *recentFile) append(e RecentRecord) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding buffered log record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	if f.size > 0 && f.size+int64(len(line)) > f.maxSize && !time.Now().Before(f.retryAt) {
+		f.rotate()
+	}
+	n, err := f.w.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing %s: %v", f.path, err)
+	}
+}
+
+// rotate replaces path.1 with path and starts a new path. If the rename
+// fails, as it does on Windows while a search is reading the file, records
+// are appended to the current file and rotation is tried again after
+// rotateRetry.
+func (f *recentFile) rotate() {
+	f.w.Flush()
+	f.f.Close()
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		log.Printf("Error rotating %s: %v", f.path, err)
+		f.retryAt = time.Now().Add(rotateRetry)
+	}
+	if err := f.open(); err != nil {
+		log.Printf("Error reopening %s: %v", f.path, err)
+		f.w = bufio.NewWriter(io.Discard)
+	}
+}
+
+// snapshotFile is an open file and its size when the snapshot was taken.
+type snapshotFile struct {
+	f    *os.File
+	size int64
+}
+
+// snapshot flushes the buffered writes and opens the files as they are
+// now, older first. Records appended or rotated in while they are read
+// are not seen.
+func (f *recentFile) snapshot() []snapshotFile {
+	f.w.Flush()
+	var files []snapshotFile
+	for _, name := range []string{f.path + ".1", f.path} {
+		file, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			continue
+		}
+		files = append(files, snapshotFile{f: file, size: fi.Size()})
+	}
+	return files
+}
+
+func (f *recentFile) close() {
+	if err := f.w.Flush(); err != nil {
+		log.Printf("Error writing %s: %v", f.path, err)
+	}
+	f.f.Close()
+}
+
+// scanRecentFiles returns the newest limit (0 for all) records in files
+// that match q and are older than before, oldest first. It closes the
+// files.
+func scanRecentFiles(files []snapshotFile, q *LogQuery, before uint64, limit int) []RecentRecord {
+	var matched []RecentRecord
+	for _, sf := range files {
+		readRecentRecords(io.LimitReader(sf.f, sf.size), func(e RecentRecord) {
+			if e.Seq >= before || !q.Match(&e) {
+				return
+			}
+			matched = append(matched, e)
+			if limit > 0 && len(matched) > 2*limit {
+				matched = append(matched[:0], matched[len(matched)-limit:]...)
+			}
+		})
+		sf.f.Close()
+	}
+	if limit > 0 && len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	return matched
+}
+
+// scanRecentFile calls fn for every record in the named file.
+func scanRecentFile(name string, fn func(RecentRecord)) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	readRecentRecords(file, fn)
+	return nil
+}
+
+// readRecentRecords decodes one record per line, skipping lines that do
+// not decode, such as one cut short by a crash.
+func readRecentRecords(r io.Reader, fn func(RecentRecord)) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var e RecentRecord
+			if json.Unmarshal(line, &e) == nil && e.Seq > 0 {
+				fn(e)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
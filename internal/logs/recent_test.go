@@ -0,0 +1,126 @@
+package logs
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startDispatch runs dispatch on a fresh channel with the given sinks and
+// recent buffer, restoring the package state when the test ends.
+func startDispatch(t *testing.T, b *recentBuffer) chan Record {
+	t.Helper()
+	savedSinks, savedRecent := sinks, recent
+	in := make(chan Record)
+	sinks, recent = nil, b
+	dispatchDone, abort = make(chan struct{}), make(chan struct{})
+	go dispatch(in)
+	t.Cleanup(func() {
+		sinks, recent = savedSinks, savedRecent
+	})
+	return in
+}
+
+func TestRecentFedWhileAckingSinkBlocked(t *testing.T) {
+	b, err := openRecent(RecentOptions{Enabled: true, MaxRecords: 50000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := startDispatch(t, b)
+	block := make(chan struct{})
+	RegisterSink(func(Record) { <-block }, true)
+	var plain int
+	RegisterSink(func(Record) { plain++ }, false)
+
+	// More records than the blocked sink can queue; syslog-like records
+	// without an ack are dropped for it instead of stalling dispatch.
+	n := sinkQueueSize + sinkHeadroom + 1000
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			in <- Record{Time: time.Now(), Source: SyslogSource, Line: fmt.Sprintf("message %d", i)}
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(10 * time.Second):
+		t.Fatal("dispatch blocked behind the acknowledging sink")
+	}
+	close(in)
+	<-dispatchDone
+
+	if got := len(QueryRecent(LogQuery{Severity: -1})); got != n {
+		t.Errorf("recent buffer holds %d records, want %d", got, n)
+	}
+	if plain != n {
+		t.Errorf("non-acknowledging sink got %d records, want %d", plain, n)
+	}
+	last := QueryRecent(LogQuery{Severity: -1, Limit: 1})
+	if len(last) != 1 || last[0].Line != fmt.Sprintf("message %d", n-1) {
+		t.Errorf("newest record = %+v", last)
+	}
+	close(block)
+}
+
+func TestRecentQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recent.ndjson")
+	b, err := openRecent(RecentOptions{Enabled: true, MaxRecords: 10, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		severity := "info"
+		if i%10 == 0 {
+			severity = "err"
+		}
+		b.add(Record{
+			Time:   base.Add(time.Duration(i) * time.Second),
+			Source: fmt.Sprintf("/var/log/app%d.log", i%2),
+			Line:   fmt.Sprintf("request %d Timeout", i),
+			Fields: map[string]string{"severity": severity},
+		})
+	}
+	// Reopening refills memory from the file and continues the sequence.
+	b.close()
+	if b, err = openRecent(RecentOptions{Enabled: true, MaxRecords: 10, Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	tests := []struct {
+		query string
+		want  []uint64
+	}{
+		{"severity=error&limit=3", []uint64{71, 81, 91}},
+		{"severity=warn&since=2024-05-01T12:01:00Z&until=2024-05-01T12:01:25Z", []uint64{61, 71, 81}},
+		{"source=/var/log/app1.log&limit=2", []uint64{98, 100}},
+		{"q=request+5+timeout", []uint64{6}},
+		{"regex=^request+9[78]+&limit=0", []uint64{98, 99}},
+		{"after=98", []uint64{99, 100}},
+	}
+	for _, tt := range tests {
+		v, _ := url.ParseQuery(tt.query)
+		q, err := ParseLogQuery(v)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		var got []uint64
+		for _, r := range b.query(&q) {
+			got = append(got, r.Seq)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got seq %v, want %v", tt.query, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"severity=loud", "regex=(", "since=yesterday", "limit=-1"} {
+		v, _ := url.ParseQuery(bad)
+		if _, err := ParseLogQuery(v); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package logs
+
+import "time"
+
+// Record is one log line travelling from an input to the sinks.
+type Record struct {
+	Time   time.Time         `json:"time"`
+	Source string            `json:"source"` // file path, or the input name for network inputs
+	Line   string            `json:"line"`
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// ack is called once the record has been delivered, to advance the
+	// input's stored position. Nil for inputs that cannot replay.
+	ack func()
+}
+
+// Ack marks the record as delivered. Inputs that persist positions only
+// move past a record once it has been acknowledged, so undelivered records
+// are read again after a restart.
+func (r *Record) Ack() {
+	if r.ack != nil {
+		r.ack()
+	}
+}
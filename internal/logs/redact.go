@@ -0,0 +1,217 @@
+package logs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RedactRule is a custom redaction pattern. When the pattern has a
+// capturing group only the first group is redacted, so context such as a
+// key name can be kept.
+type RedactRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+type detector struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(string) bool // nil accepts every match
+}
+
+// builtinDetectors are applied in this order.
+var builtinDetectors = []detector{
+	{name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{name: "bearer", re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`)},
+	{name: "aws_key", re: regexp.MustCompile(`\b((?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[A-Z0-9]{16})\b`)},
+	{name: "aws_key", re: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`)},
+	{name: "credit_card", re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: cardNumber},
+	{name: "ipv6", re: regexp.MustCompile(`(?i)[0-9a-f]*:[0-9a-f]*:[0-9a-f:.]*[0-9a-f]`), valid: isIPv6},
+	{name: "ipv4", re: regexp.MustCompile(`\b(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)(?:\.(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)){3}\b`)},
+}
+
+// cardNumber reports whether s looks like a payment card number: 13 to 19
+// digits passing the Luhn check. One number in ten passes Luhn by chance,
+// so a number written without spaces or dashes, such as a millisecond
+// timestamp or an ID, must also have a card network's prefix and length.
+func cardNumber(s string) bool {
+	digits := strings.Map(func(c rune) rune {
+		if c >= '0' && c <= '9' {
+			return c
+		}
+		return -1
+	}, s)
+	if len(digits) < 13 || len(digits) > 19 || !luhnValid(digits) {
+		return false
+	}
+	return len(digits) != len(s) || cardNetworkPrefix(digits)
+}
+
+// luhnValid reports whether the digits pass the Luhn check.
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// cardNetworkPrefix reports whether digits start with the issuer prefix of
+// a major card network and have one of its lengths.
+func cardNetworkPrefix(digits string) bool {
+	n := len(digits)
+	p2, _ := strconv.Atoi(digits[:2])
+	p3, _ := strconv.Atoi(digits[:3])
+	p4, _ := strconv.Atoi(digits[:4])
+	switch {
+	case digits[0] == '4': // Visa
+		return n == 13 || n == 16 || n == 19
+	case p2 >= 51 && p2 <= 55, p4 >= 2221 && p4 <= 2720: // Mastercard
+		return n == 16
+	case p2 == 34 || p2 == 37: // American Express
+		return n == 15
+	case p4 == 6011, p3 >= 644 && p3 <= 649, p2 == 65, // Discover
+		p4 >= 3528 && p4 <= 3589, // JCB
+		p2 == 62:                 // UnionPay
+		return n >= 16
+	case p3 >= 300 && p3 <= 305, p2 == 36, p2 == 38, p2 == 39: // Diners Club
+		return n >= 14
+	}
+	return false
+}
+
+func isIPv6(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && strings.Contains(s, ":")
+}
+
+// redactor replaces sensitive values in the line and in every field.
+type redactor struct {
+	detectors []detector
+	mode      string // mask, hash or drop
+	key       []byte
+	pipeline  string
+}
+
+func newRedactor(o StageOptions) (*redactor, error) {
+	r := &redactor{mode: o.Mode}
+	switch r.mode {
+	case "":
+		r.mode = "mask"
+	case "mask", "drop":
+	case "hash":
+		key := o.HashKey
+		if name, ok := strings.CutPrefix(key, "env:"); ok {
+			key = os.Getenv(name)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("redact: hash mode needs hash_key")
+		}
+		r.key = []byte(key)
+	default:
+		return nil, fmt.Errorf("redact: unknown mode %q (want mask, hash or drop)", o.Mode)
+	}
+
+	if len(o.Detectors) == 0 && len(o.Rules) == 0 {
+		r.detectors = builtinDetectors
+	}
+	for _, name := range o.Detectors {
+		found := false
+		for _, d := range builtinDetectors {
+			if d.name == name {
+				r.detectors = append(r.detectors, d)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("redact: unknown detector %q (want email, ipv4, ipv6, credit_card, bearer or aws_key)", name)
+		}
+	}
+	for _, rule := range o.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("redact: rule %q needs a name", rule.Pattern)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redact: invalid pattern for rule %s: %v", rule.Name, err)
+		}
+		r.detectors = append(r.detectors, detector{name: rule.Name, re: re})
+	}
+	return r, nil
+}
+
+func (r *redactor) setPipeline(name string) { r.pipeline = name }
+
+func (r *redactor) process(rec Record) []Record {
+	found := false
+	rec.Line = r.redact(rec.Line, &found)
+	for k, v := range rec.Fields {
+		rec.Fields[k] = r.redact(v, &found)
+	}
+	if found && r.mode == "drop" {
+		recordDropped(r.pipeline, "redact")
+		return nil
+	}
+	return []Record{rec}
+}
+
+// redact applies every detector to s, setting found when one matched.
+func (r *redactor) redact(s string, found *bool) string {
+	for _, d := range r.detectors {
+		s = r.apply(d, s, found)
+	}
+	return s
+}
+
+func (r *redactor) apply(d detector, s string, found *bool) string {
+	matches := d.re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var b strings.Builder
+	last, replaced := 0, false
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		value := s[start:end]
+		if d.valid != nil && !d.valid(value) {
+			continue
+		}
+		*found, replaced = true, true
+		recordRedaction(r.pipeline, d.name)
+		b.WriteString(s[last:start])
+		b.WriteString(r.replacement(d.name, value))
+		last = end
+	}
+	if !replaced {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// replacement is what a value is replaced with: a fixed marker, or a keyed
+// hash that is the same for equal values so that records stay joinable.
+func (r *redactor) replacement(name, value string) string {
+	if r.mode != "hash" {
+		return "[REDACTED:" + name + "]"
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return "[" + name + ":" + hex.EncodeToString(mac.Sum(nil)[:8]) + "]"
+}
@@ -0,0 +1,230 @@
+package logs
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// rotatedFile is a rotated copy of a tailed file, such as app.log.1,
+// app.log.2.gz or app.log-20240101.zst.
+type rotatedFile struct {
+	path        string
+	modTime     time.Time
+	compression string // one of compressedExts, or "" for a plain copy
+}
+
+// rotatedFiles lists the rotated copies of path, oldest first. Copies are
+// named "<file>.<suffix>" or "<file>-<suffix>" in the same directory.
+func rotatedFiles(path string) []rotatedFile {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []rotatedFile
+	for _, e := range entries {
+		name := e.Name()
+		if name == base || !(strings.HasPrefix(name, base+".") || strings.HasPrefix(name, base+"-")) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		if !compressedExts[ext] {
+			ext = ""
+		}
+		files = append(files, rotatedFile{
+			path:        filepath.Join(dir, name),
+			modTime:     info.ModTime(),
+			compression: ext,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files
+}
+
+// open returns the decompressed content of the copy. Copies compressed
+// with xz cannot be read.
+func (r rotatedFile) open() (io.ReadCloser, error) {
+	f, err := openFile(r.path)
+	if err != nil || r.compression == "" {
+		return f, err
+	}
+	var rd io.Reader
+	closer := func() {}
+	switch r.compression {
+	case ".gz":
+		rd, err = gzip.NewReader(f)
+	case ".bz2":
+		rd = bzip2.NewReader(f)
+	case ".zst":
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err == nil {
+			rd, closer = zr, zr.Close
+		}
+	case ".zip":
+		rd, err = firstZipEntry(f)
+	default:
+		err = fmt.Errorf("%s compression is not supported", strings.TrimPrefix(r.compression, "."))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readCloser{rd, func() error { closer(); return f.Close() }}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error { return rc.close() }
+
+// firstZipEntry opens the only file of an archive holding a rotated log.
+func firstZipEntry(f *os.File) (io.Reader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	for _, zf := range zr.File {
+		if !zf.FileInfo().IsDir() {
+			return zf.Open()
+		}
+	}
+	return nil, fmt.Errorf("empty zip archive")
+}
+
+// matches reports whether r is the file a saved position refers to: the
+// same file ID for plain copies, or the same leading bytes once
+// decompressed.
+func (r rotatedFile) matches(saved position) bool {
+	if r.compression == "" {
+		if id, err := pathID(r.path); err == nil && id == saved.ID {
+			return true
+		}
+	}
+	if saved.Fingerprint == "" {
+		return false
+	}
+	rc, err := r.open()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	head := make([]byte, hex.DecodedLen(len(saved.Fingerprint)))
+	n, _ := io.ReadFull(rc, head)
+	return fingerprintMatches(saved.Fingerprint, head[:n])
+}
+
+// catchUp reads what was written to a file after the saved position but
+// before it was rotated, followed by any later rotations, before tailing
+// the new file tf from the start. The stored position moves to tf only
+// when the last caught-up line is acknowledged.
+func (t *Tailer) catchUp(tf *tailedFile, saved position) {
+	files := rotatedFiles(tf.path)
+	start := -1
+	for i, r := range files {
+		if r.matches(saved) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		log.Printf("Log %s was rotated while stopped and its rotated copy was not found; reading the new file from the start", tf.path)
+		return
+	}
+
+	// Hold back one record so that the last one can carry the ack that
+	// moves the position to the new file.
+	var held *Record
+	for i := start; i < len(files); i++ {
+		skip := int64(0)
+		if i == start {
+			skip = saved.Offset
+		}
+		ok := t.readRotated(tf.path, files[i], skip, func(r Record) bool {
+			if held != nil && !t.send(*held) {
+				return false
+			}
+			held = &r
+			return true
+		})
+		if !ok {
+			return
+		}
+		recordRotation(tf.path, "catch_up")
+	}
+	if held != nil {
+		path, pos := tf.path, position{ID: tf.id, Fingerprint: hex.EncodeToString(tf.fp)}
+		held.ack = func() { t.positions.set(path, pos) }
+		t.send(*held)
+	}
+}
+
+// readRotated passes each line of a rotated file after skip bytes to emit,
+// with source set to the path being tailed.
+func (t *Tailer) readRotated(source string, r rotatedFile, skip int64, emit func(Record) bool) bool {
+	rc, err := r.open()
+	if err != nil {
+		recordTailError(source, err)
+		return true
+	}
+	defer rc.Close()
+	if _, err := io.CopyN(io.Discard, rc, skip); err != nil {
+		return true
+	}
+
+	br := bufio.NewReaderSize(rc, readChunkSize)
+	var line []byte
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				recordTailError(source, err)
+			}
+			if len(line) == 0 {
+				return true
+			}
+			chunk, isPrefix = nil, false
+		}
+		line = append(line, chunk...)
+		if isPrefix && len(line) < t.opts.MaxLineBytes {
+			continue
+		}
+		for len(line) > t.opts.MaxLineBytes {
+			if !emit(Record{Time: time.Now(), Source: source, Line: string(line[:t.opts.MaxLineBytes])}) {
+				return false
+			}
+			line = line[t.opts.MaxLineBytes:]
+		}
+		if !emit(Record{Time: time.Now(), Source: source, Line: string(bytes.TrimSuffix(line, []byte{'\r'}))}) {
+			return false
+		}
+		line = line[:0]
+		if err != nil {
+			return true
+		}
+	}
+}
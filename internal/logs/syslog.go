@@ -0,0 +1,247 @@
+package logs
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// syslogMessage is a parsed RFC 5424 or RFC 3164 message. Priority is -1
+// when the message had none, as in files written by a local syslog daemon.
+type syslogMessage struct {
+	Priority  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// Structured holds RFC 5424 structured data as "id.param" -> value.
+	Structured map[string]string
+	Message    string
+}
+
+func (m syslogMessage) Facility() string {
+	if m.Priority < 0 || m.Priority/8 >= len(syslogFacilities) {
+		return ""
+	}
+	return syslogFacilities[m.Priority/8]
+}
+
+func (m syslogMessage) Severity() string {
+	if m.Priority < 0 {
+		return ""
+	}
+	return syslogSeverities[m.Priority%8]
+}
+
+// fields returns the message as record fields; empty parts are left out.
+func (m syslogMessage) fields() map[string]string {
+	f := map[string]string{"message": m.Message}
+	set := func(k, v string) {
+		if v != "" {
+			f[k] = v
+		}
+	}
+	if m.Priority >= 0 {
+		set("priority", strconv.Itoa(m.Priority))
+	}
+	set("facility", m.Facility())
+	set("severity", m.Severity())
+	if !m.Timestamp.IsZero() {
+		f["timestamp"] = m.Timestamp.Format(time.RFC3339Nano)
+	}
+	set("hostname", m.Hostname)
+	set("app_name", m.AppName)
+	set("proc_id", m.ProcID)
+	set("msg_id", m.MsgID)
+	for k, v := range m.Structured {
+		f["sd."+k] = v
+	}
+	return f
+}
+
+// parseSyslog parses an RFC 5424 message, or failing that an RFC 3164
+// (BSD) one; a message with a priority but no valid header is taken whole
+// as the message text. Years missing from RFC 3164 timestamps are taken to be the
+// current one, or the previous one for dates more than a day ahead.
+func parseSyslog(text string) (syslogMessage, bool) {
+	m := syslogMessage{Priority: -1}
+	rest := text
+	if strings.HasPrefix(rest, "<") {
+		end := strings.IndexByte(rest, '>')
+		if end < 2 || end > 4 {
+			return m, false
+		}
+		pri, err := strconv.Atoi(rest[1:end])
+		if err != nil || pri > 191 {
+			return m, false
+		}
+		m.Priority = pri
+		rest = rest[end+1:]
+	}
+	if strings.HasPrefix(rest, "1 ") {
+		if parse5424(&m, rest[2:]) {
+			return m, true
+		}
+		m = syslogMessage{Priority: m.Priority}
+	}
+	if parse3164(&m, rest) {
+		return m, true
+	}
+	// RFC 3164 has receivers accept a priority followed by anything.
+	m = syslogMessage{Priority: m.Priority, Message: rest}
+	return m, m.Priority >= 0
+}
+
+// parse5424 reads "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]".
+func parse5424(m *syslogMessage, s string) bool {
+	parts := make([]string, 5)
+	for i := range parts {
+		sp := strings.IndexByte(s, ' ')
+		if sp < 0 {
+			return false
+		}
+		parts[i], s = s[:sp], s[sp+1:]
+	}
+	if parts[0] != "-" {
+		ts, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return false
+		}
+		m.Timestamp = ts
+	}
+	nilValue := func(v string) string {
+		if v == "-" {
+			return ""
+		}
+		return v
+	}
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = nilValue(parts[1]), nilValue(parts[2]), nilValue(parts[3]), nilValue(parts[4])
+
+	switch {
+	case strings.HasPrefix(s, "-"):
+		s = s[1:]
+	case strings.HasPrefix(s, "["):
+		sd, rest, ok := parseStructuredData(s)
+		if !ok {
+			return false
+		}
+		m.Structured, s = sd, rest
+	default:
+		return false
+	}
+	s = strings.TrimPrefix(s, " ")
+	m.Message = strings.TrimPrefix(s, "\ufeff") // BOM before UTF-8 messages
+	return true
+}
+
+// parseStructuredData reads SD-ELEMENTs ("[id key="value" ...]") from the
+// start of s and returns the rest.
+func parseStructuredData(s string) (map[string]string, string, bool) {
+	sd := make(map[string]string)
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		end := strings.IndexAny(s, " ]")
+		if end <= 0 {
+			return nil, s, false
+		}
+		id := s[:end]
+		s = s[end:]
+		for {
+			s = strings.TrimLeft(s, " ")
+			if strings.HasPrefix(s, "]") {
+				s = s[1:]
+				break
+			}
+			eq := strings.Index(s, `="`)
+			if eq <= 0 {
+				return nil, s, false
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var b strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				c := s[i]
+				if c == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					b.WriteByte(s[i+1])
+					i++
+					continue
+				}
+				if c == '"' {
+					s, closed = s[i+1:], true
+					break
+				}
+				b.WriteByte(c)
+			}
+			if !closed {
+				return nil, s, false
+			}
+			sd[id+"."+name] = b.String()
+		}
+	}
+	return sd, s, true
+}
+
+const rfc3164Layout = "Jan _2 15:04:05"
+
+// parse3164 reads "TIMESTAMP [HOSTNAME] TAG[PID]: MSG". The timestamp may
+// also be RFC 3339, as written by rsyslog's high precision templates.
+func parse3164(m *syslogMessage, s string) bool {
+	if ts, ok := parseRFC3164Time(s, time.Now(), time.Local); ok {
+		m.Timestamp = ts
+		s = s[len(rfc3164Layout):]
+	} else if sp := strings.IndexByte(s, ' '); sp > 0 {
+		ts, err := time.Parse(time.RFC3339Nano, s[:sp])
+		if err != nil {
+			return false
+		}
+		m.Timestamp = ts
+		s = s[sp:]
+	} else {
+		return false
+	}
+	s = strings.TrimLeft(s, " ")
+
+	// The hostname is absent from messages sent to a local socket; a
+	// first word that looks like a tag is taken to be one.
+	if sp := strings.IndexByte(s, ' '); sp > 0 && !strings.HasSuffix(s[:sp], ":") && !strings.Contains(s[:sp], "[") {
+		m.Hostname, s = s[:sp], s[sp+1:]
+	}
+	if colon := strings.Index(s, ": "); colon > 0 && !strings.ContainsAny(s[:colon], " ") {
+		tag := s[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			m.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		m.AppName, s = tag, s[colon+2:]
+	}
+	m.Message = s
+	return true
+}
+
+// parseRFC3164Time parses the "Jan _2 15:04:05" timestamp at the start of
+// s, in loc and in the year that puts it closest before now.
+func parseRFC3164Time(s string, now time.Time, loc *time.Location) (time.Time, bool) {
+	if len(s) < len(rfc3164Layout) {
+		return time.Time{}, false
+	}
+	ts, err := time.ParseInLocation(rfc3164Layout, s[:len(rfc3164Layout)], loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	now = now.In(loc)
+	ts = ts.AddDate(now.Year(), 0, 0)
+	if ts.Sub(now) > 24*time.Hour {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	return ts, true
+}
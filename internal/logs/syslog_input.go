@@ -0,0 +1,394 @@
+package logs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyslogMaxMessage  = 64 << 10
+	defaultSyslogMaxConns    = 1000
+	defaultSyslogReadTimeout = 5 * time.Minute
+	// syslogHandshakeTimeout bounds the TLS handshake of a new connection.
+	syslogHandshakeTimeout = 10 * time.Second
+)
+
+// SyslogSource prefixes Record.Source for messages from the syslog
+// receiver: the source is "syslog/<hostname>", with the hostname from the
+// message header, or the sender's address for messages without one, so
+// that per-source stages such as dedup and rate_limit apply per device.
+const SyslogSource = "syslog"
+
+// SyslogOptions configures the syslog receiver. Each listener is enabled by
+// setting its address. Messages may be RFC 5424 or RFC 3164; over TCP and
+// TLS they are framed by octet counting or newlines (RFC 6587).
+type SyslogOptions struct {
+	UDP             string `json:"udp"`               // e.g. ":514"
+	TCP             string `json:"tcp"`               // e.g. ":514"
+	TLS             string `json:"tls"`               // e.g. ":6514"
+	CertFile        string `json:"cert_file"`         // TLS certificate
+	KeyFile         string `json:"key_file"`          // TLS private key
+	ClientCAFile    string `json:"client_ca_file"`    // when set, TLS clients must present a certificate signed by it
+	MaxMessageBytes int    `json:"max_message_bytes"` // longer messages are truncated (UDP) or end the connection, default 65536
+	MaxConnections  int    `json:"max_connections"`   // open TCP and TLS connections, further ones are refused, default 1000
+	ReadTimeout     string `json:"read_timeout"`      // a connection that sends no complete message for this long is closed, default "5m"
+}
+
+func (o SyslogOptions) enabled() bool {
+	return o.UDP != "" || o.TCP != "" || o.TLS != ""
+}
+
+// syslogReceiver owns the listeners and connections of the receiver.
+type syslogReceiver struct {
+	opts        SyslogOptions
+	readTimeout time.Duration
+	out         chan<- Record
+	stop        chan struct{}
+	wg          sync.WaitGroup
+
+	mu        sync.Mutex
+	closers   []io.Closer
+	conns     map[net.Conn]bool
+	lastError time.Time
+}
+
+// withDefaults checks the options and fills in defaults, returning the
+// read timeout.
+func (o SyslogOptions) withDefaults() (SyslogOptions, time.Duration, error) {
+	if o.MaxMessageBytes <= 0 {
+		o.MaxMessageBytes = defaultSyslogMaxMessage
+	}
+	if o.MaxConnections <= 0 {
+		o.MaxConnections = defaultSyslogMaxConns
+	}
+	readTimeout := defaultSyslogReadTimeout
+	if o.ReadTimeout != "" {
+		d, err := time.ParseDuration(o.ReadTimeout)
+		if err != nil || d <= 0 {
+			return o, 0, fmt.Errorf("logs.syslog: invalid read_timeout %q", o.ReadTimeout)
+		}
+		readTimeout = d
+	}
+	if o.TLS != "" && (o.CertFile == "" || o.KeyFile == "") {
+		return o, 0, fmt.Errorf("logs.syslog: tls needs cert_file and key_file")
+	}
+	return o, readTimeout, nil
+}
+
+// startSyslog opens the configured listeners and starts receiving.
+func startSyslog(o SyslogOptions, out chan<- Record) (*syslogReceiver, error) {
+	o, readTimeout, err := o.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	s := &syslogReceiver{opts: o, readTimeout: readTimeout, out: out, stop: make(chan struct{}), conns: make(map[net.Conn]bool)}
+
+	var tlsConfig *tls.Config
+	if o.TLS != "" {
+		cfg, err := syslogTLSConfig(o)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = cfg
+	}
+	if o.UDP != "" {
+		pc, err := net.ListenPacket("udp", o.UDP)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("logs.syslog: listening on udp %s: %v", o.UDP, err)
+		}
+		s.closers = append(s.closers, pc)
+		s.wg.Add(1)
+		go s.serveUDP(pc)
+	}
+	if o.TCP != "" {
+		ln, err := net.Listen("tcp", o.TCP)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("logs.syslog: listening on tcp %s: %v", o.TCP, err)
+		}
+		s.closers = append(s.closers, ln)
+		s.wg.Add(1)
+		go s.serveStream(ln, "tcp")
+	}
+	if tlsConfig != nil {
+		ln, err := tls.Listen("tcp", o.TLS, tlsConfig)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("logs.syslog: listening on tls %s: %v", o.TLS, err)
+		}
+		s.closers = append(s.closers, ln)
+		s.wg.Add(1)
+		go s.serveStream(ln, "tls")
+	}
+	return s, nil
+}
+
+func syslogTLSConfig(o SyslogOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("logs.syslog: loading TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if o.ClientCAFile != "" {
+		pem, err := os.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("logs.syslog: reading client_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("logs.syslog: no certificates in %s", o.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Close stops the listeners, closes open connections and waits for the
+// receiving goroutines to return.
+func (s *syslogReceiver) Close() {
+	close(s.stop)
+	s.mu.Lock()
+	for _, c := range s.closers {
+		c.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *syslogReceiver) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// logError logs receive errors at most once a minute; they are counted in
+// the metrics either way.
+func (s *syslogReceiver) logError(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastError) >= time.Minute {
+		log.Printf(format, args...)
+		s.lastError = time.Now()
+	}
+}
+
+func (s *syslogReceiver) serveUDP(pc net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.stopping() {
+				return
+			}
+			recordSyslogError("udp", "read")
+			s.logError("Syslog UDP receive error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		msg := buf[:n]
+		if n > s.opts.MaxMessageBytes {
+			recordSyslogError("udp", "too_long")
+			msg = msg[:s.opts.MaxMessageBytes]
+		}
+		if !s.deliver(string(msg), "udp", addr) {
+			return
+		}
+	}
+}
+
+func (s *syslogReceiver) serveStream(ln net.Listener, transport string) {
+	defer s.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.stopping() {
+				return
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			recordSyslogError(transport, "accept")
+			s.logError("Syslog %s accept error: %v", transport, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		if s.stopping() {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		if len(s.conns) >= s.opts.MaxConnections {
+			s.mu.Unlock()
+			c.Close()
+			recordSyslogError(transport, "rejected")
+			s.logError("Syslog %s connection from %s refused: %d connections open (max_connections)", transport, c.RemoteAddr(), s.opts.MaxConnections)
+			continue
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(c, transport)
+	}
+}
+
+func (s *syslogReceiver) serveConn(c net.Conn, transport string) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+	if tc, ok := c.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(syslogHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			if !s.stopping() {
+				recordSyslogError(transport, "handshake")
+				s.logError("Syslog %s handshake with %s: %v", transport, c.RemoteAddr(), err)
+			}
+			return
+		}
+		tc.SetDeadline(time.Time{})
+	}
+	br := bufio.NewReaderSize(c, 64<<10)
+	for {
+		c.SetReadDeadline(time.Now().Add(s.readTimeout))
+		msg, err := readFramed(br, s.opts.MaxMessageBytes)
+		if msg != "" && !s.deliver(msg, transport, c.RemoteAddr()) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !s.stopping() {
+				kind := "read"
+				var ne net.Error
+				switch {
+				case errors.Is(err, errFraming):
+					kind = "framing"
+				case errors.As(err, &ne) && ne.Timeout():
+					kind = "timeout"
+				}
+				recordSyslogError(transport, kind)
+				s.logError("Syslog %s connection from %s: %v", transport, c.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+var errFraming = errors.New("invalid syslog framing")
+
+// readFramed reads one message from a stream. A message starting with a
+// digit is octet counted ("<length> <message>"); otherwise it ends at a
+// newline or NUL. Trailing newlines are trimmed.
+func readFramed(br *bufio.Reader, max int) (string, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return "", err
+		}
+		if b[0] != '\n' && b[0] != '\r' && b[0] != 0 {
+			break
+		}
+		br.ReadByte()
+	}
+
+	if b, _ := br.Peek(1); b[0] >= '0' && b[0] <= '9' {
+		prefix, err := br.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		n, perr := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+		if perr != nil || n <= 0 {
+			return "", fmt.Errorf("%w: bad length %q", errFraming, prefix)
+		}
+		if n > max {
+			return "", fmt.Errorf("%w: message of %d bytes exceeds max_message_bytes", errFraming, n)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+
+	var line []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return strings.TrimRight(string(line), "\r"), err
+		}
+		if c == '\n' || c == 0 {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		if len(line) >= max {
+			return "", fmt.Errorf("%w: message exceeds max_message_bytes without a newline", errFraming)
+		}
+		line = append(line, c)
+	}
+}
+
+// deliver parses a message and sends it as a record. The record's line is
+// the message text; the header goes into fields. Messages that do not
+// parse are passed on whole.
+func (s *syslogReceiver) deliver(text, transport string, from net.Addr) bool {
+	r := Record{Time: time.Now(), Line: text}
+	m, ok := parseSyslog(text)
+	if ok {
+		r.Fields = m.fields()
+		r.Line = r.Fields["message"]
+		delete(r.Fields, "message")
+		if !m.Timestamp.IsZero() {
+			r.Time = m.Timestamp
+		}
+	} else {
+		recordSyslogError(transport, "parse")
+		r.Fields = make(map[string]string)
+	}
+	r.Fields["transport"] = transport
+	if from != nil {
+		host := from.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		r.Fields["remote_addr"] = host
+	}
+	r.Source = SyslogSource
+	if device := r.Fields["hostname"]; device != "" {
+		r.Source += "/" + device
+	} else if device := r.Fields["remote_addr"]; device != "" {
+		r.Source += "/" + device
+	}
+	recordSyslogMessage(transport, m.Facility(), m.Severity())
+
+	select {
+	case s.out <- r:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
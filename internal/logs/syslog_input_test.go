@@ -0,0 +1,95 @@
+package logs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTestSyslog(t *testing.T, o SyslogOptions) (*syslogReceiver, string, chan Record) {
+	t.Helper()
+	o.TCP = "127.0.0.1:0"
+	out := make(chan Record, 16)
+	s, err := startSyslog(o, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s, s.closers[0].(net.Listener).Addr().String(), out
+}
+
+func receive(t *testing.T, out <-chan Record) Record {
+	t.Helper()
+	select {
+	case r := <-out:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record received")
+		return Record{}
+	}
+}
+
+func TestSyslogSourcePerDevice(t *testing.T) {
+	_, addr, out := startTestSyslog(t, SyslogOptions{})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprint(c, "<34>1 2024-05-01T10:00:00Z router1 sshd 42 - - login failed\n")
+	fmt.Fprint(c, "no header at all\n")
+
+	if r := receive(t, out); r.Source != "syslog/router1" || r.Line != "login failed" {
+		t.Errorf("got source %q line %q", r.Source, r.Line)
+	}
+	if r := receive(t, out); r.Source != "syslog/127.0.0.1" {
+		t.Errorf("unparsed message: source %q, want the sender's address", r.Source)
+	}
+}
+
+func TestSyslogMaxConnections(t *testing.T) {
+	s, addr, out := startTestSyslog(t, SyslogOptions{MaxConnections: 1})
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	fmt.Fprint(first, "<13>hello\n")
+	receive(t, out)
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("second connection: read %v, want it closed", err)
+	}
+	s.mu.Lock()
+	n := len(s.conns)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Errorf("%d connections open, want 1", n)
+	}
+}
+
+func TestSyslogReadTimeout(t *testing.T) {
+	_, addr, _ := startTestSyslog(t, SyslogOptions{ReadTimeout: "50ms"})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprint(c, "<13>no newline yet")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection: read %v, want it closed", err)
+	}
+
+	if _, err := startSyslog(SyslogOptions{TCP: "127.0.0.1:0", ReadTimeout: "soon"}, nil); err == nil {
+		t.Error("invalid read_timeout: want an error")
+	}
+}
@@ -0,0 +1,386 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPollInterval  = time.Second
+	defaultMaxLineBytes  = 256 << 10
+	defaultPositionsFile = "logs_positions.json"
+
+	readChunkSize = 64 << 10
+	// fingerprintSize bytes from the start of a file recognise it after
+	// rotation, including once it has been compressed.
+	fingerprintSize = 1024
+	// Files that disappear are forgotten after this long.
+	removedFileTimeout = 5 * time.Minute
+	positionsSyncEvery = 5 * time.Second
+)
+
+// compressedExts are skipped when globbing; compressed files are only read
+// while catching up on rotations. All but xz can be decompressed.
+var compressedExts = map[string]bool{".gz": true, ".bz2": true, ".xz": true, ".zip": true, ".zst": true}
+
+// TailOptions selects the files to tail. Positions are saved per path, so
+// files are resumed where they were left after a restart; a file that was
+// rotated meanwhile is finished from its rotated copy first.
+type TailOptions struct {
+	Paths         []string `json:"paths"`          // glob patterns, e.g. "/var/log/*.log"
+	Exclude       []string `json:"exclude"`        // glob patterns matched against the full path
+	StartAt       string   `json:"start_at"`       // "end" (default) or "beginning", for files without a saved position
+	PollInterval  string   `json:"poll_interval"`  // default "1s"
+	PositionsFile string   `json:"positions_file"` // default "logs_positions.json", relative to the executable
+	MaxLineBytes  int      `json:"max_line_bytes"` // longer lines are split, default 262144
+}
+
+// tailedFile is an open file being followed.
+type tailedFile struct {
+	path    string
+	f       *os.File
+	id      string
+	offset  int64  // end of the last complete line sent
+	partial []byte // bytes after offset not yet ending in a newline
+	fp      []byte // first bytes of the file
+	missing time.Time
+}
+
+// Tailer polls its globs and sends every complete line as a Record.
+type Tailer struct {
+	opts      TailOptions
+	poll      time.Duration
+	positions *positions
+	files     map[string]*tailedFile
+	// finished maps the IDs of files that were rotated away to the offset
+	// already read, in case they reappear under a name the globs match.
+	finished map[string]int64
+	first    bool
+	buf      []byte
+
+	out  chan<- Record
+	stop chan struct{}
+	done chan struct{}
+}
+
+// withDefaults checks the options and fills in defaults, returning the
+// poll interval.
+func (o TailOptions) withDefaults() (TailOptions, time.Duration, error) {
+	for _, p := range append(append([]string{}, o.Paths...), o.Exclude...) {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return o, 0, fmt.Errorf("logs.files: invalid pattern %q: %v", p, err)
+		}
+	}
+	switch o.StartAt {
+	case "":
+		o.StartAt = "end"
+	case "end", "beginning":
+	default:
+		return o, 0, fmt.Errorf("logs.files: unknown start_at %q (want end or beginning)", o.StartAt)
+	}
+	poll := defaultPollInterval
+	if o.PollInterval != "" {
+		d, err := time.ParseDuration(o.PollInterval)
+		if err != nil || d <= 0 {
+			return o, 0, fmt.Errorf("logs.files: invalid poll_interval %q", o.PollInterval)
+		}
+		poll = d
+	}
+	if o.PositionsFile == "" {
+		o.PositionsFile = defaultPositionsFile
+	}
+	o.PositionsFile = stateFile(o.PositionsFile)
+	if o.MaxLineBytes <= 0 {
+		o.MaxLineBytes = defaultMaxLineBytes
+	}
+	return o, poll, nil
+}
+
+// NewTailer validates the options and loads saved positions.
+func NewTailer(o TailOptions) (*Tailer, error) {
+	o, poll, err := o.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &Tailer{
+		opts:      o,
+		poll:      poll,
+		positions: loadPositions(o.PositionsFile),
+		files:     make(map[string]*tailedFile),
+		finished:  make(map[string]int64),
+		first:     true,
+		buf:       make([]byte, readChunkSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Run tails until Close, sending records to out. Sends block, and wait
+// while an acknowledging sink is behind, so a slow consumer holds reading
+// back rather than losing lines.
+func (t *Tailer) Run(out chan<- Record) {
+	defer close(t.done)
+	t.out = out
+	lastSync := time.Now()
+	for {
+		t.scan()
+		if time.Since(lastSync) >= positionsSyncEvery {
+			t.savePositions()
+			lastSync = time.Now()
+		}
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(t.poll):
+		}
+	}
+}
+
+// Close stops tailing, closes the files and saves positions.
+func (t *Tailer) Close() {
+	close(t.stop)
+	<-t.done
+	for _, tf := range t.files {
+		tf.f.Close()
+	}
+	t.savePositions()
+}
+
+func (t *Tailer) savePositions() {
+	if err := t.positions.save(); err != nil {
+		log.Printf("Error saving log positions: %v", err)
+	}
+}
+
+func (t *Tailer) stopping() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// scan expands the globs, follows known files and opens new ones.
+func (t *Tailer) scan() {
+	seen := make(map[string]bool)
+	for _, pattern := range t.opts.Paths {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if seen[path] || t.excluded(path) || compressedExts[strings.ToLower(filepath.Ext(path))] {
+				continue
+			}
+			if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			seen[path] = true
+			if tf, ok := t.files[path]; ok {
+				tf.missing = time.Time{}
+				t.follow(tf)
+			} else {
+				t.open(path)
+			}
+			if t.stopping() {
+				return
+			}
+		}
+	}
+
+	now := time.Now()
+	for path, tf := range t.files {
+		if seen[path] {
+			continue
+		}
+		// Renamed or deleted: finish what was written to it.
+		t.read(tf)
+		if tf.missing.IsZero() {
+			tf.missing = now
+		} else if now.Sub(tf.missing) > removedFileTimeout {
+			t.finish(tf)
+			delete(t.files, path)
+			t.positions.forget(path)
+		}
+	}
+	setFilesWatched(len(t.files))
+	t.first = false
+}
+
+func (t *Tailer) excluded(path string) bool {
+	for _, p := range t.opts.Exclude {
+		if ok, _ := filepath.Match(p, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// open starts following a file, choosing where to start reading.
+func (t *Tailer) open(path string) {
+	f, err := openFile(path)
+	if err != nil {
+		recordTailError(path, err)
+		return
+	}
+	id, err := fileID(f)
+	if err != nil {
+		f.Close()
+		recordTailError(path, err)
+		return
+	}
+	tf := &tailedFile{path: path, f: f, id: id}
+	t.positions.opened(path, id)
+	t.updateFingerprint(tf)
+	size := int64(0)
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+
+	saved, hasSaved := t.positions.get(path)
+	if off, ok := t.finished[id]; ok {
+		// A rotated file that moved under a matching name.
+		tf.offset = off
+		delete(t.finished, id)
+	} else if hasSaved && saved.ID == id && fingerprintMatches(saved.Fingerprint, tf.fp) {
+		tf.offset = saved.Offset
+		if tf.offset > size {
+			recordRotation(path, "truncate")
+			tf.offset = 0
+		}
+	} else if hasSaved {
+		// Rotated while we were not running.
+		t.catchUp(tf, saved)
+	} else if t.first && t.opts.StartAt == "end" {
+		tf.offset = size
+	}
+	t.files[path] = tf
+	t.read(tf)
+}
+
+// follow reads new lines from a known file, detecting rename rotation (the
+// path now names another file) and copytruncate rotation (the file shrank).
+func (t *Tailer) follow(tf *tailedFile) {
+	id, err := pathID(tf.path)
+	if err != nil {
+		return
+	}
+	if id != tf.id {
+		t.read(tf)
+		t.finish(tf)
+		delete(t.files, tf.path)
+		recordRotation(tf.path, "rename")
+		t.open(tf.path)
+		return
+	}
+
+	if fi, err := tf.f.Stat(); err == nil && fi.Size() < tf.offset+int64(len(tf.partial)) {
+		recordRotation(tf.path, "truncate")
+		tf.offset, tf.partial = 0, nil
+		tf.fp = nil
+		t.updateFingerprint(tf)
+	}
+	t.read(tf)
+}
+
+// finish closes a file that has been rotated away, remembering how far it
+// was read.
+func (t *Tailer) finish(tf *tailedFile) {
+	tf.f.Close()
+	if len(t.finished) >= 1000 {
+		t.finished = make(map[string]int64)
+	}
+	t.finished[tf.id] = tf.offset
+}
+
+// read sends every complete line available in the file.
+func (t *Tailer) read(tf *tailedFile) {
+	for {
+		n, err := tf.f.ReadAt(t.buf, tf.offset+int64(len(tf.partial)))
+		if n > 0 {
+			recordBytesRead(tf.path, n)
+			tf.partial = append(tf.partial, t.buf[:n]...)
+			if !t.sendLines(tf) {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				recordTailError(tf.path, err)
+			}
+			break
+		}
+	}
+	if len(tf.fp) < fingerprintSize {
+		t.updateFingerprint(tf)
+	}
+}
+
+// sendLines sends the complete lines in tf.partial and keeps the rest.
+func (t *Tailer) sendLines(tf *tailedFile) bool {
+	for {
+		i := bytes.IndexByte(tf.partial, '\n')
+		cut, skip := i, 1
+		switch {
+		case i < 0 && len(tf.partial) > t.opts.MaxLineBytes:
+			cut, skip = t.opts.MaxLineBytes, 0
+		case i < 0:
+			// Compact so the buffer does not grow with the file.
+			tf.partial = append([]byte(nil), tf.partial...)
+			return true
+		case i > t.opts.MaxLineBytes:
+			cut, skip = t.opts.MaxLineBytes, 0
+		}
+		line := bytes.TrimSuffix(tf.partial[:cut], []byte{'\r'})
+		end := tf.offset + int64(cut+skip)
+		if !t.send(t.fileRecord(tf, line, end)) {
+			return false
+		}
+		tf.offset = end
+		tf.partial = tf.partial[cut+skip:]
+	}
+}
+
+func (t *Tailer) fileRecord(tf *tailedFile, line []byte, end int64) Record {
+	path, pos := tf.path, position{ID: tf.id, Offset: end, Fingerprint: hex.EncodeToString(tf.fp)}
+	return Record{
+		Time:   time.Now(),
+		Source: path,
+		Line:   string(line),
+		ack:    func() { t.positions.set(path, pos) },
+	}
+}
+
+func (t *Tailer) send(r Record) bool {
+	if !waitForSinks(t.stop) {
+		return false
+	}
+	select {
+	case t.out <- r:
+		recordLineRead(r.Source)
+		return true
+	case <-t.stop:
+		return false
+	}
+}
+
+func (t *Tailer) updateFingerprint(tf *tailedFile) {
+	buf := make([]byte, fingerprintSize)
+	n, _ := tf.f.ReadAt(buf, 0)
+	tf.fp = buf[:n]
+}
+
+// fingerprintMatches compares a saved fingerprint with the start of a file.
+// An empty saved fingerprint (the file was empty) matches any file.
+func fingerprintMatches(saved string, head []byte) bool {
+	fp, err := hex.DecodeString(saved)
+	if err != nil || len(fp) > len(head) {
+		return false
+	}
+	return bytes.Equal(fp, head[:len(fp)])
+}
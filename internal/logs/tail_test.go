@@ -0,0 +1,171 @@
+package logs
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const rotatedContent = "one\ntwo\nthree\n"
+
+func compress(t *testing.T, ext string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch ext {
+	case ".gz":
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+	case ".zst":
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+	case ".zip":
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create("app.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		zw.Close()
+	case ".bz2":
+		b, err := os.ReadFile("testdata/rotated.log.bz2") // bzip2 of rotatedContent
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	default:
+		return data
+	}
+	return buf.Bytes()
+}
+
+func TestRotatedFilesCompressed(t *testing.T) {
+	for name, ext := range map[string]string{"plain": "", "gzip": ".gz", "bzip2": ".bz2", "zstd": ".zst", "zip": ".zip"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "app.log")
+			if err := os.WriteFile(path+".1"+ext, compress(t, ext, []byte(rotatedContent)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			files := rotatedFiles(path)
+			if len(files) != 1 || files[0].compression != ext {
+				t.Fatalf("rotatedFiles = %+v", files)
+			}
+			rc, err := files[0].open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			if b, err := io.ReadAll(rc); err != nil || string(b) != rotatedContent {
+				t.Errorf("read %q, %v", b, err)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	os.WriteFile(path+".1.xz", []byte("\xfd7zXZ\x00"), 0o644)
+	files := rotatedFiles(path)
+	if len(files) != 1 {
+		t.Fatalf("rotatedFiles = %+v", files)
+	}
+	if _, err := files[0].open(); err == nil {
+		t.Error("opening an xz copy: want an error")
+	}
+}
+
+// tailUntil runs a tailer until it has sent n records, acknowledging each.
+func tailUntil(t *testing.T, o TailOptions, n int) []string {
+	t.Helper()
+	tl, err := NewTailer(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan Record)
+	go tl.Run(out)
+	var got []string
+	for len(got) < n {
+		select {
+		case r := <-out:
+			got = append(got, r.Line)
+			r.Ack()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, want %d lines", got, n)
+		}
+	}
+	tl.Close()
+	return got
+}
+
+func TestTailerCatchesUpCompressedRotation(t *testing.T) {
+	for _, ext := range []string{".gz", ".bz2", ".zst"} {
+		t.Run(ext, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "app.log")
+			o := TailOptions{
+				Paths:         []string{path},
+				StartAt:       "beginning",
+				PollInterval:  "10ms",
+				PositionsFile: filepath.Join(dir, "positions.json"),
+			}
+			os.WriteFile(path, []byte("one\n"), 0o644)
+			if got := tailUntil(t, o, 1); !reflect.DeepEqual(got, []string{"one"}) {
+				t.Fatalf("first run: %q", got)
+			}
+
+			// While stopped, two more lines are written and the file is
+			// rotated and compressed.
+			os.Remove(path)
+			os.WriteFile(path+".1"+ext, compress(t, ext, []byte(rotatedContent)), 0o644)
+			os.WriteFile(path, []byte("four\n"), 0o644)
+			if got := tailUntil(t, o, 3); !reflect.DeepEqual(got, []string{"two", "three", "four"}) {
+				t.Errorf("after rotation: %q", got)
+			}
+		})
+	}
+}
+
+func TestPositionsLateAck(t *testing.T) {
+	p := loadPositions(filepath.Join(t.TempDir(), "positions.json"))
+	p.opened("app.log", "a")
+	p.set("app.log", position{ID: "a", Offset: 10})
+
+	// Renamed away: its lines may still be acknowledged until the new
+	// file's first ack.
+	p.opened("app.log", "b")
+	p.set("app.log", position{ID: "a", Offset: 20})
+	if pos, _ := p.get("app.log"); pos.ID != "a" || pos.Offset != 20 {
+		t.Errorf("before the new file's ack: %+v", pos)
+	}
+	p.set("app.log", position{ID: "b", Offset: 5})
+	p.set("app.log", position{ID: "a", Offset: 30})
+	if pos, _ := p.get("app.log"); pos.ID != "b" || pos.Offset != 5 {
+		t.Errorf("a late ack replaced the new file's position: %+v", pos)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	abs := filepath.Join(t.TempDir(), "positions.json")
+	if got := stateFile(abs); got != abs {
+		t.Errorf("stateFile(%q) = %q", abs, got)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	if got, want := stateFile("positions.json"), filepath.Join(filepath.Dir(exe), "positions.json"); got != want {
+		t.Errorf("stateFile = %q, want %q", got, want)
+	}
+}
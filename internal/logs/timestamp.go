@@ -0,0 +1,124 @@
+package logs
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	// Time zone names must resolve on Windows hosts, which have no zoneinfo.
+	_ "time/tzdata"
+)
+
+// Named timestamp layouts, besides Go reference layouts.
+var namedLayouts = map[string]string{
+	"rfc3339": time.RFC3339Nano,
+	"common":  "02/Jan/2006:15:04:05 -0700", // nginx and Apache time_local
+}
+
+// timestampParser sets Record.Time from a field.
+type timestampParser struct {
+	field   string
+	layouts []string
+	loc     *time.Location
+	now     func() time.Time
+}
+
+func newTimestampParser(o StageOptions) (*timestampParser, error) {
+	p := &timestampParser{field: o.Field, layouts: append([]string(nil), o.Layouts...), loc: time.Local, now: time.Now}
+	if p.field == "" {
+		p.field = "timestamp"
+	}
+	if len(p.layouts) == 0 {
+		p.layouts = []string{"rfc3339"}
+	}
+	for i, l := range p.layouts {
+		if named, ok := namedLayouts[l]; ok {
+			p.layouts[i] = named
+		}
+	}
+	if o.Location != "" {
+		loc, err := time.LoadLocation(o.Location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid location %q: %v", o.Location, err)
+		}
+		p.loc = loc
+	}
+	return p, nil
+}
+
+func (p *timestampParser) parse(r *Record) bool {
+	v, ok := r.Fields[p.field]
+	if !ok || v == "" {
+		return false
+	}
+	for _, layout := range p.layouts {
+		if t, ok := p.parseLayout(layout, v); ok {
+			r.Time = t
+			return true
+		}
+	}
+	return false
+}
+
+func (p *timestampParser) parseLayout(layout, v string) (time.Time, bool) {
+	switch layout {
+	case "unix", "unix_ms":
+		return parseUnix(strings.TrimSpace(v), layout == "unix_ms")
+	case "rfc3164":
+		return parseRFC3164Time(v, p.now(), p.loc)
+	}
+	t, err := time.ParseInLocation(layout, strings.TrimSpace(v), p.loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if t.Year() == 0 {
+		// Layouts without a year, as in syslog.
+		t = t.AddDate(p.now().In(p.loc).Year(), 0, 0)
+	}
+	return t, true
+}
+
+// parseUnix parses seconds or milliseconds since the epoch. Decimal
+// fractions are read exactly; other numbers, such as "1.7e9", through a
+// float.
+func parseUnix(v string, ms bool) (time.Time, bool) {
+	unit, digits := time.Second, 9 // fraction digits down to a nanosecond
+	if ms {
+		unit, digits = time.Millisecond, 6
+	}
+	whole, frac, _ := strings.Cut(v, ".")
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err == nil && isDigits(frac) {
+		if len(frac) > digits {
+			frac = frac[:digits]
+		}
+		var nsec int64
+		if frac != "" {
+			nsec, _ = strconv.ParseInt(frac+strings.Repeat("0", digits-len(frac)), 10, 64)
+		}
+		if strings.HasPrefix(whole, "-") {
+			nsec = -nsec
+		}
+		if ms {
+			return time.UnixMilli(n).Add(time.Duration(nsec)), true
+		}
+		return time.Unix(n, nsec), true
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	f *= unit.Seconds()
+	sec, fr := math.Modf(f)
+	return time.Unix(int64(sec), int64(fr*1e9)), true
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package logs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampParser(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		opts  StageOptions
+		value string
+		want  time.Time // zero: must not parse
+	}{
+		{"rfc3339 default", StageOptions{}, "2024-05-01T12:00:00.5+02:00", time.Date(2024, 5, 1, 10, 0, 0, 5e8, time.UTC)},
+		{"common", StageOptions{Layouts: []string{"common"}}, "10/Oct/2023:13:55:36 +0200", time.Date(2023, 10, 10, 11, 55, 36, 0, time.UTC)},
+		{"unix", StageOptions{Layouts: []string{"unix"}}, "1700000000.25", time.Unix(1700000000, 25e7)},
+		{"unix_ms", StageOptions{Layouts: []string{"unix_ms"}}, "1700000000123", time.Unix(1700000000, 123e6)},
+		{"unix_ms fraction", StageOptions{Layouts: []string{"unix_ms"}}, "1700000000123.5", time.Unix(1700000000, 1235e5)},
+		{"unix exponent", StageOptions{Layouts: []string{"unix"}}, "1.7e9", time.Unix(1700000000, 0)},
+		{"go layout in location", StageOptions{Layouts: []string{"2006-01-02 15:04:05"}, Location: "Europe/Berlin"},
+			"2024-07-01 08:00:00", time.Date(2024, 7, 1, 8, 0, 0, 0, berlin)},
+		{"zone in value wins over location", StageOptions{Layouts: []string{"rfc3339"}, Location: "Europe/Berlin"},
+			"2024-07-01T08:00:00Z", time.Date(2024, 7, 1, 8, 0, 0, 0, time.UTC)},
+		{"first matching layout", StageOptions{Layouts: []string{"unix", "common"}}, "10/Oct/2023:13:55:36 +0000", time.Date(2023, 10, 10, 13, 55, 36, 0, time.UTC)},
+		{"rfc3164 this year", StageOptions{Layouts: []string{"rfc3164"}, Location: "UTC"}, "Jan  2 11:00:00", time.Date(2024, 1, 2, 11, 0, 0, 0, time.UTC)},
+		{"rfc3164 last year", StageOptions{Layouts: []string{"rfc3164"}, Location: "UTC"}, "Dec 31 23:00:00", time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)},
+		{"layout without year", StageOptions{Layouts: []string{"Jan 2 15:04"}, Location: "UTC"}, "Mar 5 10:30", time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)},
+		{"no layout matches", StageOptions{Layouts: []string{"rfc3339", "unix"}}, "yesterday", time.Time{}},
+		{"NaN", StageOptions{Layouts: []string{"unix"}}, "NaN", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Type = "timestamp"
+			p := mustStage(t, tt.opts).(*parseStage).parser.(*timestampParser)
+			p.now = func() time.Time { return now }
+			r := Record{Fields: map[string]string{"timestamp": tt.value}}
+			ok := p.parse(&r)
+			if tt.want.IsZero() {
+				if ok {
+					t.Errorf("parsed %q as %v, want a failure", tt.value, r.Time)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("failed to parse %q", tt.value)
+			}
+			if !r.Time.Equal(tt.want) {
+				t.Errorf("got %v, want %v", r.Time, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampParserField(t *testing.T) {
+	s := mustStage(t, StageOptions{Type: "timestamp", Field: "ts", Layouts: []string{"unix"}}).(*parseStage)
+	r := Record{Time: time.Unix(1, 0), Fields: map[string]string{"timestamp": "5", "ts": "7"}}
+	if !s.parse(&r) || !r.Time.Equal(time.Unix(7, 0)) {
+		t.Errorf("time = %v, want the ts field", r.Time)
+	}
+	missing := Record{Time: time.Unix(1, 0)}
+	if s.parse(&missing) || !missing.Time.Equal(time.Unix(1, 0)) {
+		t.Error("a record without the field was changed")
+	}
+}